@@ -19,7 +19,9 @@ package commands
 import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/server"
+	"github.com/nalej/edge-controller/internal/pkg/server/bootstrap"
 	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
 	"github.com/nalej/infra-net-plugin"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -52,7 +54,10 @@ var runCmd = &cobra.Command{
 		log.Info().Msg("Launching API!")
 		cfg.Debug = debugLevel
 		server := server.NewService(cfg)
-		server.Run()
+		runErr := server.Run()
+		if runErr != nil{
+			log.Fatal().Str("error", runErr.Error()).Msg("edge controller finished with errors")
+		}
 	},
 }
 
@@ -69,7 +74,10 @@ func init() {
 	runCmd.Flags().StringVar(&configFile, "configFile", "config.yaml", "configuration file")
 	runCmd.Flags().IntVar(&cfg.Port, "port", 5577, "Port to receive management communications")
 	runCmd.Flags().IntVar(&cfg.AgentPort, "agentPort", 5588, "Port to receive agent messages")
+	runCmd.Flags().IntVar(&cfg.AdminPort, "adminPort", 5599, "Port on the loopback interface to serve the queries of the operators, 0 to disable it")
 	runCmd.Flags().DurationVar(&cfg.NotifyPeriod, "notifyPeriod", d, "Notification period to the management cluster")
+	runCmd.Flags().IntVar(&cfg.NotifyBatchSize, "notifyBatchSize", 500, "Maximum number of pending messages read at once to notify the management cluster")
+	runCmd.Flags().IntVar(&cfg.NotifySenders, "notifySenders", 8, "Maximum number of concurrent calls to notify the management cluster")
 	runCmd.Flags().BoolVar(&cfg.UseInMemoryProviders, "useInMemoryProviders", false,"Use InMemory providers")
 	runCmd.Flags().BoolVar(&cfg.UseBBoltProviders, "useBBoltProviders", false,"Use Bbolt providers")
 	runCmd.Flags().StringVar(&cfg.BboltPath, "bboltpath", "", "Database path")
@@ -80,10 +88,35 @@ func init() {
 	runCmd.Flags().DurationVar(&cfg.AlivePeriod, "alivePeriod", a,"Notification period to the management cluster")
 	runCmd.Flags().StringVar(&cfg.Geolocation, "geolocation", "", "Edge Controller Geolocation")
 	runCmd.Flags().StringVar(&cfg.AgentBinaryPath, "agentBinaryPath", "/opt/agents", "Agents binary path as <os_arch>/service-net-agent")
+	runCmd.Flags().StringVar(&cfg.InstallRecipesPath, "installRecipesPath", "/opt/agents/recipes", "Agent install recipes path as <os_arch>.yaml")
+	runCmd.Flags().IntVar(&cfg.InstallWorkers, "installWorkers", 8, "Maximum number of agent installs running at the same time")
+	runCmd.Flags().IntVar(&cfg.AgentQueueSize, "agentQueueSize", 32, "Maximum number of operations queued for an agent")
+	runCmd.Flags().IntVar(&cfg.AgentOpsPerCheck, "agentOpsPerCheck", 5, "Maximum number of operations sent to an agent on each check, 0 for all")
+	runCmd.Flags().DurationVar(&cfg.AgentOpTimeout, "agentOpTimeout", time.Hour, "Default time an agent operation waits for the agent before it expires")
+	runCmd.Flags().DurationVar(&cfg.AgentOpLease, "agentOpLease", 2*time.Minute, "Time an agent has to respond to an operation before it is delivered again")
+	runCmd.Flags().IntVar(&cfg.AgentOpMaxAttempts, "agentOpMaxAttempts", 3, "Maximum number of times an operation is delivered to an agent")
+	runCmd.Flags().StringVar(&cfg.RuntimeConfigPath, "runtimeConfigPath", config.DefaultRuntimeConfigPath, "Path of the options received from the management cluster")
+	runCmd.Flags().StringVar(&cfg.BootstrapStatePath, "bootstrapStatePath", bootstrap.DefaultStateFile, "Path of the progress of the bootstrap")
+	runCmd.Flags().StringVar(&cfg.HostKeyPolicy, "hostKeyPolicy", "tofu", "Policy to verify the SSH host keys when installing agents (known_hosts or tofu)")
+	runCmd.Flags().StringVar(&cfg.KnownHostsPath, "knownHostsPath", "/etc/edge-controller/known_hosts", "known_hosts file for the known_hosts policy")
+	runCmd.Flags().DurationVar(&cfg.AgentTokenGrace, "agentTokenGrace", time.Hour, "Time the previous token of an agent is valid after a rotation")
+	runCmd.Flags().StringVar(&cfg.AgentClientCerts, "agentClientCerts", config.ClientCertsDisabled, "Policy for the client certificates of the agents (disabled, optional or required)")
+	runCmd.Flags().DurationVar(&cfg.AgentCertValidity, "agentCertValidity", 365*24*time.Hour, "Time the client certificates issued to the agents are valid")
+	runCmd.Flags().StringVar(&cfg.AgentCAKeyPath, "agentCAKeyPath", pki.DefaultKeyFile, "Path of the private key of the authority that issues the client certificates of the agents")
+	runCmd.Flags().DurationVar(&cfg.JanitorPeriod, "janitorPeriod", 10*time.Minute, "Period between the removals of stale records from the storage")
+	runCmd.Flags().DurationVar(&cfg.JoinTokenRetention, "joinTokenRetention", 24*time.Hour, "Time expired join tokens are kept, 0 to keep them")
+	runCmd.Flags().IntVar(&cfg.JoinTokenMaxRecords, "joinTokenMaxRecords", 10000, "Maximum number of join tokens stored, 0 for no limit")
+	runCmd.Flags().DurationVar(&cfg.OutboxRetention, "outboxRetention", 14*24*time.Hour, "Time messages not delivered to the management cluster are kept, 0 to keep them")
+	runCmd.Flags().IntVar(&cfg.OutboxMaxRecords, "outboxMaxRecords", 100000, "Maximum number of messages not delivered to the management cluster, 0 for no limit")
+	runCmd.Flags().DurationVar(&cfg.AgentStartRetention, "agentStartRetention", 30*24*time.Hour, "Time the agent starts are kept, 0 to keep them")
+	runCmd.Flags().IntVar(&cfg.AgentStartMaxRecords, "agentStartMaxRecords", 10000, "Maximum number of agent starts stored, 0 for no limit")
 
 	configHelper.BindPFlag("port", runCmd.Flags().Lookup("port"))
 	configHelper.BindPFlag("agentPort", runCmd.Flags().Lookup("agentPort"))
+	configHelper.BindPFlag("adminPort", runCmd.Flags().Lookup("adminPort"))
 	configHelper.BindPFlag("notifyPeriod", runCmd.Flags().Lookup("notifyPeriod"))
+	configHelper.BindPFlag("notifyBatchSize", runCmd.Flags().Lookup("notifyBatchSize"))
+	configHelper.BindPFlag("notifySenders", runCmd.Flags().Lookup("notifySenders"))
 	configHelper.BindPFlag("useInMemoryProviders", runCmd.Flags().Lookup("useInMemoryProviders"))
 	configHelper.BindPFlag("useBBoltProviders", runCmd.Flags().Lookup("useBBoltProviders"))
 	configHelper.BindPFlag("bboltpath", runCmd.Flags().Lookup("bboltpath"))
@@ -94,6 +127,27 @@ func init() {
 	configHelper.BindPFlag("alivePeriod", runCmd.Flags().Lookup("alivePeriod"))
 	configHelper.BindPFlag("geolocation", runCmd.Flags().Lookup("geolocation"))
 	configHelper.BindPFlag("agentBinaryPath", runCmd.Flags().Lookup("agentBinaryPath"))
+	configHelper.BindPFlag("installRecipesPath", runCmd.Flags().Lookup("installRecipesPath"))
+	configHelper.BindPFlag("installWorkers", runCmd.Flags().Lookup("installWorkers"))
+	configHelper.BindPFlag("agentQueueSize", runCmd.Flags().Lookup("agentQueueSize"))
+	configHelper.BindPFlag("agentOpsPerCheck", runCmd.Flags().Lookup("agentOpsPerCheck"))
+	configHelper.BindPFlag("agentOpTimeout", runCmd.Flags().Lookup("agentOpTimeout"))
+	configHelper.BindPFlag("agentOpLease", runCmd.Flags().Lookup("agentOpLease"))
+	configHelper.BindPFlag("agentOpMaxAttempts", runCmd.Flags().Lookup("agentOpMaxAttempts"))
+	configHelper.BindPFlag("runtimeConfigPath", runCmd.Flags().Lookup("runtimeConfigPath"))
+	configHelper.BindPFlag("bootstrapStatePath", runCmd.Flags().Lookup("bootstrapStatePath"))
+	configHelper.BindPFlag("hostKeyPolicy", runCmd.Flags().Lookup("hostKeyPolicy"))
+	configHelper.BindPFlag("knownHostsPath", runCmd.Flags().Lookup("knownHostsPath"))
+	configHelper.BindPFlag("agentTokenGrace", runCmd.Flags().Lookup("agentTokenGrace"))
+	configHelper.BindPFlag("agentClientCerts", runCmd.Flags().Lookup("agentClientCerts"))
+	configHelper.BindPFlag("agentCertValidity", runCmd.Flags().Lookup("agentCertValidity"))
+	configHelper.BindPFlag("janitorPeriod", runCmd.Flags().Lookup("janitorPeriod"))
+	configHelper.BindPFlag("joinTokenRetention", runCmd.Flags().Lookup("joinTokenRetention"))
+	configHelper.BindPFlag("joinTokenMaxRecords", runCmd.Flags().Lookup("joinTokenMaxRecords"))
+	configHelper.BindPFlag("outboxRetention", runCmd.Flags().Lookup("outboxRetention"))
+	configHelper.BindPFlag("outboxMaxRecords", runCmd.Flags().Lookup("outboxMaxRecords"))
+	configHelper.BindPFlag("agentStartRetention", runCmd.Flags().Lookup("agentStartRetention"))
+	configHelper.BindPFlag("agentStartMaxRecords", runCmd.Flags().Lookup("agentStartMaxRecords"))
 
 	// Add plugin-specific flags
 	plugin.SetCommandFlags(runCmd, cfg.PluginConfig, plugin.DefaultPluginPrefix)
@@ -115,6 +169,9 @@ func ReadConfigFile() derrors.Error{
 	if configHelper.IsSet("agentPort"){
 		cfg.AgentPort = configHelper.GetInt("agentPort")
 	}
+	if configHelper.IsSet("adminPort"){
+		cfg.AdminPort = configHelper.GetInt("adminPort")
+	}
 	if configHelper.IsSet("useInMemoryProviders"){
 		cfg.UseInMemoryProviders = configHelper.GetBool("useInMemoryProviders")
 	}
@@ -142,8 +199,80 @@ func ReadConfigFile() derrors.Error{
 	if configHelper.IsSet("notifyPeriod"){
 		cfg.NotifyPeriod = configHelper.GetDuration("notifyPeriod")
 	}
+	if configHelper.IsSet("notifyBatchSize"){
+		cfg.NotifyBatchSize = configHelper.GetInt("notifyBatchSize")
+	}
+	if configHelper.IsSet("notifySenders"){
+		cfg.NotifySenders = configHelper.GetInt("notifySenders")
+	}
 	if configHelper.IsSet("alivePeriod"){
 		cfg.AlivePeriod = configHelper.GetDuration("alivePeriod")
 	}
+	if configHelper.IsSet("installRecipesPath"){
+		cfg.InstallRecipesPath = configHelper.GetString("installRecipesPath")
+	}
+	if configHelper.IsSet("installWorkers"){
+		cfg.InstallWorkers = configHelper.GetInt("installWorkers")
+	}
+	if configHelper.IsSet("agentQueueSize"){
+		cfg.AgentQueueSize = configHelper.GetInt("agentQueueSize")
+	}
+	if configHelper.IsSet("agentOpsPerCheck"){
+		cfg.AgentOpsPerCheck = configHelper.GetInt("agentOpsPerCheck")
+	}
+	if configHelper.IsSet("agentOpTimeout"){
+		cfg.AgentOpTimeout = configHelper.GetDuration("agentOpTimeout")
+	}
+	if configHelper.IsSet("agentOpLease"){
+		cfg.AgentOpLease = configHelper.GetDuration("agentOpLease")
+	}
+	if configHelper.IsSet("agentOpMaxAttempts"){
+		cfg.AgentOpMaxAttempts = configHelper.GetInt("agentOpMaxAttempts")
+	}
+	if configHelper.IsSet("runtimeConfigPath"){
+		cfg.RuntimeConfigPath = configHelper.GetString("runtimeConfigPath")
+	}
+	if configHelper.IsSet("bootstrapStatePath"){
+		cfg.BootstrapStatePath = configHelper.GetString("bootstrapStatePath")
+	}
+	if configHelper.IsSet("hostKeyPolicy"){
+		cfg.HostKeyPolicy = configHelper.GetString("hostKeyPolicy")
+	}
+	if configHelper.IsSet("knownHostsPath"){
+		cfg.KnownHostsPath = configHelper.GetString("knownHostsPath")
+	}
+	if configHelper.IsSet("agentTokenGrace"){
+		cfg.AgentTokenGrace = configHelper.GetDuration("agentTokenGrace")
+	}
+	if configHelper.IsSet("agentClientCerts"){
+		cfg.AgentClientCerts = configHelper.GetString("agentClientCerts")
+	}
+	if configHelper.IsSet("agentCertValidity"){
+		cfg.AgentCertValidity = configHelper.GetDuration("agentCertValidity")
+	}
+	if configHelper.IsSet("agentCAKeyPath"){
+		cfg.AgentCAKeyPath = configHelper.GetString("agentCAKeyPath")
+	}
+	if configHelper.IsSet("janitorPeriod"){
+		cfg.JanitorPeriod = configHelper.GetDuration("janitorPeriod")
+	}
+	if configHelper.IsSet("joinTokenRetention"){
+		cfg.JoinTokenRetention = configHelper.GetDuration("joinTokenRetention")
+	}
+	if configHelper.IsSet("joinTokenMaxRecords"){
+		cfg.JoinTokenMaxRecords = configHelper.GetInt("joinTokenMaxRecords")
+	}
+	if configHelper.IsSet("outboxRetention"){
+		cfg.OutboxRetention = configHelper.GetDuration("outboxRetention")
+	}
+	if configHelper.IsSet("outboxMaxRecords"){
+		cfg.OutboxMaxRecords = configHelper.GetInt("outboxMaxRecords")
+	}
+	if configHelper.IsSet("agentStartRetention"){
+		cfg.AgentStartRetention = configHelper.GetDuration("agentStartRetention")
+	}
+	if configHelper.IsSet("agentStartMaxRecords"){
+		cfg.AgentStartMaxRecords = configHelper.GetInt("agentStartMaxRecords")
+	}
 	return nil
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/nalej/grpc-edge-controller-go"
 	"github.com/nalej/grpc-inventory-go"
 	"github.com/nalej/grpc-inventory-manager-go"
+	"strconv"
 	"time"
 )
 
@@ -41,9 +42,46 @@ type AgentOpRequest struct {
 	Plugin string `json:"plugin,omitempty"`
 	// Params for the operation.
 	Params map[string]string `json:"params,omitempty"`
+	// Priority of the operation in the queue of the agent, the highest first.
+	Priority int `json:"priority,omitempty"`
+	// Deadline with the unix time when the operation expires if the agent has not responded, 0 if it never expires.
+	Deadline int64 `json:"deadline,omitempty"`
+	// Attempts with the number of times the operation has been delivered to the agent.
+	Attempts int `json:"attempts,omitempty"`
+	// LeaseExpires with the unix time when the operation is delivered again if the agent has not responded, 0 if it
+	// is not delivered again.
+	LeaseExpires int64 `json:"lease_expires,omitempty"`
+	// Canceled is true if the operation was canceled after being delivered to the agent.
+	Canceled bool `json:"canceled,omitempty"`
+}
+
+// Optional params of an AgentOpRequest handled by the edge controller.
+const (
+	// PriorityParam with the priority of the operation in the queue of the agent. It is an integer, the highest
+	// first, 0 if it is not set.
+	PriorityParam = "priority"
+	// TimeoutParam with the time the operation waits for the response of the agent before it expires, as a
+	// duration, e.g. 30m. It replaces the default timeout of the edge controller.
+	TimeoutParam = "timeout"
+)
+
+// GetOperationTimeout returns the timeout set in the params of an operation, or defaultTimeout if it is not set.
+func GetOperationTimeout(params map[string]string, defaultTimeout time.Duration) time.Duration {
+	// the timeout is checked by ValidAgentOpRequest
+	if timeout, err := time.ParseDuration(params[TimeoutParam]); err == nil {
+		return timeout
+	}
+	return defaultTimeout
+}
+
+// IsExpired returns whether the deadline of the operation has passed.
+func (aor *AgentOpRequest) IsExpired(now int64) bool {
+	return aor.Deadline != 0 && aor.Deadline <= now
 }
 
 func NewAgentOpRequestFromGRPC(request * grpc_inventory_manager_go.AgentOpRequest) * AgentOpRequest{
+	// the priority is checked by ValidAgentOpRequest
+	priority, _ := strconv.Atoi(request.Params[PriorityParam])
 	return &AgentOpRequest{
 		Created: time.Now().Unix(),
 		OrganizationId:   request.OrganizationId,
@@ -53,6 +91,7 @@ func NewAgentOpRequestFromGRPC(request * grpc_inventory_manager_go.AgentOpReques
 		Operation:        request.Operation,
 		Plugin:           request.Plugin,
 		Params:           request.Params,
+		Priority:         priority,
 	}
 }
 
@@ -76,6 +115,77 @@ type AgentJoinInfo struct {
 	// Token that the agent needs to send for further requests. The token should be added in the
 	// authorization metadata of the gRPC context.
 	Token                string   `json:"token,omitempty"`
+	// Labels of the asset sent by the agent when joining, and the ones of its join token.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Os with the operating system of the asset.
+	Os *OperatingSystemInfo `json:"os,omitempty"`
+	// Hardware with the hardware of the asset.
+	Hardware *HardwareInfo `json:"hardware,omitempty"`
+	// PreviousToken replaced by the last rotation of the token, valid until PreviousTokenExpires.
+	PreviousToken string `json:"previous_token,omitempty"`
+	// PreviousTokenExpires with the timestamp when the previous token stops being valid.
+	PreviousTokenExpires int64 `json:"previous_token_expires,omitempty"`
+	// TokenRevoked is true if the token has been revoked. The agent cannot authenticate and must join again.
+	TokenRevoked bool `json:"token_revoked,omitempty"`
+	// Certificate with the client certificates issued to the agent. Other certificates with the asset identifier are
+	// rejected, so removing the asset revokes its certificates.
+	Certificate AgentCertificate `json:"certificate,omitempty"`
+}
+
+// AgentCertificate with the state of the client certificates of an agent. The agent generates its private key and
+// sends a certificate request, so the key never leaves the agent.
+type AgentCertificate struct {
+	// Serial number of the last certificate issued to the agent in hexadecimal.
+	Serial string `json:"serial,omitempty"`
+	// Expires with the timestamp when the last certificate issued to the agent expires.
+	Expires int64 `json:"expires,omitempty"`
+	// Installed is true once the agent confirms that it uses the last certificate issued.
+	Installed bool `json:"installed,omitempty"`
+	// PreviousSerial with the certificate used by the agent until it installs the last one.
+	PreviousSerial string `json:"previous_serial,omitempty"`
+	// Requested with the timestamp until the edge controller waits for the certificate request of the agent.
+	Requested int64 `json:"requested,omitempty"`
+}
+
+// HasCertificate returns whether the agent uses a client certificate, so it must send it.
+func (aji *AgentJoinInfo) HasCertificate() bool {
+	return aji.Certificate.Installed || aji.Certificate.PreviousSerial != ""
+}
+
+// ValidCertificate checks if an agent can authenticate as the asset with a certificate.
+func (aji *AgentJoinInfo) ValidCertificate(serial string) bool {
+	if serial == "" {
+		return false
+	}
+	return serial == aji.Certificate.Serial || serial == aji.Certificate.PreviousSerial
+}
+
+// NeedsCertificate returns whether the agent must be asked for a certificate request at a given timestamp, either
+// because it has none or because the last one expires in less than renewBefore seconds.
+func (aji *AgentJoinInfo) NeedsCertificate(now int64, renewBefore int64) bool {
+	if aji.Certificate.Requested > now {
+		return false
+	}
+	return aji.Certificate.Serial == "" || aji.Certificate.Expires-renewBefore <= now
+}
+
+// ValidToken checks if an agent can authenticate as the asset with a token at a given timestamp.
+func (aji *AgentJoinInfo) ValidToken(token string, now int64) bool {
+	if token == "" {
+		return false
+	}
+	if token == aji.Token {
+		return !aji.TokenRevoked
+	}
+	return token == aji.PreviousToken && now <= aji.PreviousTokenExpires
+}
+
+// Tokens returns the tokens of the asset that may be stored in the index of the assets by token.
+func (aji *AgentJoinInfo) Tokens() []string {
+	if aji.PreviousToken == "" {
+		return []string{aji.Token}
+	}
+	return []string{aji.Token, aji.PreviousToken}
 }
 
 func NewAgentJoinInfoFromGRPC(request * grpc_inventory_manager_go.AgentJoinResponse) * AgentJoinInfo{
@@ -86,6 +196,91 @@ func NewAgentJoinInfoFromGRPC(request * grpc_inventory_manager_go.AgentJoinRespo
 	}
 }
 
+// NewAgentJoinInfo creates the information of a joined agent with the request of the agent and the response of the
+// management cluster.
+func NewAgentJoinInfo(request *grpc_edge_controller_go.AgentJoinRequest, response *grpc_inventory_manager_go.AgentJoinResponse) *AgentJoinInfo {
+	info := NewAgentJoinInfoFromGRPC(response)
+	info.Labels = request.Labels
+	info.Os = NewOperatingSystemInfoFromGRPC(request.Os)
+	info.Hardware = NewHardwareInfoFromGRPC(request.Hardware)
+	return info
+}
+
+// OperatingSystemInfo with the operating system of an asset.
+type OperatingSystemInfo struct {
+	// Name of the operating system.
+	Name string `json:"name,omitempty"`
+	// Version of the operating system.
+	Version string `json:"version,omitempty"`
+	// Class of the operating system: LINUX, WINDOWS or DARWIN.
+	Class string `json:"class,omitempty"`
+	// Architecture of the operating system.
+	Architecture string `json:"architecture,omitempty"`
+}
+
+func NewOperatingSystemInfoFromGRPC(os *grpc_inventory_go.OperatingSystemInfo) *OperatingSystemInfo {
+	if os == nil {
+		return nil
+	}
+	return &OperatingSystemInfo{
+		Name:         os.Name,
+		Version:      os.Version,
+		Class:        os.Class.String(),
+		Architecture: os.Architecture,
+	}
+}
+
+// CPUInfo with a processor of an asset.
+type CPUInfo struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	NumCores     int32  `json:"num_cores,omitempty"`
+}
+
+// NetworkingHardwareInfo with a network interface of an asset.
+type NetworkingHardwareInfo struct {
+	Type         string `json:"type,omitempty"`
+	LinkCapacity int64  `json:"link_capacity,omitempty"`
+}
+
+// HardwareInfo with the hardware of an asset.
+type HardwareInfo struct {
+	// Cpus with the processors of the asset.
+	Cpus []CPUInfo `json:"cpus,omitempty"`
+	// InstalledRam with the installed memory.
+	InstalledRam int64 `json:"installed_ram,omitempty"`
+	// NetInterfaces with the network interfaces of the asset.
+	NetInterfaces []NetworkingHardwareInfo `json:"net_interfaces,omitempty"`
+}
+
+func NewHardwareInfoFromGRPC(hardware *grpc_inventory_go.HardwareInfo) *HardwareInfo {
+	if hardware == nil {
+		return nil
+	}
+	cpus := make([]CPUInfo, 0, len(hardware.Cpus))
+	for _, cpu := range hardware.Cpus {
+		cpus = append(cpus, CPUInfo{
+			Manufacturer: cpu.Manufacturer,
+			Model:        cpu.Model,
+			Architecture: cpu.Architecture,
+			NumCores:     cpu.NumCores,
+		})
+	}
+	interfaces := make([]NetworkingHardwareInfo, 0, len(hardware.NetInterfaces))
+	for _, iface := range hardware.NetInterfaces {
+		interfaces = append(interfaces, NetworkingHardwareInfo{
+			Type:         iface.Type,
+			LinkCapacity: iface.LinkCapacity,
+		})
+	}
+	return &HardwareInfo{
+		Cpus:          cpus,
+		InstalledRam:  hardware.InstalledRam,
+		NetInterfaces: interfaces,
+	}
+}
+
 func ValidJoinRequest(request * grpc_edge_controller_go.AgentJoinRequest) derrors.Error{
 	if request.AgentId == ""{
 		return derrors.NewInvalidArgumentError("agent_id cannot be empty")
@@ -205,12 +400,37 @@ type JoinToken struct{
 	Token string   `json:"token,omitempty"`
 	// ExpiredOn with information about when the token expires
 	ExpiredOn int64 `json:"expired_on"`
+	// Created with the timestamp when the token was added.
+	Created int64 `json:"created,omitempty"`
+	// MaxUses with the number of agents that can join with the token. Zero means unlimited.
+	MaxUses int `json:"max_uses,omitempty"`
+	// Uses with the number of agents that have joined with the token.
+	Uses int `json:"uses,omitempty"`
+	// Labels added to the agents that join with the token.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Revoked is true if the token has been revoked and no agent can join with it.
+	Revoked bool `json:"revoked,omitempty"`
 	// OrganizationId with the organization identifier.
 	// OrganizationId string `json:"organization_id,omitempty"`
 	// EdgeControllerId with the EIC identifier that facilitated the operation.
 	// EdgeControllerId string `json:"edge_controller_id,omitempty"`
 }
 
+// IsExpired checks if the token has expired at a given timestamp.
+func (jt *JoinToken) IsExpired(now int64) bool {
+	return jt.ExpiredOn < now
+}
+
+// IsExhausted checks if the token has been used by as many agents as allowed.
+func (jt *JoinToken) IsExhausted() bool {
+	return jt.MaxUses > 0 && jt.Uses >= jt.MaxUses
+}
+
+// IsValid checks if an agent can join with the token at a given timestamp.
+func (jt *JoinToken) IsValid(now int64) bool {
+	return !jt.Revoked && !jt.IsExpired(now) && !jt.IsExhausted()
+}
+
 func ValidEdgeControllerID(edge *grpc_inventory_go.EdgeControllerId) derrors.Error{
 	if edge.OrganizationId == ""{
 		return derrors.NewInvalidArgumentError("organization_id cannot be empty")
@@ -272,6 +492,17 @@ func ValidAgentOpRequest (request *grpc_inventory_manager_go.AgentOpRequest) der
 	if request.Plugin == "" {
 		return derrors.NewInvalidArgumentError("plugin cannot be empty")
 	}
+	if priority, exists := request.Params[PriorityParam]; exists {
+		if _, err := strconv.Atoi(priority); err != nil {
+			return derrors.NewInvalidArgumentError("priority must be an integer").WithParams(priority)
+		}
+	}
+	if timeout, exists := request.Params[TimeoutParam]; exists {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil || duration <= 0 {
+			return derrors.NewInvalidArgumentError("timeout must be a positive duration").WithParams(timeout)
+		}
+	}
 	return nil
 }
 
@@ -344,6 +575,15 @@ func (ecor * EdgeControllerOpResponse) ToGRPC() *grpc_inventory_manager_go.EdgeC
 	}
 }
 
+// Params of the InstallAgentRequest to install the agent in several hosts with the same credentials. They replace
+// the target host.
+const (
+	// TargetHostsParam with a comma separated list of hosts.
+	TargetHostsParam = "target_hosts"
+	// TargetCIDRParam with a range of addresses, e.g. 192.168.1.0/28.
+	TargetCIDRParam = "target_cidr"
+)
+
 func ValidInstallAgentRequest(request *grpc_inventory_manager_go.InstallAgentRequest) derrors.Error{
 	if request.OrganizationId == ""{
 		return derrors.NewInvalidArgumentError("organization_id cannot be empty")
@@ -351,9 +591,26 @@ func ValidInstallAgentRequest(request *grpc_inventory_manager_go.InstallAgentReq
 	if request.EdgeControllerId == ""{
 		return derrors.NewInvalidArgumentError("edge_controller_id cannot be empty")
 	}
-	if request.TargetHost == ""{
+	bulk := request.Params[TargetHostsParam] != "" || request.Params[TargetCIDRParam] != ""
+	if request.TargetHost == "" && !bulk {
 		return derrors.NewInvalidArgumentError("target_host cannot be empty")
 	}
+	if request.TargetHost != "" && bulk {
+		return derrors.NewInvalidArgumentError("target_host cannot be used with a list or range of hosts")
+	}
+	return nil
+}
+
+func ValidConfigureEICRequest(request *grpc_inventory_manager_go.ConfigureEICRequest) derrors.Error{
+	if request.OrganizationId == ""{
+		return derrors.NewInvalidArgumentError("organization_id cannot be empty")
+	}
+	if request.EdgeControllerId == ""{
+		return derrors.NewInvalidArgumentError("edge_controller_id cannot be empty")
+	}
+	if len(request.Params) == 0{
+		return derrors.NewInvalidArgumentError("params cannot be empty")
+	}
 	return nil
 }
 
@@ -380,3 +637,24 @@ func NewUninstallAgentRequestFromGRPC (assetID *grpc_inventory_manager_go.FullUn
 		OperationId:operationID,
 	}
 }
+
+// InstallOperation with the progress of an agent install. It is journaled while the install runs so an install
+// interrupted by a restart of the edge controller can be reported. Credentials are never journaled.
+type InstallOperation struct {
+	// OperationId with the operation identifier.
+	OperationId string `json:"operation_id,omitempty"`
+	// OrganizationId with the organization identifier.
+	OrganizationId string `json:"organization_id,omitempty"`
+	// EdgeControllerId with the EIC identifier.
+	EdgeControllerId string `json:"edge_controller_id,omitempty"`
+	// TargetHost where the agent is being installed.
+	TargetHost string `json:"target_host,omitempty"`
+	// Token with the join token generated for the agent.
+	Token string `json:"token,omitempty"`
+	// Step with the name of the step being executed.
+	Step string `json:"step,omitempty"`
+	// Created with the timestamp when the install started.
+	Created int64 `json:"created,omitempty"`
+	// Updated with the timestamp of the last step change.
+	Updated int64 `json:"updated,omitempty"`
+}
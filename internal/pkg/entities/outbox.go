@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/satori/go.uuid"
+)
+
+// OutboxMessageType with the call of the inventory proxy that delivers a message.
+type OutboxMessageType string
+
+const (
+	// AgentsAliveMessage with a batch of alive timestamps and IP changes of the agents.
+	AgentsAliveMessage OutboxMessageType = "AgentsAlive"
+	// AgentStartMessage with the AgentStartInfo of an agent that has been started.
+	AgentStartMessage OutboxMessageType = "AgentStart"
+	// AgentUninstalledMessage with the UninstallAgentRequest of an agent that has been uninstalled.
+	AgentUninstalledMessage OutboxMessageType = "AgentUninstalled"
+	// AgentOpResponseMessage with the AgentOpResponse of an operation executed by an agent.
+	AgentOpResponseMessage OutboxMessageType = "AgentOpResponse"
+	// ECOpResponseMessage with the EdgeControllerOpResponse of an operation executed by the edge controller.
+	ECOpResponseMessage OutboxMessageType = "ECOpResponse"
+)
+
+// AliveOrderKey is the order key of the alive batches, as they include several assets.
+const AliveOrderKey = "alive"
+
+// OutboxMessage with a message waiting to be delivered to the management cluster. Messages are removed from the
+// outbox once they are delivered, so they are delivered at least once.
+type OutboxMessage struct {
+	// Id deduplicates the messages: adding a message whose identifier is already in the outbox has no effect.
+	Id string `json:"id"`
+	// Sequence with the position of the message in the outbox. It is assigned by the provider.
+	Sequence uint64 `json:"sequence"`
+	// Type of the message.
+	Type OutboxMessageType `json:"type"`
+	// OrderKey groups the messages that must be delivered in order: the asset identifier for the agent messages and
+	// the operation identifier for the edge controller responses.
+	OrderKey string `json:"order_key"`
+	// Created with the timestamp when the message was added.
+	Created int64 `json:"created"`
+	// Payload with the JSON representation of the entity being sent.
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewOutboxMessage creates a message with the JSON representation of the payload. If the identifier is empty, a
+// random one is generated and the message is never deduplicated.
+func NewOutboxMessage(msgType OutboxMessageType, id string, orderKey string, payload interface{}) (*OutboxMessage, derrors.Error) {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot marshal outbox payload")
+	}
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	return &OutboxMessage{
+		Id:       id,
+		Type:     msgType,
+		OrderKey: orderKey,
+		Created:  time.Now().Unix(),
+		Payload:  content,
+	}, nil
+}
+
+// GetPayload unmarshals the payload of the message into the given entity.
+func (om *OutboxMessage) GetPayload(payload interface{}) derrors.Error {
+	err := json.Unmarshal(om.Payload, payload)
+	if err != nil {
+		return derrors.AsError(err, "cannot unmarshal outbox payload").WithParams(om.Id, string(om.Type))
+	}
+	return nil
+}
+
+// AgentsAlive with the agents that have sent a ping since the last batch was sent.
+type AgentsAlive struct {
+	// Agents with the timestamp of the last ping by asset identifier.
+	Agents map[string]int64 `json:"agents,omitempty"`
+	// AgentsIp with the new IP of the assets whose IP has changed.
+	AgentsIp map[string]string `json:"agents_ip,omitempty"`
+}
@@ -17,6 +17,7 @@
 package asset
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/nalej/derrors"
@@ -31,10 +32,14 @@ const (
 	assetsByAssetIDBucket 	= "assetsByAssetIDBucket"
 	assetsByTokenBucket 	= "assetsByTokenBucket"
 	pendingOpsBucket 		= "pendingOpsBucket"
-	pendingResultBucket 	= "pendingResultBucket"
-	pendingECResultBucket 	= "pendingECResultBucket"
+	deliveredOpsBucket 		= "deliveredOpsBucket"
+	outboxBucket 			= "outboxBucket"
+	outboxIDsBucket 		= "outboxIDsBucket"
 	joinTokenBucket 		= "joinTokenBucket"
 	agentStartBucket 		= "agentStartBucket"
+	hostKeyBucket 			= "hostKeyBucket"
+	installOpsBucket 		= "installOpsBucket"
+	pendingUninstallBucket 	= "pendingUninstallBucket"
 )
 
 type BboltAssetProvider struct {
@@ -56,64 +61,366 @@ func NewBboltAssetProvider(databasePath string) * BboltAssetProvider{
 }
 
 
-func (b *BboltAssetProvider) AddPendingOperation(op entities.AgentOpRequest) derrors.Error {
+func (b *BboltAssetProvider) AddPendingOperation(op entities.AgentOpRequest, capacity int) (int, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
-	obj := make([]entities.AgentOpRequest, 0)
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return 0, checkErr
+	}
+
+	position := 0
+	newErr := b.DB.Update(func(tx *bolt.Tx) error {
+		if err := checkManagedAsset(tx, op.AssetId); err != nil {
+			return err
+		}
+		delivered, err := readOperationList(tx, deliveredOpsBucket, op.AssetId)
+		if err != nil {
+			return err
+		}
+		return updateOperationList(tx, pendingOpsBucket, op.AssetId, func(queue []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			result, pos, err := queueOperation(queue, delivered, op, capacity)
+			position = pos
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		})
+	})
+
+	if newErr != nil {
+		// keep the type of the rejections so the position or capacity reaches the caller
+		if dErr, ok := newErr.(derrors.Error); ok {
+			return 0, dErr
+		}
+		return 0, derrors.AsError(newErr, "cannot add pending operation")
+	}
+
+	return position, nil
+}
+
+// TakePendingOperations returns the operations to deliver to an agent following the policy, and the delivered
+// operations that reached the maximum number of attempts.
+func (b *BboltAssetProvider) TakePendingOperations(assetID string, now int64, policy DeliveryPolicy) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
 
+	toDeliver := make([]entities.AgentOpRequest, 0)
+	exhausted := make([]entities.AgentOpRequest, 0)
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
-		return checkErr
+		return toDeliver, exhausted, checkErr
 	}
 
-	newErr :=  b.DB.Update(func(tx *bolt.Tx) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		if err := checkManagedAsset(tx, assetID); err != nil {
+			return err
+		}
+		return updateOperationList(tx, pendingOpsBucket, assetID, func(queue []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			var updatedQueue []entities.AgentOpRequest
+			err := updateOperationList(tx, deliveredOpsBucket, assetID, func(delivered []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+				var updatedDelivered []entities.AgentOpRequest
+				updatedQueue, updatedDelivered, toDeliver, exhausted = deliverOperations(queue, delivered, now, policy)
+				return updatedDelivered, nil
+			})
+			return updatedQueue, err
+		})
+	})
 
-		key := []byte(op.AssetId)
+	if err != nil {
+		return make([]entities.AgentOpRequest, 0), make([]entities.AgentOpRequest, 0), derrors.AsError(err, "cannot take pending agent operations")
+	}
 
+	return toDeliver, exhausted, nil
+}
 
-		// check if asset is managed by this EIC, if not exists -> return an error
-		bkAsset, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+// GetDeliveredOperations retrieves the operations delivered to an agent that has not responded yet.
+func (b *BboltAssetProvider) GetDeliveredOperations(assetID string) ([]entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	result := make([]entities.AgentOpRequest, 0)
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return result, checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(deliveredOpsBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", deliveredOpsBucket))
 		}
-		asset := bkAsset.Get(key)
-		if asset == nil {
-			return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(op.AssetId)
+		res := bk.Get([]byte(assetID))
+		if res == nil {
+			return nil
 		}
-
-		// Get pendings operations to add this new one
-		bk, err := tx.CreateBucketIfNotExists([]byte(pendingOpsBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingOpsBucket))
+		if err := json.Unmarshal(res, &result); err != nil {
+			return derrors.NewInternalError("error creating object")
 		}
+		return nil
+	})
+
+	if err != nil {
+		return result, derrors.AsError(err, "cannot retrieve delivered agent operations")
+	}
 
-		res := bk.Get([]byte (op.AssetId))
+	return result, nil
+}
 
-		if res != nil {
-			if err := json.Unmarshal(res, &obj); err != nil {
-				return derrors.NewInternalError("error creating object")
+// RemoveDeliveredOperation removes a delivered operation once the agent responds.
+func (b *BboltAssetProvider) RemoveDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var removed *entities.AgentOpRequest
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return updateOperationList(tx, deliveredOpsBucket, assetID, func(delivered []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			var result []entities.AgentOpRequest
+			result, removed = removeOperation(delivered, operationID)
+			if removed == nil {
+				return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
 			}
+			return result, nil
+		})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
 		}
-			obj = append(obj, op)
+		return nil, derrors.AsError(err, "cannot remove delivered agent operation")
+	}
 
-			toAddBytes, err := json.Marshal(obj)
-			if err != nil {
-				return derrors.AsError(err, "cannot marshal entity")
+	return removed, nil
+}
+
+// CancelDeliveredOperation flags a delivered operation as canceled so it is not delivered again.
+func (b *BboltAssetProvider) CancelDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var canceled *entities.AgentOpRequest
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return updateOperationList(tx, deliveredOpsBucket, assetID, func(delivered []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			var result []entities.AgentOpRequest
+			result, canceled = cancelOperation(delivered, operationID)
+			if canceled == nil {
+				return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
 			}
-			if err := bk.Put([]byte (op.AssetId), toAddBytes); err != nil {
-				return derrors.NewInternalError("Cannot add new element")
+			return result, nil
+		})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
+		}
+		return nil, derrors.AsError(err, "cannot cancel delivered agent operation")
+	}
+
+	return canceled, nil
+}
+
+// AcknowledgeDeliveredOperation clears the lease of a delivered operation so it is not delivered again.
+func (b *BboltAssetProvider) AcknowledgeDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var acknowledged *entities.AgentOpRequest
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return updateOperationList(tx, deliveredOpsBucket, assetID, func(delivered []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			var result []entities.AgentOpRequest
+			result, acknowledged = acknowledgeOperation(delivered, operationID)
+			if acknowledged == nil {
+				return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
 			}
+			return result, nil
+		})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
+		}
+		return nil, derrors.AsError(err, "cannot acknowledge delivered agent operation")
+	}
+
+	return acknowledged, nil
+}
+
+// RemoveExpiredOperations removes the queued and the delivered operations whose deadline has passed.
+func (b *BboltAssetProvider) RemoveExpiredOperations(now int64) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	queued := make([]entities.AgentOpRequest, 0)
+	delivered := make([]entities.AgentOpRequest, 0)
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return queued, delivered, checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		if err := expireOperationLists(tx, pendingOpsBucket, now, &queued); err != nil {
+			return err
+		}
+		return expireOperationLists(tx, deliveredOpsBucket, now, &delivered)
+	})
+
+	if err != nil {
+		return make([]entities.AgentOpRequest, 0), make([]entities.AgentOpRequest, 0), derrors.AsError(err, "cannot remove expired agent operations")
+	}
 
+	return queued, delivered, nil
+}
+
+// expireOperationLists removes the expired operations of all the assets from a bucket of operation lists and
+// appends them to expired.
+func expireOperationLists(tx *bolt.Tx, bucket string, now int64, expired *[]entities.AgentOpRequest) error {
+	bk, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", bucket))
+	}
 
+	// the bucket cannot be modified while iterating it
+	assetIDs := make([]string, 0)
+	err = bk.ForEach(func(k, v []byte) error {
+		assetIDs = append(assetIDs, string(k))
 		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, assetID := range assetIDs {
+		err := updateOperationList(tx, bucket, assetID, func(ops []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+			kept, removed := expireOperations(ops, now)
+			*expired = append(*expired, removed...)
+			return kept, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePendingOperation removes an operation from the queue of an asset before it is delivered.
+func (b *BboltAssetProvider) RemovePendingOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
 
+	var removed *entities.AgentOpRequest
+	err := b.updateOperationQueue(assetID, func(queue []entities.AgentOpRequest) ([]entities.AgentOpRequest, error) {
+		var result []entities.AgentOpRequest
+		result, removed = removeOperation(queue, operationID)
+		if removed == nil {
+			return nil, derrors.NewNotFoundError("operation is not queued").WithParams(assetID, operationID)
+		}
+		return result, nil
 	})
 
-	if newErr != nil {
-		return derrors.AsError(newErr, "cannot add pending operation")
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
+		}
+		return nil, derrors.AsError(err, "cannot remove pending agent operation")
+	}
+
+	return removed, nil
+}
+
+// updateOperationQueue replaces the queue of operations of a managed asset with the result of update in a single
+// transaction.
+func (b *BboltAssetProvider) updateOperationQueue(assetID string, update func(queue []entities.AgentOpRequest) ([]entities.AgentOpRequest, error)) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		if err := checkManagedAsset(tx, assetID); err != nil {
+			return err
+		}
+		return updateOperationList(tx, pendingOpsBucket, assetID, update)
+	})
+}
+
+// checkManagedAsset returns a FailedPrecondition error if the asset is not managed by this EIC.
+func checkManagedAsset(tx *bolt.Tx, assetID string) error {
+	bkAsset, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+	}
+	if bkAsset.Get([]byte(assetID)) == nil {
+		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	return nil
+}
+
+// readOperationList retrieves the list of operations of an asset stored in a bucket, an empty list if there is none.
+func readOperationList(tx *bolt.Tx, bucket string, assetID string) ([]entities.AgentOpRequest, error) {
+	ops := make([]entities.AgentOpRequest, 0)
+	bk := tx.Bucket([]byte(bucket))
+	if bk == nil {
+		return ops, nil
+	}
+	if res := bk.Get([]byte(assetID)); res != nil {
+		if err := json.Unmarshal(res, &ops); err != nil {
+			return nil, derrors.NewInternalError("error creating object")
+		}
+	}
+	return ops, nil
+}
+
+// updateOperationList replaces the list of operations of an asset stored in a bucket with the result of update. The
+// list is deleted if it ends up empty.
+func updateOperationList(tx *bolt.Tx, bucket string, assetID string, update func(ops []entities.AgentOpRequest) ([]entities.AgentOpRequest, error)) error {
+	key := []byte(assetID)
+	bk, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", bucket))
+	}
+
+	ops, err := readOperationList(tx, bucket, assetID)
+	if err != nil {
+		return err
+	}
+
+	updated, err := update(ops)
+	if err != nil {
+		return err
 	}
 
+	if len(updated) == 0 {
+		if err := bk.Delete(key); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
+		}
+		return nil
+	}
+	toAddBytes, err := json.Marshal(updated)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal entity")
+	}
+	if err := bk.Put(key, toAddBytes); err != nil {
+		return derrors.NewInternalError("Cannot add new element")
+	}
 	return nil
 }
 
@@ -177,8 +484,9 @@ func (b *BboltAssetProvider) GetPendingOperations(assetID string, removeEntries
 
 }
 
-// AddECOpResponse stores a response for an operation executed by the edge controller.
-func (b *BboltAssetProvider) AddECOpResponse(op entities.EdgeControllerOpResponse) derrors.Error{
+// AddOutboxMessage appends a message to the outbox of the management cluster. Messages whose identifier is already
+// in the outbox are ignored.
+func (b *BboltAssetProvider) AddOutboxMessage(msg entities.OutboxMessage) derrors.Error {
 	b.Lock()
 	defer b.Unlock()
 
@@ -187,33 +495,54 @@ func (b *BboltAssetProvider) AddECOpResponse(op entities.EdgeControllerOpRespons
 		return checkErr
 	}
 
-	toAddBytes, err := json.Marshal(op)
-	if err != nil {
-		return derrors.AsError(err, "cannot marshal entity")
-	}
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxBucket))
+		}
+		ids, err := tx.CreateBucketIfNotExists([]byte(outboxIDsBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxIDsBucket))
+		}
 
-	err =  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(pendingECResultBucket))
+		if ids.Get([]byte(msg.Id)) != nil {
+			// already queued
+			return nil
+		}
+		msg.Sequence, err = bk.NextSequence()
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingECResultBucket))
+			return derrors.NewInternalError("Cannot get outbox sequence")
+		}
+		toAddBytes, err := json.Marshal(msg)
+		if err != nil {
+			return derrors.AsError(err, "cannot marshal entity")
 		}
 
-		key := []byte(op.OperationId)
-		// add pending operation (or rewrite previous result)
+		// the keys are the big endian sequence so the messages are iterated in order
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, msg.Sequence)
 		if err := bk.Put(key, toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot registry ec operation result")
+			return derrors.NewInternalError("Cannot add outbox message")
+		}
+		if err := ids.Put([]byte(msg.Id), key); err != nil {
+			return derrors.NewInternalError("Cannot add outbox message")
 		}
 		return nil
 	})
 
+	if err != nil {
+		return derrors.AsError(err, "cannot add outbox message")
+	}
 	return nil
 }
-// GetPendingECOpResponses retrieves the list of pending operation responses
-func (b *BboltAssetProvider) GetPendingECOpResponses(removeEntries bool)([]entities.EdgeControllerOpResponse, derrors.Error){
+
+// GetOutboxMessages retrieves up to limit messages added after the given sequence, in the order they were added.
+// A limit of 0 retrieves all of them.
+func (b *BboltAssetProvider) GetOutboxMessages(afterSequence uint64, limit int) ([]entities.OutboxMessage, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
-	result := make([]entities.EdgeControllerOpResponse, 0)
+	result := make([]entities.OutboxMessage, 0)
 
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
@@ -221,127 +550,1035 @@ func (b *BboltAssetProvider) GetPendingECOpResponses(removeEntries bool)([]entit
 	}
 
 	err := b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(pendingECResultBucket))
+		bk, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingECResultBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxBucket))
 		}
 
-		// get all the operations (without key)
-		bk.ForEach(func(k, v []byte) error {
-			var response entities.EdgeControllerOpResponse
-			if err := json.Unmarshal(v, &response); err != nil {
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, afterSequence+1)
+		c := bk.Cursor()
+		for k, v := c.Seek(start); k != nil && (limit <= 0 || len(result) < limit); k, v = c.Next() {
+			var msg entities.OutboxMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
 				return derrors.NewInternalError("error creating object")
 			}
-			result = append(result, response)
+			result = append(result, msg)
+		}
+		return nil
+	})
 
-			return nil
-		})
+	if err != nil {
+		return result, derrors.AsError(err, "cannot get outbox messages")
+	}
+	return result, nil
+}
+
+// RemoveOutboxMessages removes a set of messages from the outbox once they have been delivered.
+func (b *BboltAssetProvider) RemoveOutboxMessages(ids []string) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxBucket))
+		}
+		idsBk, err := tx.CreateBucketIfNotExists([]byte(outboxIDsBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxIDsBucket))
+		}
+
+		for _, id := range ids {
+			key := idsBk.Get([]byte(id))
+			if key == nil {
+				continue
+			}
+			if err := bk.Delete(key); err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", id, err))
+			}
+			if err := idsBk.Delete([]byte(id)); err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", id, err))
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return derrors.AsError(err, "cannot remove outbox messages")
+	}
+	return nil
+}
+
+// AddAgentStart adds the start information to the history of the agent, keeping the last AgentStartHistorySize.
+func (b *BboltAssetProvider) AddAgentStart(op entities.AgentStartInfo) derrors.Error{
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err :=  b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(agentStartBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", agentStartBucket))
+		}
+
+		key := []byte(op.AssetId)
+
+		history := make([]entities.AgentStartInfo, 0)
+		if res := bk.Get(key); res != nil {
+			if err := json.Unmarshal(res, &history); err != nil {
+				return derrors.NewInternalError("error creating object")
+			}
+		}
+		history = addAgentStart(history, op)
+
+		toAddBytes, err := json.Marshal(history)
+		if err != nil {
+			return derrors.AsError(err, "cannot marshal entity")
+		}
+		if err := bk.Put(key, toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add agent start")
+		}
+		return nil
+	})
+
+	if err != nil {
+		return derrors.AsError(err, "cannot add agent start")
+	}
+
+	return nil
+}
+
+// GetAgentStarts retrieves the recent starts of an agent, the most recent first.
+func (b *BboltAssetProvider) GetAgentStarts(assetID string) ([]entities.AgentStartInfo, derrors.Error){
+
+	b.Lock()
+	defer b.Unlock()
+
+	result := make([]entities.AgentStartInfo, 0)
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return result, checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(agentStartBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", agentStartBucket))
+		}
+
+		res := bk.Get([]byte(assetID))
+		if res != nil {
+			if err := json.Unmarshal(res, &result); err != nil {
+				return derrors.NewInternalError("error creating object")
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return result, derrors.AsError(err, "cannot get agent starts")
+	}
+
+	return result, nil
+}
+
+
+func (b *BboltAssetProvider) AddManagedAsset(asset entities.AgentJoinInfo) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	newErr :=  b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+		}
+
+		// check if asset is already managed
+		res := bk.Get([]byte (asset.AssetId))
+
+		if res != nil {
+			return derrors.NewAlreadyExistsError("asset already managed by this EIC").WithParams(asset.AssetId)
+		}
+
+		toAddBytes, err := json.Marshal(asset)
+		if err != nil {
+			return derrors.AsError(err, "cannot marshal entity")
+		}
+
+		// add the asset in assetsByAssetIDBucket bucket
+		if err := bk.Put([]byte (asset.AssetId), toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add new element")
+		}
+
+		bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
+		}
+		// add the asset in assetsByTokenBucket bucket
+		if err := bkToken.Put([]byte (asset.Token), toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add new element")
+		}
+
+		return nil
+
+	})
+
+	if newErr != nil {
+		return derrors.AsError(newErr, "cannot add managed asset")
+	}
+
+	return nil
+}
+
+func (b *BboltAssetProvider) RemoveManagedAsset(assetID string) derrors.Error {
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	newErr :=  b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+		}
+
+		// get the asses to check if it exists
+		res := bk.Get([]byte (assetID))
+
+		var asset entities.AgentJoinInfo
+
+		// if the asset does not exist -> error
+		if res == nil {
+			return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+		}
+
+		if err := json.Unmarshal(res, &asset); err != nil {
+			return derrors.NewInternalError("error creating object")
+		}
+
+		bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
+		if bkToken == nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
+		}
+
+		// delete assetsByAssetIDToken
+		for _, token := range asset.Tokens() {
+			if err := bkToken.Delete([]byte(token)); err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", token, err))
+			}
+		}
+
+		// delete assetsByAssetIDBucket
+		if err := bk.Delete([]byte(assetID)); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
+		}
+
+		// delete the queued and the delivered operations
+		for _, bucket := range []string{pendingOpsBucket, deliveredOpsBucket} {
+			bkOps, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", bucket))
+			}
+			if err := bkOps.Delete([]byte(assetID)); err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
+			}
+		}
+
+		return nil
+
+	})
+
+	if newErr != nil {
+		return derrors.AsError(newErr, "cannot remove managed asset")
+	}
+
+	return nil
+}
+
+func (b *BboltAssetProvider) GetAssetByToken(token string) (*entities.AgentJoinInfo, derrors.Error) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var result entities.AgentJoinInfo
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
+		}
+
+		// get the asset
+		res := bk.Get([]byte(token))
+
+		if res == nil {
+			return derrors.NewFailedPreconditionError("asset is not managed by this EIC")
+		}
+
+		if err := json.Unmarshal(res, &result); err != nil {
+			return derrors.NewInternalError("error creating object")
+		}
+
+		// the index may contain a previous token of the asset
+		asset, err := getManagedAsset(tx, result.AssetId)
+		if err != nil {
+			return err
+		}
+		if !asset.ValidToken(token, time.Now().Unix()) {
+			if err := bk.Delete([]byte(token)); err != nil {
+				return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", token, err))
+			}
+			return derrors.NewFailedPreconditionError("asset is not managed by this EIC")
+		}
+		result = *asset
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot get asset by token")
+	}
+
+	return &result, nil
+}
+
+// getManagedAsset reads an asset returning a FailedPrecondition error if it is not managed by this EIC.
+func getManagedAsset(tx *bolt.Tx, assetID string) (*entities.AgentJoinInfo, error) {
+	bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+	if err != nil {
+		return nil, derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+	}
+	res := bk.Get([]byte(assetID))
+	if res == nil {
+		return nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	var asset entities.AgentJoinInfo
+	if err := json.Unmarshal(res, &asset); err != nil {
+		return nil, derrors.NewInternalError("error creating object")
+	}
+	return &asset, nil
+}
+
+// updateManagedAsset stores an asset and the index of its valid tokens, removing the tokens no longer valid.
+func updateManagedAsset(tx *bolt.Tx, asset *entities.AgentJoinInfo, invalid []string) error {
+	toAddBytes, err := json.Marshal(asset)
+	if err != nil {
+		return derrors.NewInternalError("cannot marshal entity")
+	}
+	bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+	}
+	if err := bk.Put([]byte(asset.AssetId), toAddBytes); err != nil {
+		return derrors.NewInternalError("Cannot update managed asset")
+	}
+
+	bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
+	}
+	for _, token := range invalid {
+		if err := bkToken.Delete([]byte(token)); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", token, err))
+		}
+	}
+	for _, token := range asset.Tokens() {
+		if token == asset.Token && asset.TokenRevoked {
+			continue
+		}
+		if err := bkToken.Put([]byte(token), toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot update managed asset")
+		}
+	}
+	return nil
+}
+
+// RotateAssetToken replaces the token of an asset. The previous token is still valid until graceUntil.
+func (b *BboltAssetProvider) RotateAssetToken(assetID string, token string, graceUntil int64) (*entities.AgentJoinInfo, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var result *entities.AgentJoinInfo
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		asset, err := getManagedAsset(tx, assetID)
+		if err != nil {
+			return err
+		}
+		bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
+		}
+		if bkToken.Get([]byte(token)) != nil {
+			return derrors.NewAlreadyExistsError("token already in use")
+		}
+		obsolete := rotateAssetToken(asset, token, graceUntil)
+		result = asset
+		return updateManagedAsset(tx, asset, []string{obsolete})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
+		}
+		return nil, derrors.AsError(err, "cannot rotate asset token")
+	}
+	return result, nil
+}
+
+// RevokeAssetToken revokes a token of an asset immediately, either the current or the previous one. An empty token
+// revokes both of them.
+func (b *BboltAssetProvider) RevokeAssetToken(assetID string, token string) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		asset, err := getManagedAsset(tx, assetID)
+		if err != nil {
+			return err
+		}
+		revoked, err := revokeAssetToken(asset, token)
+		if err != nil {
+			return err
+		}
+		return updateManagedAsset(tx, asset, revoked)
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return dErr
+		}
+		return derrors.AsError(err, "cannot revoke asset token")
+	}
+	return nil
+}
+
+// RequestAssetCertificate records that the agent has been asked for a certificate request, which is waited for
+// until the given timestamp.
+func (b *BboltAssetProvider) RequestAssetCertificate(assetID string, until int64) derrors.Error {
+	return b.updateAssetCertificate(assetID, func(asset *entities.AgentJoinInfo) derrors.Error {
+		asset.Certificate.Requested = until
+		return nil
+	})
+}
+
+// SetAssetCertificate records a new certificate issued to an asset.
+func (b *BboltAssetProvider) SetAssetCertificate(assetID string, serial string, expires int64) derrors.Error {
+	return b.updateAssetCertificate(assetID, func(asset *entities.AgentJoinInfo) derrors.Error {
+		setAssetCertificate(asset, serial, expires)
+		return nil
+	})
+}
+
+// InstallAssetCertificate records that the agent uses the last certificate issued.
+func (b *BboltAssetProvider) InstallAssetCertificate(assetID string, serial string) derrors.Error {
+	return b.updateAssetCertificate(assetID, func(asset *entities.AgentJoinInfo) derrors.Error {
+		return installAssetCertificate(asset, serial)
+	})
+}
+
+// updateAssetCertificate applies an update to the certificates of a managed asset in a single transaction.
+func (b *BboltAssetProvider) updateAssetCertificate(assetID string, update func(asset *entities.AgentJoinInfo) derrors.Error) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		asset, err := getManagedAsset(tx, assetID)
+		if err != nil {
+			return err
+		}
+		if uErr := update(asset); uErr != nil {
+			return uErr
+		}
+		return updateManagedAsset(tx, asset, nil)
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return dErr
+		}
+		return derrors.AsError(err, "cannot update asset certificate")
+	}
+	return nil
+}
+
+func (b *BboltAssetProvider) GetManagedAsset(assetID string) (*entities.AgentJoinInfo, derrors.Error) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var result entities.AgentJoinInfo
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+		}
+
+		res := bk.Get([]byte(assetID))
+		if res == nil {
+			return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+		}
+
+		if err := json.Unmarshal(res, &result); err != nil {
+			return derrors.NewInternalError("error creating object")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot get managed asset")
+	}
+
+	return &result, nil
+}
+
+func (b *BboltAssetProvider) ListManagedAssets(filter ManagedAssetFilter) ([]entities.AgentJoinInfo, derrors.Error) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	result := make([]entities.AgentJoinInfo, 0)
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
+		}
+
+		return bk.ForEach(func(k, v []byte) error {
+			var asset entities.AgentJoinInfo
+			if err := json.Unmarshal(v, &asset); err != nil {
+				return derrors.NewInternalError("error creating object")
+			}
+			if filter.Matches(asset) {
+				result = append(result, asset)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot list managed assets")
+	}
+
+	sortManagedAssets(result)
+	return result, nil
+}
+
+// AddJoinToken adds a new join token for agents
+func (b *BboltAssetProvider) AddJoinToken(joinToken string, options JoinTokenOptions)  (*entities.JoinToken, derrors.Error){
+
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	token := newJoinToken(joinToken, options, time.Now())
+	toAddBytes, err := json.Marshal(token)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot marshal entity")
+	}
+
+	err =  b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+		}
+
+		key := []byte(joinToken)
+
+		if err := bk.Put(key, toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add join token")
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot add join token")
+	}
+
+	return &token, nil
+}
+
+// unmarshalJoinToken reads a stored join token. Tokens stored by previous versions only contain the expiration date.
+func unmarshalJoinToken(joinToken string, res []byte) (*entities.JoinToken, error) {
+	token := &entities.JoinToken{Token: joinToken}
+	if err := json.Unmarshal(res, token); err != nil {
+		if err := json.Unmarshal(res, &token.ExpiredOn); err != nil {
+			return nil, derrors.NewInternalError("error creating object")
+		}
+	}
+	return token, nil
+}
+
+// updateJoinToken replaces a join token with the result of update. It returns a NotFound error if the token does not
+// exist.
+func updateJoinToken(tx *bolt.Tx, joinToken string, update func(token *entities.JoinToken) error) error {
+	bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+	if err != nil {
+		return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+	}
+
+	res := bk.Get([]byte(joinToken))
+	if res == nil {
+		return derrors.NewNotFoundError("join token not found")
+	}
+	token, err := unmarshalJoinToken(joinToken, res)
+	if err != nil {
+		return err
+	}
+	if err := update(token); err != nil {
+		return err
+	}
+
+	toAddBytes, err := json.Marshal(token)
+	if err != nil {
+		return derrors.NewInternalError("cannot marshal entity")
+	}
+	if err := bk.Put([]byte(joinToken), toAddBytes); err != nil {
+		return derrors.NewInternalError("Cannot update join token")
+	}
+	return nil
+}
+
+// CheckJoinToken checks if a join token is valid
+func (b *BboltAssetProvider) CheckJoinToken(joinToken string) (bool, derrors.Error){
+	b.Lock()
+	defer b.Unlock()
+
+	check := false
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return false, checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+		}
+
+		res := bk.Get([]byte(joinToken))
+
+		if res != nil {
+
+			token, err := unmarshalJoinToken(joinToken, res)
+			if err != nil {
+				return err
+			}
+			now := time.Now().Unix()
+			if token.IsValid(now) {
+				check = true
+			}else if token.IsExpired(now) {
+				// Expire the token
+				if err := bk.Delete([]byte(joinToken)); err != nil {
+					return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", joinToken, err))
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return false, derrors.AsError(err, "cannot check join token")
+	}
+
+	return check, nil
+}
+
+// UseJoinToken registers that an agent joins with a token and returns the token. It fails if the token is not valid.
+func (b *BboltAssetProvider) UseJoinToken(joinToken string) (*entities.JoinToken, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var used *entities.JoinToken
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return updateJoinToken(tx, joinToken, func(token *entities.JoinToken) error {
+			if err := useJoinToken(token, time.Now().Unix()); err != nil {
+				return err
+			}
+			used = token
+			return nil
+		})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return nil, dErr
+		}
+		return nil, derrors.AsError(err, "cannot use join token")
+	}
+
+	return used, nil
+}
+
+// ReleaseJoinToken gives back the use of a token whose agent could not join.
+func (b *BboltAssetProvider) ReleaseJoinToken(joinToken string) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		err := updateJoinToken(tx, joinToken, func(token *entities.JoinToken) error {
+			releaseJoinToken(token)
+			return nil
+		})
+		if dErr, ok := err.(derrors.Error); ok && dErr.Type() == derrors.NotFound {
+			// the token has been removed in the meantime
+			return nil
+		}
+		return err
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return dErr
+		}
+		return derrors.AsError(err, "cannot release join token")
+	}
+	return nil
+}
+
+// RevokeJoinToken revokes a join token so it cannot be used by agents. The token is kept for listing purposes.
+func (b *BboltAssetProvider) RevokeJoinToken(joinToken string) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return updateJoinToken(tx, joinToken, func(token *entities.JoinToken) error {
+			token.Revoked = true
+			return nil
+		})
+	})
+
+	if err != nil {
+		if dErr, ok := err.(derrors.Error); ok {
+			return dErr
+		}
+		return derrors.AsError(err, "cannot revoke join token")
+	}
+	return nil
+}
+
+// ListJoinTokens retrieves the join tokens sorted by creation date.
+func (b *BboltAssetProvider) ListJoinTokens() ([]entities.JoinToken, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	result := make([]entities.JoinToken, 0)
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+		}
+		return bk.ForEach(func(k, v []byte) error {
+			token, err := unmarshalJoinToken(string(k), v)
+			if err != nil {
+				return err
+			}
+			result = append(result, *token)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot list join tokens")
+	}
+
+	sortJoinTokens(result)
+	return result, nil
+}
+
+// RemoveJoinToken removes a join token so it cannot be used by agents.
+func (b *BboltAssetProvider) RemoveJoinToken(joinToken string) derrors.Error {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return checkErr
+	}
+
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+		if err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+		}
+
+		if err := bk.Delete([]byte(joinToken)); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", joinToken, err))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return derrors.AsError(err, "cannot remove join token")
+	}
+	return nil
+}
+
+// RemoveStaleRecords removes the join tokens, outbox messages and agent starts that exceed the retention policy.
+func (b *BboltAssetProvider) RemoveStaleRecords(policy RetentionPolicy, now int64) (*CollectionResult, derrors.Error) {
+	b.Lock()
+	defer b.Unlock()
+
+	checkErr := b.CheckConnection()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	result := &CollectionResult{}
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		if result.JoinTokens, err = collectJoinTokens(tx, policy.JoinTokens, now); err != nil {
+			return err
+		}
+		if result.OutboxMessages, err = collectOutboxMessages(tx, policy.OutboxMessages, now); err != nil {
+			return err
+		}
+		result.AgentStarts, err = collectAgentStarts(tx, policy.AgentStarts, now)
+		return err
+	})
+
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot remove stale records")
+	}
+	return result, nil
+}
+
+// collectJoinTokens removes the join tokens that exceed the retention.
+func collectJoinTokens(tx *bolt.Tx, retention Retention, now int64) (CollectedRecords, error) {
+	bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+	if err != nil {
+		return CollectedRecords{}, derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+	}
+
+	tokens := make([]entities.JoinToken, 0)
+	err = bk.ForEach(func(k, v []byte) error {
+		token, err := unmarshalJoinToken(string(k), v)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, *token)
+		return nil
+	})
+	if err != nil {
+		return CollectedRecords{}, err
+	}
+	sortJoinTokens(tokens)
+	records := make([]storedRecord, 0, len(tokens))
+	for _, token := range tokens {
+		records = append(records, storedRecord{key: token.Token, timestamp: token.ExpiredOn})
+	}
+
+	removed, result := collectRecords(records, retention, now)
+	for _, record := range removed {
+		if err := bk.Delete([]byte(record.key)); err != nil {
+			return result, derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", record.key, err))
+		}
+	}
+	return result, nil
+}
+
+// collectOutboxMessages removes the outbox messages that exceed the retention.
+func collectOutboxMessages(tx *bolt.Tx, retention Retention, now int64) (CollectedRecords, error) {
+	bk, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
+	if err != nil {
+		return CollectedRecords{}, derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxBucket))
+	}
+	idsBk, err := tx.CreateBucketIfNotExists([]byte(outboxIDsBucket))
+	if err != nil {
+		return CollectedRecords{}, derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", outboxIDsBucket))
+	}
 
-		// if removes -> foreach response -> remove it
-		if removeEntries{
-			for _, res := range result {
-				if err := bk.Delete([]byte(res.OperationId)); err != nil {
-					return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", res.OperationId, err))
-				}
-			}
+	// the keys are iterated in sequence order
+	records := make([]storedRecord, 0)
+	ids := make(map[string]string, 0)
+	err = bk.ForEach(func(k, v []byte) error {
+		var msg entities.OutboxMessage
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return derrors.NewInternalError("error creating object")
 		}
-
+		records = append(records, storedRecord{key: string(k), timestamp: msg.Created})
+		ids[string(k)] = msg.Id
 		return nil
 	})
-
 	if err != nil {
-		return result, derrors.AsError(err, "cannot retrieve pending EC operations")
+		return CollectedRecords{}, err
 	}
 
+	removed, result := collectRecords(records, retention, now)
+	for _, record := range removed {
+		if err := bk.Delete([]byte(record.key)); err != nil {
+			return result, derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", ids[record.key], err))
+		}
+		if err := idsBk.Delete([]byte(ids[record.key])); err != nil {
+			return result, derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", ids[record.key], err))
+		}
+	}
 	return result, nil
 }
 
-
-// AddPendingOperationResult stores a pending operation for an agent.
-func (b *BboltAssetProvider) AddOpResponse(op entities.AgentOpResponse) derrors.Error{
-	b.Lock()
-	defer b.Unlock()
-
-	checkErr := b.CheckConnection()
-	if checkErr != nil {
-		return checkErr
-	}
-
-
-	toAddBytes, err := json.Marshal(op)
+// collectAgentStarts removes the agent starts that exceed the retention.
+func collectAgentStarts(tx *bolt.Tx, retention Retention, now int64) (CollectedRecords, error) {
+	bk, err := tx.CreateBucketIfNotExists([]byte(agentStartBucket))
 	if err != nil {
-		return derrors.AsError(err, "cannot marshal entity")
+		return CollectedRecords{}, derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", agentStartBucket))
 	}
 
-	err =  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(pendingResultBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingResultBucket))
+	records := make([]storedRecord, 0)
+	histories := make(map[string][]entities.AgentStartInfo, 0)
+	err = bk.ForEach(func(k, v []byte) error {
+		history := make([]entities.AgentStartInfo, 0)
+		if err := json.Unmarshal(v, &history); err != nil {
+			return derrors.NewInternalError("error creating object")
 		}
-
-		key := []byte(op.OperationId)
-		// add pending operation (or rewrite previous result)
-		if err := bk.Put(key, toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot registry operation result")
+		for index, start := range history {
+			records = append(records, storedRecord{key: string(k), index: index, timestamp: start.Created})
 		}
+		histories[string(k)] = history
 		return nil
 	})
+	if err != nil {
+		return CollectedRecords{}, err
+	}
 
-	return nil
+	removed, result := collectRecords(records, retention, now)
+	for assetID, toRemove := range indexesByKey(removed) {
+		history := make([]entities.AgentStartInfo, 0)
+		for index, start := range histories[assetID] {
+			if !toRemove[index] {
+				history = append(history, start)
+			}
+		}
+		if len(history) == 0 {
+			if err := bk.Delete([]byte(assetID)); err != nil {
+				return result, derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
+			}
+			continue
+		}
+		toAddBytes, err := json.Marshal(history)
+		if err != nil {
+			return result, derrors.NewInternalError("cannot marshal entity")
+		}
+		if err := bk.Put([]byte(assetID), toAddBytes); err != nil {
+			return result, derrors.NewInternalError("Cannot update agent starts")
+		}
+	}
+	return result, nil
 }
 
-// GetPendingOpResponses retrieves the list of pending operation responses
-func (b *BboltAssetProvider) GetPendingOpResponses(removeEntries bool)([]entities.AgentOpResponse, derrors.Error){
-
+// AddInstallOperation stores or updates the progress of an agent install.
+func (b *BboltAssetProvider) AddInstallOperation(op entities.InstallOperation) derrors.Error {
 	b.Lock()
 	defer b.Unlock()
 
-	result := make([]entities.AgentOpResponse, 0)
-
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
-		return result, checkErr
+		return checkErr
 	}
 
-	err := b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(pendingResultBucket))
+	toAddBytes, err := json.Marshal(op)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal entity")
+	}
+
+	err = b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(installOpsBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingResultBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", installOpsBucket))
 		}
 
-		// get all the operations (without key)
-		bk.ForEach(func(k, v []byte) error {
-			var response entities.AgentOpResponse
-			if err := json.Unmarshal(v, &response); err != nil {
-				return derrors.NewInternalError("error creating object")
-			}
-			result = append(result, response)
-
-			return nil
-		})
-
-		// if removes -> foreach response -> remove it
-		if removeEntries{
-			for _, res := range result {
-				if err := bk.Delete([]byte(res.OperationId)); err != nil {
-					return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", res.OperationId, err))
-				}
-			}
+		if err := bk.Put([]byte(op.OperationId), toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add install operation")
 		}
-
 		return nil
 	})
 
 	if err != nil {
-		return result, derrors.AsError(err, "cannot get pending operations")
+		return derrors.AsError(err, "cannot add install operation")
 	}
-
-	return result, nil
+	return nil
 }
 
-// AddAgentStart stores a pending message with the agent start information.
-func (b *BboltAssetProvider) AddAgentStart(op entities.AgentStartInfo) derrors.Error{
-
+// RemoveInstallOperation removes an agent install once it is finished.
+func (b *BboltAssetProvider) RemoveInstallOperation(operationID string) derrors.Error {
 	b.Lock()
 	defer b.Unlock()
 
@@ -350,40 +1587,30 @@ func (b *BboltAssetProvider) AddAgentStart(op entities.AgentStartInfo) derrors.E
 		return checkErr
 	}
 
-	toAddBytes, err := json.Marshal(op)
-	if err != nil {
-		return derrors.AsError(err, "cannot marshal entity")
-	}
-
-	err =  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(agentStartBucket))
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(installOpsBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", agentStartBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", installOpsBucket))
 		}
 
-		key := []byte(op.AssetId)
-
-		// add the agent
-		if err := bk.Put(key, toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot add agent")
+		if err := bk.Delete([]byte(operationID)); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", operationID, err))
 		}
 		return nil
 	})
 
 	if err != nil {
-		return derrors.AsError(err, "cannot add agent start")
+		return derrors.AsError(err, "cannot remove install operation")
 	}
-
 	return nil
 }
 
-// GetPendingAgetStart retrieves the list of Agent start operations that need to be send
-func (b *BboltAssetProvider) GetPendingAgentStart(removeEntries bool) ([]entities.AgentStartInfo, derrors.Error){
-
+// GetInstallOperations retrieves the list of agent installs that have not finished.
+func (b *BboltAssetProvider) GetInstallOperations() ([]entities.InstallOperation, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
-	result := make([]entities.AgentStartInfo, 0)
+	result := make([]entities.InstallOperation, 0)
 
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
@@ -391,43 +1618,29 @@ func (b *BboltAssetProvider) GetPendingAgentStart(removeEntries bool) ([]entitie
 	}
 
 	err := b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(agentStartBucket))
+		bk, err := tx.CreateBucketIfNotExists([]byte(installOpsBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", agentStartBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", installOpsBucket))
 		}
 
-		// get ALL the agents (without key)
-		bk.ForEach(func(k, v []byte) error {
-			var response entities.AgentStartInfo
-			if err := json.Unmarshal(v, &response); err != nil {
+		return bk.ForEach(func(k, v []byte) error {
+			var op entities.InstallOperation
+			if err := json.Unmarshal(v, &op); err != nil {
 				return derrors.NewInternalError("error creating object")
 			}
-			result = append(result, response)
-
+			result = append(result, op)
 			return nil
 		})
-
-		// if remove flag is true -> delete all the agents that are going to be returned
-		if removeEntries{
-			for _, res := range result {
-				if err := bk.Delete([]byte(res.AssetId)); err != nil {
-					return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", res.AssetId, err))
-				}
-			}
-		}
-
-		return nil
 	})
 
 	if err != nil {
-		return result, derrors.AsError(err, "cannot get pending agent start messages")
+		return result, derrors.AsError(err, "cannot get install operations")
 	}
-
 	return result, nil
 }
 
-
-func (b *BboltAssetProvider) AddManagedAsset(asset entities.AgentJoinInfo) derrors.Error {
+// AddPendingUninstall stores the uninstall of an agent that waits for the agent to connect.
+func (b *BboltAssetProvider) AddPendingUninstall(request entities.UninstallAgentRequest) derrors.Error {
 	b.Lock()
 	defer b.Unlock()
 
@@ -436,107 +1649,54 @@ func (b *BboltAssetProvider) AddManagedAsset(asset entities.AgentJoinInfo) derro
 		return checkErr
 	}
 
-	newErr :=  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
-		}
-
-		// check if asset is already managed
-		res := bk.Get([]byte (asset.AssetId))
-
-		if res != nil {
-			return derrors.NewAlreadyExistsError("asset already managed by this EIC").WithParams(asset.AssetId)
-		}
+	toAddBytes, err := json.Marshal(request)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal entity")
+	}
 
-		toAddBytes, err := json.Marshal(asset)
+	err = b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(pendingUninstallBucket))
 		if err != nil {
-			return derrors.AsError(err, "cannot marshal entity")
-		}
-
-		// add the asset in assetsByAssetIDBucket bucket
-		if err := bk.Put([]byte (asset.AssetId), toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot add new element")
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", pendingUninstallBucket))
 		}
 
-		bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
-		}
-		// add the asset in assetsByTokenBucket bucket
-		if err := bkToken.Put([]byte (asset.Token), toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot add new element")
+		if err := bk.Put([]byte(request.AssetId), toAddBytes); err != nil {
+			return derrors.NewInternalError("Cannot add pending uninstall")
 		}
-
 		return nil
-
 	})
 
-	if newErr != nil {
-		return derrors.AsError(newErr, "cannot add managed asset")
+	if err != nil {
+		return derrors.AsError(err, "cannot add pending uninstall")
 	}
-
 	return nil
 }
 
-func (b *BboltAssetProvider) RemoveManagedAsset(assetID string) derrors.Error {
-
+// GetPendingUninstall retrieves the uninstall pending for an agent, or nil if the agent is not being uninstalled.
+func (b *BboltAssetProvider) GetPendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
-		return checkErr
+		return nil, checkErr
 	}
 
-	newErr :=  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByAssetIDBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByAssetIDBucket))
-		}
-
-		// get the asses to check if it exists
-		res := bk.Get([]byte (assetID))
-
-		var asset entities.AgentJoinInfo
-
-		// if the asset does not exist -> error
-		if res == nil {
-			return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
-		}
-
-		if err := json.Unmarshal(res, &asset); err != nil {
-			return derrors.NewInternalError("error creating object")
-		}
-
-		bkToken, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
-		if bkToken == nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
-		}
-
-		// delete assetsByAssetIDToken
-		if err := bkToken.Delete([]byte(asset.Token)); err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", asset.Token, err))
-		}
-
-		// delete assetsByAssetIDBucket
-		if err := bk.Delete([]byte(assetID)); err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
-		}
-
-		return nil
-
+	var result *entities.UninstallAgentRequest
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = readPendingUninstall(tx, assetID)
+		return err
 	})
 
-	if newErr != nil {
-		return derrors.AsError(newErr, "cannot remove managed asset")
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot get pending uninstall")
 	}
-
-	return nil
+	return result, nil
 }
 
-func (b *BboltAssetProvider) GetAssetByToken(token string) (*entities.AgentJoinInfo, derrors.Error) {
-
+// RemovePendingUninstall removes the uninstall pending for an agent and returns it, or nil if there is none.
+func (b *BboltAssetProvider) RemovePendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
@@ -545,118 +1705,105 @@ func (b *BboltAssetProvider) GetAssetByToken(token string) (*entities.AgentJoinI
 		return nil, checkErr
 	}
 
-	var result entities.AgentJoinInfo
-
+	var result *entities.UninstallAgentRequest
 	err := b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(assetsByTokenBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", assetsByTokenBucket))
-		}
-
-		// get the asset
-		res := bk.Get([]byte(token))
-
-		if res == nil {
-			return derrors.NewFailedPreconditionError("asset is not managed by this EIC")
+		var err error
+		result, err = readPendingUninstall(tx, assetID)
+		if err != nil || result == nil {
+			return err
 		}
-
-		if err := json.Unmarshal(res, &result); err != nil {
-			return derrors.NewInternalError("error creating object")
+		if err := tx.Bucket([]byte(pendingUninstallBucket)).Delete([]byte(assetID)); err != nil {
+			return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", assetID, err))
 		}
-
 		return nil
 	})
 
 	if err != nil {
-		return nil, derrors.AsError(err, "cannot get asset by token")
+		return nil, derrors.AsError(err, "cannot remove pending uninstall")
 	}
-
-	return &result, nil
+	return result, nil
 }
 
-// AddJoinToken adds a new join token for agents
-func (b *BboltAssetProvider) AddJoinToken(joinToken string)  (*entities.JoinToken, derrors.Error){
+// readPendingUninstall retrieves the uninstall pending for an agent, or nil if there is none.
+func readPendingUninstall(tx *bolt.Tx, assetID string) (*entities.UninstallAgentRequest, error) {
+	bk := tx.Bucket([]byte(pendingUninstallBucket))
+	if bk == nil {
+		return nil, nil
+	}
+	res := bk.Get([]byte(assetID))
+	if res == nil {
+		return nil, nil
+	}
+	request := &entities.UninstallAgentRequest{}
+	if err := json.Unmarshal(res, request); err != nil {
+		return nil, derrors.NewInternalError("error creating object")
+	}
+	return request, nil
+}
 
+// TrustHostKey stores the fingerprint of the key of a remote host trusted on first use if the host is not known,
+// and returns the fingerprint trusted for the host.
+func (b *BboltAssetProvider) TrustHostKey(host string, fingerprint string) (string, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
-		return nil, checkErr
-	}
-
-	expired := time.Now().Add(AgentJoinTokenTTL).Unix()
-	toAddBytes, err := json.Marshal(expired)
-	if err != nil {
-		return nil, derrors.AsError(err, "cannot marshal entity")
+		return "", checkErr
 	}
 
-	err =  b.DB.Update(func(tx *bolt.Tx) error {
-		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
+	trusted := fingerprint
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(hostKeyBucket))
 		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", hostKeyBucket))
 		}
 
-		key := []byte(joinToken)
-
-		if err := bk.Put(key, toAddBytes); err != nil {
-			return derrors.NewInternalError("Cannot add join token")
+		res := bk.Get([]byte(host))
+		if res != nil {
+			trusted = string(res)
+			return nil
+		}
+		if err := bk.Put([]byte(host), []byte(fingerprint)); err != nil {
+			return derrors.NewInternalError("Cannot add host key")
 		}
 		return nil
 	})
 
 	if err != nil {
-		return nil, derrors.AsError(err, "cannot add join token")
+		return "", derrors.AsError(err, "cannot trust host key")
 	}
-
-	return &entities.JoinToken{Token:joinToken, ExpiredOn:expired}, nil
+	return trusted, nil
 }
 
-// CheckJoinToken checks if a join token is valid
-func (b *BboltAssetProvider) CheckJoinToken(joinToken string) (bool, derrors.Error){
+// GetHostKey retrieves the fingerprint of a remote host, or an empty string if the host is not known.
+func (b *BboltAssetProvider) GetHostKey(host string) (string, derrors.Error) {
 	b.Lock()
 	defer b.Unlock()
 
-	check := false
-
 	checkErr := b.CheckConnection()
 	if checkErr != nil {
-		return false, checkErr
+		return "", checkErr
 	}
 
-	err := b.DB.Update(func(tx *bolt.Tx) error {
-		var result int64
-
-		bk, err := tx.CreateBucketIfNotExists([]byte(joinTokenBucket))
-		if err != nil {
-			return derrors.NewInternalError(fmt.Sprintf("Failed to get bucket '%s'", joinTokenBucket))
+	var fingerprint string
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(hostKeyBucket))
+		if bk == nil {
+			return nil
 		}
 
-		res := bk.Get([]byte(joinToken))
-
+		res := bk.Get([]byte(host))
 		if res != nil {
-
-			if err := json.Unmarshal(res, &result); err != nil {
-				return derrors.NewInternalError("error creating object")
-			}
-			if result >= time.Now().Unix() {
-				check = true
-			}else{
-				// Expire the token
-				if err := bk.Delete([]byte(joinToken)); err != nil {
-					return derrors.NewInternalError(fmt.Sprintf("Failed to delete '%s': %v", joinToken, err))
-				}
-			}
+			fingerprint = string(res)
 		}
-
 		return nil
 	})
 
 	if err != nil {
-		return false, derrors.AsError(err, "cannot check join token")
+		return "", derrors.AsError(err, "cannot get host key")
 	}
-
-	return check, nil
+	return fingerprint, nil
 }
 
 func (b *BboltAssetProvider) clear(table string) derrors.Error{
@@ -694,9 +1841,21 @@ func (b *BboltAssetProvider) Clear() derrors.Error{
 	b.clear(assetsByAssetIDBucket)
 	b.clear(assetsByTokenBucket)
 	b.clear(pendingOpsBucket)
-	b.clear(pendingResultBucket)
+	b.clear(deliveredOpsBucket)
+	b.clear(outboxBucket)
+	b.clear(outboxIDsBucket)
 	b.clear(joinTokenBucket)
 	b.clear(agentStartBucket)
+	b.clear(hostKeyBucket)
+	b.clear(installOpsBucket)
+	b.clear(pendingUninstallBucket)
 
 	return nil
-}
\ No newline at end of file
+}
+
+// Close the underlying database waiting for any ongoing operation.
+func (b *BboltAssetProvider) Close() {
+	b.Lock()
+	defer b.Unlock()
+	b.BboltDB.Close()
+}
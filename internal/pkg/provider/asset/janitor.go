@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package asset
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultJanitorPeriod with the period between garbage collections of the stale records.
+const DefaultJanitorPeriod = 10 * time.Minute
+
+// Retention determines how long the records of a kind are kept.
+type Retention struct {
+	// MaxAge with the time a record is kept, 0 to keep it until it is evicted.
+	MaxAge time.Duration
+	// MaxRecords with the maximum number of records kept, 0 for no limit. The oldest records are evicted first.
+	MaxRecords int
+}
+
+// RetentionPolicy with the retention of each kind of record collected by the janitor.
+type RetentionPolicy struct {
+	// JoinTokens retention. The age of a token is counted from its expiration so valid tokens are only evicted.
+	JoinTokens Retention
+	// OutboxMessages retention. The messages are removed even if they have not been delivered to the management
+	// cluster.
+	OutboxMessages Retention
+	// AgentStarts retention of the start history of the agents.
+	AgentStarts Retention
+}
+
+// CollectedRecords with the number of records of a kind removed by the garbage collection.
+type CollectedRecords struct {
+	// Expired with the records older than the retention.
+	Expired int `json:"expired"`
+	// Evicted with the records removed to keep the maximum number of records.
+	Evicted int `json:"evicted"`
+}
+
+// Total number of records removed.
+func (cr CollectedRecords) Total() int {
+	return cr.Expired + cr.Evicted
+}
+
+func (cr *CollectedRecords) add(other CollectedRecords) {
+	cr.Expired += other.Expired
+	cr.Evicted += other.Evicted
+}
+
+// CollectionResult with the records removed by the garbage collection of each kind.
+type CollectionResult struct {
+	JoinTokens     CollectedRecords `json:"join_tokens"`
+	OutboxMessages CollectedRecords `json:"outbox_messages"`
+	AgentStarts    CollectedRecords `json:"agent_starts"`
+}
+
+// Total number of records removed.
+func (cr CollectionResult) Total() int {
+	return cr.JoinTokens.Total() + cr.OutboxMessages.Total() + cr.AgentStarts.Total()
+}
+
+func (cr *CollectionResult) add(other CollectionResult) {
+	cr.JoinTokens.add(other.JoinTokens)
+	cr.OutboxMessages.add(other.OutboxMessages)
+	cr.AgentStarts.add(other.AgentStarts)
+}
+
+// storedRecord identifies a record considered by the garbage collection.
+type storedRecord struct {
+	// key of the record in its bucket.
+	key string
+	// index of the record in the list stored under the key, for the kinds stored as lists.
+	index int
+	// timestamp from which the age of the record is counted.
+	timestamp int64
+}
+
+// collectRecords returns the records older than the retention and, among the remaining ones, the oldest ones exceeding
+// the maximum number of records. Records with the same timestamp keep the order of the list.
+func collectRecords(records []storedRecord, retention Retention, now int64) ([]storedRecord, CollectedRecords) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].timestamp < records[j].timestamp
+	})
+	result := CollectedRecords{}
+	if retention.MaxAge > 0 {
+		limit := now - int64(retention.MaxAge.Seconds())
+		for result.Expired < len(records) && records[result.Expired].timestamp < limit {
+			result.Expired++
+		}
+	}
+	if retention.MaxRecords > 0 && len(records)-result.Expired > retention.MaxRecords {
+		result.Evicted = len(records) - result.Expired - retention.MaxRecords
+	}
+	return records[:result.Total()], result
+}
+
+// indexesByKey groups the indexes of the records by key.
+func indexesByKey(records []storedRecord) map[string]map[int]bool {
+	result := make(map[string]map[int]bool, 0)
+	for _, record := range records {
+		if _, exists := result[record.key]; !exists {
+			result[record.key] = make(map[int]bool, 0)
+		}
+		result[record.key][record.index] = true
+	}
+	return result
+}
+
+// Janitor periodically removes the records that are no longer needed, or that exceed the retention if the edge
+// controller cannot deliver them, so the storage does not grow forever.
+type Janitor struct {
+	sync.Mutex
+	provider Provider
+	policy   RetentionPolicy
+	period   time.Duration
+	// collected with the records removed since the janitor was created.
+	collected CollectionResult
+}
+
+func NewJanitor(provider Provider, policy RetentionPolicy, period time.Duration) *Janitor {
+	return &Janitor{
+		provider: provider,
+		policy:   policy,
+		period:   period,
+	}
+}
+
+// LaunchJanitorLoop is intended to be launched as goroutine to collect the stale records periodically until the
+// context is done.
+func (j *Janitor) LaunchJanitorLoop(ctx context.Context) {
+	log.Info().Str("period", j.period.String()).Msg("Launching storage janitor loop")
+	ticker := time.NewTicker(j.period)
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Collect(); err != nil {
+				log.Error().Str("trace", err.DebugReport()).Msg("cannot collect stale records")
+			}
+		case <-ctx.Done():
+			ticker.Stop()
+			log.Info().Msg("Storage janitor loop finished")
+			return
+		}
+	}
+}
+
+// Collect removes the stale records according to the retention policy.
+func (j *Janitor) Collect() derrors.Error {
+	result, err := j.provider.RemoveStaleRecords(j.policy, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	j.Lock()
+	j.collected.add(*result)
+	total := j.collected
+	j.Unlock()
+
+	if result.Total() == 0 {
+		return nil
+	}
+	event := log.Info()
+	if result.OutboxMessages.Total() > 0 {
+		// the management cluster never receives these messages
+		event = log.Warn()
+	}
+	event.Interface("collected", result).Int("totalCollected", total.Total()).Msg("stale records removed")
+	return nil
+}
+
+// Collected returns the records removed since the janitor was created.
+func (j *Janitor) Collected() CollectionResult {
+	j.Lock()
+	defer j.Unlock()
+	return j.collected
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package asset
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Storage janitor", func() {
+
+	ginkgo.It("should accumulate the records removed", func() {
+		provider := NewMockupAssetProvider()
+		policy := RetentionPolicy{OutboxMessages: Retention{MaxRecords: 1}}
+		janitor := NewJanitor(provider, policy, time.Minute)
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 3; i++ {
+				gomega.Expect(provider.AddOutboxMessage(*CreateTestOutboxMessage())).To(gomega.Succeed())
+			}
+			gomega.Expect(janitor.Collect()).To(gomega.Succeed())
+		}
+		gomega.Expect(janitor.Collected().OutboxMessages).To(gomega.Equal(CollectedRecords{Evicted: 5}))
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should evict the oldest records after the expired ones", func() {
+		records := []storedRecord{{key: "c", timestamp: 30}, {key: "a", timestamp: 10}, {key: "b", timestamp: 20}, {key: "d", timestamp: 40}}
+		removed, result := collectRecords(records, Retention{MaxAge: 15 * time.Second, MaxRecords: 2}, 30)
+		gomega.Expect(result).To(gomega.Equal(CollectedRecords{Expired: 1, Evicted: 1}))
+		gomega.Expect(removed).To(gomega.Equal([]storedRecord{{key: "a", timestamp: 10}, {key: "b", timestamp: 20}}))
+	})
+})
@@ -19,6 +19,7 @@ package asset
 import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"sort"
 	"sync"
 	"time"
 )
@@ -32,14 +33,22 @@ type MockupAssetProvider struct {
 	assetsByToken map[string]entities.AgentJoinInfo
 	// pendingOps with a map of operations pending per asset identifier.
 	pendingOps map[string][]entities.AgentOpRequest
-	// pendingResult with a map of pending responses per operation identifier.
-	pendingResult map[string]entities.AgentOpResponse
-	// pendingECResult with a map of pending responses per operation identifier.
-	pendingECResult map[string]entities.EdgeControllerOpResponse
-	// joinToken map with the join tokens and their expiration date.
-	joinToken map[string]int64
-	// agentStart map with the start info by asset identifier.
-	agentStart map[string]entities.AgentStartInfo
+	// deliveredOps with a map of operations delivered to the agent without response per asset identifier.
+	deliveredOps map[string][]entities.AgentOpRequest
+	// outbox with the messages for the management cluster in the order they were added.
+	outbox []entities.OutboxMessage
+	// outboxSequence with the sequence of the last message added to the outbox.
+	outboxSequence uint64
+	// joinToken map with the join tokens indexed by token.
+	joinToken map[string]entities.JoinToken
+	// agentStart map with the recent starts by asset identifier.
+	agentStart map[string][]entities.AgentStartInfo
+	// hostKeys map with the fingerprint of the remote hosts trusted on first use.
+	hostKeys map[string]string
+	// installOps map with the agent installs in progress by operation identifier.
+	installOps map[string]entities.InstallOperation
+	// pendingUninstalls map with the uninstalls waiting for the agent to connect by asset identifier.
+	pendingUninstalls map[string]entities.UninstallAgentRequest
 }
 
 func NewMockupAssetProvider() * MockupAssetProvider{
@@ -47,10 +56,13 @@ func NewMockupAssetProvider() * MockupAssetProvider{
 		assetsByAssetID: make(map[string]entities.AgentJoinInfo, 0),
 		assetsByToken: make(map[string]entities.AgentJoinInfo, 0),
 		pendingOps: make(map[string][]entities.AgentOpRequest, 0),
-		pendingResult: make(map[string]entities.AgentOpResponse, 0),
-		pendingECResult: make(map[string]entities.EdgeControllerOpResponse, 0),
-		joinToken: make(map[string]int64, 0),
-		agentStart: make(map[string]entities.AgentStartInfo, 0),
+		deliveredOps: make(map[string][]entities.AgentOpRequest, 0),
+		outbox: make([]entities.OutboxMessage, 0),
+		joinToken: make(map[string]entities.JoinToken, 0),
+		agentStart: make(map[string][]entities.AgentStartInfo, 0),
+		hostKeys: make(map[string]string, 0),
+		installOps: make(map[string]entities.InstallOperation, 0),
+		pendingUninstalls: make(map[string]entities.UninstallAgentRequest, 0),
 	}
 }
 
@@ -69,15 +81,18 @@ func (m*MockupAssetProvider) unsafeExistAgentStart(assetID string) bool{
 	return exists
 }
 
-func (m *MockupAssetProvider) AddPendingOperation(op entities.AgentOpRequest) derrors.Error {
+func (m *MockupAssetProvider) AddPendingOperation(op entities.AgentOpRequest, capacity int) (int, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
 	if !m.unsafeExistAsset(op.AssetId){
-		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(op.AssetId)
+		return 0, derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(op.AssetId)
 	}
-	opList, _ := m.pendingOps[op.AssetId]
-	m.pendingOps[op.AssetId] = append(opList, op)
-	return nil
+	opList, position, err := queueOperation(m.pendingOps[op.AssetId], m.deliveredOps[op.AssetId], op, capacity)
+	if err != nil {
+		return 0, err
+	}
+	m.pendingOps[op.AssetId] = opList
+	return position, nil
 }
 
 func (m *MockupAssetProvider) GetPendingOperations(assetID string, removeEntries bool) ([]entities.AgentOpRequest, derrors.Error) {
@@ -96,72 +111,172 @@ func (m *MockupAssetProvider) GetPendingOperations(assetID string, removeEntries
 	return opList, nil
 }
 
-// AddPendingOperationResult stores a pending operation for an agent.
-func (m *MockupAssetProvider) AddOpResponse(op entities.AgentOpResponse) derrors.Error{
+func (m *MockupAssetProvider) TakePendingOperations(assetID string, now int64, policy DeliveryPolicy) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
-	
-	m.pendingResult[op.OperationId] = op
-	return nil
+	if !m.unsafeExistAsset(assetID){
+		return nil, nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	queue, delivered, toDeliver, exhausted := deliverOperations(m.pendingOps[assetID], m.deliveredOps[assetID], now, policy)
+	m.unsafeSetOperations(m.pendingOps, assetID, queue)
+	m.unsafeSetOperations(m.deliveredOps, assetID, delivered)
+	return toDeliver, exhausted, nil
+}
+
+// unsafeSetOperations replaces the list of operations of an asset, removing it if it is empty.
+func (m *MockupAssetProvider) unsafeSetOperations(ops map[string][]entities.AgentOpRequest, assetID string, opList []entities.AgentOpRequest) {
+	if len(opList) == 0 {
+		delete(ops, assetID)
+	} else {
+		ops[assetID] = opList
+	}
 }
 
-// GetPendingOpResponses retrieves the list of pending operation responses
-func (m *MockupAssetProvider) GetPendingOpResponses(removeEntries bool)([]entities.AgentOpResponse, derrors.Error){
+func (m *MockupAssetProvider) GetDeliveredOperations(assetID string) ([]entities.AgentOpRequest, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
-	result := make([]entities.AgentOpResponse, 0, len(m.agentStart))
-	for _, v := range m.pendingResult{
-		result = append(result, v)
+	result := make([]entities.AgentOpRequest, 0, len(m.deliveredOps[assetID]))
+	return append(result, m.deliveredOps[assetID]...), nil
+}
+
+func (m *MockupAssetProvider) RemoveDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	opList, removed := removeOperation(m.deliveredOps[assetID], operationID)
+	if removed == nil {
+		return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
 	}
-	if removeEntries{
-		m.pendingResult = make(map[string]entities.AgentOpResponse, 0)
+	if len(opList) == 0 {
+		delete(m.deliveredOps, assetID)
+	} else {
+		m.deliveredOps[assetID] = opList
 	}
-	return result, nil
+	return removed, nil
 }
 
+func (m *MockupAssetProvider) CancelDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	opList, canceled := cancelOperation(m.deliveredOps[assetID], operationID)
+	if canceled == nil {
+		return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
+	}
+	m.deliveredOps[assetID] = opList
+	return canceled, nil
+}
+
+func (m *MockupAssetProvider) AcknowledgeDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	opList, acknowledged := acknowledgeOperation(m.deliveredOps[assetID], operationID)
+	if acknowledged == nil {
+		return nil, derrors.NewNotFoundError("operation has not been delivered").WithParams(assetID, operationID)
+	}
+	m.deliveredOps[assetID] = opList
+	return acknowledged, nil
+}
 
-// AddECOpResponse stores a response for an operation executed by the edge controller.
-func (m *MockupAssetProvider) AddECOpResponse(op entities.EdgeControllerOpResponse) derrors.Error{
+func (m *MockupAssetProvider) RemoveExpiredOperations(now int64) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
+	return m.unsafeExpireOperations(m.pendingOps, now), m.unsafeExpireOperations(m.deliveredOps, now), nil
+}
 
-	m.pendingECResult[op.OperationId] = op
-	return nil
+// unsafeExpireOperations removes the expired operations from a map of operations per asset and returns them.
+func (m *MockupAssetProvider) unsafeExpireOperations(ops map[string][]entities.AgentOpRequest, now int64) []entities.AgentOpRequest {
+	result := make([]entities.AgentOpRequest, 0)
+	for assetID, opList := range ops {
+		kept, expired := expireOperations(opList, now)
+		if len(expired) == 0 {
+			continue
+		}
+		result = append(result, expired...)
+		if len(kept) == 0 {
+			delete(ops, assetID)
+		} else {
+			ops[assetID] = kept
+		}
+	}
+	return result
 }
-// GetPendingECOpResponses retrieves the list of pending operation responses
-func (m *MockupAssetProvider) GetPendingECOpResponses(removeEntries bool)([]entities.EdgeControllerOpResponse, derrors.Error){
+
+func (m *MockupAssetProvider) RemovePendingOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
-	result := make([]entities.EdgeControllerOpResponse, 0, len(m.pendingECResult))
-	for _, v := range m.pendingECResult{
-		result = append(result, v)
+	opList, removed := removeOperation(m.pendingOps[assetID], operationID)
+	if removed == nil {
+		return nil, derrors.NewNotFoundError("operation is not queued").WithParams(assetID, operationID)
 	}
-	if removeEntries{
-		m.pendingECResult = make(map[string]entities.EdgeControllerOpResponse, 0)
+	m.pendingOps[assetID] = opList
+	return removed, nil
+}
+
+// AddOutboxMessage appends a message to the outbox of the management cluster. Messages whose identifier is already
+// in the outbox are ignored.
+func (m *MockupAssetProvider) AddOutboxMessage(msg entities.OutboxMessage) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	for _, queued := range m.outbox{
+		if queued.Id == msg.Id{
+			return nil
+		}
+	}
+	m.outboxSequence++
+	msg.Sequence = m.outboxSequence
+	m.outbox = append(m.outbox, msg)
+	return nil
+}
+
+// GetOutboxMessages retrieves up to limit messages added after the given sequence, in the order they were added.
+// A limit of 0 retrieves all of them.
+func (m *MockupAssetProvider) GetOutboxMessages(afterSequence uint64, limit int) ([]entities.OutboxMessage, derrors.Error){
+	m.Lock()
+	defer m.Unlock()
+	result := make([]entities.OutboxMessage, 0)
+	for _, msg := range m.outbox{
+		if limit > 0 && len(result) == limit{
+			break
+		}
+		if msg.Sequence > afterSequence{
+			result = append(result, msg)
+		}
 	}
 	return result, nil
 }
 
+// RemoveOutboxMessages removes a set of messages from the outbox once they have been delivered.
+func (m *MockupAssetProvider) RemoveOutboxMessages(ids []string) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	toRemove := make(map[string]bool, len(ids))
+	for _, id := range ids{
+		toRemove[id] = true
+	}
+	remaining := make([]entities.OutboxMessage, 0, len(m.outbox))
+	for _, msg := range m.outbox{
+		if !toRemove[msg.Id]{
+			remaining = append(remaining, msg)
+		}
+	}
+	m.outbox = remaining
+	return nil
+}
 
-// AddAgentStart stores a pending message with the agent start information.
+// AddAgentStart adds the start information to the history of the agent, keeping the last AgentStartHistorySize.
 func (m *MockupAssetProvider) AddAgentStart(op entities.AgentStartInfo) derrors.Error{
 	m.Lock()
 	defer m.Unlock()
-	m.agentStart[op.AssetId] = op
+	m.agentStart[op.AssetId] = addAgentStart(m.agentStart[op.AssetId], op)
 	return nil
 }
 
-// GetPendingAgetStart retrieves the list of Agent start operations that need to be send
-func (m *MockupAssetProvider) GetPendingAgentStart(removeEntries bool) ([]entities.AgentStartInfo, derrors.Error){
+// GetAgentStarts retrieves the recent starts of an agent, the most recent first.
+func (m *MockupAssetProvider) GetAgentStarts(assetID string) ([]entities.AgentStartInfo, derrors.Error){
 	m.Lock()
 	defer m.Unlock()
-	result := make([]entities.AgentStartInfo, 0, len(m.agentStart))
-	for _, v := range m.agentStart{
-		result = append(result, v)
-	}
-	if removeEntries{
-		m.agentStart = make(map[string]entities.AgentStartInfo, 0)
-	}
+	history := m.agentStart[assetID]
+	result := make([]entities.AgentStartInfo, len(history))
+	copy(result, history)
 	return result, nil
 }
 
@@ -183,51 +298,165 @@ func (m *MockupAssetProvider) RemoveManagedAsset(assetID string) derrors.Error {
 	if !m.unsafeExistAsset(assetID){
 		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
 	}
-	associatedToken := ""
-	for token, asset := range m.assetsByToken{
-		if asset.AssetId == assetID {
-			associatedToken = token
-			break
-		}
+	asset := m.assetsByAssetID[assetID]
+	for _, token := range asset.Tokens(){
+		delete(m.assetsByToken, token)
 	}
-	delete(m.assetsByToken, associatedToken)
 	delete(m.assetsByAssetID, assetID)
+	delete(m.pendingOps, assetID)
+	delete(m.deliveredOps, assetID)
 	return nil
 }
 
 func (m *MockupAssetProvider) GetAssetByToken(token string) (*entities.AgentJoinInfo, derrors.Error) {
 	m.Lock()
 	defer m.Unlock()
-	asset, exists := m.assetsByToken[token]
+	indexed, exists := m.assetsByToken[token]
 	if !exists{
 		return nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC")
 	}
+	asset, exists := m.assetsByAssetID[indexed.AssetId]
+	if !exists || !asset.ValidToken(token, time.Now().Unix()){
+		return nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC")
+	}
+	return &asset, nil
+}
+
+// RotateAssetToken replaces the token of an asset. The previous token is still valid until graceUntil.
+func (m *MockupAssetProvider) RotateAssetToken(assetID string, token string, graceUntil int64) (*entities.AgentJoinInfo, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	if _, exists := m.assetsByToken[token]; exists{
+		return nil, derrors.NewAlreadyExistsError("token already in use")
+	}
+	delete(m.assetsByToken, rotateAssetToken(&asset, token, graceUntil))
+	m.unsafeSetManagedAsset(asset)
 	return &asset, nil
 }
 
+// RevokeAssetToken revokes a token of an asset immediately, either the current or the previous one. An empty token
+// revokes both of them.
+func (m *MockupAssetProvider) RevokeAssetToken(assetID string, token string) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	revoked, err := revokeAssetToken(&asset, token)
+	if err != nil{
+		return err
+	}
+	for _, token := range revoked{
+		delete(m.assetsByToken, token)
+	}
+	m.unsafeSetManagedAsset(asset)
+	return nil
+}
+
+// RequestAssetCertificate records that the agent has been asked for a certificate request, which is waited for
+// until the given timestamp.
+func (m *MockupAssetProvider) RequestAssetCertificate(assetID string, until int64) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	asset.Certificate.Requested = until
+	m.unsafeSetManagedAsset(asset)
+	return nil
+}
+
+// SetAssetCertificate records a new certificate issued to an asset.
+func (m *MockupAssetProvider) SetAssetCertificate(assetID string, serial string, expires int64) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	setAssetCertificate(&asset, serial, expires)
+	m.unsafeSetManagedAsset(asset)
+	return nil
+}
+
+// InstallAssetCertificate records that the agent uses the last certificate issued.
+func (m *MockupAssetProvider) InstallAssetCertificate(assetID string, serial string) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	if err := installAssetCertificate(&asset, serial); err != nil{
+		return err
+	}
+	m.unsafeSetManagedAsset(asset)
+	return nil
+}
+
+// unsafeSetManagedAsset updates an asset and the index of its valid tokens.
+func (m *MockupAssetProvider) unsafeSetManagedAsset(asset entities.AgentJoinInfo) {
+	m.assetsByAssetID[asset.AssetId] = asset
+	for _, token := range asset.Tokens(){
+		if token != asset.Token || !asset.TokenRevoked{
+			m.assetsByToken[token] = asset
+		}
+	}
+}
+
+func (m *MockupAssetProvider) GetManagedAsset(assetID string) (*entities.AgentJoinInfo, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	asset, exists := m.assetsByAssetID[assetID]
+	if !exists{
+		return nil, derrors.NewFailedPreconditionError("asset is not managed by this EIC").WithParams(assetID)
+	}
+	return &asset, nil
+}
+
+func (m *MockupAssetProvider) ListManagedAssets(filter ManagedAssetFilter) ([]entities.AgentJoinInfo, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	result := make([]entities.AgentJoinInfo, 0)
+	for _, asset := range m.assetsByAssetID{
+		if filter.Matches(asset){
+			result = append(result, asset)
+		}
+	}
+	sortManagedAssets(result)
+	return result, nil
+}
+
 // AddJoinToken adds a new join token for agents
-func (m *MockupAssetProvider) AddJoinToken(joinToken string) (*entities.JoinToken, derrors.Error){
+func (m *MockupAssetProvider) AddJoinToken(joinToken string, options JoinTokenOptions) (*entities.JoinToken, derrors.Error){
 	m.Lock()
 	defer m.Unlock()
 	if m.unsafeExistJoinToken(joinToken){
 		return nil, derrors.NewAlreadyExistsError("agent join token already exists")
 	}
 
-	expired := time.Now().Add(AgentJoinTokenTTL).Unix()
-	m.joinToken[joinToken] = expired
+	token := newJoinToken(joinToken, options, time.Now())
+	m.joinToken[joinToken] = token
 
-	return &entities.JoinToken{Token:joinToken, ExpiredOn:expired }, nil
+	return &token, nil
 }
 
 // CheckJoinToken checks if a join token is valid
 func (m *MockupAssetProvider) CheckJoinToken(joinToken string) (bool, derrors.Error){
 	m.Lock()
 	defer m.Unlock()
-	expire, exists := m.joinToken[joinToken]
+	token, exists := m.joinToken[joinToken]
 	if exists{
-		if expire >= time.Now().Unix(){
+		now := time.Now().Unix()
+		if token.IsValid(now){
 			return true, nil
-		}else{
+		}else if token.IsExpired(now){
 			// Expire the token
 			delete(m.joinToken, joinToken)
 		}
@@ -235,16 +464,226 @@ func (m *MockupAssetProvider) CheckJoinToken(joinToken string) (bool, derrors.Er
 	return false, nil
 }
 
+// UseJoinToken registers that an agent joins with a token and returns the token. It fails if the token is not valid.
+func (m *MockupAssetProvider) UseJoinToken(joinToken string) (*entities.JoinToken, derrors.Error){
+	m.Lock()
+	defer m.Unlock()
+	token, exists := m.joinToken[joinToken]
+	if !exists{
+		return nil, derrors.NewNotFoundError("join token not found")
+	}
+	if err := useJoinToken(&token, time.Now().Unix()); err != nil{
+		return nil, err
+	}
+	m.joinToken[joinToken] = token
+	return &token, nil
+}
+
+// ReleaseJoinToken gives back the use of a token whose agent could not join.
+func (m *MockupAssetProvider) ReleaseJoinToken(joinToken string) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	token, exists := m.joinToken[joinToken]
+	if exists{
+		releaseJoinToken(&token)
+		m.joinToken[joinToken] = token
+	}
+	return nil
+}
+
+// RevokeJoinToken revokes a join token so it cannot be used by agents. The token is kept for listing purposes.
+func (m *MockupAssetProvider) RevokeJoinToken(joinToken string) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	token, exists := m.joinToken[joinToken]
+	if !exists{
+		return derrors.NewNotFoundError("join token not found")
+	}
+	token.Revoked = true
+	m.joinToken[joinToken] = token
+	return nil
+}
+
+// ListJoinTokens retrieves the join tokens sorted by creation date.
+func (m *MockupAssetProvider) ListJoinTokens() ([]entities.JoinToken, derrors.Error){
+	m.Lock()
+	defer m.Unlock()
+	result := make([]entities.JoinToken, 0, len(m.joinToken))
+	for _, token := range m.joinToken{
+		result = append(result, token)
+	}
+	sortJoinTokens(result)
+	return result, nil
+}
+
+// RemoveJoinToken removes a join token so it cannot be used by agents.
+func (m *MockupAssetProvider) RemoveJoinToken(joinToken string) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	delete(m.joinToken, joinToken)
+	return nil
+}
+
+// RemoveStaleRecords removes the join tokens, outbox messages and agent starts that exceed the retention policy.
+func (m *MockupAssetProvider) RemoveStaleRecords(policy RetentionPolicy, now int64) (*CollectionResult, derrors.Error){
+	m.Lock()
+	defer m.Unlock()
+	result := &CollectionResult{}
+
+	tokens := make([]entities.JoinToken, 0, len(m.joinToken))
+	for _, token := range m.joinToken{
+		tokens = append(tokens, token)
+	}
+	sortJoinTokens(tokens)
+	tokenRecords := make([]storedRecord, 0, len(tokens))
+	for _, token := range tokens{
+		tokenRecords = append(tokenRecords, storedRecord{key: token.Token, timestamp: token.ExpiredOn})
+	}
+	var removed []storedRecord
+	removed, result.JoinTokens = collectRecords(tokenRecords, policy.JoinTokens, now)
+	for _, record := range removed{
+		delete(m.joinToken, record.key)
+	}
+
+	msgRecords := make([]storedRecord, 0, len(m.outbox))
+	for index, msg := range m.outbox{
+		msgRecords = append(msgRecords, storedRecord{index: index, timestamp: msg.Created})
+	}
+	removed, result.OutboxMessages = collectRecords(msgRecords, policy.OutboxMessages, now)
+	if len(removed) > 0{
+		toRemove := indexesByKey(removed)[""]
+		outbox := make([]entities.OutboxMessage, 0, len(m.outbox)-len(removed))
+		for index, msg := range m.outbox{
+			if !toRemove[index]{
+				outbox = append(outbox, msg)
+			}
+		}
+		m.outbox = outbox
+	}
+
+	assetIDs := make([]string, 0, len(m.agentStart))
+	for assetID := range m.agentStart{
+		assetIDs = append(assetIDs, assetID)
+	}
+	sort.Strings(assetIDs)
+	startRecords := make([]storedRecord, 0)
+	for _, assetID := range assetIDs{
+		for index, start := range m.agentStart[assetID]{
+			startRecords = append(startRecords, storedRecord{key: assetID, index: index, timestamp: start.Created})
+		}
+	}
+	removed, result.AgentStarts = collectRecords(startRecords, policy.AgentStarts, now)
+	for assetID, toRemove := range indexesByKey(removed){
+		history := make([]entities.AgentStartInfo, 0)
+		for index, start := range m.agentStart[assetID]{
+			if !toRemove[index]{
+				history = append(history, start)
+			}
+		}
+		if len(history) == 0{
+			delete(m.agentStart, assetID)
+		}else{
+			m.agentStart[assetID] = history
+		}
+	}
+
+	return result, nil
+}
+
+// AddInstallOperation stores or updates the progress of an agent install.
+func (m *MockupAssetProvider) AddInstallOperation(op entities.InstallOperation) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	m.installOps[op.OperationId] = op
+	return nil
+}
+
+// RemoveInstallOperation removes an agent install once it is finished.
+func (m *MockupAssetProvider) RemoveInstallOperation(operationID string) derrors.Error{
+	m.Lock()
+	defer m.Unlock()
+	delete(m.installOps, operationID)
+	return nil
+}
+
+// GetInstallOperations retrieves the list of agent installs that have not finished.
+func (m *MockupAssetProvider) GetInstallOperations() ([]entities.InstallOperation, derrors.Error){
+	m.Lock()
+	defer m.Unlock()
+	result := make([]entities.InstallOperation, 0, len(m.installOps))
+	for _, v := range m.installOps{
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// AddPendingUninstall stores the uninstall of an agent that waits for the agent to connect.
+func (m *MockupAssetProvider) AddPendingUninstall(request entities.UninstallAgentRequest) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	m.pendingUninstalls[request.AssetId] = request
+	return nil
+}
+
+// GetPendingUninstall retrieves the uninstall pending for an agent, or nil if the agent is not being uninstalled.
+func (m *MockupAssetProvider) GetPendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	request, exists := m.pendingUninstalls[assetID]
+	if !exists {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+// RemovePendingUninstall removes the uninstall pending for an agent and returns it, or nil if there is none.
+func (m *MockupAssetProvider) RemovePendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	request, exists := m.pendingUninstalls[assetID]
+	if !exists {
+		return nil, nil
+	}
+	delete(m.pendingUninstalls, assetID)
+	return &request, nil
+}
+
+// TrustHostKey stores the fingerprint of the key of a remote host trusted on first use if the host is not known,
+// and returns the fingerprint trusted for the host.
+func (m *MockupAssetProvider) TrustHostKey(host string, fingerprint string) (string, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	if trusted, exists := m.hostKeys[host]; exists {
+		return trusted, nil
+	}
+	m.hostKeys[host] = fingerprint
+	return fingerprint, nil
+}
+
+// GetHostKey retrieves the fingerprint of a remote host, or an empty string if the host is not known.
+func (m *MockupAssetProvider) GetHostKey(host string) (string, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.hostKeys[host], nil
+}
+
 // Clear all elements
 func (m *MockupAssetProvider) Clear() derrors.Error{
 	m.Lock()
 	m.assetsByAssetID = make(map[string]entities.AgentJoinInfo, 0)
 	m.assetsByToken = make(map[string]entities.AgentJoinInfo, 0)
 	m.pendingOps = make(map[string][]entities.AgentOpRequest, 0)
-	m.pendingResult = make(map[string]entities.AgentOpResponse, 0)
-	m.pendingECResult = make(map[string]entities.EdgeControllerOpResponse, 0)
-	m.joinToken = make(map[string]int64, 0)
-	m.agentStart = make(map[string]entities.AgentStartInfo, 0)
+	m.deliveredOps = make(map[string][]entities.AgentOpRequest, 0)
+	m.outbox = make([]entities.OutboxMessage, 0)
+	m.joinToken = make(map[string]entities.JoinToken, 0)
+	m.agentStart = make(map[string][]entities.AgentStartInfo, 0)
+	m.hostKeys = make(map[string]string, 0)
+	m.installOps = make(map[string]entities.InstallOperation, 0)
+	m.pendingUninstalls = make(map[string]entities.UninstallAgentRequest, 0)
 	m.Unlock()
 	return nil
 }
+
+// Close has nothing to release in the mockup provider.
+func (m *MockupAssetProvider) Close() {
+}
@@ -17,47 +17,426 @@
 package asset
 
 import (
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"sort"
 	"time"
 )
 
 // TTL for agent join tokens.
 const AgentJoinTokenTTL = time.Hour
 
+// AgentStartHistorySize with the number of starts kept for each agent.
+const AgentStartHistorySize = 10
+
+// JoinTokenOptions with the restrictions of a new join token.
+type JoinTokenOptions struct {
+	// TTL with the time the token is valid, 0 to use AgentJoinTokenTTL.
+	TTL time.Duration
+	// MaxUses with the number of agents that can join with the token, 0 for no limit.
+	MaxUses int
+	// Labels added to the agents that join with the token.
+	Labels map[string]string
+}
+
+// DeliveryPolicy determines how the operations are delivered to the agents.
+type DeliveryPolicy struct {
+	// Limit with the maximum number of operations delivered at once, 0 to deliver all of them.
+	Limit int
+	// Lease with the time an agent has to respond before the operation is delivered again, 0 to deliver it once.
+	Lease time.Duration
+	// MaxAttempts with the maximum number of deliveries of an operation, 0 for no limit.
+	MaxAttempts int
+}
+
+// ManagedAssetFilter selects managed assets by their join date. A zero bound is not applied.
+type ManagedAssetFilter struct {
+	// JoinedAfter with the unix time after which the assets joined, included.
+	JoinedAfter int64
+	// JoinedBefore with the unix time before which the assets joined, excluded.
+	JoinedBefore int64
+}
+
+// Matches returns whether an asset passes the filter.
+func (f ManagedAssetFilter) Matches(asset entities.AgentJoinInfo) bool {
+	if f.JoinedAfter != 0 && asset.Created < f.JoinedAfter {
+		return false
+	}
+	if f.JoinedBefore != 0 && asset.Created >= f.JoinedBefore {
+		return false
+	}
+	return true
+}
+
 type Provider interface {
 
-	// AddECOpResponse stores a response for an operation executed by the edge controller.
-	AddECOpResponse(op entities.EdgeControllerOpResponse) derrors.Error
-	// GetPendingECOpResponses retrieves the list of pending operation responses
-	GetPendingECOpResponses(removeEntries bool)([]entities.EdgeControllerOpResponse, derrors.Error)
+	// AddOutboxMessage appends a message to the outbox of the management cluster. Messages whose identifier is
+	// already in the outbox are ignored.
+	AddOutboxMessage(msg entities.OutboxMessage) derrors.Error
+	// GetOutboxMessages retrieves up to limit messages added after the given sequence, in the order they were added.
+	// A limit of 0 retrieves all of them.
+	GetOutboxMessages(afterSequence uint64, limit int) ([]entities.OutboxMessage, derrors.Error)
+	// RemoveOutboxMessages removes a set of messages from the outbox once they have been delivered.
+	RemoveOutboxMessages(ids []string) derrors.Error
 
-	// AddPendingOperation stores a pending operation for an agent.
-	AddPendingOperation(op entities.AgentOpRequest) derrors.Error
-	// GetPendingOperations retrieves the list of pending operations for a given asset. The removeEntries
+	// AddPendingOperation adds an operation to the queue of an agent and returns its position in the queue, starting
+	// at 0. The queue is sorted by priority, the highest first, and then by arrival. An operation whose identifier is
+	// already queued or delivered is not added again. If the queue already has capacity operations, the operation is rejected with
+	// a ResourceExhausted error. A capacity of 0 does not limit the queue.
+	AddPendingOperation(op entities.AgentOpRequest, capacity int) (int, derrors.Error)
+	// GetPendingOperations retrieves the queue of pending operations for a given asset. The removeEntries
 	// flags determines if the elements are removed before returning the list.
 	GetPendingOperations(assetID string, removeEntries bool) ([]entities.AgentOpRequest, derrors.Error)
+	// TakePendingOperations returns the operations to deliver to an agent following the policy: first the delivered
+	// operations whose lease has expired, and then the head of the queue. They are kept as delivered until the agent
+	// responds. The delivered operations that reached the maximum number of attempts are removed and returned
+	// in the second list.
+	TakePendingOperations(assetID string, now int64, policy DeliveryPolicy) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error)
+	// GetDeliveredOperations retrieves the operations delivered to an agent that has not responded yet.
+	GetDeliveredOperations(assetID string) ([]entities.AgentOpRequest, derrors.Error)
+	// RemoveDeliveredOperation removes a delivered operation once the agent responds and returns it.
+	RemoveDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error)
+	// CancelDeliveredOperation flags a delivered operation as canceled so it is not delivered again, and returns it.
+	CancelDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error)
+	// AcknowledgeDeliveredOperation clears the lease of a delivered operation once the agent reports that it has
+	// received it, so it is not delivered again, and returns it.
+	AcknowledgeDeliveredOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error)
+	// RemoveExpiredOperations removes the queued and the delivered operations whose deadline has passed, and returns
+	// both lists.
+	RemoveExpiredOperations(now int64) ([]entities.AgentOpRequest, []entities.AgentOpRequest, derrors.Error)
+	// RemovePendingOperation removes an operation from the queue of an asset before it is delivered and returns it.
+	RemovePendingOperation(assetID string, operationID string) (*entities.AgentOpRequest, derrors.Error)
 
-	// AddPendingOperationResult stores a pending operation for an agent.
-	AddOpResponse(op entities.AgentOpResponse) derrors.Error
-	// GetPendingOpResponses retrieves the list of pending operation responses
-	GetPendingOpResponses(removeEntries bool)([]entities.AgentOpResponse, derrors.Error)
-
-	// AddAgentStart stores a pending message with the agent start information.
+	// AddAgentStart adds the start information to the history of the agent, keeping the last AgentStartHistorySize.
 	AddAgentStart(op entities.AgentStartInfo) derrors.Error
-	// GetPendingAgetStart retrieves the list of Agent start operations that need to be send
-	GetPendingAgentStart(removeEntries bool) ([]entities.AgentStartInfo, derrors.Error)
+	// GetAgentStarts retrieves the recent starts of an agent, the most recent first.
+	GetAgentStarts(assetID string) ([]entities.AgentStartInfo, derrors.Error)
 
 	// AddManagedAsset adds a new asset to the list of assets that are managed by this EIC and can send data to it.
 	AddManagedAsset(asset entities.AgentJoinInfo) derrors.Error
-	// RemoveManagedAsset removes an asset from the list.
+	// RemoveManagedAsset removes an asset from the list with its queued and delivered operations.
 	RemoveManagedAsset(assetID string) derrors.Error
 	// GetAssetByToken checks if there is an asset with a given token.
 	GetAssetByToken(token string) (*entities.AgentJoinInfo, derrors.Error)
+	// RotateAssetToken replaces the token of an asset. The previous token is still valid until graceUntil.
+	RotateAssetToken(assetID string, token string, graceUntil int64) (*entities.AgentJoinInfo, derrors.Error)
+	// RevokeAssetToken revokes a token of an asset immediately, either the current or the previous one. An empty token
+	// revokes both of them.
+	RevokeAssetToken(assetID string, token string) derrors.Error
+	// RequestAssetCertificate records that the agent has been asked for a certificate request, which is waited for
+	// until the given timestamp.
+	RequestAssetCertificate(assetID string, until int64) derrors.Error
+	// SetAssetCertificate records a new certificate issued to an asset. The certificate installed by the agent is
+	// still valid until the agent installs the new one.
+	SetAssetCertificate(assetID string, serial string, expires int64) derrors.Error
+	// InstallAssetCertificate records that the agent uses the last certificate issued, so the previous one is no
+	// longer valid.
+	InstallAssetCertificate(assetID string, serial string) derrors.Error
+	// GetManagedAsset retrieves a managed asset by its identifier.
+	GetManagedAsset(assetID string) (*entities.AgentJoinInfo, derrors.Error)
+	// ListManagedAssets retrieves the managed assets that match the filter, sorted by join date.
+	ListManagedAssets(filter ManagedAssetFilter) ([]entities.AgentJoinInfo, derrors.Error)
 	// AddJoinToken adds a new join token for agents
-	AddJoinToken(joinToken string) (*entities.JoinToken, derrors.Error)
+	AddJoinToken(joinToken string, options JoinTokenOptions) (*entities.JoinToken, derrors.Error)
 	// CheckJoinToken checks if a join token is valid
 	CheckJoinToken(joinToken string) (bool, derrors.Error)
+	// UseJoinToken registers that an agent joins with a token and returns the token. It fails if the token is not valid.
+	UseJoinToken(joinToken string) (*entities.JoinToken, derrors.Error)
+	// ReleaseJoinToken gives back the use of a token whose agent could not join.
+	ReleaseJoinToken(joinToken string) derrors.Error
+	// RevokeJoinToken revokes a join token so it cannot be used by agents. The token is kept for listing purposes.
+	RevokeJoinToken(joinToken string) derrors.Error
+	// ListJoinTokens retrieves the join tokens sorted by creation date.
+	ListJoinTokens() ([]entities.JoinToken, derrors.Error)
+	// RemoveJoinToken removes a join token so it cannot be used by agents.
+	RemoveJoinToken(joinToken string) derrors.Error
+	// RemoveStaleRecords removes the join tokens, outbox messages and agent starts that exceed the retention policy.
+	RemoveStaleRecords(policy RetentionPolicy, now int64) (*CollectionResult, derrors.Error)
+	// AddInstallOperation stores or updates the progress of an agent install.
+	AddInstallOperation(op entities.InstallOperation) derrors.Error
+	// RemoveInstallOperation removes an agent install once it is finished.
+	RemoveInstallOperation(operationID string) derrors.Error
+	// GetInstallOperations retrieves the list of agent installs that have not finished.
+	GetInstallOperations() ([]entities.InstallOperation, derrors.Error)
+	// AddPendingUninstall stores the uninstall of an agent that waits for the agent to connect, replacing the previous
+	// one of the same agent.
+	AddPendingUninstall(request entities.UninstallAgentRequest) derrors.Error
+	// GetPendingUninstall retrieves the uninstall pending for an agent, or nil if the agent is not being uninstalled.
+	GetPendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error)
+	// RemovePendingUninstall removes the uninstall pending for an agent and returns it, or nil if there is none.
+	RemovePendingUninstall(assetID string) (*entities.UninstallAgentRequest, derrors.Error)
+	// TrustHostKey stores the fingerprint of the key of a remote host trusted on first use if the host is not known,
+	// and returns the fingerprint trusted for the host.
+	TrustHostKey(host string, fingerprint string) (string, derrors.Error)
+	// GetHostKey retrieves the fingerprint of a remote host, or an empty string if the host is not known.
+	GetHostKey(host string) (string, derrors.Error)
 	// Clear all elements
 	Clear() derrors.Error
-}
\ No newline at end of file
+	// Close releases the resources associated with the provider.
+	Close()
+}
+
+// addAgentStart adds a start to the beginning of the history of an agent, dropping the oldest ones if the history
+// exceeds AgentStartHistorySize.
+func addAgentStart(history []entities.AgentStartInfo, start entities.AgentStartInfo) []entities.AgentStartInfo {
+	result := append([]entities.AgentStartInfo{start}, history...)
+	if len(result) > AgentStartHistorySize {
+		result = result[:AgentStartHistorySize]
+	}
+	return result
+}
+
+// sortManagedAssets sorts a list of assets by join date, and by identifier for assets that joined at the same time.
+func sortManagedAssets(assets []entities.AgentJoinInfo) {
+	sort.Slice(assets, func(i, j int) bool {
+		if assets[i].Created != assets[j].Created {
+			return assets[i].Created < assets[j].Created
+		}
+		return assets[i].AssetId < assets[j].AssetId
+	})
+}
+
+// rotateAssetToken replaces the token of an asset and returns the token that is no longer valid, if any.
+func rotateAssetToken(asset *entities.AgentJoinInfo, token string, graceUntil int64) string {
+	obsolete := asset.PreviousToken
+	if asset.TokenRevoked {
+		// a revoked token is not valid during the grace period
+		obsolete = asset.Token
+		asset.PreviousToken = ""
+		asset.PreviousTokenExpires = 0
+	} else {
+		asset.PreviousToken = asset.Token
+		asset.PreviousTokenExpires = graceUntil
+	}
+	asset.Token = token
+	asset.TokenRevoked = false
+	return obsolete
+}
+
+// revokeAssetToken revokes a token of an asset and returns the tokens that are no longer valid. An empty token revokes
+// all of them.
+func revokeAssetToken(asset *entities.AgentJoinInfo, token string) ([]string, derrors.Error) {
+	revoked := make([]string, 0)
+	if token == "" || token == asset.PreviousToken {
+		if asset.PreviousToken != "" {
+			revoked = append(revoked, asset.PreviousToken)
+		}
+		asset.PreviousToken = ""
+		asset.PreviousTokenExpires = 0
+	}
+	if token == "" || token == asset.Token {
+		revoked = append(revoked, asset.Token)
+		asset.TokenRevoked = true
+	}
+	if len(revoked) == 0 {
+		return nil, derrors.NewNotFoundError("token does not belong to the asset").WithParams(asset.AssetId)
+	}
+	return revoked, nil
+}
+
+// setAssetCertificate records a new certificate of an asset, keeping the one installed by the agent.
+func setAssetCertificate(asset *entities.AgentJoinInfo, serial string, expires int64) {
+	previous := asset.Certificate.PreviousSerial
+	if asset.Certificate.Installed {
+		previous = asset.Certificate.Serial
+	}
+	asset.Certificate = entities.AgentCertificate{
+		Serial:         serial,
+		Expires:        expires,
+		PreviousSerial: previous,
+	}
+}
+
+// installAssetCertificate records that the agent uses the last certificate issued.
+func installAssetCertificate(asset *entities.AgentJoinInfo, serial string) derrors.Error {
+	if serial == "" || serial != asset.Certificate.Serial {
+		return derrors.NewNotFoundError("certificate is not the last one issued to the asset").WithParams(asset.AssetId, serial)
+	}
+	asset.Certificate.Installed = true
+	asset.Certificate.PreviousSerial = ""
+	return nil
+}
+
+// newJoinToken creates a join token with the given options.
+func newJoinToken(joinToken string, options JoinTokenOptions, now time.Time) entities.JoinToken {
+	ttl := options.TTL
+	if ttl <= 0 {
+		ttl = AgentJoinTokenTTL
+	}
+	return entities.JoinToken{
+		Token:     joinToken,
+		Created:   now.Unix(),
+		ExpiredOn: now.Add(ttl).Unix(),
+		MaxUses:   options.MaxUses,
+		Labels:    options.Labels,
+	}
+}
+
+// useJoinToken checks that an agent can join with a token and counts the use.
+func useJoinToken(token *entities.JoinToken, now int64) derrors.Error {
+	if token.Revoked {
+		return derrors.NewFailedPreconditionError("join token has been revoked")
+	}
+	if token.IsExpired(now) {
+		return derrors.NewFailedPreconditionError("join token has expired")
+	}
+	if token.IsExhausted() {
+		return derrors.NewFailedPreconditionError("join token has been used by the maximum number of agents")
+	}
+	token.Uses++
+	return nil
+}
+
+// releaseJoinToken gives back a use of a token.
+func releaseJoinToken(token *entities.JoinToken) {
+	if token.Uses > 0 {
+		token.Uses--
+	}
+}
+
+// sortJoinTokens sorts a list of tokens by creation date, and by token for the ones created at the same time.
+func sortJoinTokens(tokens []entities.JoinToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Created != tokens[j].Created {
+			return tokens[i].Created < tokens[j].Created
+		}
+		return tokens[i].Token < tokens[j].Token
+	})
+}
+
+// queueOperation adds an operation to the queue of an asset after the operations with the same or higher priority,
+// and returns the new queue and the position of the operation. An operation that has already been delivered is not
+// queued again and it is reported at the head of the queue.
+func queueOperation(queue []entities.AgentOpRequest, delivered []entities.AgentOpRequest, op entities.AgentOpRequest, capacity int) ([]entities.AgentOpRequest, int, derrors.Error) {
+	for _, sent := range delivered {
+		if sent.OperationId == op.OperationId {
+			return queue, 0, nil
+		}
+	}
+	position := len(queue)
+	for index, queued := range queue {
+		if queued.OperationId == op.OperationId {
+			return queue, index, nil
+		}
+		if position == len(queue) && queued.Priority < op.Priority {
+			position = index
+		}
+	}
+	if capacity > 0 && len(queue) >= capacity {
+		return queue, 0, derrors.NewResourceExhaustedError(
+			fmt.Sprintf("the operation queue of the asset is full, capacity %d", capacity)).WithParams(op.AssetId, op.OperationId)
+	}
+	result := make([]entities.AgentOpRequest, 0, len(queue)+1)
+	result = append(result, queue[:position]...)
+	result = append(result, op)
+	result = append(result, queue[position:]...)
+	return result, position, nil
+}
+
+// deliverOperations selects the operations to deliver from the queue and the delivered operations of an asset, and
+// returns the new queue, the new list of delivered operations, the operations to deliver and the operations that
+// reached the maximum number of attempts.
+func deliverOperations(queue []entities.AgentOpRequest, delivered []entities.AgentOpRequest, now int64, policy DeliveryPolicy) (
+	[]entities.AgentOpRequest, []entities.AgentOpRequest, []entities.AgentOpRequest, []entities.AgentOpRequest) {
+	kept := make([]entities.AgentOpRequest, 0, len(delivered))
+	toDeliver := make([]entities.AgentOpRequest, 0)
+	exhausted := make([]entities.AgentOpRequest, 0)
+	for _, op := range delivered {
+		if policy.Lease <= 0 || op.LeaseExpires == 0 || op.LeaseExpires > now {
+			kept = append(kept, op)
+		} else if op.Canceled {
+			// the cancellation has already been reported, the operation is forgotten
+			continue
+		} else if policy.MaxAttempts > 0 && op.Attempts >= policy.MaxAttempts {
+			exhausted = append(exhausted, op)
+		} else if policy.Limit > 0 && len(toDeliver) >= policy.Limit {
+			kept = append(kept, op)
+		} else {
+			toDeliver = append(toDeliver, op)
+		}
+	}
+
+	if policy.Limit <= 0 || len(toDeliver) < policy.Limit {
+		limit := 0
+		if policy.Limit > 0 {
+			limit = policy.Limit - len(toDeliver)
+		}
+		var taken []entities.AgentOpRequest
+		taken, queue = takeOperations(queue, limit)
+		toDeliver = append(toDeliver, taken...)
+	}
+
+	for index := range toDeliver {
+		toDeliver[index].Attempts++
+		if policy.Lease > 0 {
+			toDeliver[index].LeaseExpires = now + int64(policy.Lease.Seconds())
+		}
+	}
+	return queue, append(kept, toDeliver...), toDeliver, exhausted
+}
+
+// takeOperations splits a queue into the first limit operations and the rest. A limit of 0 takes the whole queue.
+func takeOperations(queue []entities.AgentOpRequest, limit int) ([]entities.AgentOpRequest, []entities.AgentOpRequest) {
+	if limit <= 0 || limit >= len(queue) {
+		return queue, make([]entities.AgentOpRequest, 0)
+	}
+	return queue[:limit], queue[limit:]
+}
+
+// removeOperation removes an operation from a queue and returns the new queue and the removed operation, nil if it
+// is not queued.
+func removeOperation(queue []entities.AgentOpRequest, operationID string) ([]entities.AgentOpRequest, *entities.AgentOpRequest) {
+	for index, queued := range queue {
+		if queued.OperationId == operationID {
+			result := make([]entities.AgentOpRequest, 0, len(queue)-1)
+			result = append(result, queue[:index]...)
+			return append(result, queue[index+1:]...), &queued
+		}
+	}
+	return queue, nil
+}
+
+// expireOperations splits a list of operations into the ones that have not expired and the expired ones.
+func expireOperations(ops []entities.AgentOpRequest, now int64) ([]entities.AgentOpRequest, []entities.AgentOpRequest) {
+	kept := make([]entities.AgentOpRequest, 0, len(ops))
+	expired := make([]entities.AgentOpRequest, 0)
+	for _, op := range ops {
+		if op.IsExpired(now) {
+			expired = append(expired, op)
+		} else {
+			kept = append(kept, op)
+		}
+	}
+	return kept, expired
+}
+
+// cancelOperation flags an operation of a list as canceled and returns the new list and the operation, nil if it is
+// not in the list.
+func cancelOperation(ops []entities.AgentOpRequest, operationID string) ([]entities.AgentOpRequest, *entities.AgentOpRequest) {
+	result := make([]entities.AgentOpRequest, len(ops))
+	copy(result, ops)
+	for index := range result {
+		if result[index].OperationId == operationID {
+			result[index].Canceled = true
+			canceled := result[index]
+			return result, &canceled
+		}
+	}
+	return ops, nil
+}
+
+// acknowledgeOperation clears the lease of a delivered operation so it is not delivered again, it is kept until the
+// agent sends the final response or its deadline passes.
+func acknowledgeOperation(ops []entities.AgentOpRequest, operationID string) ([]entities.AgentOpRequest, *entities.AgentOpRequest) {
+	result := make([]entities.AgentOpRequest, len(ops))
+	copy(result, ops)
+	for index := range result {
+		if result[index].OperationId == operationID {
+			result[index].LeaseExpires = 0
+			acknowledged := result[index]
+			return result, &acknowledged
+		}
+	}
+	return ops, nil
+}
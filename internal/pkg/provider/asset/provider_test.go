@@ -17,6 +17,7 @@
 package asset
 
 import (
+	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/entities"
 	"github.com/nalej/grpc-inventory-go"
 	"github.com/onsi/ginkgo"
@@ -34,27 +35,15 @@ func CreateTestAgentOpRequest(assetID string) * entities.AgentOpRequest{
 		OrganizationId:   uuid.NewV4().String(),
 		EdgeControllerId: uuid.NewV4().String(),
 		AssetId:          assetID,
+		OperationId:      uuid.NewV4().String(),
 		Operation:        "test",
 		Plugin:           "test",
 		Params:           params,
 	}
 }
 
-func CreateTestAgentOpResponse(assetID string) * entities.AgentOpResponse{
-	return &entities.AgentOpResponse{
-		Created:          time.Now().Unix(),
-		OrganizationId:   uuid.NewV4().String(),
-		EdgeControllerId: uuid.NewV4().String(),
-		AssetId:          assetID,
-		OperationId:      uuid.NewV4().String(),
-		Timestamp:        time.Now().Unix(),
-		Status:           grpc_inventory_go.OpStatus_SUCCESS.String(),
-		Info:             "",
-	}
-}
-
-func CreateTestECOpResponse() * entities.EdgeControllerOpResponse{
-	return &entities.EdgeControllerOpResponse{
+func CreateTestOutboxMessage() * entities.OutboxMessage{
+	response := &entities.EdgeControllerOpResponse{
 		OrganizationId:   uuid.NewV4().String(),
 		EdgeControllerId: uuid.NewV4().String(),
 		OperationId:      uuid.NewV4().String(),
@@ -62,6 +51,9 @@ func CreateTestECOpResponse() * entities.EdgeControllerOpResponse{
 		Status:           grpc_inventory_go.OpStatus_SUCCESS.String(),
 		Info:             "",
 	}
+	msg, err := entities.NewOutboxMessage(entities.ECOpResponseMessage, "", response.OperationId, response)
+	gomega.Expect(err).To(gomega.Succeed())
+	return msg
 }
 
 func CreateTestAgentStartInfo(assetID string) * entities.AgentStartInfo{
@@ -72,6 +64,19 @@ func CreateTestAgentStartInfo(assetID string) * entities.AgentStartInfo{
 	}
 }
 
+func CreateTestInstallOperation() * entities.InstallOperation{
+	return &entities.InstallOperation{
+		OperationId:      uuid.NewV4().String(),
+		OrganizationId:   uuid.NewV4().String(),
+		EdgeControllerId: uuid.NewV4().String(),
+		TargetHost:       "10.0.0.1",
+		Token:            uuid.NewV4().String(),
+		Step:             "copy agent",
+		Created:          time.Now().Unix(),
+		Updated:          time.Now().Unix(),
+	}
+}
+
 func CreateTestAgentJoinInfo(assetID string) * entities.AgentJoinInfo{
 	return &entities.AgentJoinInfo{
 		Created: time.Now().Unix(),
@@ -92,6 +97,15 @@ func RegisterAsset(assetID string, provider Provider) string{
 }
 
 
+// operationIds returns the identifiers of a list of operations.
+func operationIds(ops []entities.AgentOpRequest) []string {
+	result := make([]string, 0, len(ops))
+	for _, op := range ops {
+		result = append(result, op.OperationId)
+	}
+	return result
+}
+
 func RunTest(provider Provider){
 
 	ginkgo.BeforeEach(func() {
@@ -103,8 +117,9 @@ func RunTest(provider Provider){
 			assetID := uuid.NewV4().String()
 			RegisterAsset(assetID, provider)
 			toAdd := CreateTestAgentOpRequest(assetID)
-			err := provider.AddPendingOperation(*toAdd)
+			position, err := provider.AddPendingOperation(*toAdd, 0)
 			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(position).Should(gomega.Equal(0))
 		})
 		ginkgo.It("should be able to list operations", func(){
 		    numOps := 10
@@ -112,7 +127,7 @@ func RunTest(provider Provider){
 			RegisterAsset(assetID, provider)
 		    for i := 0; i < numOps; i ++{
 				toAdd := CreateTestAgentOpRequest(assetID)
-				err := provider.AddPendingOperation(*toAdd)
+				_, err := provider.AddPendingOperation(*toAdd, 0)
 				gomega.Expect(err).To(gomega.Succeed())
 			}
 
@@ -128,68 +143,301 @@ func RunTest(provider Provider){
 			gomega.Expect(err).To(gomega.Succeed())
 			gomega.Expect(len(retrieved)).Should(gomega.Equal(0))
 		})
-	})
-
-	ginkgo.Context("Operation responses", func(){
-		ginkgo.It("should be able to add an operation response", func(){
+		ginkgo.It("should sort the operations by priority and arrival", func(){
 			assetID := uuid.NewV4().String()
 			RegisterAsset(assetID, provider)
-			toAdd := CreateTestAgentOpResponse(assetID)
-			err := provider.AddOpResponse(*toAdd)
+			expectedPositions := []int{0, 1, 0, 1, 4}
+			ids := make([]string, 0)
+			for index, priority := range []int{0, 0, 5, 1, -1} {
+				toAdd := CreateTestAgentOpRequest(assetID)
+				toAdd.Priority = priority
+				ids = append(ids, toAdd.OperationId)
+				position, err := provider.AddPendingOperation(*toAdd, 0)
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(position).Should(gomega.Equal(expectedPositions[index]))
+			}
+			retrieved, err := provider.GetPendingOperations(assetID, false)
 			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(retrieved)).Should(gomega.Equal([]string{ids[2], ids[3], ids[0], ids[1], ids[4]}))
 		})
-		ginkgo.It("should be able to get pending operations", func(){
-			numOps := 10
+		ginkgo.It("should not queue the same operation twice", func(){
 			assetID := uuid.NewV4().String()
 			RegisterAsset(assetID, provider)
-			for i := 0; i < numOps; i ++{
-				toAdd := CreateTestAgentOpResponse(assetID)
-				err := provider.AddOpResponse(*toAdd)
+			first := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*first, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.AddPendingOperation(*CreateTestAgentOpRequest(assetID), 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			position, err := provider.AddPendingOperation(*first, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(position).Should(gomega.Equal(0))
+			retrieved, err := provider.GetPendingOperations(assetID, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(retrieved).Should(gomega.HaveLen(2))
+		})
+		ginkgo.It("should reject operations when the queue is full", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			for i := 0; i < 2; i ++{
+				_, err := provider.AddPendingOperation(*CreateTestAgentOpRequest(assetID), 2)
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			_, err := provider.AddPendingOperation(*CreateTestAgentOpRequest(assetID), 2)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).Should(gomega.Equal(derrors.ResourceExhausted))
+		})
+		ginkgo.It("should take the operations from the head of the queue", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			for i := 0; i < 5; i ++{
+				_, err := provider.AddPendingOperation(*CreateTestAgentOpRequest(assetID), 0)
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			queued, err := provider.GetPendingOperations(assetID, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			taken, _, err := provider.TakePendingOperations(assetID, 100, DeliveryPolicy{Limit: 2})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal(operationIds(queued[:2])))
+			gomega.Expect(taken[0].Attempts).Should(gomega.Equal(1))
+			taken, _, err = provider.TakePendingOperations(assetID, 100, DeliveryPolicy{})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal(operationIds(queued[2:])))
+			taken, _, err = provider.TakePendingOperations(assetID, 100, DeliveryPolicy{Limit: 2})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(taken).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should be able to remove a queued operation", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			toAdd := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			removed, err := provider.RemovePendingOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removed.OperationId).Should(gomega.Equal(toAdd.OperationId))
+			_, err = provider.RemovePendingOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).Should(gomega.Equal(derrors.NotFound))
+		})
+		ginkgo.It("should keep the taken operations as delivered until the agent responds", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			toAdd := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, _, err = provider.TakePendingOperations(assetID, 100, DeliveryPolicy{})
+			gomega.Expect(err).To(gomega.Succeed())
+			delivered, err := provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).Should(gomega.HaveLen(1))
+
+			removed, err := provider.RemoveDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removed.OperationId).Should(gomega.Equal(toAdd.OperationId))
+			delivered, err = provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).Should(gomega.BeEmpty())
+			_, err = provider.RemoveDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should deliver again the operations whose response is lost", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			policy := DeliveryPolicy{Limit: 1, Lease: 10 * time.Second, MaxAttempts: 2}
+			first := CreateTestAgentOpRequest(assetID)
+			second := CreateTestAgentOpRequest(assetID)
+			for _, toAdd := range []*entities.AgentOpRequest{first, second} {
+				_, err := provider.AddPendingOperation(*toAdd, 0)
 				gomega.Expect(err).To(gomega.Succeed())
 			}
 
-			retrieved, err := provider.GetPendingOpResponses(false)
+			// the response to the first delivery is lost
+			taken, _, err := provider.TakePendingOperations(assetID, 100, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal([]string{first.OperationId}))
+			// while the lease is valid the next operation is delivered
+			taken, _, err = provider.TakePendingOperations(assetID, 105, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal([]string{second.OperationId}))
+			_, err = provider.RemoveDeliveredOperation(assetID, second.OperationId)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(numOps))
 
-			retrievedRemoving, err := provider.GetPendingOpResponses(true)
+			// once the lease expires the first operation is delivered again
+			taken, exhausted, err := provider.TakePendingOperations(assetID, 110, policy)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrievedRemoving)).Should(gomega.Equal(numOps))
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal([]string{first.OperationId}))
+			gomega.Expect(taken[0].Attempts).Should(gomega.Equal(2))
+			gomega.Expect(taken[0].LeaseExpires).Should(gomega.Equal(int64(120)))
+			gomega.Expect(exhausted).Should(gomega.BeEmpty())
 
-			retrieved, err = provider.GetPendingOpResponses(false)
+			// the response is lost again and the attempts are exhausted
+			taken, exhausted, err = provider.TakePendingOperations(assetID, 120, policy)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(0))
+			gomega.Expect(taken).Should(gomega.BeEmpty())
+			gomega.Expect(operationIds(exhausted)).Should(gomega.Equal([]string{first.OperationId}))
+			delivered, err := provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).Should(gomega.BeEmpty())
 		})
-	})
+		ginkgo.It("should not deliver again an operation acknowledged by the agent", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			policy := DeliveryPolicy{Limit: 1, Lease: 10 * time.Second, MaxAttempts: 2}
+			toAdd := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.AcknowledgeDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			taken, _, err := provider.TakePendingOperations(assetID, 100, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(taken)).Should(gomega.Equal([]string{toAdd.OperationId}))
+			acknowledged, err := provider.AcknowledgeDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(acknowledged.LeaseExpires).Should(gomega.BeZero())
+			gomega.Expect(acknowledged.Deadline).Should(gomega.Equal(toAdd.Deadline))
 
-	ginkgo.Context("EC Operation responses", func(){
-		ginkgo.It("should be able to add an ec operation response", func(){
-		    toAdd := CreateTestECOpResponse()
-			err := provider.AddECOpResponse(*toAdd)
+			// the lease no longer applies, the operation is kept until the response arrives
+			taken, exhausted, err := provider.TakePendingOperations(assetID, 110, policy)
 			gomega.Expect(err).To(gomega.Succeed())
-			retrievedRemoving, err := provider.GetPendingECOpResponses(true)
+			gomega.Expect(taken).Should(gomega.BeEmpty())
+			gomega.Expect(exhausted).Should(gomega.BeEmpty())
+			delivered, err := provider.GetDeliveredOperations(assetID)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrievedRemoving)).Should(gomega.Equal(1))
-			gomega.Expect(retrievedRemoving[0].OperationId).Should(gomega.Equal(toAdd.OperationId))
+			gomega.Expect(delivered).Should(gomega.HaveLen(1))
 		})
-		ginkgo.It("should be able to get ec pending operation responses", func(){
-			numOps := 10
-			for i := 0; i < numOps; i ++{
-				toAdd := CreateTestECOpResponse()
-				err := provider.AddECOpResponse(*toAdd)
+		ginkgo.It("should not queue again an operation already delivered", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			policy := DeliveryPolicy{Limit: 1, Lease: 10 * time.Second, MaxAttempts: 2}
+			toAdd := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, _, err = provider.TakePendingOperations(assetID, 100, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+
+			position, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(position).Should(gomega.Equal(0))
+			pending, err := provider.GetPendingOperations(assetID, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(pending).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should not deliver again a canceled operation", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			policy := DeliveryPolicy{Limit: 1, Lease: 10 * time.Second, MaxAttempts: 3}
+			toAdd := CreateTestAgentOpRequest(assetID)
+			_, err := provider.AddPendingOperation(*toAdd, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.CancelDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			_, _, err = provider.TakePendingOperations(assetID, 100, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+			canceled, err := provider.CancelDeliveredOperation(assetID, toAdd.OperationId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(canceled.Canceled).Should(gomega.BeTrue())
+			delivered, err := provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).Should(gomega.HaveLen(1))
+			gomega.Expect(delivered[0].Canceled).Should(gomega.BeTrue())
+
+			// once the lease expires the operation is forgotten
+			taken, exhausted, err := provider.TakePendingOperations(assetID, 110, policy)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(taken).Should(gomega.BeEmpty())
+			gomega.Expect(exhausted).Should(gomega.BeEmpty())
+			delivered, err = provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should remove the expired operations", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			deadlines := []int64{100, 0, 300, 100}
+			ops := make([]entities.AgentOpRequest, 0)
+			for _, deadline := range deadlines {
+				toAdd := CreateTestAgentOpRequest(assetID)
+				toAdd.Deadline = deadline
+				ops = append(ops, *toAdd)
+				_, err := provider.AddPendingOperation(*toAdd, 0)
 				gomega.Expect(err).To(gomega.Succeed())
 			}
-			retrieved, err := provider.GetPendingECOpResponses(false)
+			// the first two are delivered
+			_, _, err := provider.TakePendingOperations(assetID, 100, DeliveryPolicy{Limit: 2})
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(numOps))
 
-			retrievedRemoving, err := provider.GetPendingECOpResponses(true)
+			queued, delivered, err := provider.RemoveExpiredOperations(200)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrievedRemoving)).Should(gomega.Equal(numOps))
+			gomega.Expect(queued).Should(gomega.Equal([]entities.AgentOpRequest{ops[3]}))
+			gomega.Expect(operationIds(delivered)).Should(gomega.Equal(operationIds(ops[:1])))
 
-			retrieved, err = provider.GetPendingECOpResponses(false)
+			pending, err := provider.GetPendingOperations(assetID, false)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(0))
+			gomega.Expect(pending).Should(gomega.Equal([]entities.AgentOpRequest{ops[2]}))
+			inFlight, err := provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(operationIds(inFlight)).Should(gomega.Equal(operationIds(ops[1:2])))
+		})
+	})
+
+	ginkgo.Context("Outbox", func(){
+		ginkgo.It("should return the messages in the order they were added", func(){
+			numMsgs := 10
+			ids := make([]string, 0, numMsgs)
+			for i := 0; i < numMsgs; i ++{
+				msg := CreateTestOutboxMessage()
+				err := provider.AddOutboxMessage(*msg)
+				gomega.Expect(err).To(gomega.Succeed())
+				ids = append(ids, msg.Id)
+			}
+			retrieved, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(len(retrieved)).Should(gomega.Equal(numMsgs))
+			for i, msg := range retrieved{
+				gomega.Expect(msg.Id).Should(gomega.Equal(ids[i]))
+				if i > 0 {
+					gomega.Expect(msg.Sequence).Should(gomega.BeNumerically(">", retrieved[i-1].Sequence))
+				}
+			}
+		})
+		ginkgo.It("should retrieve the messages in batches", func(){
+			for i := 0; i < 5; i ++{
+				gomega.Expect(provider.AddOutboxMessage(*CreateTestOutboxMessage())).To(gomega.Succeed())
+			}
+			first, err := provider.GetOutboxMessages(0, 3)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(len(first)).Should(gomega.Equal(3))
+			second, err := provider.GetOutboxMessages(first[2].Sequence, 3)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(len(second)).Should(gomega.Equal(2))
+			gomega.Expect(second[0].Sequence).Should(gomega.BeNumerically(">", first[2].Sequence))
+		})
+		ginkgo.It("should ignore messages already in the outbox", func(){
+			msg := CreateTestOutboxMessage()
+			err := provider.AddOutboxMessage(*msg)
+			gomega.Expect(err).To(gomega.Succeed())
+			err = provider.AddOutboxMessage(*msg)
+			gomega.Expect(err).To(gomega.Succeed())
+			retrieved, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(len(retrieved)).Should(gomega.Equal(1))
+			response := &entities.EdgeControllerOpResponse{}
+			gomega.Expect(retrieved[0].GetPayload(response)).To(gomega.Succeed())
+			gomega.Expect(response.Status).Should(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS.String()))
+		})
+		ginkgo.It("should be able to remove a delivered message", func(){
+			first := CreateTestOutboxMessage()
+			second := CreateTestOutboxMessage()
+			gomega.Expect(provider.AddOutboxMessage(*first)).To(gomega.Succeed())
+			gomega.Expect(provider.AddOutboxMessage(*second)).To(gomega.Succeed())
+			err := provider.RemoveOutboxMessages([]string{first.Id})
+			gomega.Expect(err).To(gomega.Succeed())
+			retrieved, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(len(retrieved)).Should(gomega.Equal(1))
+			gomega.Expect(retrieved[0].Id).Should(gomega.Equal(second.Id))
 		})
 	})
 
@@ -201,27 +449,31 @@ func RunTest(provider Provider){
 			err := provider.AddAgentStart(*toAdd)
 			gomega.Expect(err).To(gomega.Succeed())
 		})
-		ginkgo.It("should be able to retrieve pending start messages", func(){
-			numOps := 10
-			for i := 0; i < numOps; i ++{
-				assetID := uuid.NewV4().String()
-				RegisterAsset(assetID, provider)
+		ginkgo.It("should be able to retrieve the recent starts of an agent", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			numStarts := AgentStartHistorySize + 2
+			for i := 0; i < numStarts; i ++{
 				toAdd := CreateTestAgentStartInfo(assetID)
+				toAdd.Created = int64(i)
 				err := provider.AddAgentStart(*toAdd)
 				gomega.Expect(err).To(gomega.Succeed())
 			}
-
-			retrieved, err := provider.GetPendingAgentStart(false)
+			other := uuid.NewV4().String()
+			RegisterAsset(other, provider)
+			err := provider.AddAgentStart(*CreateTestAgentStartInfo(other))
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(numOps))
 
-			retrievedRemoving, err := provider.GetPendingAgentStart(true)
+			retrieved, err := provider.GetAgentStarts(assetID)
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrievedRemoving)).Should(gomega.Equal(numOps))
-
-			retrieved, err = provider.GetPendingAgentStart(false)
+			gomega.Expect(len(retrieved)).Should(gomega.Equal(AgentStartHistorySize))
+			gomega.Expect(retrieved[0].Created).Should(gomega.Equal(int64(numStarts - 1)))
+			gomega.Expect(retrieved[AgentStartHistorySize-1].Created).Should(gomega.Equal(int64(2)))
+		})
+		ginkgo.It("should return an empty history for an agent that has not started", func(){
+			retrieved, err := provider.GetAgentStarts(uuid.NewV4().String())
 			gomega.Expect(err).To(gomega.Succeed())
-			gomega.Expect(len(retrieved)).Should(gomega.Equal(0))
+			gomega.Expect(retrieved).Should(gomega.BeEmpty())
 		})
 	})
 
@@ -250,22 +502,405 @@ func RunTest(provider Provider){
 			gomega.Expect(err).To(gomega.Succeed())
 			_, err = provider.GetAssetByToken(toAdd.Token)
 			gomega.Expect(err).To(gomega.HaveOccurred())
+			_, err = provider.GetManagedAsset(assetID)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should remove the queued and delivered operations of a removed asset", func(){
+			assetID := uuid.NewV4().String()
+			toAdd := CreateTestAgentJoinInfo(assetID)
+			gomega.Expect(provider.AddManagedAsset(*toAdd)).To(gomega.Succeed())
+			for i := 0; i < 2; i++ {
+				_, err := provider.AddPendingOperation(*CreateTestAgentOpRequest(assetID), 0)
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			_, _, err := provider.TakePendingOperations(assetID, 100, DeliveryPolicy{Limit: 1})
+			gomega.Expect(err).To(gomega.Succeed())
+
+			gomega.Expect(provider.RemoveManagedAsset(assetID)).To(gomega.Succeed())
+			gomega.Expect(provider.AddManagedAsset(*toAdd)).To(gomega.Succeed())
+			pending, err := provider.GetPendingOperations(assetID, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(pending).To(gomega.BeEmpty())
+			delivered, err := provider.GetDeliveredOperations(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).To(gomega.BeEmpty())
+		})
+		ginkgo.It("should be able to retrieve an asset by its identifier", func(){
+			assetID := uuid.NewV4().String()
+			toAdd := CreateTestAgentJoinInfo(assetID)
+			toAdd.Labels = map[string]string{"zone": "a"}
+			toAdd.Os = &entities.OperatingSystemInfo{Name: "ubuntu", Class: "LINUX", Architecture: "amd64"}
+			toAdd.Hardware = &entities.HardwareInfo{
+				Cpus:          []entities.CPUInfo{{Manufacturer: "intel", NumCores: 4}},
+				InstalledRam:  4096,
+				NetInterfaces: []entities.NetworkingHardwareInfo{{Type: "eth", LinkCapacity: 1000}},
+			}
+			err := provider.AddManagedAsset(*toAdd)
+			gomega.Expect(err).To(gomega.Succeed())
+			info, err := provider.GetManagedAsset(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*info).Should(gomega.Equal(*toAdd))
+		})
+		ginkgo.It("should fail to retrieve an asset that is not managed", func(){
+			_, err := provider.GetManagedAsset(uuid.NewV4().String())
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should be able to list the assets by join date", func(){
+			for index, assetID := range []string{"asset3", "asset1", "asset2"} {
+				toAdd := CreateTestAgentJoinInfo(assetID)
+				toAdd.Created = int64(100 * (index + 1))
+				err := provider.AddManagedAsset(*toAdd)
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			assets, err := provider.ListManagedAssets(ManagedAssetFilter{})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(assets).To(gomega.HaveLen(3))
+			gomega.Expect(assets[0].AssetId).Should(gomega.Equal("asset3"))
+			gomega.Expect(assets[2].AssetId).Should(gomega.Equal("asset2"))
+
+			assets, err = provider.ListManagedAssets(ManagedAssetFilter{JoinedAfter: 200})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(assets).To(gomega.HaveLen(2))
+			gomega.Expect(assets[0].AssetId).Should(gomega.Equal("asset1"))
+
+			assets, err = provider.ListManagedAssets(ManagedAssetFilter{JoinedAfter: 150, JoinedBefore: 300})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(assets).To(gomega.HaveLen(1))
+			gomega.Expect(assets[0].AssetId).Should(gomega.Equal("asset1"))
+		})
+		ginkgo.It("should return an empty list if there are no assets", func(){
+			assets, err := provider.ListManagedAssets(ManagedAssetFilter{})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(assets).Should(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("Agent certificates", func(){
+		ginkgo.It("should keep the installed certificate until the agent installs the new one", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			gomega.Expect(provider.RequestAssetCertificate(assetID, 100)).To(gomega.Succeed())
+			gomega.Expect(provider.SetAssetCertificate(assetID, "first", 200)).To(gomega.Succeed())
+			gomega.Expect(provider.InstallAssetCertificate(assetID, "first")).To(gomega.Succeed())
+			gomega.Expect(provider.SetAssetCertificate(assetID, "second", 300)).To(gomega.Succeed())
+
+			asset, err := provider.GetManagedAsset(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(asset.Certificate).Should(gomega.Equal(entities.AgentCertificate{
+				Serial: "second", Expires: 300, PreviousSerial: "first"}))
+			gomega.Expect(asset.ValidCertificate("first")).Should(gomega.BeTrue())
+
+			gomega.Expect(provider.InstallAssetCertificate(assetID, "second")).To(gomega.Succeed())
+			asset, err = provider.GetManagedAsset(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(asset.ValidCertificate("first")).Should(gomega.BeFalse())
+			gomega.Expect(asset.ValidCertificate("second")).Should(gomega.BeTrue())
+		})
+		ginkgo.It("should not install a certificate that is not the last one issued", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			gomega.Expect(provider.SetAssetCertificate(assetID, "first", 200)).To(gomega.Succeed())
+			gomega.Expect(provider.SetAssetCertificate(assetID, "second", 300)).To(gomega.Succeed())
+			gomega.Expect(provider.InstallAssetCertificate(assetID, "first")).NotTo(gomega.Succeed())
+		})
+	})
+
+	ginkgo.Context("Agent tokens", func(){
+		ginkgo.It("should accept the previous token during the grace period", func(){
+			assetID := uuid.NewV4().String()
+			previous := RegisterAsset(assetID, provider)
+			token := uuid.NewV4().String()
+			rotated, err := provider.RotateAssetToken(assetID, token, time.Now().Add(time.Hour).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(rotated.Token).Should(gomega.Equal(token))
+			gomega.Expect(rotated.PreviousToken).Should(gomega.Equal(previous))
+			for _, valid := range []string{token, previous} {
+				asset, err := provider.GetAssetByToken(valid)
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(asset.AssetId).Should(gomega.Equal(assetID))
+			}
+		})
+		ginkgo.It("should reject the previous token after the grace period", func(){
+			assetID := uuid.NewV4().String()
+			previous := RegisterAsset(assetID, provider)
+			token := uuid.NewV4().String()
+			_, err := provider.RotateAssetToken(assetID, token, time.Now().Add(-time.Minute).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.GetAssetByToken(previous)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			_, err = provider.GetAssetByToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+		ginkgo.It("should not rotate to a token in use", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			other := RegisterAsset(uuid.NewV4().String(), provider)
+			_, err := provider.RotateAssetToken(assetID, other, time.Now().Unix())
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should revoke a token immediately", func(){
+			assetID := uuid.NewV4().String()
+			previous := RegisterAsset(assetID, provider)
+			token := uuid.NewV4().String()
+			_, err := provider.RotateAssetToken(assetID, token, time.Now().Add(time.Hour).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+
+			gomega.Expect(provider.RevokeAssetToken(assetID, previous)).To(gomega.Succeed())
+			_, err = provider.GetAssetByToken(previous)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			_, err = provider.GetAssetByToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+
+			gomega.Expect(provider.RevokeAssetToken(assetID, "")).To(gomega.Succeed())
+			_, err = provider.GetAssetByToken(token)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			asset, err := provider.GetManagedAsset(assetID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(asset.TokenRevoked).Should(gomega.BeTrue())
+		})
+		ginkgo.It("should fail to revoke a token of another asset", func(){
+			assetID := uuid.NewV4().String()
+			RegisterAsset(assetID, provider)
+			other := RegisterAsset(uuid.NewV4().String(), provider)
+			gomega.Expect(provider.RevokeAssetToken(assetID, other)).ToNot(gomega.Succeed())
+			_, err := provider.GetAssetByToken(other)
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+		ginkgo.It("should remove all the tokens of a removed asset", func(){
+			assetID := uuid.NewV4().String()
+			previous := RegisterAsset(assetID, provider)
+			token := uuid.NewV4().String()
+			_, err := provider.RotateAssetToken(assetID, token, time.Now().Add(time.Hour).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(provider.RemoveManagedAsset(assetID)).To(gomega.Succeed())
+			for _, removed := range []string{token, previous} {
+				_, err := provider.GetAssetByToken(removed)
+				gomega.Expect(err).To(gomega.HaveOccurred())
+			}
 		})
 	})
 
 	ginkgo.Context("Join tokens", func(){
 		ginkgo.It("should be able add a join token", func(){
 		    token := uuid.NewV4().String()
-		    _, err := provider.AddJoinToken(token)
+		    _, err := provider.AddJoinToken(token, JoinTokenOptions{})
 		    gomega.Expect(err).To(gomega.Succeed())
 		})
 		ginkgo.It("should be able to check a join token", func(){
 			token := uuid.NewV4().String()
-			_, err := provider.AddJoinToken(token)
+			_, err := provider.AddJoinToken(token, JoinTokenOptions{})
 			gomega.Expect(err).To(gomega.Succeed())
 			result, err := provider.CheckJoinToken(token)
 			gomega.Expect(err).To(gomega.Succeed())
 			gomega.Expect(result).Should(gomega.BeTrue())
 		})
+		ginkgo.It("should be able to remove a join token", func(){
+			token := uuid.NewV4().String()
+			_, err := provider.AddJoinToken(token, JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			err = provider.RemoveJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			result, err := provider.CheckJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result).Should(gomega.BeFalse())
+		})
+		ginkgo.It("should add a join token with a custom TTL and labels", func(){
+			token := uuid.NewV4().String()
+			labels := map[string]string{"zone": "north"}
+			added, err := provider.AddJoinToken(token, JoinTokenOptions{TTL: 10 * time.Minute, MaxUses: 2, Labels: labels})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(added.ExpiredOn).Should(gomega.Equal(added.Created + 600))
+			used, err := provider.UseJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(used.Labels).Should(gomega.Equal(labels))
+			gomega.Expect(used.Uses).Should(gomega.Equal(1))
+		})
+		ginkgo.It("should reject a join token used by the maximum number of agents", func(){
+			token := uuid.NewV4().String()
+			_, err := provider.AddJoinToken(token, JoinTokenOptions{MaxUses: 1})
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.UseJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			result, err := provider.CheckJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result).Should(gomega.BeFalse())
+			_, err = provider.UseJoinToken(token)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			// the use of an agent that could not join is given back
+			gomega.Expect(provider.ReleaseJoinToken(token)).To(gomega.Succeed())
+			_, err = provider.UseJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+		ginkgo.It("should reject a revoked join token", func(){
+			token := uuid.NewV4().String()
+			_, err := provider.AddJoinToken(token, JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(provider.RevokeJoinToken(token)).To(gomega.Succeed())
+			result, err := provider.CheckJoinToken(token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result).Should(gomega.BeFalse())
+			_, err = provider.UseJoinToken(token)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should fail to revoke an unknown join token", func(){
+			err := provider.RevokeJoinToken(uuid.NewV4().String())
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+		ginkgo.It("should list the join tokens", func(){
+			first := uuid.NewV4().String()
+			second := uuid.NewV4().String()
+			for _, token := range []string{first, second} {
+				_, err := provider.AddJoinToken(token, JoinTokenOptions{})
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			gomega.Expect(provider.RevokeJoinToken(second)).To(gomega.Succeed())
+			tokens, err := provider.ListJoinTokens()
+			gomega.Expect(err).To(gomega.Succeed())
+			revoked := make(map[string]bool, 0)
+			for _, token := range tokens {
+				revoked[token.Token] = token.Revoked
+			}
+			gomega.Expect(revoked).Should(gomega.HaveKeyWithValue(first, false))
+			gomega.Expect(revoked).Should(gomega.HaveKeyWithValue(second, true))
+		})
+	})
+
+	ginkgo.Context("Stale records", func(){
+		ginkgo.It("should remove the join tokens expired for longer than the retention", func(){
+			expired := uuid.NewV4().String()
+			valid := uuid.NewV4().String()
+			_, err := provider.AddJoinToken(expired, JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = provider.AddJoinToken(valid, JoinTokenOptions{TTL: 24 * time.Hour})
+			gomega.Expect(err).To(gomega.Succeed())
+
+			policy := RetentionPolicy{JoinTokens: Retention{MaxAge: time.Hour}}
+			result, err := provider.RemoveStaleRecords(policy, time.Now().Add(3 * time.Hour).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.JoinTokens).Should(gomega.Equal(CollectedRecords{Expired: 1}))
+			tokens, err := provider.ListJoinTokens()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(tokens).Should(gomega.HaveLen(1))
+			gomega.Expect(tokens[0].Token).Should(gomega.Equal(valid))
+		})
+		ginkgo.It("should evict the oldest outbox messages over the maximum", func(){
+			ids := make([]string, 0)
+			for i := 0; i < 3; i++ {
+				msg := CreateTestOutboxMessage()
+				ids = append(ids, msg.Id)
+				gomega.Expect(provider.AddOutboxMessage(*msg)).To(gomega.Succeed())
+			}
+
+			policy := RetentionPolicy{OutboxMessages: Retention{MaxAge: time.Hour, MaxRecords: 2}}
+			result, err := provider.RemoveStaleRecords(policy, time.Now().Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.OutboxMessages).Should(gomega.Equal(CollectedRecords{Evicted: 1}))
+			messages, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			remaining := make([]string, 0)
+			for _, msg := range messages {
+				remaining = append(remaining, msg.Id)
+			}
+			gomega.Expect(remaining).Should(gomega.Equal(ids[1:]))
+		})
+		ginkgo.It("should remove the agent starts older than the retention", func(){
+			now := time.Now().Unix()
+			recent := uuid.NewV4().String()
+			stale := uuid.NewV4().String()
+			for _, start := range []entities.AgentStartInfo{
+				{Created: now - 100, AssetId: recent}, {Created: now, AssetId: recent}, {Created: now - 100, AssetId: stale}} {
+				gomega.Expect(provider.AddAgentStart(start)).To(gomega.Succeed())
+			}
+
+			policy := RetentionPolicy{AgentStarts: Retention{MaxAge: time.Minute}}
+			result, err := provider.RemoveStaleRecords(policy, now)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.AgentStarts).Should(gomega.Equal(CollectedRecords{Expired: 2}))
+			starts, err := provider.GetAgentStarts(recent)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(starts).Should(gomega.Equal([]entities.AgentStartInfo{{Created: now, AssetId: recent}}))
+			starts, err = provider.GetAgentStarts(stale)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(starts).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should keep the records without a retention", func(){
+			gomega.Expect(provider.AddOutboxMessage(*CreateTestOutboxMessage())).To(gomega.Succeed())
+			result, err := provider.RemoveStaleRecords(RetentionPolicy{}, time.Now().Add(24 * time.Hour).Unix())
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(result.Total()).Should(gomega.Equal(0))
+		})
+	})
+
+	ginkgo.Context("Install operations", func(){
+		ginkgo.It("should be able to add and update an install operation", func(){
+			op := CreateTestInstallOperation()
+			err := provider.AddInstallOperation(*op)
+			gomega.Expect(err).To(gomega.Succeed())
+			op.Step = "start agent"
+			err = provider.AddInstallOperation(*op)
+			gomega.Expect(err).To(gomega.Succeed())
+			ops, err := provider.GetInstallOperations()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(ops).Should(gomega.ConsistOf(*op))
+		})
+		ginkgo.It("should be able to remove an install operation", func(){
+			op := CreateTestInstallOperation()
+			err := provider.AddInstallOperation(*op)
+			gomega.Expect(err).To(gomega.Succeed())
+			err = provider.RemoveInstallOperation(op.OperationId)
+			gomega.Expect(err).To(gomega.Succeed())
+			ops, err := provider.GetInstallOperations()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(ops).Should(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("Pending uninstalls", func(){
+		ginkgo.It("should be able to add, retrieve and remove a pending uninstall", func(){
+			request := entities.UninstallAgentRequest{OrganizationId: "org", EdgeControllerId: "ec",
+				AssetId: uuid.NewV4().String(), OperationId: uuid.NewV4().String()}
+			pending, err := provider.GetPendingUninstall(request.AssetId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(pending).Should(gomega.BeNil())
+			err = provider.AddPendingUninstall(request)
+			gomega.Expect(err).To(gomega.Succeed())
+			pending, err = provider.GetPendingUninstall(request.AssetId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*pending).Should(gomega.Equal(request))
+
+			removed, err := provider.RemovePendingUninstall(request.AssetId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*removed).Should(gomega.Equal(request))
+			removed, err = provider.RemovePendingUninstall(request.AssetId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removed).Should(gomega.BeNil())
+		})
+	})
+
+	ginkgo.Context("Host keys", func(){
+		ginkgo.It("should return an empty fingerprint for unknown hosts", func(){
+			fingerprint, err := provider.GetHostKey("unknown:22")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(fingerprint).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should be able to trust and retrieve a host key", func(){
+			trusted, err := provider.TrustHostKey("10.0.0.1:22", "SHA256:test")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(trusted).Should(gomega.Equal("SHA256:test"))
+			fingerprint, err := provider.GetHostKey("10.0.0.1:22")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(fingerprint).Should(gomega.Equal("SHA256:test"))
+		})
+		ginkgo.It("should not replace the key trusted for a host", func(){
+			_, err := provider.TrustHostKey("10.0.0.1:22", "SHA256:test")
+			gomega.Expect(err).To(gomega.Succeed())
+			trusted, err := provider.TrustHostKey("10.0.0.1:22", "SHA256:other")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(trusted).Should(gomega.Equal("SHA256:test"))
+			fingerprint, err := provider.GetHostKey("10.0.0.1:22")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(fingerprint).Should(gomega.Equal("SHA256:test"))
+		})
 	})
 }
\ No newline at end of file
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	assetProvider "github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/rs/zerolog/log"
+)
+
+// AgentStartsPath with the path of the admin server that returns the recent starts of the agents. The asset_id query
+// parameter selects a single asset, otherwise the starts of all the managed assets are returned by asset.
+const AgentStartsPath = "/agents/starts"
+
+// AdminHandler serves the queries of the operators of the edge controller. It does not depend on the management
+// cluster, so it is available while the edge controller is offline.
+type AdminHandler struct {
+	provider assetProvider.Provider
+}
+
+// NewAdminHandler creates the handler of the admin server.
+func NewAdminHandler(provider assetProvider.Provider) http.Handler {
+	handler := &AdminHandler{provider: provider}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AgentStartsPath, handler.agentStarts)
+	return mux
+}
+
+// agentStarts returns the recent starts of an asset, or of all the managed assets, the most recent first.
+func (h *AdminHandler) agentStarts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if assetID := r.URL.Query().Get("asset_id"); assetID != "" {
+		starts, err := h.provider.GetAgentStarts(assetID)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminResponse(w, starts)
+		return
+	}
+
+	assets, err := h.provider.ListManagedAssets(assetProvider.ManagedAssetFilter{})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	result := make(map[string][]entities.AgentStartInfo, len(assets))
+	for _, joined := range assets {
+		starts, err := h.provider.GetAgentStarts(joined.AssetId)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		result[joined.AssetId] = starts
+	}
+	writeAdminResponse(w, result)
+}
+
+// writeAdminResponse writes a JSON response.
+func writeAdminResponse(w http.ResponseWriter, content interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(content); err != nil {
+		log.Warn().Err(err).Msg("cannot write admin response")
+	}
+}
+
+// writeAdminError writes an error with the HTTP status of its type.
+func writeAdminError(w http.ResponseWriter, err derrors.Error) {
+	status := http.StatusInternalServerError
+	switch err.Type() {
+	case derrors.InvalidArgument:
+		status = http.StatusBadRequest
+	case derrors.NotFound:
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+var _ = ginkgo.Describe("Agent starts", func() {
+
+	var provider *asset.MockupAssetProvider
+	var admin *httptest.Server
+	var start grpc.UnaryHandler
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		for _, assetID := range []string{"asset", "other"} {
+			gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{
+				AssetId: assetID, Token: assetID + "-token"})).To(gomega.Succeed())
+		}
+		notifier := agent.NewNotifier(time.Minute, provider, nil, "org", "ec")
+		handler := agent.NewHandler(agent.NewManager(config.Config{}, provider, notifier, nil))
+		start = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return handler.AgentStart(ctx, req.(*grpc_inventory_manager_go.AgentStartInfo))
+		}
+		admin = httptest.NewServer(NewAdminHandler(provider))
+	})
+
+	ginkgo.AfterEach(func() {
+		admin.Close()
+	})
+
+	// notifyStart sends an agent start through the interceptor of the agent server.
+	notifyStart := func(token string, assetID string) error {
+		interceptor := NewAgentTokenInterceptor(provider, config.ClientCertsDisabled)
+		info := &grpc_inventory_manager_go.AgentStartInfo{AssetId: assetID, Ip: "10.0.0.1"}
+		_, err := interceptor.UnaryInterceptor()(requestContext(token, nil), info, &grpc.UnaryServerInfo{FullMethod: agentStartMethod}, start)
+		return err
+	}
+
+	query := func(path string, result interface{}) int {
+		response, err := http.Get(admin.URL + path)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			gomega.Expect(json.NewDecoder(response.Body).Decode(result)).To(gomega.Succeed())
+		}
+		return response.StatusCode
+	}
+
+	ginkgo.It("should deliver the start of an agent and show it to the operators", func() {
+		gomega.Expect(notifyStart("asset-token", "asset")).To(gomega.Succeed())
+
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.HaveLen(1))
+		gomega.Expect(messages[0].Type).To(gomega.Equal(entities.AgentStartMessage))
+
+		starts := make([]entities.AgentStartInfo, 0)
+		gomega.Expect(query(AgentStartsPath+"?asset_id=asset", &starts)).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(starts).To(gomega.HaveLen(1))
+		gomega.Expect(starts[0].Ip).To(gomega.Equal("10.0.0.1"))
+
+		byAsset := make(map[string][]entities.AgentStartInfo, 0)
+		gomega.Expect(query(AgentStartsPath, &byAsset)).To(gomega.Equal(http.StatusOK))
+		gomega.Expect(byAsset["asset"]).To(gomega.HaveLen(1))
+		gomega.Expect(byAsset["other"]).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should not record the start notified for another asset", func() {
+		gomega.Expect(notifyStart("asset-token", "other")).ToNot(gomega.Succeed())
+		gomega.Expect(notifyStart("join", "other")).ToNot(gomega.Succeed())
+		starts, err := provider.GetAgentStarts("other")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(starts).To(gomega.BeEmpty())
+	})
+})
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeProxyClient is an inventory proxy client that records the messages it receives. The calls whose asset or
+// operation identifier is in failing return an error.
+type fakeProxyClient struct {
+	sync.Mutex
+	// calls with the name of the method and the identifier of each message received, in order.
+	calls []string
+	// failing with the asset or operation identifiers whose messages are rejected.
+	failing map[string]bool
+	// rejecting with the asset or operation identifiers whose messages are rejected as invalid with the given code.
+	rejecting map[string]codes.Code
+	// latency simulates the round trip of each call.
+	latency time.Duration
+}
+
+func newFakeProxyClient() *fakeProxyClient {
+	return &fakeProxyClient{calls: make([]string, 0), failing: make(map[string]bool, 0),
+		rejecting: make(map[string]codes.Code, 0)}
+}
+
+func (f *fakeProxyClient) record(method string, id string) error {
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.failing[id] {
+		return status.Errorf(codes.Unavailable, "proxy unavailable for %s", id)
+	}
+	if code, rejected := f.rejecting[id]; rejected {
+		return status.Errorf(code, "proxy rejected %s", id)
+	}
+	f.calls = append(f.calls, method+":"+id)
+	return nil
+}
+
+func (f *fakeProxyClient) setFailing(id string, failing bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.failing[id] = failing
+}
+
+func (f *fakeProxyClient) setRejecting(id string, code codes.Code) {
+	f.Lock()
+	defer f.Unlock()
+	f.rejecting[id] = code
+}
+
+func (f *fakeProxyClient) getCalls() []string {
+	f.Lock()
+	defer f.Unlock()
+	result := make([]string, len(f.calls))
+	copy(result, f.calls)
+	return result
+}
+
+func (f *fakeProxyClient) EICStart(ctx context.Context, in *grpc_inventory_manager_go.EICStartInfo, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("EICStart", in.EdgeControllerId)
+}
+
+func (f *fakeProxyClient) EICAlive(ctx context.Context, in *grpc_inventory_go.EdgeControllerId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("EICAlive", in.EdgeControllerId)
+}
+
+func (f *fakeProxyClient) AgentJoin(ctx context.Context, in *grpc_inventory_manager_go.AgentJoinRequest, opts ...grpc.CallOption) (*grpc_inventory_manager_go.AgentJoinResponse, error) {
+	err := f.record("AgentJoin", in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+	return &grpc_inventory_manager_go.AgentJoinResponse{AssetId: in.AgentId, Token: "token-" + in.AgentId}, nil
+}
+
+func (f *fakeProxyClient) AgentStart(ctx context.Context, in *grpc_inventory_manager_go.AgentStartInfo, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("AgentStart", in.AssetId)
+}
+
+func (f *fakeProxyClient) LogAgentAlive(ctx context.Context, in *grpc_inventory_manager_go.AgentsAlive, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("LogAgentAlive", in.EdgeControllerId)
+}
+
+func (f *fakeProxyClient) CallbackAgentOperation(ctx context.Context, in *grpc_inventory_manager_go.AgentOpResponse, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("CallbackAgentOperation", in.AssetId)
+}
+
+func (f *fakeProxyClient) CallbackECOperation(ctx context.Context, in *grpc_inventory_manager_go.EdgeControllerOpResponse, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("CallbackECOperation", in.OperationId)
+}
+
+func (f *fakeProxyClient) AgentUninstalled(ctx context.Context, in *grpc_inventory_go.AssetUninstalledId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	return &grpc_common_go.Success{}, f.record("AgentUninstalled", in.AssetId)
+}
@@ -25,9 +25,13 @@ import (
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 )
 
+// TokenHeader with the metadata key of the token sent by the agents.
+const TokenHeader = "authorization"
+
 // Handler structure for the cluster requests.
 type Handler struct {
 	Manager Manager
@@ -38,12 +42,25 @@ func NewHandler(manager Manager) *Handler{
 	return &Handler{manager}
 }
 
+// TokenFromContext returns the token sent by the agent in the TokenHeader metadata.
+func TokenFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(TokenHeader)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 func (h *Handler) AgentJoin(ctx context.Context, request *grpc_edge_controller_go.AgentJoinRequest) (*grpc_inventory_manager_go.AgentJoinResponse, error) {
 	err := entities.ValidJoinRequest(request)
 	if err != nil{
 		return nil, conversions.ToGRPCError(err)
 	}
-	response, err := h.Manager.AgentJoin(request)
+	response, err := h.Manager.AgentJoin(request, TokenFromContext(ctx))
 	if err != nil{
 		log.Warn().Str("trace", err.DebugReport()).Msg("agent join failed")
 		return nil, conversions.ToGRPCError(err)
@@ -23,36 +23,124 @@ import (
 	"github.com/nalej/edge-controller/internal/pkg/entities"
 	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
 	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
 	"github.com/nalej/grpc-edge-controller-go"
 	"github.com/nalej/grpc-edge-inventory-proxy-go"
+	"github.com/nalej/grpc-inventory-go"
 	"github.com/nalej/grpc-inventory-manager-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
+	"github.com/satori/go.uuid"
+	"sync"
 	"time"
 )
 
 const DefaultTimeout = 30 * time.Second
 const UninstallOp = "uninstall"
 const CorePluging = "core"
+// UpdateTokenOp delivers a new token to the agent in the NewTokenParam. The agent must use it in the next requests.
+const UpdateTokenOp = "update_token"
+// RequestCertificateOp asks the agent to generate a private key and to respond with a certificate request in PEM
+// format in the info of the response. The private key never leaves the agent.
+const RequestCertificateOp = "request_certificate"
+// InstallCertificateOp delivers the client certificate of the agent in the CertificateParam. The agent must use it in
+// the next connections, and respond once it is installed.
+const InstallCertificateOp = "install_certificate"
+const CertificateParam = "certificate"
+const SerialParam = "serial"
+// DefaultCertificateRenewalPeriod with the period between the checks of the certificates that must be renewed.
+const DefaultCertificateRenewalPeriod = time.Hour
+// CorePriority with the priority of the core operations that deliver credentials to the agent so they are delivered
+// first.
+const CorePriority = 1000
+const NewTokenParam = "token"
+const UnacknowledgedResponseInfo = "Operation not acknowledged by the agent"
 
 type Manager struct{
 	config config.Config
 	provider asset.Provider
-	notifier Notifier
+	notifier *Notifier
 	// managementClient that connects with the proxy on the management cluster. Notice that this will be an async
 	// proxy for most operations as the inventory manager is not directly exposed.
 	managementClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient
+	// authority that issues the client certificates of the agents. Agents do not receive a certificate if it is nil.
+	authority *pki.Authority
+	// location with the geolocation of the agents that join without one. It is shared by the copies of the manager
+	// as it can be changed at runtime.
+	location *geolocation
 }
 
-func NewManager(cfg config.Config, assetProvider asset.Provider, notifier Notifier, managementClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient) Manager{
-	return Manager{cfg,assetProvider, notifier, managementClient}
+// geolocation guards a location that can be changed while the agents join.
+type geolocation struct {
+	sync.RWMutex
+	value string
 }
 
-func (m * Manager) AgentJoin(request *grpc_edge_controller_go.AgentJoinRequest) (*grpc_inventory_manager_go.AgentJoinResponse, derrors.Error) {
+func NewManager(cfg config.Config, assetProvider asset.Provider, notifier *Notifier, managementClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient) Manager{
+	return Manager{cfg,assetProvider, notifier, managementClient, nil, &geolocation{value: cfg.Geolocation}}
+}
+
+// SetGeolocation changes the geolocation of the agents that join without one.
+func (m *Manager) SetGeolocation(location string) {
+	m.location.Lock()
+	defer m.location.Unlock()
+	m.location.value = location
+}
+
+// getGeolocation returns the geolocation of the agents that join without one.
+func (m *Manager) getGeolocation() string {
+	m.location.RLock()
+	defer m.location.RUnlock()
+	return m.location.value
+}
+
+// SetCertificateAuthority sets the authority that issues a client certificate to the agents when they join.
+func (m *Manager) SetCertificateAuthority(authority *pki.Authority) {
+	m.authority = authority
+}
+
+// AgentJoin registers an agent in the management cluster. The use of the join token is counted before joining so
+// concurrent joins cannot exceed its limit, and it is given back if the agent cannot join.
+func (m * Manager) AgentJoin(request *grpc_edge_controller_go.AgentJoinRequest, joinToken string) (*grpc_inventory_manager_go.AgentJoinResponse, derrors.Error) {
 	log.Debug().Str("agentID", request.AgentId).Msg("agent request join")
+
+	tokenInfo, tErr := m.provider.UseJoinToken(joinToken)
+	if tErr != nil{
+		log.Warn().Str("agentID", request.AgentId).Str("trace", tErr.DebugReport()).Msg("invalid join token")
+		return nil, derrors.NewUnauthenticatedError("invalid join token", tErr)
+	}
+	labels := joinLabels(request.Labels, tokenInfo.Labels)
+
+	response, err := m.joinManagementCluster(request, labels)
+	if err != nil{
+		if rErr := m.provider.ReleaseJoinToken(joinToken); rErr != nil{
+			log.Warn().Str("agentID", request.AgentId).Str("trace", rErr.DebugReport()).Msg("cannot release join token")
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// joinLabels returns the labels of an agent joining with a token. The labels of the token take precedence over the
+// ones sent by the agent.
+func joinLabels(agentLabels map[string]string, tokenLabels map[string]string) map[string]string {
+	if len(tokenLabels) == 0 {
+		return agentLabels
+	}
+	labels := make(map[string]string, len(agentLabels)+len(tokenLabels))
+	for key, value := range agentLabels {
+		labels[key] = value
+	}
+	for key, value := range tokenLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+func (m * Manager) joinManagementCluster(request *grpc_edge_controller_go.AgentJoinRequest, labels map[string]string) (*grpc_inventory_manager_go.AgentJoinResponse, derrors.Error) {
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 
-	agentLocation := m.config.Geolocation
+	agentLocation := m.getGeolocation()
 	if request.Geolocation != ""{
 		agentLocation = request.Geolocation
 	}
@@ -62,7 +150,7 @@ func (m * Manager) AgentJoin(request *grpc_edge_controller_go.AgentJoinRequest)
 		OrganizationId:       m.config.OrganizationId,
 		EdgeControllerId:     m.config.EdgeControllerId,
 		AgentId:              request.AgentId,
-		Labels:               request.Labels,
+		Labels:               labels,
 		Os:                   request.Os,
 		Hardware:             request.Hardware,
 		Storage:              request.Storage,
@@ -75,15 +163,19 @@ func (m * Manager) AgentJoin(request *grpc_edge_controller_go.AgentJoinRequest)
 	}
 
 	// add agent
-	err = m.provider.AddManagedAsset(entities.AgentJoinInfo{
-		Created: time.Now().Unix(),
-		AssetId: response.AssetId,
-		Token: response.Token,
-	})
+	joinInfo := entities.NewAgentJoinInfo(request, response)
+	joinInfo.Labels = labels
+	err = m.provider.AddManagedAsset(*joinInfo)
 	if err != nil{
 		log.Warn().Str("agentID", request.AgentId).Str("assetId", response.AssetId).Str("trace", conversions.ToDerror(err).DebugReport()).Msg("cannot add Asset")
 		return nil, conversions.ToDerror(err)
 	}
+	if m.authority != nil{
+		// the agent can use its token until it installs the certificate
+		if rErr := m.requestCertificate(response.AssetId); rErr != nil{
+			log.Warn().Str("assetID", response.AssetId).Str("trace", rErr.DebugReport()).Msg("cannot request client certificate")
+		}
+	}
 
 
 	// add Token
@@ -93,8 +185,134 @@ func (m * Manager) AgentJoin(request *grpc_edge_controller_go.AgentJoinRequest)
 
 }
 
+// requestCertificate queues the operation that asks the agent for a certificate request. It is not asked again until
+// the operation expires.
+func (m *Manager) requestCertificate(assetID string) derrors.Error {
+	now := time.Now()
+	until := now.Add(m.config.AgentOpTimeout).Unix()
+	operation := entities.AgentOpRequest{
+		Created:          now.Unix(),
+		OrganizationId:   m.config.OrganizationId,
+		EdgeControllerId: m.config.EdgeControllerId,
+		AssetId:          assetID,
+		OperationId:      uuid.NewV4().String(),
+		Operation:        RequestCertificateOp,
+		Plugin:           CorePluging,
+		Priority:         CorePriority,
+		Deadline:         until,
+	}
+	if err := m.provider.RequestAssetCertificate(assetID, until); err != nil{
+		return err
+	}
+	if _, err := m.provider.AddPendingOperation(operation, 0); err != nil{
+		return err
+	}
+	log.Debug().Str("assetID", assetID).Str("operationID", operation.OperationId).Msg("client certificate requested")
+	return nil
+}
+
+// sendCertificate signs the certificate request sent by the agent and queues the operation that delivers the
+// certificate.
+func (m *Manager) sendCertificate(assetID string, certificateRequest string) derrors.Error {
+	if m.authority == nil{
+		return derrors.NewFailedPreconditionError("client certificates are disabled")
+	}
+	issued, err := m.authority.Sign(assetID, certificateRequest)
+	if err != nil{
+		return err
+	}
+	if err := m.provider.SetAssetCertificate(assetID, issued.Serial, issued.Expires); err != nil{
+		return err
+	}
+	// the operation is useless once the certificate expires
+	operation := entities.AgentOpRequest{
+		Created:          time.Now().Unix(),
+		OrganizationId:   m.config.OrganizationId,
+		EdgeControllerId: m.config.EdgeControllerId,
+		AssetId:          assetID,
+		OperationId:      uuid.NewV4().String(),
+		Operation:        InstallCertificateOp,
+		Plugin:           CorePluging,
+		Params:           map[string]string{CertificateParam: issued.Certificate, SerialParam: issued.Serial},
+		Priority:         CorePriority,
+		Deadline:         issued.Expires,
+	}
+	if _, err := m.provider.AddPendingOperation(operation, 0); err != nil{
+		return err
+	}
+	log.Info().Str("assetID", assetID).Str("serial", issued.Serial).Msg("client certificate issued")
+	return nil
+}
+
+// certificateCallback handles the response of the agent to the operations of its client certificate. These
+// operations are created by the edge controller, so the management cluster does not receive their responses.
+func (m *Manager) certificateCallback(op *entities.AgentOpRequest, response *grpc_inventory_manager_go.AgentOpResponse) derrors.Error {
+	if response.Status != grpc_inventory_go.OpStatus_SUCCESS{
+		log.Warn().Str("assetID", op.AssetId).Str("operation", op.Operation).Str("status", response.Status.String()).
+			Str("info", response.Info).Msg("client certificate operation failed")
+		return nil
+	}
+	var err derrors.Error
+	if op.Operation == RequestCertificateOp{
+		err = m.sendCertificate(op.AssetId, response.Info)
+	}else{
+		err = m.provider.InstallAssetCertificate(op.AssetId, op.Params[SerialParam])
+	}
+	if err != nil{
+		log.Warn().Str("assetID", op.AssetId).Str("operation", op.Operation).Str("trace", err.DebugReport()).
+			Msg("cannot handle client certificate response")
+		return err
+	}
+	return nil
+}
+
+// IsCertificateOperation returns whether an operation manages the client certificate of the agent.
+func IsCertificateOperation(op *entities.AgentOpRequest) bool {
+	return op.Plugin == CorePluging && (op.Operation == RequestCertificateOp || op.Operation == InstallCertificateOp)
+}
+
+// RenewCertificates asks for a certificate request to the agents without a client certificate, and to the ones whose
+// certificate has less than a third of its validity left, so it is replaced before it expires.
+func (m *Manager) RenewCertificates() {
+	if m.authority == nil{
+		return
+	}
+	assets, err := m.provider.ListManagedAssets(asset.ManagedAssetFilter{})
+	if err != nil{
+		log.Error().Str("trace", err.DebugReport()).Msg("cannot list the assets to renew their certificates")
+		return
+	}
+	now := time.Now().Unix()
+	renewBefore := int64(m.config.AgentCertValidity.Seconds() / 3)
+	for _, joined := range assets{
+		if !joined.NeedsCertificate(now, renewBefore){
+			continue
+		}
+		if rErr := m.requestCertificate(joined.AssetId); rErr != nil{
+			log.Warn().Str("assetID", joined.AssetId).Str("trace", rErr.DebugReport()).Msg("cannot request client certificate")
+		}
+	}
+}
+
+// LaunchCertificateRenewalLoop renews the client certificates of the agents periodically until the context is done.
+func (m *Manager) LaunchCertificateRenewalLoop(ctx context.Context, period time.Duration) {
+	log.Info().Str("period", period.String()).Msg("Launching certificate renewal loop")
+	m.RenewCertificates()
+	ticker := time.NewTicker(period)
+	for {
+		select {
+		case <-ticker.C:
+			m.RenewCertificates()
+		case <-ctx.Done():
+			ticker.Stop()
+			log.Info().Msg("Certificate renewal loop finished")
+			return
+		}
+	}
+}
+
 func (m * Manager) AgentStart(info *grpc_inventory_manager_go.AgentStartInfo) derrors.Error {
-	log.Debug().Str("assetID", info.AssetId).Msg("agent started")
+	log.Info().Str("assetID", info.AssetId).Str("ip", info.Ip).Msg("agent started")
 	err := m.notifier.NotifyAgentStart(info)
 	if err != nil{
 		log.Warn().Str("trace", err.DebugReport()).Msg("error notifying agent start event")
@@ -136,12 +354,13 @@ func (m * Manager) AgentCheck(request *grpc_edge_controller_go.AgentCheckRequest
 		}
 	}
 
-	pending, err := m.provider.GetPendingOperations(request.AssetId, true)
+	pending, exhausted, err := m.provider.TakePendingOperations(request.AssetId, time.Now().Unix(), m.deliveryPolicy())
 	if err != nil {
 		log.Error().Str("trace", err.DebugReport()).Msg("cannot retrieve pending operations for an agent")
 		// In this case the error is not returned to the agent as it cannot do anything.
 		return &grpc_edge_controller_go.CheckResult{}, nil
 	}
+	m.notifyUnacknowledged(exhausted)
 	log.Info().Str("assetID", request.AssetId).Int("pending operation", len(pending)).Msg("sending pending operation to the agent")
 
 	// Return empty message
@@ -160,8 +379,63 @@ func (m * Manager) AgentCheck(request *grpc_edge_controller_go.AgentCheckRequest
 
 }
 
+// deliveryPolicy returns how the operations are delivered to the agents.
+func (m *Manager) deliveryPolicy() asset.DeliveryPolicy {
+	return asset.DeliveryPolicy{
+		Limit:       m.config.AgentOpsPerCheck,
+		Lease:       m.config.AgentOpLease,
+		MaxAttempts: m.config.AgentOpMaxAttempts,
+	}
+}
+
+// notifyUnacknowledged reports as failed the operations that the agent has not acknowledged after being delivered the
+// maximum number of times.
+func (m *Manager) notifyUnacknowledged(ops []entities.AgentOpRequest) {
+	for _, op := range ops {
+		log.Warn().Str("assetID", op.AssetId).Str("operationID", op.OperationId).Int("attempts", op.Attempts).
+			Msg("operation not acknowledged by the agent")
+		err := m.notifier.NotifyCallback(&grpc_inventory_manager_go.AgentOpResponse{
+			OrganizationId:   op.OrganizationId,
+			EdgeControllerId: op.EdgeControllerId,
+			AssetId:          op.AssetId,
+			OperationId:      op.OperationId,
+			Timestamp:        time.Now().Unix(),
+			Status:           grpc_inventory_go.OpStatus_FAIL,
+			Info:             UnacknowledgedResponseInfo,
+		})
+		if err != nil {
+			log.Error().Str("trace", err.DebugReport()).Str("operationID", op.OperationId).
+				Msg("cannot add unacknowledged operation response")
+		}
+	}
+}
+
 func (m * Manager) CallbackAgentOperation(response *grpc_inventory_manager_go.AgentOpResponse) derrors.Error {
 	log.Debug().Str("assetID", response.AssetId).Str("status", response.Status.String()).Msg("agent callback")
+	var op *entities.AgentOpRequest
+	var rErr derrors.Error
+	finished := isFinalStatus(response.Status)
+	if !finished {
+		// the agent has received the operation, it is not delivered again but it still expires
+		op, rErr = m.provider.AcknowledgeDeliveredOperation(response.AssetId, response.OperationId)
+	} else {
+		// the operation is finished, it no longer expires
+		op, rErr = m.provider.RemoveDeliveredOperation(response.AssetId, response.OperationId)
+	}
+	if rErr != nil {
+		log.Debug().Str("assetID", response.AssetId).Str("operationID", response.OperationId).
+			Str("trace", rErr.DebugReport()).Msg("callback of an operation not delivered or already expired")
+	} else if op.Canceled {
+		// the management cluster already received the cancellation as the final status
+		log.Info().Str("assetID", response.AssetId).Str("operationID", response.OperationId).
+			Str("status", response.Status.String()).Msg("ignoring callback of a canceled operation")
+		return nil
+	} else if IsCertificateOperation(op) {
+		if finished {
+			return m.certificateCallback(op, response)
+		}
+		return nil
+	}
 	err := m.notifier.NotifyCallback(response)
 	if err != nil{
 		log.Warn().Str("trace", err.DebugReport()).Msg("error notifying agent callback")
@@ -0,0 +1,283 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
+	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// newAuthority creates a certificate authority from a self-signed certificate.
+func newAuthority() *pki.Authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "edge-controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	gomega.Expect(err).To(gomega.Succeed())
+	authority, aErr := pki.NewAuthority(
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), time.Hour)
+	gomega.Expect(aErr).To(gomega.Succeed())
+	return authority
+}
+
+var _ = ginkgo.Describe("Agent manager", func() {
+
+	var provider *asset.MockupAssetProvider
+	var manager Manager
+	var cfg config.Config
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		cfg = config.Config{AgentOpLease: time.Hour, AgentOpMaxAttempts: 2}
+		gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{AssetId: "asset", Token: "token"})).To(gomega.Succeed())
+		_, err := provider.AddPendingOperation(entities.AgentOpRequest{AssetId: "asset", OperationId: "op"}, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	check := func() []string {
+		notifier := NewNotifier(time.Minute, provider, newFakeProxyClient(), "org", "ec")
+		manager = NewManager(cfg, provider, notifier, nil)
+		result, err := manager.AgentCheck(&grpc_edge_controller_go.AgentCheckRequest{AssetId: "asset"}, "10.0.0.1")
+		gomega.Expect(err).To(gomega.Succeed())
+		ids := make([]string, 0)
+		for _, op := range result.PendingRequests {
+			ids = append(ids, op.OperationId)
+		}
+		return ids
+	}
+
+	ginkgo.It("should not deliver again an acknowledged operation", func() {
+		cfg.AgentOpLease = time.Nanosecond
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		gomega.Expect(manager.CallbackAgentOperation(&grpc_inventory_manager_go.AgentOpResponse{
+			AssetId: "asset", OperationId: "op", Status: grpc_inventory_go.OpStatus_SUCCESS})).To(gomega.Succeed())
+		gomega.Expect(check()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should not deliver again an operation in progress", func() {
+		cfg.AgentOpLease = time.Nanosecond
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		gomega.Expect(manager.CallbackAgentOperation(&grpc_inventory_manager_go.AgentOpResponse{
+			AssetId: "asset", OperationId: "op", Status: grpc_inventory_go.OpStatus_INPROGRESS})).To(gomega.Succeed())
+		gomega.Expect(check()).To(gomega.BeEmpty())
+		gomega.Expect(check()).To(gomega.BeEmpty())
+
+		// the operation is waiting for its final response, it is not reported as not acknowledged
+		delivered, err := provider.GetDeliveredOperations("asset")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(delivered).To(gomega.HaveLen(1))
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.HaveLen(1))
+		response := &entities.AgentOpResponse{}
+		gomega.Expect(messages[0].GetPayload(response)).To(gomega.Succeed())
+		gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_INPROGRESS.String()))
+	})
+
+	ginkgo.It("should ignore the response of a canceled operation", func() {
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		_, err := provider.CancelDeliveredOperation("asset", "op")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(manager.CallbackAgentOperation(&grpc_inventory_manager_go.AgentOpResponse{
+			AssetId: "asset", OperationId: "op", Status: grpc_inventory_go.OpStatus_SUCCESS})).To(gomega.Succeed())
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should keep an operation whose response is lost until the lease expires", func() {
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		gomega.Expect(check()).To(gomega.BeEmpty())
+		delivered, err := provider.GetDeliveredOperations("asset")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(delivered).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should fail an operation that is never acknowledged", func() {
+		// with an expired lease each check simulates a lost response
+		cfg.AgentOpLease = time.Nanosecond
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		gomega.Expect(check()).To(gomega.Equal([]string{"op"}))
+		gomega.Expect(check()).To(gomega.BeEmpty())
+
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.HaveLen(1))
+		response := &entities.AgentOpResponse{}
+		gomega.Expect(messages[0].GetPayload(response)).To(gomega.Succeed())
+		gomega.Expect(response.OperationId).To(gomega.Equal("op"))
+		gomega.Expect(response.Info).To(gomega.Equal(UnacknowledgedResponseInfo))
+	})
+
+	ginkgo.Context("agent join", func() {
+		var proxyClient *fakeProxyClient
+
+		ginkgo.BeforeEach(func() {
+			proxyClient = newFakeProxyClient()
+			notifier := NewNotifier(time.Minute, provider, proxyClient, "org", "ec")
+			manager = NewManager(cfg, provider, notifier, proxyClient)
+			_, err := provider.AddJoinToken("join", asset.JoinTokenOptions{MaxUses: 1, Labels: map[string]string{"zone": "north"}})
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+
+		join := func(agentID string) derrors.Error {
+			_, err := manager.AgentJoin(&grpc_edge_controller_go.AgentJoinRequest{
+				AgentId: agentID,
+				Labels:  map[string]string{"zone": "south", "os": "linux"},
+			}, "join")
+			return err
+		}
+
+		ginkgo.It("should add the labels of the join token to the agent", func() {
+			gomega.Expect(join("agent")).To(gomega.Succeed())
+			joined, err := provider.GetManagedAsset("agent")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(joined.Labels).To(gomega.Equal(map[string]string{"zone": "north", "os": "linux"}))
+		})
+
+		ginkgo.It("should reject an agent joining with a token already used", func() {
+			gomega.Expect(join("agent")).To(gomega.Succeed())
+			err := join("other")
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.Unauthenticated))
+			gomega.Expect(proxyClient.getCalls()).To(gomega.Equal([]string{"AgentJoin:agent"}))
+		})
+
+		ginkgo.It("should share the geolocation changed at runtime with the copies of the manager", func() {
+			handler := NewHandler(manager)
+			manager.SetGeolocation("Madrid")
+			gomega.Expect(handler.Manager.getGeolocation()).To(gomega.Equal("Madrid"))
+		})
+
+		ginkgo.It("should give back the use of the token if the agent cannot join", func() {
+			proxyClient.setFailing("agent", true)
+			gomega.Expect(join("agent")).ToNot(gomega.Succeed())
+			proxyClient.setFailing("agent", false)
+			gomega.Expect(join("agent")).To(gomega.Succeed())
+		})
+	})
+
+	ginkgo.Context("client certificates", func() {
+
+		ginkgo.BeforeEach(func() {
+			cfg.AgentOpTimeout = time.Hour
+			cfg.AgentCertValidity = time.Hour
+			_, err := provider.RemovePendingOperation("asset", "op")
+			gomega.Expect(err).To(gomega.Succeed())
+			proxyClient := newFakeProxyClient()
+			notifier := NewNotifier(time.Minute, provider, proxyClient, "org", "ec")
+			manager = NewManager(cfg, provider, notifier, proxyClient)
+			manager.SetCertificateAuthority(newAuthority())
+		})
+
+		// take returns the operations delivered to the agent.
+		take := func(assetID string) []*grpc_inventory_manager_go.AgentOpRequest {
+			result, err := manager.AgentCheck(&grpc_edge_controller_go.AgentCheckRequest{AssetId: assetID}, "10.0.0.1")
+			gomega.Expect(err).To(gomega.Succeed())
+			return result.PendingRequests
+		}
+
+		respond := func(op *grpc_inventory_manager_go.AgentOpRequest, info string) {
+			gomega.Expect(manager.CallbackAgentOperation(&grpc_inventory_manager_go.AgentOpResponse{
+				AssetId: op.AssetId, OperationId: op.OperationId, Status: grpc_inventory_go.OpStatus_SUCCESS, Info: info})).To(gomega.Succeed())
+		}
+
+		ginkgo.It("should issue a certificate to a joined agent from its certificate request", func() {
+			_, err := provider.AddJoinToken("join", asset.JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = manager.AgentJoin(&grpc_edge_controller_go.AgentJoinRequest{AgentId: "agent"}, "join")
+			gomega.Expect(err).To(gomega.Succeed())
+
+			ops := take("agent")
+			gomega.Expect(ops).To(gomega.HaveLen(1))
+			gomega.Expect(ops[0].Operation).To(gomega.Equal(RequestCertificateOp))
+			request, _, err := pki.NewCertificateRequest("agent")
+			gomega.Expect(err).To(gomega.Succeed())
+			respond(ops[0], request)
+
+			ops = take("agent")
+			gomega.Expect(ops).To(gomega.HaveLen(1))
+			gomega.Expect(ops[0].Operation).To(gomega.Equal(InstallCertificateOp))
+			gomega.Expect(ops[0].Params).To(gomega.HaveKey(CertificateParam))
+			gomega.Expect(ops[0].Params).To(gomega.HaveLen(2))
+			respond(ops[0], "")
+
+			joined, err := provider.GetManagedAsset("agent")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(joined.Certificate.Serial).To(gomega.Equal(ops[0].Params[SerialParam]))
+			gomega.Expect(joined.Certificate.Installed).To(gomega.BeTrue())
+			// the management cluster does not know the certificate operations
+			messages, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(messages).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should renew a certificate before it expires", func() {
+			manager.RenewCertificates()
+			ops := take("asset")
+			gomega.Expect(ops).To(gomega.HaveLen(1))
+			// the request is not repeated while the agent can answer it
+			manager.RenewCertificates()
+			gomega.Expect(take("asset")).To(gomega.BeEmpty())
+
+			gomega.Expect(provider.SetAssetCertificate("asset", "serial", time.Now().Add(time.Hour).Unix())).To(gomega.Succeed())
+			gomega.Expect(provider.InstallAssetCertificate("asset", "serial")).To(gomega.Succeed())
+			manager.RenewCertificates()
+			gomega.Expect(take("asset")).To(gomega.BeEmpty())
+
+			gomega.Expect(provider.SetAssetCertificate("asset", "serial", time.Now().Add(10*time.Minute).Unix())).To(gomega.Succeed())
+			manager.RenewCertificates()
+			ops = take("asset")
+			gomega.Expect(ops).To(gomega.HaveLen(1))
+			gomega.Expect(ops[0].Operation).To(gomega.Equal(RequestCertificateOp))
+		})
+
+		ginkgo.It("should reject an invalid certificate request", func() {
+			manager.RenewCertificates()
+			ops := take("asset")
+			gomega.Expect(manager.CallbackAgentOperation(&grpc_inventory_manager_go.AgentOpResponse{
+				AssetId: "asset", OperationId: ops[0].OperationId, Status: grpc_inventory_go.OpStatus_SUCCESS,
+				Info: "invalid"})).ToNot(gomega.Succeed())
+			gomega.Expect(take("asset")).To(gomega.BeEmpty())
+		})
+	})
+})
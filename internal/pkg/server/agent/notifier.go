@@ -18,18 +18,44 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/entities"
 	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/proxy"
+	"github.com/nalej/edge-controller/internal/pkg/utils"
 	"github.com/nalej/grpc-edge-inventory-proxy-go"
 	"github.com/nalej/grpc-inventory-go"
 	"github.com/nalej/grpc-inventory-manager-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"sync"
 	"time"
 )
 
+// DefaultNotifyBatchSize with the number of outbox messages read at once if it is not configured.
+const DefaultNotifyBatchSize = 500
+
+// DefaultNotifySenders with the number of concurrent calls to deliver the outbox if it is not configured.
+const DefaultNotifySenders = 8
+
+// DefaultRetryBackoff with the delay before delivering again the messages of an order key that could not be delivered.
+var DefaultRetryBackoff = utils.Backoff{
+	Initial: 10 * time.Second,
+	Max:     10 * time.Minute,
+	Factor:  2,
+}
+
+// deliveryRetry with the failed deliveries of an order key.
+type deliveryRetry struct {
+	// failures with the number of consecutive failed deliveries.
+	failures int
+	// next with the time when the messages can be delivered again.
+	next time.Time
+}
+
 // Notifier structure to send data back to the management cluster.
 type Notifier struct {
 	// Mutex for managing the internal structure.
@@ -42,7 +68,7 @@ type Notifier struct {
 	AssetIP map [string]string
 	// AssetNewIP is a map of the assets identifiers whose ip has changed, this list will be sent to the system model to update the information
 	AssetNewIP map [string]string
-	// provider for the persistent operations.
+	// provider for the persistent operations and the outbox of the messages for the management cluster.
 	provider asset.Provider
 	// mngtClient with the client that connects to the management cluster.
 	mngtClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient
@@ -50,12 +76,22 @@ type Notifier struct {
 	organizationID string
 	// edgeControllerID with de EIC identifier
 	edgeControllerID string
-	//AssetUninstall is a map of asset identifiers whose are pending to be uninstalled
-	assetUninstall map[string]entities.UninstallAgentRequest
-	// AssetUninstalled is a map of asset identifiers whose are uninstalled and they are pending to be sent to management cluster
-	assetUninstalled map[string] entities.UninstallAgentRequest
-
-	mngLoopTicker *time.Ticker
+	// stopLoop cancels the notifier loop if it is running.
+	stopLoop context.CancelFunc
+	// periodChanged signals the notifier loop that notifyPeriod has been modified.
+	periodChanged chan struct{}
+	// batchSize with the maximum number of outbox messages read at once.
+	batchSize int
+	// senders with the maximum number of concurrent calls to deliver the outbox.
+	senders int
+	// deliveryLock serializes the deliveries of the outbox without holding the notifier lock during network calls.
+	deliveryLock sync.Mutex
+	// connectivity with the tracker of the connectivity with the management cluster, nil if it is not tracked.
+	connectivity *proxy.ConnectivityTracker
+	// retryBackoff with the delay before delivering again the messages of an order key that failed.
+	retryBackoff utils.Backoff
+	// retries with the order keys whose last delivery failed. It is protected by deliveryLock.
+	retries map[string]*deliveryRetry
 }
 
 func NewNotifier(notifyPeriod time.Duration, provider asset.Provider, mngtClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient,
@@ -69,8 +105,11 @@ func NewNotifier(notifyPeriod time.Duration, provider asset.Provider, mngtClient
 		mngtClient: mngtClient,
 		organizationID: organizationID,
 		edgeControllerID: edgeControllerID,
-		assetUninstall: make (map[string]entities.UninstallAgentRequest,0),
-		assetUninstalled: make (map[string]entities.UninstallAgentRequest,0),
+		periodChanged: make(chan struct{}, 1),
+		batchSize: DefaultNotifyBatchSize,
+		senders: DefaultNotifySenders,
+		retryBackoff: DefaultRetryBackoff,
+		retries: make(map[string]*deliveryRetry, 0),
 	}
 }
 
@@ -94,172 +133,398 @@ func (n *Notifier) AgentAlive(assetID string, ip string) {
 }
 
 // LaunchNotifierLoop is intended to be launched as goroutine for periodically sending data back to the management cluster.
-func (n *Notifier) LaunchNotifierLoop() {
+// The loop finishes when the context is done or StopNotifierLoop is called.
+func (n *Notifier) LaunchNotifierLoop(ctx context.Context) {
 	log.Info().Msg("Launching Notifier Loop")
-	n.mngLoopTicker = time.NewTicker(n.notifyPeriod)
-	for range n.mngLoopTicker.C {
-		n.notifyManagementCluster()
+	loopCtx, cancel := context.WithCancel(ctx)
+	n.Lock()
+	n.stopLoop = cancel
+	n.Unlock()
+
+	var reconnected <-chan struct{}
+	if tracker := n.Connectivity(); tracker != nil {
+		reconnected = tracker.Reconnected()
 	}
-}
 
-func (n *Notifier) StopNotifierLoop() {
-	if n.mngLoopTicker != nil {
-		log.Info().Msg("Stopping Notifier Loop")
-		n.mngLoopTicker.Stop()
-		
+	ticker := time.NewTicker(n.getNotifyPeriod())
+	for {
+		select {
+		case <-ticker.C:
+			n.notifyManagementCluster(false)
+		case <-reconnected:
+			log.Info().Msg("management cluster reachable again, sending pending notifications")
+			n.notifyManagementCluster(false)
+		case <-n.periodChanged:
+			ticker.Stop()
+			ticker = time.NewTicker(n.getNotifyPeriod())
+		case <-loopCtx.Done():
+			ticker.Stop()
+			log.Info().Msg("Notifier Loop finished")
+			return
+		}
 	}
 }
 
-func (n * Notifier) sendAliveMessages() bool{
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
-	defer cancel()
-
-	messages := &grpc_inventory_manager_go.AgentsAlive{
-		OrganizationId: n.organizationID,
-		EdgeControllerId: n.edgeControllerID,
-		Agents: n.assetAlive,
-		AgentsIp: n.AssetNewIP,
+// SetNotifyPeriod changes the period between notifications. The ticker of a running loop is reset.
+func (n *Notifier) SetNotifyPeriod(notifyPeriod time.Duration) {
+	n.Lock()
+	n.notifyPeriod = notifyPeriod
+	n.Unlock()
+	log.Info().Str("duration", notifyPeriod.String()).Msg("Notify period changed")
+
+	select {
+	case n.periodChanged <- struct{}{}:
+	default:
+		// a change is already pending, the loop will read the new value
 	}
+}
 
-	_, err := n.mngtClient.LogAgentAlive(ctx, messages)
-	if err != nil{
-		log.Warn().Str("trace", conversions.ToDerror(err).DebugReport()).Msg("cannot send alive messages to management cluster")
-		return false
+// SetDeliveryLimits changes the number of outbox messages read at once and the number of concurrent calls to deliver
+// them. Values lower than 1 are ignored.
+func (n *Notifier) SetDeliveryLimits(batchSize int, senders int) {
+	n.Lock()
+	defer n.Unlock()
+	if batchSize > 0 {
+		n.batchSize = batchSize
 	}
+	if senders > 0 {
+		n.senders = senders
+	}
+}
 
-	return true
+// SetConnectivity sets the tracker of the connectivity with the management cluster. While it is offline, the messages
+// are kept in the outbox and they are sent at once when it is reachable again. It must be set before launching the
+// notifier loop.
+func (n *Notifier) SetConnectivity(tracker *proxy.ConnectivityTracker) {
+	n.Lock()
+	defer n.Unlock()
+	n.connectivity = tracker
 }
 
-// sendPendingResponses send the results of the last operations to the management cluster
-// if an error occurs, the response is stored again in pending responses
-func (n *Notifier) sendPendingResponses() {
-	// get pending responses from database.
-	pendingRes, err := n.provider.GetPendingOpResponses(true)
-	if err != nil {
-		log.Warn().Str("error", err.DebugReport()).Msg("error getting pending operation responses")
-		return
-	}
+// Connectivity returns the tracker of the connectivity with the management cluster, nil if it is not tracked.
+func (n *Notifier) Connectivity() *proxy.ConnectivityTracker {
+	n.Lock()
+	defer n.Unlock()
+	return n.connectivity
+}
 
-	for _, res := range pendingRes {
+func (n *Notifier) getDeliveryLimits() (int, int) {
+	n.Lock()
+	defer n.Unlock()
+	return n.batchSize, n.senders
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
-		_, err := n.mngtClient.CallbackAgentOperation(ctx, res.ToGRPC())
-		cancel()
+func (n *Notifier) getNotifyPeriod() time.Duration {
+	n.Lock()
+	defer n.Unlock()
+	return n.notifyPeriod
+}
 
-		if err != nil {
-			log.Warn().Str("assetID", res.AssetId).Str("operation_id", res.OperationId).Str("error", conversions.ToDerror(err).DebugReport()).
-				Msg("error sending agent response")
-			// store again in the pending op responses
-			errAdd := n.provider.AddOpResponse(res)
-			if errAdd != nil{
-				log.Warn().Str("assetID", res.AssetId).Str("operation_id", res.OperationId).Msg("storing the agent response")
-			}
-		}
+// StopNotifierLoop stops the notifier loop. Pending notifications are kept until Flush is called.
+func (n *Notifier) StopNotifierLoop() {
+	n.Lock()
+	defer n.Unlock()
+	if n.stopLoop != nil {
+		log.Info().Msg("Stopping Notifier Loop")
+		n.stopLoop()
+		n.stopLoop = nil
 	}
+}
 
+// Flush stores the alive messages in the outbox and tries to deliver all the pending notifications to the management
+// cluster, even the ones waiting for a retry. It is intended to be called on shutdown so the in-memory state is not lost.
+func (n *Notifier) Flush() {
+	log.Info().Msg("Flushing pending notifications")
+	n.notifyManagementCluster(true)
 }
 
-// sendPendingECResponses get all pending edge-controller responses and send them to management cluster
-func (n *Notifier) sendPendingECResponses() {
-	log.Debug().Msg("sending pending edge-controller responses")
-	// get pending EC responses from database.
-	pendingRes, err := n.provider.GetPendingECOpResponses(true)
+// enqueue adds a message to the outbox of the management cluster. Messages with an identifier are only added once.
+func (n *Notifier) enqueue(msgType entities.OutboxMessageType, id string, orderKey string, payload interface{}) derrors.Error {
+	msg, err := entities.NewOutboxMessage(msgType, id, orderKey, payload)
 	if err != nil {
-		log.Warn().Str("error", err.DebugReport()).Msg("error getting pending edge-controller operation responses")
+		return err
+	}
+	return n.provider.AddOutboxMessage(*msg)
+}
+
+// queueAliveMessages moves the alive messages received since the last notification to the outbox.
+func (n *Notifier) queueAliveMessages() {
+	if len(n.assetAlive) == 0 && len(n.AssetNewIP) == 0 {
+		return
+	}
+	err := n.enqueue(entities.AgentsAliveMessage, "", entities.AliveOrderKey, entities.AgentsAlive{
+		Agents:   n.assetAlive,
+		AgentsIp: n.AssetNewIP,
+	})
+	if err != nil {
+		// keep them in memory for the next notification
+		log.Warn().Str("trace", err.DebugReport()).Msg("cannot store alive messages")
 		return
 	}
+	n.assetAlive = make(map[string]int64, 0)
+	n.AssetNewIP = make(map[string]string, 0)
+}
 
-	log.Debug().Int("pending len", len(pendingRes)).Msg("pending responses")
+// deliverOutbox sends the messages of the outbox to the management cluster in batches of batchSize. The messages of
+// each batch are grouped by order key and the groups are sent by concurrent senders, each group in order. A message
+// is only removed once it has been delivered. If a message cannot be delivered, the following ones with the same
+// order key wait so they are not delivered out of order, and the order key is retried with backoff unless
+// ignoreBackoff is set. The delivery stops if the management cluster is unreachable.
+func (n *Notifier) deliverOutbox(ignoreBackoff bool) {
+	batchSize, senders := n.getDeliveryLimits()
+	blocked := make(map[string]bool, 0)
+	now := time.Now()
+	for key, retry := range n.retries {
+		// a key whose retry is overdue by more than the max backoff has no messages left in the outbox, as they
+		// may be evicted by the janitor without being delivered
+		if now.Sub(retry.next) > n.retryBackoff.Max {
+			delete(n.retries, key)
+			continue
+		}
+		if !ignoreBackoff && now.Before(retry.next) {
+			blocked[key] = true
+		}
+	}
+	var after uint64
+	for {
+		messages, err := n.provider.GetOutboxMessages(after, batchSize)
+		if err != nil {
+			log.Warn().Str("error", err.DebugReport()).Msg("error getting outbox messages")
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		log.Debug().Int("pending len", len(messages)).Msg("delivering outbox messages")
+		after = messages[len(messages)-1].Sequence
+
+		delivered, unreachable := n.deliverBatch(messages, blocked, senders)
+		if len(delivered) > 0 {
+			rErr := n.provider.RemoveOutboxMessages(delivered)
+			if rErr != nil {
+				log.Warn().Int("delivered", len(delivered)).Str("error", rErr.DebugReport()).Msg("cannot remove delivered messages from outbox")
+			}
+		}
+		if unreachable {
+			log.Debug().Msg("management cluster unreachable, delivery postponed")
+			return
+		}
+		if len(messages) < batchSize {
+			return
+		}
+	}
+}
 
-	for _, res := range pendingRes {
+// deliverBatch sends a batch of messages with up to senders concurrent calls and returns the identifiers of the
+// delivered ones, and whether the management cluster is unreachable. The order keys of the messages that cannot be
+// delivered are added to blocked.
+func (n *Notifier) deliverBatch(messages []entities.OutboxMessage, blocked map[string]bool, senders int) ([]string, bool) {
+	// group the messages by order key, keeping the order of the keys and the messages
+	keys := make([]string, 0)
+	groups := make(map[string][]entities.OutboxMessage, 0)
+	for _, msg := range messages {
+		if blocked[msg.OrderKey] {
+			continue
+		}
+		if _, exists := groups[msg.OrderKey]; !exists {
+			keys = append(keys, msg.OrderKey)
+		}
+		groups[msg.OrderKey] = append(groups[msg.OrderKey], msg)
+	}
+	if senders > len(keys) {
+		senders = len(keys)
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
-		_, err := n.mngtClient.CallbackECOperation(ctx, res.ToGRPC())
-		cancel()
+	// lock protects delivered, unreachable and blocked while the senders are running
+	var lock sync.Mutex
+	delivered := make([]string, 0, len(messages))
+	unreachable := false
+	isUnreachable := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return unreachable
+	}
 
-		if err != nil {
-			log.Warn().Str("operation_id", res.OperationId).Str("error", conversions.ToDerror(err).DebugReport()).
-				Msg("error sending Edge-controller response")
-			// store again in the pending op responses
-			errAdd := n.provider.AddECOpResponse(res)
-			if errAdd != nil{
-				log.Warn().Str("operation_id", res.OperationId).Msg("storing the edge-controller response")
+	pending := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range pending {
+				for _, msg := range groups[key] {
+					if isUnreachable() {
+						break
+					}
+					remove, stop := n.deliveryResult(msg, n.deliver(msg))
+					lock.Lock()
+					if remove {
+						delivered = append(delivered, msg.Id)
+						delete(n.retries, key)
+					} else if stop {
+						unreachable = true
+					} else {
+						blocked[key] = true
+						n.addRetry(key)
+					}
+					lock.Unlock()
+					if !remove {
+						break
+					}
+				}
 			}
+		}()
+	}
+	for _, key := range keys {
+		if isUnreachable() {
+			break
 		}
+		pending <- key
+	}
+	close(pending)
+	wg.Wait()
+
+	return delivered, unreachable
+}
+
+// addRetry registers a failed delivery of the messages of an order key and schedules the next one.
+func (n *Notifier) addRetry(key string) {
+	retry, exists := n.retries[key]
+	if !exists {
+		retry = &deliveryRetry{}
+		n.retries[key] = retry
 	}
+	retry.next = time.Now().Add(n.retryBackoff.Delay(retry.failures))
+	retry.failures++
+}
 
+// deliveryResult checks the result of a delivery and returns whether the message must be removed from the outbox,
+// and whether the management cluster is unreachable.
+func (n *Notifier) deliveryResult(msg entities.OutboxMessage, sendErr error) (bool, bool) {
+	if sendErr == nil {
+		return true, false
+	}
+	if proxy.IsCircuitOpen(sendErr) {
+		return false, true
+	}
+	if isRejected(sendErr) {
+		// the message cannot ever be delivered, drop it so it does not block the others
+		log.Error().Str("id", msg.Id).Str("type", string(msg.Type)).
+			Str("trace", conversions.ToDerror(sendErr).DebugReport()).Msg("dropping rejected outbox message")
+		return true, false
+	}
+	log.Warn().Str("id", msg.Id).Str("type", string(msg.Type)).Str("key", msg.OrderKey).
+		Str("error", conversions.ToDerror(sendErr).DebugReport()).Msg("cannot deliver message to management cluster")
+	return false, false
 }
 
-func (n *Notifier) sendPendingUninstallMessages() bool {
+// isRejected returns whether a message is rejected either locally because it cannot be decoded, or by the management
+// cluster because it is invalid, so sending it again would fail the same way. Other errors, such as a failed
+// precondition while the asset is not registered yet, may be transient so the message is retried.
+func isRejected(sendErr error) bool {
+	if invalid, ok := sendErr.(derrors.Error); ok {
+		return invalid.Type() == derrors.InvalidArgument
+	}
+	return status.Code(sendErr) == codes.InvalidArgument
+}
 
-	for _, msg := range n.assetUninstalled {
-		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+// deliver sends a message of the outbox through the call of the inventory proxy of its type. The messages that cannot
+// be decoded return an invalid argument error.
+func (n *Notifier) deliver(msg entities.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
 
-		_, err := n.mngtClient.AgentUninstalled(ctx, &grpc_inventory_go.AssetUninstalledId{
-			OrganizationId: msg.OrganizationId,
-			EdgeControllerId: msg.EdgeControllerId,
-			AssetId: msg.AssetId,
-			OperationId: msg.OperationId,
+	var err error
+	switch msg.Type {
+	case entities.AgentsAliveMessage:
+		alive := &entities.AgentsAlive{}
+		if pErr := msg.GetPayload(alive); pErr != nil {
+			return derrors.NewInvalidArgumentError(pErr.Error())
+		}
+		_, err = n.mngtClient.LogAgentAlive(ctx, &grpc_inventory_manager_go.AgentsAlive{
+			OrganizationId:   n.organizationID,
+			EdgeControllerId: n.edgeControllerID,
+			Agents:           alive.Agents,
+			AgentsIp:         alive.AgentsIp,
 		})
-		cancel()
-		if err != nil {
-			log.Warn().Str("trace", conversions.ToDerror(err).DebugReport()).Msg("cannot send agent uninstalled messages to management cluster")
-			return false
+	case entities.AgentStartMessage:
+		start := &entities.AgentStartInfo{}
+		if pErr := msg.GetPayload(start); pErr != nil {
+			return derrors.NewInvalidArgumentError(pErr.Error())
+		}
+		info := start.ToGRPC()
+		info.OrganizationId = n.organizationID
+		info.EdgeControllerId = n.edgeControllerID
+		_, err = n.mngtClient.AgentStart(ctx, info)
+	case entities.AgentUninstalledMessage:
+		uninstalled := &entities.UninstallAgentRequest{}
+		if pErr := msg.GetPayload(uninstalled); pErr != nil {
+			return derrors.NewInvalidArgumentError(pErr.Error())
+		}
+		_, err = n.mngtClient.AgentUninstalled(ctx, &grpc_inventory_go.AssetUninstalledId{
+			OrganizationId:   uninstalled.OrganizationId,
+			EdgeControllerId: uninstalled.EdgeControllerId,
+			AssetId:          uninstalled.AssetId,
+			OperationId:      uninstalled.OperationId,
+		})
+	case entities.AgentOpResponseMessage:
+		response := &entities.AgentOpResponse{}
+		if pErr := msg.GetPayload(response); pErr != nil {
+			return derrors.NewInvalidArgumentError(pErr.Error())
+		}
+		_, err = n.mngtClient.CallbackAgentOperation(ctx, response.ToGRPC())
+	case entities.ECOpResponseMessage:
+		response := &entities.EdgeControllerOpResponse{}
+		if pErr := msg.GetPayload(response); pErr != nil {
+			return derrors.NewInvalidArgumentError(pErr.Error())
 		}
+		_, err = n.mngtClient.CallbackECOperation(ctx, response.ToGRPC())
+	default:
+		return derrors.NewInvalidArgumentError("unknown outbox message type").WithParams(msg.Id, string(msg.Type))
 	}
-	return true
+	return err
 }
 
-// notifyManagementCluster compiles the list of notifications to be sent to the management cluster regarding assets
-// being online.
-func (n *Notifier) notifyManagementCluster() {
+// notifyManagementCluster stores the alive messages in the outbox and delivers the pending messages to the
+// management cluster unless it is offline.
+func (n *Notifier) notifyManagementCluster(ignoreBackoff bool) {
 	n.Lock()
-	defer n.Unlock()
-	if len(n.assetAlive) > 0{
-		// TODO Implement send
-		if n.sendAliveMessages(){
-			// If successfull, cleanup the map
-			for k := range n.assetAlive{
-				delete(n.assetAlive, k)
-			}
-			for ip := range  n.AssetNewIP {
-				delete (n.AssetNewIP, ip)
-			}
-		}
-	}
-	n.sendPendingResponses()
+	n.queueAliveMessages()
+	tracker := n.connectivity
+	n.Unlock()
 
-	// send installed message to management cluster
-	if n.sendPendingUninstallMessages(){
-		for k := range n.assetUninstalled {
-			delete(n.assetUninstalled, k)
-		}
+	if tracker != nil && tracker.IsOffline() {
+		log.Debug().Msg("management cluster offline, notifications kept in the outbox")
+		return
 	}
 
-	// send EcResponses messages to management cluster
-	n.sendPendingECResponses()
-
+	n.deliveryLock.Lock()
+	defer n.deliveryLock.Unlock()
+	n.deliverOutbox(ignoreBackoff)
 }
 
 func (n * Notifier) NotifyAgentStart(start * grpc_inventory_manager_go.AgentStartInfo) derrors.Error{
 	n.Lock()
 	defer n.Unlock()
-	err := n.provider.AddAgentStart(*entities.NewAgentStartInfoFromGRPC(start))
+	info := entities.NewAgentStartInfoFromGRPC(start)
+	err := n.provider.AddAgentStart(*info)
 	if err != nil{
 		return err
 	}
-	// TODO Implement send or queue
-	return nil
+	// the identifier includes the time of the start so the same start is queued once
+	id := fmt.Sprintf("%s/%s/%d", entities.AgentStartMessage, info.AssetId, info.Created)
+	return n.enqueue(entities.AgentStartMessage, id, info.AssetId, info)
 }
 
 func (n * Notifier) NotifyCallback(response * grpc_inventory_manager_go.AgentOpResponse) derrors.Error {
 	n.Lock()
 	defer n.Unlock()
-	err := n.provider.AddOpResponse(*entities.NewAgentOpResponseFromGRPC(response))
-	if err != nil{
-		return err
+	// the final status of an operation is queued once, each progress update is queued
+	id := ""
+	if isFinalStatus(response.Status) {
+		id = fmt.Sprintf("%s/%s/%s/%s", entities.AgentOpResponseMessage, response.AssetId, response.OperationId, response.Status.String())
 	}
-	return nil
+	return n.enqueue(entities.AgentOpResponseMessage, id, response.AssetId, entities.NewAgentOpResponseFromGRPC(response))
 }
 
 func (n *Notifier) UninstallAgent(assetID *grpc_inventory_manager_go.FullUninstallAgentRequest, opID string) derrors.Error {
@@ -269,11 +534,17 @@ func (n *Notifier) UninstallAgent(assetID *grpc_inventory_manager_go.FullUninsta
 
 	if assetID.Force{
 		// if the uninstalling is forced, the agent is deleted directly,
-		// the agent is been saved in assetUninstalled map
-		n.assetUninstalled[assetID.AssetId] = *entities.NewUninstallAgentRequestFromGRPC(assetID, opID)
+		// and the confirmation is sent to the management cluster
+		err := n.queueUninstalled(*entities.NewUninstallAgentRequestFromGRPC(assetID, opID))
+		if err != nil{
+			return err
+		}
 	}else {
-		// add the assetID in AssetUninstall map
-		n.assetUninstall[assetID.AssetId] = *entities.NewUninstallAgentRequestFromGRPC(assetID, opID)
+		// the uninstall waits for the agent to connect, it is stored so it survives a restart
+		err := n.provider.AddPendingUninstall(*entities.NewUninstallAgentRequestFromGRPC(assetID, opID))
+		if err != nil{
+			return err
+		}
 	}
 
 	// remove all the entries
@@ -286,26 +557,40 @@ func (n *Notifier) UninstallAgent(assetID *grpc_inventory_manager_go.FullUninsta
 
 // PendingInstall check if a message has been sent to uninstall this agent
 func (n *Notifier) PendingUnInstall(assetId string) (bool, entities.UninstallAgentRequest) {
-	n.Lock()
-	defer n.Unlock()
-
-	asset, exists := n.assetUninstall[assetId]
+	request, err := n.provider.GetPendingUninstall(assetId)
+	if err != nil{
+		log.Warn().Str("assetID", assetId).Str("trace", err.DebugReport()).Msg("cannot check pending uninstall")
+		return false, entities.UninstallAgentRequest{}
+	}
+	if request == nil{
+		return false, entities.UninstallAgentRequest{}
+	}
+	return true, *request
+}
 
-	return exists, asset
+// queueUninstalled stores the confirmation of an uninstalled agent in the outbox. The identifier of the message
+// includes the operation so the confirmation is queued once.
+func (n *Notifier) queueUninstalled(request entities.UninstallAgentRequest) derrors.Error {
+	id := fmt.Sprintf("%s/%s/%s", entities.AgentUninstalledMessage, request.AssetId, request.OperationId)
+	return n.enqueue(entities.AgentUninstalledMessage, id, request.AssetId, request)
 }
 
-// RemovePendingUninstall move a asset from assetUninstall to assetUninstalled
+// RemovePendingUninstall removes the pending uninstall of an asset and queues the confirmation for the management cluster
 func (n *Notifier) RemovePendingUninstall (assetId string) {
 
 	n.Lock()
 	defer n.Unlock()
 
-	asset, exists := n.assetUninstall[assetId]
-	if exists{
-		delete (n.assetUninstall, assetId)
-		n.assetUninstalled[assetId] = asset
+	asset, err := n.provider.RemovePendingUninstall(assetId)
+	if err != nil{
+		log.Error().Str("assetID", assetId).Str("trace", err.DebugReport()).Msg("cannot remove pending uninstall")
+	}else if asset != nil{
+		err := n.queueUninstalled(*asset)
+		if err != nil{
+			log.Error().Str("assetID", assetId).Str("trace", err.DebugReport()).Msg("cannot store agent uninstalled message")
+		}
 	}else{
-		log.Warn().Str("assetID", assetId).Msg("not found in assetUninstall map")
+		log.Warn().Str("assetID", assetId).Msg("no pending uninstall found")
 	}
 
 }
@@ -313,9 +598,15 @@ func (n *Notifier) RemovePendingUninstall (assetId string) {
 func (n *Notifier) NotifyECOpResponse(response * grpc_inventory_manager_go.EdgeControllerOpResponse) derrors.Error{
 	n.Lock()
 	defer n.Unlock()
-	err := n.provider.AddECOpResponse(*entities.NewEdgeControllerOpResponseFromGRPC(response))
-	if err != nil{
-		return err
+	// the final status of an operation is queued once, each progress update is queued
+	id := ""
+	if isFinalStatus(response.Status) {
+		id = fmt.Sprintf("%s/%s/%s/%s", entities.ECOpResponseMessage, response.EdgeControllerId, response.OperationId, response.Status.String())
 	}
-	return nil
+	return n.enqueue(entities.ECOpResponseMessage, id, response.OperationId, entities.NewEdgeControllerOpResponseFromGRPC(response))
+}
+
+// isFinalStatus returns whether an operation with the given status has finished.
+func isFinalStatus(opStatus grpc_inventory_go.OpStatus) bool {
+	return opStatus != grpc_inventory_go.OpStatus_SCHEDULED && opStatus != grpc_inventory_go.OpStatus_INPROGRESS
 }
\ No newline at end of file
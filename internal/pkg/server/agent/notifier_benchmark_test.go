@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/rs/zerolog"
+)
+
+// benchmarkResponses with the number of operation responses queued before each delivery.
+const benchmarkResponses = 10000
+
+// benchmarkAssets with the number of assets the responses are spread over.
+const benchmarkAssets = 500
+
+// benchmarkLatency with the simulated round trip of each call to the proxy.
+const benchmarkLatency = 100 * time.Microsecond
+
+// BenchmarkDeliverOutbox measures the delivery of 10k queued operation responses to a local fake proxy with
+// different numbers of concurrent senders.
+func BenchmarkDeliverOutbox(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer zerolog.SetGlobalLevel(level)
+	for _, senders := range []int{1, DefaultNotifySenders, 32} {
+		b.Run(fmt.Sprintf("senders=%d", senders), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				provider := asset.NewMockupAssetProvider()
+				client := newFakeProxyClient()
+				client.latency = benchmarkLatency
+				notifier := NewNotifier(time.Minute, provider, client, "org", "ec")
+				notifier.SetDeliveryLimits(DefaultNotifyBatchSize, senders)
+				for r := 0; r < benchmarkResponses; r++ {
+					err := notifier.NotifyCallback(&grpc_inventory_manager_go.AgentOpResponse{
+						OrganizationId:   "org",
+						EdgeControllerId: "ec",
+						AssetId:          fmt.Sprintf("asset-%d", r%benchmarkAssets),
+						OperationId:      fmt.Sprintf("op-%d", r),
+						Status:           grpc_inventory_go.OpStatus_SUCCESS,
+					})
+					if err != nil {
+						b.Fatal(err.DebugReport())
+					}
+				}
+				b.StartTimer()
+
+				notifier.notifyManagementCluster(false)
+
+				b.StopTimer()
+				if len(client.getCalls()) != benchmarkResponses {
+					b.Fatalf("expected %d calls, got %d", benchmarkResponses, len(client.getCalls()))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/proxy"
+	"github.com/nalej/edge-controller/internal/pkg/utils"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+)
+
+var _ = ginkgo.Describe("Notifier", func() {
+
+	var provider *asset.MockupAssetProvider
+	var client *fakeProxyClient
+	var notifier *Notifier
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		client = newFakeProxyClient()
+		notifier = NewNotifier(time.Minute, provider, client, "org", "ec")
+	})
+
+	callback := func(assetID string, operationID string) *grpc_inventory_manager_go.AgentOpResponse {
+		return &grpc_inventory_manager_go.AgentOpResponse{
+			OrganizationId:   "org",
+			EdgeControllerId: "ec",
+			AssetId:          assetID,
+			OperationId:      operationID,
+			Status:           grpc_inventory_go.OpStatus_SUCCESS,
+		}
+	}
+
+	ginkgo.It("should keep the messages in the outbox until they are delivered", func() {
+		gomega.Expect(notifier.NotifyCallback(callback("asset", "op1"))).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyECOpResponse(&grpc_inventory_manager_go.EdgeControllerOpResponse{OperationId: "ecop"})).To(gomega.Succeed())
+		client.setFailing("asset", true)
+		client.setFailing("ecop", true)
+
+		notifier.Flush()
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(2))
+
+		client.setFailing("asset", false)
+		client.setFailing("ecop", false)
+		notifier.Flush()
+		pending, err = provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.BeEmpty())
+		gomega.Expect(client.getCalls()).To(gomega.ConsistOf("CallbackAgentOperation:asset", "CallbackECOperation:ecop"))
+	})
+
+	ginkgo.It("should only keep the messages that cannot be delivered when delivering in batches", func() {
+		notifier.SetDeliveryLimits(2, 3)
+		for _, assetID := range []string{"asset1", "asset2", "asset3", "asset4", "asset5"} {
+			gomega.Expect(notifier.NotifyCallback(callback(assetID, "op-"+assetID))).To(gomega.Succeed())
+		}
+		gomega.Expect(notifier.NotifyCallback(callback("asset2", "op-asset2-2"))).To(gomega.Succeed())
+		client.setFailing("asset2", true)
+
+		notifier.Flush()
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(2))
+		for index, operationID := range []string{"op-asset2", "op-asset2-2"} {
+			response := &entities.AgentOpResponse{}
+			gomega.Expect(pending[index].GetPayload(response)).To(gomega.Succeed())
+			gomega.Expect(response.OperationId).To(gomega.Equal(operationID))
+		}
+		gomega.Expect(client.getCalls()).To(gomega.ConsistOf("CallbackAgentOperation:asset1",
+			"CallbackAgentOperation:asset3", "CallbackAgentOperation:asset4", "CallbackAgentOperation:asset5"))
+	})
+
+	ginkgo.It("should deliver the messages of an asset in order", func() {
+		gomega.Expect(notifier.NotifyCallback(callback("asset1", "op1"))).To(gomega.Succeed())
+		gomega.Expect(notifier.UninstallAgent(&grpc_inventory_manager_go.FullUninstallAgentRequest{
+			OrganizationId: "org", EdgeControllerId: "ec", AssetId: "asset1", Force: true}, "op2")).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyCallback(callback("asset2", "op3"))).To(gomega.Succeed())
+
+		// the uninstall of asset1 waits for its callback, asset2 is not blocked
+		client.setFailing("asset1", true)
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{"CallbackAgentOperation:asset2"}))
+
+		client.setFailing("asset1", false)
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{
+			"CallbackAgentOperation:asset2", "CallbackAgentOperation:asset1", "AgentUninstalled:asset1"}))
+	})
+
+	ginkgo.It("should queue the confirmation of an uninstall once", func() {
+		request := &grpc_inventory_manager_go.FullUninstallAgentRequest{
+			OrganizationId: "org", EdgeControllerId: "ec", AssetId: "asset", Force: true}
+		gomega.Expect(notifier.UninstallAgent(request, "op")).To(gomega.Succeed())
+		gomega.Expect(notifier.UninstallAgent(request, "op")).To(gomega.Succeed())
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should keep a pending uninstall after a restart", func() {
+		request := &grpc_inventory_manager_go.FullUninstallAgentRequest{
+			OrganizationId: "org", EdgeControllerId: "ec", AssetId: "asset"}
+		gomega.Expect(notifier.UninstallAgent(request, "op")).To(gomega.Succeed())
+
+		restarted := NewNotifier(time.Minute, provider, client, "org", "ec")
+		pending, uninstall := restarted.PendingUnInstall("asset")
+		gomega.Expect(pending).To(gomega.BeTrue())
+		gomega.Expect(uninstall.OperationId).To(gomega.Equal("op"))
+		restarted.RemovePendingUninstall("asset")
+		pending, _ = restarted.PendingUnInstall("asset")
+		gomega.Expect(pending).To(gomega.BeFalse())
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(messages).To(gomega.HaveLen(1))
+		gomega.Expect(messages[0].Type).To(gomega.Equal(entities.AgentUninstalledMessage))
+	})
+
+	ginkgo.It("should queue the final status of an operation once", func() {
+		gomega.Expect(notifier.NotifyCallback(callback("asset", "op"))).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyCallback(callback("asset", "op"))).To(gomega.Succeed())
+		ecResponse := &grpc_inventory_manager_go.EdgeControllerOpResponse{EdgeControllerId: "ec", OperationId: "ecop",
+			Status: grpc_inventory_go.OpStatus_SUCCESS}
+		gomega.Expect(notifier.NotifyECOpResponse(ecResponse)).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyECOpResponse(ecResponse)).To(gomega.Succeed())
+		start := &grpc_inventory_manager_go.AgentStartInfo{AssetId: "asset", Ip: "10.0.0.1"}
+		gomega.Expect(notifier.NotifyAgentStart(start)).To(gomega.Succeed())
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(3))
+	})
+
+	ginkgo.It("should queue every progress update of an operation", func() {
+		inProgress := callback("asset", "op")
+		inProgress.Status = grpc_inventory_go.OpStatus_INPROGRESS
+		gomega.Expect(notifier.NotifyCallback(inProgress)).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyCallback(inProgress)).To(gomega.Succeed())
+		for _, step := range []string{"connect", "copy agent"} {
+			gomega.Expect(notifier.NotifyECOpResponse(&grpc_inventory_manager_go.EdgeControllerOpResponse{EdgeControllerId: "ec",
+				OperationId: "ecop", Status: grpc_inventory_go.OpStatus_INPROGRESS, Info: step})).To(gomega.Succeed())
+		}
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(4))
+	})
+
+	ginkgo.It("should only drop the messages rejected as invalid by the management cluster", func() {
+		gomega.Expect(notifier.NotifyCallback(callback("asset1", "op1"))).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyCallback(callback("asset2", "op2"))).To(gomega.Succeed())
+		gomega.Expect(notifier.NotifyCallback(callback("asset3", "op3"))).To(gomega.Succeed())
+		client.setRejecting("asset1", codes.InvalidArgument)
+		client.setRejecting("asset2", codes.FailedPrecondition)
+		client.setFailing("asset3", true)
+
+		notifier.Flush()
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(2))
+		gomega.Expect(pending[0].OrderKey).To(gomega.Equal("asset2"))
+		gomega.Expect(pending[1].OrderKey).To(gomega.Equal("asset3"))
+	})
+
+	ginkgo.It("should retry with backoff the messages that cannot be delivered", func() {
+		notifier.retryBackoff = utils.Backoff{Initial: time.Hour, Max: time.Hour, Factor: 2}
+		gomega.Expect(notifier.NotifyCallback(callback("asset1", "op1"))).To(gomega.Succeed())
+		client.setFailing("asset1", true)
+		notifier.notifyManagementCluster(false)
+		gomega.Expect(notifier.NotifyCallback(callback("asset2", "op2"))).To(gomega.Succeed())
+
+		client.setFailing("asset1", false)
+		notifier.notifyManagementCluster(false)
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{"CallbackAgentOperation:asset2"}))
+
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{"CallbackAgentOperation:asset2", "CallbackAgentOperation:asset1"}))
+		gomega.Expect(notifier.retries).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should forget the retries of the order keys without messages", func() {
+		notifier.retryBackoff = utils.Backoff{Initial: time.Minute, Max: time.Hour, Factor: 2}
+		notifier.retries["evicted"] = &deliveryRetry{failures: 3, next: time.Now().Add(-2 * time.Hour)}
+		notifier.retries["waiting"] = &deliveryRetry{failures: 1, next: time.Now().Add(time.Minute)}
+
+		notifier.notifyManagementCluster(false)
+		gomega.Expect(notifier.retries).To(gomega.HaveLen(1))
+		gomega.Expect(notifier.retries).To(gomega.HaveKey("waiting"))
+	})
+
+	ginkgo.It("should store the alive messages in the outbox", func() {
+		notifier.AgentAlive("asset", "10.0.0.1")
+		client.setFailing("ec", true)
+		notifier.Flush()
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(1))
+		gomega.Expect(notifier.assetAlive).To(gomega.BeEmpty())
+
+		client.setFailing("ec", false)
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{"LogAgentAlive:ec"}))
+	})
+
+	ginkgo.It("should keep the messages in the outbox while the management cluster is offline", func() {
+		tracker := proxy.NewConnectivityTracker()
+		notifier.SetConnectivity(tracker)
+		gomega.Expect(notifier.NotifyCallback(callback("asset", "op1"))).To(gomega.Succeed())
+
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.BeEmpty())
+		pending, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(1))
+
+		tracker.Record(nil, proxy.CircuitClosed)
+		notifier.Flush()
+		gomega.Expect(client.getCalls()).To(gomega.Equal([]string{"CallbackAgentOperation:asset"}))
+	})
+})
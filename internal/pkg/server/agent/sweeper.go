@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultSweepPeriod with the period between checks of expired agent operations.
+const DefaultSweepPeriod = time.Minute
+
+const ExpiredQueuedResponseInfo = "Operation expired before being delivered to the agent"
+const ExpiredDeliveredResponseInfo = "Operation expired without a response from the agent"
+
+// OperationSweeper expires the agent operations whose deadline has passed, both the ones waiting in the queue and the
+// ones delivered to an agent that has not responded, and reports them as failed to the management cluster.
+type OperationSweeper struct {
+	provider asset.Provider
+	notifier *Notifier
+	period   time.Duration
+}
+
+func NewOperationSweeper(provider asset.Provider, notifier *Notifier, period time.Duration) *OperationSweeper {
+	return &OperationSweeper{
+		provider: provider,
+		notifier: notifier,
+		period:   period,
+	}
+}
+
+// LaunchSweeperLoop is intended to be launched as goroutine to expire the operations periodically until the context
+// is done.
+func (s *OperationSweeper) LaunchSweeperLoop(ctx context.Context) {
+	log.Info().Str("period", s.period.String()).Msg("Launching operation sweeper loop")
+	ticker := time.NewTicker(s.period)
+	for {
+		select {
+		case <-ticker.C:
+			s.Sweep()
+		case <-ctx.Done():
+			ticker.Stop()
+			log.Info().Msg("Operation sweeper loop finished")
+			return
+		}
+	}
+}
+
+// Sweep removes the expired operations and sends a failed response for each of them.
+func (s *OperationSweeper) Sweep() {
+	queued, delivered, err := s.provider.RemoveExpiredOperations(time.Now().Unix())
+	if err != nil {
+		log.Error().Str("trace", err.DebugReport()).Msg("cannot remove expired agent operations")
+		return
+	}
+	if len(queued) == 0 && len(delivered) == 0 {
+		return
+	}
+	log.Warn().Int("queued", len(queued)).Int("delivered", len(delivered)).Msg("agent operations expired")
+	s.notifyExpired(queued, ExpiredQueuedResponseInfo)
+	s.notifyExpired(delivered, ExpiredDeliveredResponseInfo)
+}
+
+func (s *OperationSweeper) notifyExpired(ops []entities.AgentOpRequest, info string) {
+	for _, op := range ops {
+		if op.Canceled {
+			// the cancellation has already been reported
+			continue
+		}
+		err := s.notifier.NotifyCallback(&grpc_inventory_manager_go.AgentOpResponse{
+			OrganizationId:   op.OrganizationId,
+			EdgeControllerId: op.EdgeControllerId,
+			AssetId:          op.AssetId,
+			OperationId:      op.OperationId,
+			Timestamp:        time.Now().Unix(),
+			Status:           grpc_inventory_go.OpStatus_FAIL,
+			Info:             info,
+		})
+		if err != nil {
+			log.Error().Str("trace", err.DebugReport()).Str("asset_id", op.AssetId).
+				Str("operation_id", op.OperationId).Msg("cannot add expired operation response")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Operation sweeper", func() {
+
+	var provider *asset.MockupAssetProvider
+	var sweeper *OperationSweeper
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		notifier := NewNotifier(time.Minute, provider, newFakeProxyClient(), "org", "ec")
+		sweeper = NewOperationSweeper(provider, notifier, time.Minute)
+		gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{AssetId: "asset", Token: "token"})).To(gomega.Succeed())
+	})
+
+	addOperation := func(operationID string, deadline int64) {
+		_, err := provider.AddPendingOperation(entities.AgentOpRequest{
+			AssetId: "asset", OperationId: operationID, Deadline: deadline}, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+	}
+
+	ginkgo.It("should report the expired operations as failed", func() {
+		past := time.Now().Add(-time.Minute).Unix()
+		addOperation("delivered", past)
+		_, _, err := provider.TakePendingOperations("asset", time.Now().Unix(), asset.DeliveryPolicy{Limit: 1})
+		gomega.Expect(err).To(gomega.Succeed())
+		addOperation("queued", past)
+		addOperation("valid", time.Now().Add(time.Hour).Unix())
+
+		sweeper.Sweep()
+
+		pending, err := provider.GetPendingOperations("asset", false)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(1))
+		gomega.Expect(pending[0].OperationId).To(gomega.Equal("valid"))
+
+		messages, err := provider.GetOutboxMessages(0, 0)
+		gomega.Expect(err).To(gomega.Succeed())
+		infos := make(map[string]string, 0)
+		for _, msg := range messages {
+			response := &entities.AgentOpResponse{}
+			gomega.Expect(msg.GetPayload(response)).To(gomega.Succeed())
+			gomega.Expect(response.Status).To(gomega.Equal("FAIL"))
+			infos[response.OperationId] = response.Info
+		}
+		gomega.Expect(infos).To(gomega.Equal(map[string]string{
+			"queued":    ExpiredQueuedResponseInfo,
+			"delivered": ExpiredDeliveredResponseInfo,
+		}))
+	})
+})
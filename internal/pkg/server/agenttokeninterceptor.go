@@ -17,26 +17,104 @@
 package server
 
 import (
+	"context"
+	"crypto/x509"
 	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
 	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 )
 
+// tokenKind with the kind of token a method of the agent server can be called with.
+type tokenKind int
+
+const (
+	// joinToken is used by the agents that are not managed yet.
+	joinToken tokenKind = iota
+	// agentToken is used by the managed agents, on behalf of their asset.
+	agentToken
+)
+
+// agentMethods with the methods of the agent server and the token they can be called with.
+var agentMethods = map[string]tokenKind{
+	"/edge_controller.Agent/AgentJoin": joinToken,
+	"/edge_controller.Agent/AgentStart": agentToken,
+	"/edge_controller.Agent/AgentCheck": agentToken,
+	"/edge_controller.Agent/CallbackAgentOperation": agentToken,
+}
+
+// certificateBootstrapMethods with the methods an agent can call without a client certificate under the required
+// policy until it installs its first one, and whether the request must respond to one of its certificate operations.
+var certificateBootstrapMethods = map[string]bool{
+	"/edge_controller.Agent/AgentCheck": false,
+	"/edge_controller.Agent/CallbackAgentOperation": true,
+}
+
+// assetRequest is implemented by the requests sent by an agent on behalf of an asset.
+type assetRequest interface {
+	GetAssetId() string
+}
+
+// operationResponse is implemented by the responses of an agent to an operation.
+type operationResponse interface {
+	GetOperationId() string
+}
+
 type AgentTokenInterceptor struct {
 	tokenProvider asset.Provider
+	// clientCerts with the policy for the client certificates of the agents.
+	clientCerts string
 }
 
-func NewAgentTokenInterceptor (provider asset.Provider) *AgentTokenInterceptor {
+func NewAgentTokenInterceptor (provider asset.Provider, clientCerts string) *AgentTokenInterceptor {
 	return &AgentTokenInterceptor{
 		tokenProvider: provider,
+		clientCerts: clientCerts,
 	}
 }
 
-func (at *AgentTokenInterceptor) Connect() derrors.Error {
-	return nil
+// UnaryInterceptor returns the interceptor that authenticates the requests of the agents.
+func (at *AgentTokenInterceptor) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := at.authenticate(ctx, info.FullMethod, req); err != nil {
+			return nil, conversions.ToGRPCError(err)
+		}
+		return handler(ctx, req)
+	}
 }
 
+// authenticate checks that the request carries the kind of token of the method. Join tokens can only be used to join,
+// and agent tokens can only be used on behalf of their own asset.
+func (at *AgentTokenInterceptor) authenticate(ctx context.Context, method string, req interface{}) derrors.Error {
+	kind, exists := agentMethods[method]
+	if !exists {
+		return derrors.NewPermissionDeniedError("unauthorized method").WithParams(method)
+	}
+	token := agent.TokenFromContext(ctx)
+	if token == "" {
+		return derrors.NewUnauthenticatedError("token not found")
+	}
+	if kind == joinToken {
+		return at.validJoinToken(token)
+	}
+
+	joined, err := at.validAgentToken(token)
+	if err != nil {
+		return derrors.NewUnauthenticatedError("invalid token", err)
+	}
+	if cErr := at.validCertificate(ctx, method, req, joined); cErr != nil {
+		return cErr
+	}
+	return validAsset(req, joined)
+}
 
-// validJoinToken
+// validJoinToken checks that the join token has not expired, has not been revoked and can be used by another agent.
 func (at *AgentTokenInterceptor) validJoinToken(token string)  derrors.Error {
 
 	check, err := at.tokenProvider.CheckJoinToken(token)
@@ -50,26 +128,86 @@ func (at *AgentTokenInterceptor) validJoinToken(token string)  derrors.Error {
 	return nil
 }
 
-// validAgentToken checks if the token
-func (at *AgentTokenInterceptor) validAgentToken(token string) derrors.Error {
+// validAgentToken returns the managed asset of the token, or of its previous token during the grace period of a
+// rotation. Revoked tokens are rejected.
+func (at *AgentTokenInterceptor) validAgentToken(token string) (*entities.AgentJoinInfo, derrors.Error) {
+	return at.tokenProvider.GetAssetByToken(token)
+}
 
-	_, err := at.tokenProvider.GetAssetByToken(token)
-	if err != nil {
-		return  err
+// validCertificate checks that the client certificate of the connection is one issued to the asset that has not been
+// replaced. The agents receive their certificate after joining, so with the required policy an agent without one can
+// only call the methods to receive it.
+func (at *AgentTokenInterceptor) validCertificate(ctx context.Context, method string, req interface{}, joined *entities.AgentJoinInfo) derrors.Error {
+	if at.clientCerts == config.ClientCertsDisabled {
+		return nil
+	}
+	certificate := peerCertificate(ctx)
+	if certificate == nil {
+		if at.clientCerts != config.ClientCertsRequired {
+			return nil
+		}
+		if joined.HasCertificate() {
+			return derrors.NewUnauthenticatedError("client certificate required").WithParams(joined.AssetId)
+		}
+		return at.certificateBootstrap(method, req, joined)
+	}
+	assetID := pki.AssetID(certificate)
+	if assetID != joined.AssetId {
+		return derrors.NewPermissionDeniedError("client certificate does not belong to the asset").WithParams(joined.AssetId, assetID)
+	}
+	if !joined.ValidCertificate(pki.Serial(certificate)) {
+		return derrors.NewUnauthenticatedError("client certificate revoked").WithParams(joined.AssetId, pki.Serial(certificate))
 	}
-
 	return nil
 }
 
-// IsValid First check if the token is valid ( First check if the token is a valid agent token, if not check if it is a valid join token)
-func (at *AgentTokenInterceptor) IsValid (tokenInfo string) derrors.Error {
-
-	// check if is a valid agent token
-	err := at.validAgentToken(tokenInfo)
-	// if not check if it is a valid join token
+// certificateBootstrap checks that an agent without a client certificate only checks its operations and responds to
+// the operations of its certificate.
+func (at *AgentTokenInterceptor) certificateBootstrap(method string, req interface{}, joined *entities.AgentJoinInfo) derrors.Error {
+	respondsCertificate, allowed := certificateBootstrapMethods[method]
+	if !allowed {
+		return derrors.NewUnauthenticatedError("client certificate required").WithParams(joined.AssetId)
+	}
+	if !respondsCertificate {
+		return nil
+	}
+	response, ok := req.(operationResponse)
+	if !ok {
+		return derrors.NewPermissionDeniedError("the request does not identify the operation").WithParams(joined.AssetId)
+	}
+	delivered, err := at.tokenProvider.GetDeliveredOperations(joined.AssetId)
 	if err != nil {
-		return at.validJoinToken(tokenInfo)
+		return err
+	}
+	for _, op := range delivered {
+		if op.OperationId == response.GetOperationId() && agent.IsCertificateOperation(&op) {
+			return nil
+		}
+	}
+	return derrors.NewUnauthenticatedError("client certificate required").WithParams(joined.AssetId, response.GetOperationId())
+}
+
+// peerCertificate returns the verified client certificate of the connection, or nil if the client did not send it.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
 
+// validAsset checks that the request is sent on behalf of the asset of the token.
+func validAsset(req interface{}, joined *entities.AgentJoinInfo) derrors.Error {
+	request, ok := req.(assetRequest)
+	if !ok {
+		return derrors.NewPermissionDeniedError("the request does not identify the asset").WithParams(joined.AssetId)
+	}
+	if request.GetAssetId() != joined.AssetId {
+		return derrors.NewPermissionDeniedError("the token does not belong to the asset").WithParams(joined.AssetId, request.GetAssetId())
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
+	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const agentJoinMethod = "/edge_controller.Agent/AgentJoin"
+const agentCheckMethod = "/edge_controller.Agent/AgentCheck"
+const agentStartMethod = "/edge_controller.Agent/AgentStart"
+const callbackMethod = "/edge_controller.Agent/CallbackAgentOperation"
+
+// newAuthority creates a certificate authority from a self-signed certificate.
+func newAuthority() *pki.Authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "edge-controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	gomega.Expect(err).To(gomega.Succeed())
+	authority, aErr := pki.NewAuthority(
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), time.Hour)
+	gomega.Expect(aErr).To(gomega.Succeed())
+	return authority
+}
+
+// sign returns a certificate for an asset from a certificate request as the agents send it.
+func sign(authority *pki.Authority, assetID string) *pki.IssuedCertificate {
+	request, _, err := pki.NewCertificateRequest(assetID)
+	gomega.Expect(err).To(gomega.Succeed())
+	issued, err := authority.Sign(assetID, request)
+	gomega.Expect(err).To(gomega.Succeed())
+	return issued
+}
+
+// requestContext returns the context of a request with a token and the client certificate of the connection.
+func requestContext(token string, certificate *pki.IssuedCertificate) context.Context {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(agent.TokenHeader, token))
+	if certificate == nil {
+		return ctx
+	}
+	block, _ := pem.Decode([]byte(certificate.Certificate))
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	gomega.Expect(err).To(gomega.Succeed())
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{parsed}}}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+var _ = ginkgo.Describe("Agent token interceptor", func() {
+
+	var provider *asset.MockupAssetProvider
+	var authority *pki.Authority
+	var certificates map[string]*pki.IssuedCertificate
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		authority = newAuthority()
+		certificates = make(map[string]*pki.IssuedCertificate, 0)
+		for _, assetID := range []string{"asset", "other"} {
+			issued := sign(authority, assetID)
+			certificates[assetID] = issued
+			gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{
+				AssetId: assetID, Token: assetID + "-token",
+				Certificate: entities.AgentCertificate{Serial: issued.Serial, Installed: true}})).To(gomega.Succeed())
+		}
+		_, err := provider.AddJoinToken("join", asset.JoinTokenOptions{})
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	authenticate := func(policy string, ctx context.Context) derrors.Error {
+		request := &grpc_edge_controller_go.AgentCheckRequest{AssetId: "asset"}
+		return NewAgentTokenInterceptor(provider, policy).authenticate(ctx, agentCheckMethod, request)
+	}
+
+	ginkgo.It("should accept an agent with its token and its certificate", func() {
+		ctx := requestContext("asset-token", certificates["asset"])
+		gomega.Expect(authenticate(config.ClientCertsRequired, ctx)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should reject the certificate of another asset", func() {
+		ctx := requestContext("asset-token", certificates["other"])
+		err := authenticate(config.ClientCertsOptional, ctx)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.PermissionDenied))
+	})
+
+	ginkgo.It("should reject a certificate that is not the last one issued to the asset", func() {
+		issued := sign(authority, "asset")
+		rejected := authenticate(config.ClientCertsOptional, requestContext("asset-token", issued))
+		gomega.Expect(rejected).To(gomega.HaveOccurred())
+		gomega.Expect(rejected.Type()).To(gomega.Equal(derrors.Unauthenticated))
+	})
+
+	ginkgo.It("should reject the certificate of a removed asset", func() {
+		gomega.Expect(provider.RemoveManagedAsset("asset")).To(gomega.Succeed())
+		ctx := requestContext("asset-token", certificates["asset"])
+		gomega.Expect(authenticate(config.ClientCertsRequired, ctx)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should require the certificate only with the required policy", func() {
+		ctx := requestContext("asset-token", nil)
+		gomega.Expect(authenticate(config.ClientCertsOptional, ctx)).To(gomega.Succeed())
+		err := authenticate(config.ClientCertsRequired, ctx)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.Unauthenticated))
+	})
+
+	ginkgo.It("should accept an agent without certificate until it installs one", func() {
+		gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{AssetId: "new", Token: "new-token"})).To(gomega.Succeed())
+		ctx := requestContext("new-token", nil)
+		request := &grpc_edge_controller_go.AgentCheckRequest{AssetId: "new"}
+		interceptor := NewAgentTokenInterceptor(provider, config.ClientCertsRequired)
+		gomega.Expect(interceptor.authenticate(ctx, agentCheckMethod, request)).To(gomega.Succeed())
+
+		issued := sign(authority, "new")
+		gomega.Expect(provider.SetAssetCertificate("new", issued.Serial, issued.Expires)).To(gomega.Succeed())
+		gomega.Expect(interceptor.authenticate(ctx, agentCheckMethod, request)).To(gomega.Succeed())
+		gomega.Expect(provider.InstallAssetCertificate("new", issued.Serial)).To(gomega.Succeed())
+		gomega.Expect(interceptor.authenticate(ctx, agentCheckMethod, request)).ToNot(gomega.Succeed())
+		gomega.Expect(interceptor.authenticate(requestContext("new-token", issued), agentCheckMethod, request)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should only accept the certificate operations of an agent without certificate", func() {
+		gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{AssetId: "new", Token: "new-token"})).To(gomega.Succeed())
+		for _, op := range []entities.AgentOpRequest{
+			{AssetId: "new", OperationId: "certificate", Plugin: agent.CorePluging, Operation: agent.RequestCertificateOp},
+			{AssetId: "new", OperationId: "other", Plugin: "metrics", Operation: "collect"},
+		} {
+			_, err := provider.AddPendingOperation(op, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+		}
+		_, _, err := provider.TakePendingOperations("new", time.Now().Unix(), asset.DeliveryPolicy{})
+		gomega.Expect(err).To(gomega.Succeed())
+
+		ctx := requestContext("new-token", nil)
+		interceptor := NewAgentTokenInterceptor(provider, config.ClientCertsRequired)
+		callback := func(operationID string) derrors.Error {
+			request := &grpc_inventory_manager_go.AgentOpResponse{AssetId: "new", OperationId: operationID}
+			return interceptor.authenticate(ctx, callbackMethod, request)
+		}
+		gomega.Expect(callback("certificate")).To(gomega.Succeed())
+		gomega.Expect(callback("other")).ToNot(gomega.Succeed())
+		start := &grpc_inventory_manager_go.AgentStartInfo{AssetId: "new"}
+		gomega.Expect(interceptor.authenticate(ctx, agentStartMethod, start)).ToNot(gomega.Succeed())
+		gomega.Expect(NewAgentTokenInterceptor(provider, config.ClientCertsOptional).authenticate(ctx, agentStartMethod, start)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept the previous certificate until the renewed one is installed", func() {
+		renewed := sign(authority, "asset")
+		gomega.Expect(provider.SetAssetCertificate("asset", renewed.Serial, renewed.Expires)).To(gomega.Succeed())
+		previous := requestContext("asset-token", certificates["asset"])
+		gomega.Expect(authenticate(config.ClientCertsRequired, previous)).To(gomega.Succeed())
+		gomega.Expect(authenticate(config.ClientCertsRequired, requestContext("asset-token", renewed))).To(gomega.Succeed())
+
+		gomega.Expect(provider.InstallAssetCertificate("asset", renewed.Serial)).To(gomega.Succeed())
+		gomega.Expect(authenticate(config.ClientCertsRequired, previous)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept a join token without certificate", func() {
+		interceptor := NewAgentTokenInterceptor(provider, config.ClientCertsRequired)
+		request := &grpc_edge_controller_go.AgentJoinRequest{AgentId: "agent"}
+		gomega.Expect(interceptor.authenticate(requestContext("join", nil), agentJoinMethod, request)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should ignore the certificates when they are disabled", func() {
+		ctx := requestContext("asset-token", certificates["other"])
+		gomega.Expect(authenticate(config.ClientCertsDisabled, ctx)).To(gomega.Succeed())
+	})
+
+	ginkgo.Context("per method authorization", func() {
+		var interceptor *AgentTokenInterceptor
+
+		ginkgo.BeforeEach(func() {
+			interceptor = NewAgentTokenInterceptor(provider, config.ClientCertsDisabled)
+		})
+
+		// call returns the type of the error of a request, or an empty string if it is authorized.
+		call := func(token string, method string, request interface{}) derrors.ErrorType {
+			err := interceptor.authenticate(requestContext(token, nil), method, request)
+			if err != nil {
+				return err.Type()
+			}
+			return ""
+		}
+
+		ginkgo.It("should allow an agent to call the methods on behalf of its asset", func() {
+			gomega.Expect(call("asset-token", agentCheckMethod, &grpc_edge_controller_go.AgentCheckRequest{AssetId: "asset"})).To(gomega.BeEmpty())
+			gomega.Expect(call("asset-token", callbackMethod, &grpc_inventory_manager_go.AgentOpResponse{AssetId: "asset"})).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reject a join token for the methods of the managed agents", func() {
+			gomega.Expect(call("join", agentCheckMethod, &grpc_edge_controller_go.AgentCheckRequest{AssetId: "asset"})).To(gomega.Equal(derrors.Unauthenticated))
+			gomega.Expect(call("join", callbackMethod, &grpc_inventory_manager_go.AgentOpResponse{AssetId: "asset"})).To(gomega.Equal(derrors.Unauthenticated))
+		})
+
+		ginkgo.It("should reject an agent token to join", func() {
+			gomega.Expect(call("asset-token", agentJoinMethod, &grpc_edge_controller_go.AgentJoinRequest{AgentId: "agent"})).ToNot(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reject an agent checking the operations of another asset", func() {
+			gomega.Expect(call("asset-token", agentCheckMethod, &grpc_edge_controller_go.AgentCheckRequest{AssetId: "other"})).To(gomega.Equal(derrors.PermissionDenied))
+		})
+
+		ginkgo.It("should reject an agent answering the operations of another asset", func() {
+			gomega.Expect(call("asset-token", callbackMethod, &grpc_inventory_manager_go.AgentOpResponse{AssetId: "other"})).To(gomega.Equal(derrors.PermissionDenied))
+		})
+
+		ginkgo.It("should allow an agent to notify the start of its asset", func() {
+			gomega.Expect(call("asset-token", agentStartMethod, &grpc_inventory_manager_go.AgentStartInfo{AssetId: "asset"})).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should reject an agent notifying the start of another asset", func() {
+			gomega.Expect(call("asset-token", agentStartMethod, &grpc_inventory_manager_go.AgentStartInfo{AssetId: "other"})).To(gomega.Equal(derrors.PermissionDenied))
+			gomega.Expect(call("join", agentStartMethod, &grpc_inventory_manager_go.AgentStartInfo{AssetId: "asset"})).To(gomega.Equal(derrors.Unauthenticated))
+		})
+
+		ginkgo.It("should reject the methods not called by the agents", func() {
+			gomega.Expect(call("asset-token", "/edge_controller.Agent/Unknown", &grpc_edge_controller_go.AgentCheckRequest{AssetId: "asset"})).To(gomega.Equal(derrors.PermissionDenied))
+		})
+
+		ginkgo.It("should not handle a rejected request", func() {
+			handled := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				handled = true
+				return nil, nil
+			}
+			request := &grpc_edge_controller_go.AgentCheckRequest{AssetId: "other"}
+			_, err := interceptor.UnaryInterceptor()(requestContext("asset-token", nil), request, &grpc.UnaryServerInfo{FullMethod: agentCheckMethod}, handler)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(handled).To(gomega.BeFalse())
+
+			request.AssetId = "asset"
+			_, err = interceptor.UnaryInterceptor()(requestContext("asset-token", nil), request, &grpc.UnaryServerInfo{FullMethod: agentCheckMethod}, handler)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(handled).To(gomega.BeTrue())
+		})
+	})
+})
@@ -0,0 +1,262 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bootstrap contains the steps required to link the edge controller with the management cluster. The
+// progress is persisted so a restart resumes from the last completed step. This avoids creating a new VPN user
+// each time the service is restarted in the middle of the process.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/utils"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+)
+
+// JoinOperations with the operations required to link the edge controller. It is implemented by helper.JoinHelper
+// and it is defined as an interface so the steps can be tested without executing the shell commands.
+type JoinOperations interface {
+	// NeedJoin returns true if there are no credentials stored.
+	NeedJoin() (bool, error)
+	// Join sends the join request to the management cluster.
+	Join(name string, labels string, geolocation string) (*grpc_inventory_manager_go.EICJoinResponse, error)
+	// SaveCredentials stores the join response in the credentials file.
+	SaveCredentials(edge grpc_inventory_manager_go.EICJoinResponse) error
+	// LoadCredentials reads the join response from the credentials file.
+	LoadCredentials() (*grpc_inventory_manager_go.EICJoinResponse, error)
+	// ConfigureDNS adds the platform DNS to the resolver.
+	ConfigureDNS() error
+	// ConfigureLocalVPN creates and connects the VPN account.
+	ConfigureLocalVPN(credentials *grpc_inventory_manager_go.VPNCredentials) error
+	// GetIP enables IP forwarding and requests an address for the VPN interface.
+	GetIP() error
+	// ExecuteDhClient requests an address for the VPN interface.
+	ExecuteDhClient() error
+	// GetVPNAddress returns the address of the VPN interface.
+	GetVPNAddress() (*string, error)
+}
+
+// EICStartFunc notifies the management cluster that the edge controller is running with the given VPN address.
+type EICStartFunc func(ip string) error
+
+// step of the bootstrap process.
+type step struct {
+	// name of the step for logging purposes.
+	name string
+	// target state reached when the step succeeds.
+	target State
+	// run executes the step.
+	run func() error
+}
+
+// Bootstrap drives the edge controller through the bootstrap states.
+type Bootstrap struct {
+	config    config.Config
+	ops       JoinOperations
+	statePath string
+	backoff   utils.Backoff
+	status    Status
+	// credentials with the join response once it has been received or loaded.
+	credentials *grpc_inventory_manager_go.EICJoinResponse
+}
+
+// NewBootstrap creates a Bootstrap that persists its state in statePath and retries failed steps using backoff.
+func NewBootstrap(cfg config.Config, ops JoinOperations, statePath string, backoff utils.Backoff) *Bootstrap {
+	return &Bootstrap{
+		config:    cfg,
+		ops:       ops,
+		statePath: statePath,
+		backoff:   backoff,
+	}
+}
+
+// State returns the last completed state.
+func (b *Bootstrap) State() State {
+	return b.status.State
+}
+
+// Prepare executes the pending steps until the edge controller has an address in the VPN and returns the
+// credentials obtained in the join. Steps are retried until they succeed, so an error is only returned if the
+// context is done before.
+func (b *Bootstrap) Prepare(ctx context.Context) (*grpc_inventory_manager_go.EICJoinResponse, derrors.Error) {
+	err := b.retry(ctx, "load state", b.loadStatus)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("state", b.status.State.String()).Msg("resuming bootstrap")
+
+	steps := []step{
+		{name: "join", target: Joined, run: b.join},
+		{name: "save credentials", target: CredentialsSaved, run: b.saveCredentials},
+		{name: "configure DNS", target: DNSConfigured, run: b.ops.ConfigureDNS},
+		{name: "configure VPN", target: VPNConfigured, run: b.configureVPN},
+		{name: "acquire IP", target: IPAcquired, run: b.ops.GetIP},
+	}
+	for _, s := range steps {
+		if b.status.State >= s.target {
+			continue
+		}
+		err = b.execute(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = b.retry(ctx, "load credentials", b.loadCredentials)
+	if err != nil {
+		return nil, err
+	}
+	return b.credentials, nil
+}
+
+// Start requests an address for the VPN interface and notifies the management cluster using start. It is executed
+// on each run of the edge controller, after Prepare.
+func (b *Bootstrap) Start(ctx context.Context, start EICStartFunc) derrors.Error {
+	var ip string
+	err := b.retry(ctx, "get VPN address", func() error {
+		err := b.ops.ExecuteDhClient()
+		if err != nil {
+			return err
+		}
+		address, err := b.ops.GetVPNAddress()
+		if err != nil {
+			return err
+		}
+		ip = *address
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Str("ip", ip).Msg("VPN address")
+
+	return b.execute(ctx, step{name: "start EIC", target: EICStarted, run: func() error {
+		return start(ip)
+	}})
+}
+
+// execute runs a step until it succeeds and persists the new state.
+func (b *Bootstrap) execute(ctx context.Context, s step) derrors.Error {
+	log.Info().Str("step", s.name).Msg("executing bootstrap step")
+	err := b.retry(ctx, s.name, s.run)
+	if err != nil {
+		return err
+	}
+	b.status.State = s.target
+	return b.retry(ctx, "save state", func() error {
+		return saveStatus(b.statePath, b.status)
+	})
+}
+
+// retry executes an operation until it succeeds or the context is done.
+func (b *Bootstrap) retry(ctx context.Context, name string, operation func() error) derrors.Error {
+	for retry := 0; ; retry++ {
+		if ctx.Err() != nil {
+			return derrors.AsError(ctx.Err(), fmt.Sprintf("bootstrap interrupted in step %s", name))
+		}
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		log.Warn().Str("step", name).Int("retry", retry).Str("error", conversions.ToDerror(err).DebugReport()).
+			Str("next", b.backoff.Delay(retry).String()).Msg("bootstrap step failed")
+		if !b.backoff.Wait(ctx, retry) {
+			return derrors.AsError(ctx.Err(), fmt.Sprintf("bootstrap interrupted in step %s", name))
+		}
+	}
+}
+
+// loadStatus reads the persisted state. Edge controllers linked before the state was persisted only have the
+// credentials file, in that case the linking steps are considered done.
+func (b *Bootstrap) loadStatus() error {
+	status, found, err := loadStatus(b.statePath)
+	if err != nil {
+		return err
+	}
+	needJoin, jErr := b.ops.NeedJoin()
+	if jErr != nil {
+		return jErr
+	}
+
+	if !found {
+		if needJoin {
+			b.status = Status{State: NotJoined}
+		} else {
+			log.Info().Msg("credentials found without bootstrap state, skipping the join steps")
+			b.status = Status{State: IPAcquired}
+		}
+		return nil
+	}
+
+	switch {
+	case status.State == Joined && status.JoinResponse == nil:
+		log.Warn().Msg("join response not found in bootstrap state, joining again")
+		status = &Status{State: NotJoined}
+	case status.State >= CredentialsSaved && needJoin:
+		log.Warn().Str("state", status.State.String()).Msg("credentials file not found, joining again")
+		status = &Status{State: NotJoined}
+	}
+	b.status = *status
+	return nil
+}
+
+func (b *Bootstrap) join() error {
+	response, err := b.ops.Join(b.config.Name, b.config.Labels, b.config.Geolocation)
+	if err != nil {
+		return err
+	}
+	b.credentials = response
+	b.status.JoinResponse = response
+	return nil
+}
+
+func (b *Bootstrap) saveCredentials() error {
+	if b.credentials == nil {
+		b.credentials = b.status.JoinResponse
+	}
+	err := b.ops.SaveCredentials(*b.credentials)
+	if err != nil {
+		return err
+	}
+	// the credentials file is the only copy from now on
+	b.status.JoinResponse = nil
+	return nil
+}
+
+func (b *Bootstrap) configureVPN() error {
+	err := b.loadCredentials()
+	if err != nil {
+		return err
+	}
+	return b.ops.ConfigureLocalVPN(b.credentials.Credentials)
+}
+
+func (b *Bootstrap) loadCredentials() error {
+	if b.credentials != nil {
+		return nil
+	}
+	credentials, err := b.ops.LoadCredentials()
+	if err != nil {
+		return err
+	}
+	b.credentials = credentials
+	return nil
+}
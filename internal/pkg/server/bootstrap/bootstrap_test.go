@@ -0,0 +1,260 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/utils"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+const testIP = "172.16.0.10"
+
+var testBackoff = utils.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond, Factor: 2}
+
+// fakeOperations implements JoinOperations keeping the credentials in memory and counting the calls.
+type fakeOperations struct {
+	sync.Mutex
+	credentials *grpc_inventory_manager_go.EICJoinResponse
+	// calls with the number of executions of each operation.
+	calls map[string]int
+	// failures with the number of times an operation fails before succeeding.
+	failures map[string]int
+}
+
+func newFakeOperations() *fakeOperations {
+	return &fakeOperations{
+		calls:    make(map[string]int, 0),
+		failures: make(map[string]int, 0),
+	}
+}
+
+func (f *fakeOperations) called(operation string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls[operation]++
+	if f.failures[operation] > 0 {
+		f.failures[operation]--
+		return errors.New(operation + " failed")
+	}
+	return nil
+}
+
+func (f *fakeOperations) count(operation string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[operation]
+}
+
+func (f *fakeOperations) NeedJoin() (bool, error) {
+	return f.credentials == nil, nil
+}
+
+func (f *fakeOperations) Join(name string, labels string, geolocation string) (*grpc_inventory_manager_go.EICJoinResponse, error) {
+	if err := f.called("Join"); err != nil {
+		return nil, err
+	}
+	return &grpc_inventory_manager_go.EICJoinResponse{
+		OrganizationId:   "org",
+		EdgeControllerId: name,
+		Credentials:      &grpc_inventory_manager_go.VPNCredentials{Username: "user", Password: "pass"},
+	}, nil
+}
+
+func (f *fakeOperations) SaveCredentials(edge grpc_inventory_manager_go.EICJoinResponse) error {
+	if err := f.called("SaveCredentials"); err != nil {
+		return err
+	}
+	f.credentials = &edge
+	return nil
+}
+
+func (f *fakeOperations) LoadCredentials() (*grpc_inventory_manager_go.EICJoinResponse, error) {
+	if f.credentials == nil {
+		return nil, errors.New("credentials not found")
+	}
+	return f.credentials, nil
+}
+
+func (f *fakeOperations) ConfigureDNS() error {
+	return f.called("ConfigureDNS")
+}
+
+func (f *fakeOperations) ConfigureLocalVPN(credentials *grpc_inventory_manager_go.VPNCredentials) error {
+	return f.called("ConfigureLocalVPN")
+}
+
+func (f *fakeOperations) GetIP() error {
+	return f.called("GetIP")
+}
+
+func (f *fakeOperations) ExecuteDhClient() error {
+	return f.called("ExecuteDhClient")
+}
+
+func (f *fakeOperations) GetVPNAddress() (*string, error) {
+	if err := f.called("GetVPNAddress"); err != nil {
+		return nil, err
+	}
+	ip := testIP
+	return &ip, nil
+}
+
+var _ = ginkgo.Describe("Bootstrap", func() {
+
+	var dir string
+	var statePath string
+	var ops *fakeOperations
+	cfg := config.Config{Name: "ec1", Labels: "", Geolocation: "Madrid"}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "bootstrap")
+		gomega.Expect(err).To(gomega.Succeed())
+		statePath = filepath.Join(dir, "bootstrap.json")
+		ops = newFakeOperations()
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	persistedState := func() State {
+		status, found, err := loadStatus(statePath)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(found).To(gomega.BeTrue())
+		return status.State
+	}
+
+	ginkgo.It("should execute all the steps on the first start", func() {
+		b := NewBootstrap(cfg, ops, statePath, testBackoff)
+		credentials, err := b.Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(credentials.EdgeControllerId).To(gomega.Equal("ec1"))
+		gomega.Expect(b.State()).To(gomega.Equal(IPAcquired))
+		gomega.Expect(persistedState()).To(gomega.Equal(IPAcquired))
+		for _, operation := range []string{"Join", "SaveCredentials", "ConfigureDNS", "ConfigureLocalVPN", "GetIP"} {
+			gomega.Expect(ops.count(operation)).To(gomega.Equal(1), operation)
+		}
+
+		var startedIP string
+		err = b.Start(context.Background(), func(ip string) error {
+			startedIP = ip
+			return nil
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(startedIP).To(gomega.Equal(testIP))
+		gomega.Expect(persistedState()).To(gomega.Equal(EICStarted))
+	})
+
+	ginkgo.It("should retry the failed steps", func() {
+		ops.failures["ConfigureDNS"] = 2
+		ops.failures["GetVPNAddress"] = 1
+		b := NewBootstrap(cfg, ops, statePath, testBackoff)
+		_, err := b.Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(ops.count("ConfigureDNS")).To(gomega.Equal(3))
+
+		starts := 0
+		err = b.Start(context.Background(), func(ip string) error {
+			starts++
+			if starts == 1 {
+				return errors.New("proxy unavailable")
+			}
+			return nil
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(ops.count("GetVPNAddress")).To(gomega.Equal(2))
+		gomega.Expect(starts).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("should resume from the last completed step after a restart", func() {
+		ops.failures["ConfigureLocalVPN"] = 1000
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := NewBootstrap(cfg, ops, statePath, testBackoff).Prepare(ctx)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(persistedState()).To(gomega.Equal(DNSConfigured))
+
+		ops.failures["ConfigureLocalVPN"] = 0
+		b := NewBootstrap(cfg, ops, statePath, testBackoff)
+		credentials, err := b.Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(credentials.Credentials.Username).To(gomega.Equal("user"))
+		gomega.Expect(b.State()).To(gomega.Equal(IPAcquired))
+		gomega.Expect(ops.count("Join")).To(gomega.Equal(1))
+		gomega.Expect(ops.count("ConfigureDNS")).To(gomega.Equal(1))
+		gomega.Expect(ops.count("GetIP")).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should save the credentials received before a restart", func() {
+		response := &grpc_inventory_manager_go.EICJoinResponse{
+			OrganizationId:   "org",
+			EdgeControllerId: "previous",
+			Credentials:      &grpc_inventory_manager_go.VPNCredentials{Username: "previous"},
+		}
+		gomega.Expect(saveStatus(statePath, Status{State: Joined, JoinResponse: response})).To(gomega.Succeed())
+
+		credentials, err := NewBootstrap(cfg, ops, statePath, testBackoff).Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(ops.count("Join")).To(gomega.Equal(0))
+		gomega.Expect(credentials.EdgeControllerId).To(gomega.Equal("previous"))
+		gomega.Expect(ops.credentials.EdgeControllerId).To(gomega.Equal("previous"))
+
+		status, _, lErr := loadStatus(statePath)
+		gomega.Expect(lErr).To(gomega.Succeed())
+		gomega.Expect(status.JoinResponse).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should skip the join steps if only the credentials are found", func() {
+		ops.credentials = &grpc_inventory_manager_go.EICJoinResponse{EdgeControllerId: "linked"}
+
+		b := NewBootstrap(cfg, ops, statePath, testBackoff)
+		credentials, err := b.Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(credentials.EdgeControllerId).To(gomega.Equal("linked"))
+		gomega.Expect(b.State()).To(gomega.Equal(IPAcquired))
+		gomega.Expect(ops.calls).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should join again if the credentials have been removed", func() {
+		gomega.Expect(saveStatus(statePath, Status{State: EICStarted})).To(gomega.Succeed())
+
+		_, err := NewBootstrap(cfg, ops, statePath, testBackoff).Prepare(context.Background())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(ops.count("Join")).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should remove the state", func() {
+		gomega.Expect(saveStatus(statePath, Status{State: EICStarted})).To(gomega.Succeed())
+		gomega.Expect(RemoveState(statePath)).To(gomega.Succeed())
+		_, found, err := loadStatus(statePath)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(found).To(gomega.BeFalse())
+		gomega.Expect(RemoveState(statePath)).To(gomega.Succeed())
+	})
+})
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-inventory-manager-go"
+)
+
+// DefaultStateFile with the path where the bootstrap state is persisted if it is not configured.
+const DefaultStateFile = "/etc/edge-controller/bootstrap.json"
+
+// State of the bootstrap process. States are ordered, reaching one implies all the previous ones have been completed.
+type State int
+
+const (
+	// NotJoined is the initial state.
+	NotJoined State = iota
+	// Joined when the management cluster has accepted the join request.
+	Joined
+	// CredentialsSaved when the join response has been stored in the credentials file.
+	CredentialsSaved
+	// DNSConfigured when the platform DNS has been added to the resolver.
+	DNSConfigured
+	// VPNConfigured when the VPN account has been created and connected.
+	VPNConfigured
+	// IPAcquired when IP forwarding is enabled and the VPN interface has an address.
+	IPAcquired
+	// EICStarted when the management cluster has been notified of the start of the edge controller.
+	EICStarted
+)
+
+var stateNames = map[State]string{
+	NotJoined:        "not_joined",
+	Joined:           "joined",
+	CredentialsSaved: "credentials_saved",
+	DNSConfigured:    "dns_configured",
+	VPNConfigured:    "vpn_configured",
+	IPAcquired:       "ip_acquired",
+	EICStarted:       "eic_started",
+}
+
+func (s State) String() string {
+	name, exists := stateNames[s]
+	if !exists {
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+	return name
+}
+
+// MarshalText stores the state with its name so the state file can be read by an operator.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a state name.
+func (s *State) UnmarshalText(text []byte) error {
+	for state, name := range stateNames {
+		if name == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return derrors.NewInvalidArgumentError("unknown bootstrap state").WithParams(string(text))
+}
+
+// Status is the persisted information of the bootstrap process.
+type Status struct {
+	// State with the last completed step.
+	State State `json:"state"`
+	// Updated with the timestamp of the last change.
+	Updated int64 `json:"updated"`
+	// JoinResponse received from the management cluster. It is only kept until the credentials file is written, as
+	// it is the only copy of the credentials in the meantime.
+	JoinResponse *grpc_inventory_manager_go.EICJoinResponse `json:"join_response,omitempty"`
+}
+
+// loadStatus reads the status from a file. The boolean is false if the file does not exist.
+func loadStatus(path string) (*Status, bool, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, derrors.AsError(err, "cannot read bootstrap state")
+	}
+	status := &Status{}
+	err = json.Unmarshal(content, status)
+	if err != nil {
+		return nil, false, derrors.AsError(err, "cannot parse bootstrap state")
+	}
+	return status, true, nil
+}
+
+// saveStatus writes the status into a temporary file that replaces the previous one, so a crash never leaves a
+// partially written state.
+func saveStatus(path string, status Status) derrors.Error {
+	status.Updated = time.Now().Unix()
+	content, err := json.Marshal(status)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal bootstrap state")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return derrors.AsError(err, "cannot create bootstrap state file")
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return derrors.AsError(err, "cannot write bootstrap state")
+	}
+	return nil
+}
+
+// RemoveState deletes the persisted bootstrap state so the next start begins with a join.
+func RemoveState(path string) derrors.Error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return derrors.AsError(err, "cannot remove bootstrap state")
+	}
+	return nil
+}
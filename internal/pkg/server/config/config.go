@@ -24,6 +24,16 @@ import (
 	"time"
 )
 
+const (
+	// ClientCertsDisabled does not issue client certificates to the agents, they authenticate with their token.
+	ClientCertsDisabled = "disabled"
+	// ClientCertsOptional issues client certificates to the agents and verifies them when they are sent.
+	ClientCertsOptional = "optional"
+	// ClientCertsRequired rejects the agents that do not send their client certificate. Until an agent installs its
+	// first certificate, it can only check its operations and respond to the operations of its certificate.
+	ClientCertsRequired = "required"
+)
+
 type PEMCertificate struct {
 	// Certificate content
 	Certificate string `json:"certificate,omitempty"`
@@ -38,6 +48,9 @@ type Config struct {
 	Port int
 	// Port where the edge controller receives messages from agents.
 	AgentPort int
+	// AdminPort where the edge controller serves the queries of the operators on the loopback interface, 0 to
+	// disable it.
+	AdminPort int
 	// UseInMemoryProviders determines if the in memory providers are used.
 	UseInMemoryProviders bool
 	// UseBBoltProviders determines if Bbolt providers are used
@@ -46,6 +59,10 @@ type Config struct {
 	BboltPath string
 	// NotifyPeriod determines how often the EIC sends data back to the management cluster.
 	NotifyPeriod time.Duration
+	// NotifyBatchSize with the maximum number of pending messages read at once to notify the management cluster.
+	NotifyBatchSize int
+	// NotifySenders with the maximum number of concurrent calls to notify the management cluster.
+	NotifySenders int
 	// EdgeManagementURL with the URL required to connect to the Management cluster
 	EdgeManagementURL string
 	// OrganizationId with the organization identifier
@@ -70,6 +87,51 @@ type Config struct {
 	Geolocation string
 	// AgentBinaryPath with the base path where the agent binaries are stored.
 	AgentBinaryPath string
+	// InstallRecipesPath with the directory containing the install recipe of each agent type as <os_arch>.yaml.
+	InstallRecipesPath string
+	// InstallWorkers with the maximum number of agent installs running at the same time.
+	InstallWorkers int
+	// RuntimeConfigPath with the file where the options received from the management cluster are persisted.
+	RuntimeConfigPath string
+	// BootstrapStatePath with the file where the progress of the bootstrap is persisted.
+	BootstrapStatePath string
+	// HostKeyPolicy with the default policy to verify the identity of the hosts where agents are installed
+	// (known_hosts or tofu).
+	HostKeyPolicy string
+	// KnownHostsPath with the known_hosts file used by the known_hosts policy.
+	KnownHostsPath string
+	// AgentQueueSize with the maximum number of operations queued for an agent.
+	AgentQueueSize int
+	// AgentOpsPerCheck with the maximum number of operations sent to an agent on each check, 0 to send all of them.
+	AgentOpsPerCheck int
+	// AgentOpTimeout with the default time an agent operation waits for the response of the agent before it expires.
+	AgentOpTimeout time.Duration
+	// AgentOpLease with the time an agent has to respond to a delivered operation before it is delivered again.
+	AgentOpLease time.Duration
+	// AgentOpMaxAttempts with the maximum number of times an operation is delivered to an agent.
+	AgentOpMaxAttempts int
+	// AgentTokenGrace with the default time the previous token of an agent is valid after a rotation.
+	AgentTokenGrace time.Duration
+	// AgentClientCerts with the policy for the client certificates of the agents: disabled, optional or required.
+	AgentClientCerts string
+	// AgentCertValidity with the time the client certificates issued to the agents are valid.
+	AgentCertValidity time.Duration
+	// AgentCAKeyPath with the file where the private key of the authority that issues the client certificates is stored.
+	AgentCAKeyPath string
+	// JanitorPeriod with the period between the removals of stale records from the storage.
+	JanitorPeriod time.Duration
+	// JoinTokenRetention with the time expired join tokens are kept, 0 to keep them.
+	JoinTokenRetention time.Duration
+	// JoinTokenMaxRecords with the maximum number of join tokens stored, 0 for no limit.
+	JoinTokenMaxRecords int
+	// OutboxRetention with the time the messages not delivered to the management cluster are kept, 0 to keep them.
+	OutboxRetention time.Duration
+	// OutboxMaxRecords with the maximum number of messages not delivered to the management cluster, 0 for no limit.
+	OutboxMaxRecords int
+	// AgentStartRetention with the time the agent starts are kept, 0 to keep them.
+	AgentStartRetention time.Duration
+	// AgentStartMaxRecords with the maximum number of agent starts stored, 0 for no limit.
+	AgentStartMaxRecords int
 
 	// Plugin configuration - using Viper to be flexible so it's easy to
 	// add new plugins
@@ -86,9 +148,18 @@ func (conf * Config) Validate() derrors.Error {
 	if conf.AgentPort <= 0 {
 		return derrors.NewInvalidArgumentError("agentPort must be specified")
 	}
+	if conf.AdminPort < 0 {
+		return derrors.NewInvalidArgumentError("adminPort cannot be negative")
+	}
 	if conf.NotifyPeriod.Seconds() < 1 {
 		return derrors.NewInvalidArgumentError("notifyPeriod should be minimum 1s")
 	}
+	if conf.NotifyBatchSize <= 0 {
+		return derrors.NewInvalidArgumentError("notifyBatchSize must be greater than 0")
+	}
+	if conf.NotifySenders <= 0 {
+		return derrors.NewInvalidArgumentError("notifySenders must be greater than 0")
+	}
 	if conf.UseBBoltProviders {
 		if conf.BboltPath == "" {
 			return derrors.NewAlreadyExistsError("bboltpatth must be specified")
@@ -112,6 +183,60 @@ func (conf * Config) Validate() derrors.Error {
 	if conf.AgentBinaryPath == "" {
 		return derrors.NewInvalidArgumentError("agentBinaryPath must be set")
 	}
+	if conf.InstallRecipesPath == "" {
+		return derrors.NewInvalidArgumentError("installRecipesPath must be set")
+	}
+	if conf.InstallWorkers <= 0 {
+		return derrors.NewInvalidArgumentError("installWorkers must be greater than 0")
+	}
+	if conf.AgentQueueSize <= 0 {
+		return derrors.NewInvalidArgumentError("agentQueueSize must be greater than 0")
+	}
+	if conf.AgentOpsPerCheck < 0 {
+		return derrors.NewInvalidArgumentError("agentOpsPerCheck cannot be negative")
+	}
+	if conf.AgentOpTimeout.Seconds() < 1 {
+		return derrors.NewInvalidArgumentError("agentOpTimeout should be minimum 1s")
+	}
+	if conf.AgentOpLease.Seconds() < 1 {
+		return derrors.NewInvalidArgumentError("agentOpLease should be minimum 1s")
+	}
+	if conf.AgentOpMaxAttempts <= 0 {
+		return derrors.NewInvalidArgumentError("agentOpMaxAttempts must be greater than 0")
+	}
+	if conf.AgentTokenGrace.Seconds() < 1 {
+		return derrors.NewInvalidArgumentError("agentTokenGrace should be minimum 1s")
+	}
+	if conf.AgentClientCerts != ClientCertsDisabled && conf.AgentClientCerts != ClientCertsOptional && conf.AgentClientCerts != ClientCertsRequired {
+		return derrors.NewInvalidArgumentError("agentClientCerts must be disabled, optional or required").WithParams(conf.AgentClientCerts)
+	}
+	if conf.AgentClientCerts != ClientCertsDisabled && conf.AgentCertValidity.Hours() < 1 {
+		return derrors.NewInvalidArgumentError("agentCertValidity should be minimum 1h")
+	}
+	if conf.AgentClientCerts != ClientCertsDisabled && conf.AgentCAKeyPath == "" {
+		return derrors.NewInvalidArgumentError("agentCAKeyPath must be set")
+	}
+	if conf.JanitorPeriod.Seconds() < 1 {
+		return derrors.NewInvalidArgumentError("janitorPeriod should be minimum 1s")
+	}
+	if conf.JoinTokenRetention < 0 || conf.OutboxRetention < 0 || conf.AgentStartRetention < 0 {
+		return derrors.NewInvalidArgumentError("retentions cannot be negative")
+	}
+	if conf.JoinTokenMaxRecords < 0 || conf.OutboxMaxRecords < 0 || conf.AgentStartMaxRecords < 0 {
+		return derrors.NewInvalidArgumentError("maximum number of records cannot be negative")
+	}
+	if conf.RuntimeConfigPath == "" {
+		return derrors.NewInvalidArgumentError("runtimeConfigPath must be set")
+	}
+	if conf.BootstrapStatePath == "" {
+		return derrors.NewInvalidArgumentError("bootstrapStatePath must be set")
+	}
+	if conf.HostKeyPolicy != "known_hosts" && conf.HostKeyPolicy != "tofu" {
+		return derrors.NewInvalidArgumentError("hostKeyPolicy must be known_hosts or tofu").WithParams(conf.HostKeyPolicy)
+	}
+	if conf.HostKeyPolicy == "known_hosts" && conf.KnownHostsPath == "" {
+		return derrors.NewInvalidArgumentError("knownHostsPath must be set")
+	}
 
 	return nil
 }
@@ -120,6 +245,7 @@ func (conf * Config) Validate() derrors.Error {
 func (conf *Config) Print() {
 	log.Info().Str("app", version.AppVersion).Str("commit", version.Commit).Msg("Version")
 	log.Info().Int("management", conf.Port).Int("agent", conf.AgentPort).Msg("gRPC port")
+	log.Info().Int("admin", conf.AdminPort).Msg("Admin port")
 	if conf.UseInMemoryProviders {
 		log.Info().Bool("UseInMemoryProviders", conf.UseInMemoryProviders).Msg("Using in-memory providers")
 	}
@@ -128,6 +254,7 @@ func (conf *Config) Print() {
 		log.Info().Str("BboltPath", conf.BboltPath).Msg("BboltPath")
 	}
 	log.Info().Str("duration", conf.NotifyPeriod.String()).Msg("Notify period")
+	log.Info().Int("batchSize", conf.NotifyBatchSize).Int("senders", conf.NotifySenders).Msg("Notify delivery")
 	log.Info().Str("JoinTokenPath", conf.JoinTokenPath).Msg("Join Token Path")
 	log.Info().Int("EIC-APIPort", conf.EicApiPort).Msg("gRPC EIC-API port")
 	log.Info().Str("Name", conf.Name).Msg("Edge Controller name")
@@ -137,6 +264,21 @@ func (conf *Config) Print() {
 	log.Info().Interface("AlivePeriod", conf.AlivePeriod).Msg("Alive Period")
 	log.Info().Str("Geolocation", conf.Geolocation).Msg("Edge Controller Location")
 	log.Info().Str("basePath", conf.AgentBinaryPath).Msg("Agent binaries")
+	log.Info().Str("path", conf.InstallRecipesPath).Int("workers", conf.InstallWorkers).Msg("Agent install recipes")
+	log.Info().Int("size", conf.AgentQueueSize).Int("perCheck", conf.AgentOpsPerCheck).
+		Str("timeout", conf.AgentOpTimeout.String()).Str("lease", conf.AgentOpLease.String()).
+		Int("maxAttempts", conf.AgentOpMaxAttempts).Msg("Agent operation queue")
+	log.Info().Str("grace", conf.AgentTokenGrace.String()).Msg("Agent token rotation")
+	log.Info().Str("policy", conf.AgentClientCerts).Str("validity", conf.AgentCertValidity.String()).
+		Str("caKeyPath", conf.AgentCAKeyPath).Msg("Agent client certificates")
+	log.Info().Str("period", conf.JanitorPeriod.String()).
+		Str("joinTokenRetention", conf.JoinTokenRetention.String()).Int("joinTokenMaxRecords", conf.JoinTokenMaxRecords).
+		Str("outboxRetention", conf.OutboxRetention.String()).Int("outboxMaxRecords", conf.OutboxMaxRecords).
+		Str("agentStartRetention", conf.AgentStartRetention.String()).Int("agentStartMaxRecords", conf.AgentStartMaxRecords).
+		Msg("Storage janitor")
+	log.Info().Str("RuntimeConfigPath", conf.RuntimeConfigPath).Msg("Runtime configuration")
+	log.Info().Str("BootstrapStatePath", conf.BootstrapStatePath).Msg("Bootstrap state")
+	log.Info().Str("HostKeyPolicy", conf.HostKeyPolicy).Str("KnownHostsPath", conf.KnownHostsPath).Msg("SSH host key verification")
 	for _, k := range(conf.PluginConfig.AllKeys()) {
 		log.Info().Interface(k, conf.PluginConfig.Get(k)).Msg("Plugin configuration option")
 	}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/spf13/viper"
+)
+
+// Keys of the options that can be changed at runtime by the management cluster. They match the names used in the
+// configuration file. The labels are only sent when the edge controller joins, so they cannot be changed at runtime.
+const (
+	NotifyPeriodKey = "notifyPeriod"
+	AlivePeriodKey  = "alivePeriod"
+	// GeolocationKey with the location of the edge controller. It is sent in the next join of the edge controller and
+	// it is the location of the agents that join without one.
+	GeolocationKey = "geolocation"
+	// PluginKeyPrefix is the prefix of the plugin options with the format plugin.<plugin_name>.<option>.
+	PluginKeyPrefix = "plugin."
+)
+
+// DefaultRuntimeConfigPath with the file where the options received at runtime are persisted.
+const DefaultRuntimeConfigPath = "/etc/edge-controller/runtime.json"
+
+// RuntimeChanges contains the result of applying a set of runtime options.
+type RuntimeChanges struct {
+	// Applied with the options that have been applied.
+	Applied map[string]string
+	// NotifyPeriodChanged is true if the notification period has changed.
+	NotifyPeriodChanged bool
+	// AlivePeriodChanged is true if the alive period has changed.
+	AlivePeriodChanged bool
+	// GeolocationChanged is true if the geolocation has changed.
+	GeolocationChanged bool
+	// Plugins with the name of the plugins whose options have changed.
+	Plugins []string
+}
+
+// PluginName returns the plugin an option belongs to, or an empty string if it is not a plugin option.
+func PluginName(key string) string {
+	if !strings.HasPrefix(key, PluginKeyPrefix) {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, PluginKeyPrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	return parts[0]
+}
+
+// ApplyRuntimeParams validates a set of options and applies them to the configuration. If any of the options is
+// not valid, the configuration is not modified.
+func (conf *Config) ApplyRuntimeParams(params map[string]string) (*RuntimeChanges, derrors.Error) {
+	updated := *conf
+	changes := &RuntimeChanges{
+		Applied: make(map[string]string, len(params)),
+		Plugins: make([]string, 0),
+	}
+	pluginOptions := make(map[string]string, 0)
+
+	for key, value := range params {
+		switch key {
+		case NotifyPeriodKey, AlivePeriodKey:
+			period, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, derrors.NewInvalidArgumentError("invalid period").WithParams(key, value)
+			}
+			if period.Seconds() < 1 {
+				return nil, derrors.NewInvalidArgumentError("period should be minimum 1s").WithParams(key, value)
+			}
+			if key == NotifyPeriodKey {
+				changes.NotifyPeriodChanged = updated.NotifyPeriod != period
+				updated.NotifyPeriod = period
+			} else {
+				changes.AlivePeriodChanged = updated.AlivePeriod != period
+				updated.AlivePeriod = period
+			}
+		case GeolocationKey:
+			changes.GeolocationChanged = updated.Geolocation != value
+			updated.Geolocation = value
+		default:
+			name := PluginName(key)
+			if name == "" {
+				return nil, derrors.NewInvalidArgumentError("unsupported configuration option").WithParams(key)
+			}
+			pluginOptions[key] = value
+			if !containsString(changes.Plugins, name) {
+				changes.Plugins = append(changes.Plugins, name)
+			}
+		}
+		changes.Applied[key] = value
+	}
+
+	if len(pluginOptions) > 0 && updated.PluginConfig == nil {
+		return nil, derrors.NewFailedPreconditionError("plugin configuration not available")
+	}
+	for key, value := range pluginOptions {
+		updated.PluginConfig.Set(key, value)
+	}
+	// only the runtime options are assigned as the rest of the configuration may be read concurrently
+	conf.NotifyPeriod = updated.NotifyPeriod
+	conf.AlivePeriod = updated.AlivePeriod
+	conf.Geolocation = updated.Geolocation
+	return changes, nil
+}
+
+// GetPluginOptions returns the current value of a set of plugin options. The options that are not set are not
+// included.
+func (conf *Config) GetPluginOptions(keys []string) map[string]interface{} {
+	options := make(map[string]interface{}, 0)
+	if conf.PluginConfig == nil {
+		return options
+	}
+	for _, key := range keys {
+		if conf.PluginConfig.IsSet(key) {
+			options[key] = conf.PluginConfig.Get(key)
+		}
+	}
+	return options
+}
+
+// RestorePluginOptions sets a set of plugin options back to the values returned by GetPluginOptions. The options
+// that were not set are removed.
+func (conf *Config) RestorePluginOptions(keys []string, previous map[string]interface{}) {
+	if conf.PluginConfig == nil {
+		return
+	}
+	removed := make(map[string]bool, 0)
+	for _, key := range keys {
+		if value, exists := previous[key]; exists {
+			conf.PluginConfig.Set(key, value)
+		} else {
+			removed[strings.ToLower(key)] = true
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	// viper cannot unset a key, so the configuration is rebuilt without the removed ones
+	restored := viper.New()
+	for _, key := range conf.PluginConfig.AllKeys() {
+		if !removed[key] {
+			restored.Set(key, conf.PluginConfig.Get(key))
+		}
+	}
+	conf.PluginConfig = restored
+}
+
+// LoadRuntimeParams reads the options persisted in a file. A missing file means there are no options.
+func LoadRuntimeParams(path string) (map[string]string, derrors.Error) {
+	params := make(map[string]string, 0)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return params, nil
+	}
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read runtime configuration")
+	}
+	err = json.Unmarshal(content, &params)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot parse runtime configuration")
+	}
+	return params, nil
+}
+
+// SaveRuntimeParams merges a set of options with the ones already persisted in a file.
+func SaveRuntimeParams(path string, params map[string]string) derrors.Error {
+	stored, derr := LoadRuntimeParams(path)
+	if derr != nil {
+		return derr
+	}
+	for key, value := range params {
+		stored[key] = value
+	}
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return derrors.AsError(err, "cannot marshal runtime configuration")
+	}
+	// the options are written to a temporary file first so a failure does not leave the file truncated
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return derrors.AsError(err, "cannot create runtime configuration")
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return derrors.AsError(err, "cannot write runtime configuration")
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = ginkgo.Describe("Runtime configuration", func() {
+
+	var conf Config
+
+	ginkgo.BeforeEach(func() {
+		conf = Config{
+			NotifyPeriod: 30 * time.Second,
+			AlivePeriod:  5 * time.Minute,
+			Labels:       "env:dev",
+			PluginConfig: viper.New(),
+		}
+	})
+
+	ginkgo.It("should apply valid options", func() {
+		changes, err := conf.ApplyRuntimeParams(map[string]string{
+			NotifyPeriodKey:            "10s",
+			AlivePeriodKey:             "5m",
+			"plugin.metrics.retention": "7d",
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(changes.Applied).To(gomega.HaveLen(3))
+		gomega.Expect(changes.NotifyPeriodChanged).To(gomega.BeTrue())
+		gomega.Expect(changes.AlivePeriodChanged).To(gomega.BeFalse())
+		gomega.Expect(changes.Plugins).To(gomega.Equal([]string{"metrics"}))
+
+		gomega.Expect(conf.NotifyPeriod).To(gomega.Equal(10 * time.Second))
+		gomega.Expect(conf.PluginConfig.GetString("plugin.metrics.retention")).To(gomega.Equal("7d"))
+	})
+
+	ginkgo.It("should not modify the configuration if an option is not valid", func() {
+		invalid := []map[string]string{
+			{NotifyPeriodKey: "10s", AlivePeriodKey: "often"},
+			{NotifyPeriodKey: "10ms"},
+			{NotifyPeriodKey: "10s", "port": "8080"},
+			{NotifyPeriodKey: "10s", "labels": "env:prod"},
+			{"plugin.metrics": "7d"},
+		}
+		for _, params := range invalid {
+			_, err := conf.ApplyRuntimeParams(params)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(conf.NotifyPeriod).To(gomega.Equal(30 * time.Second))
+			gomega.Expect(conf.Labels).To(gomega.Equal("env:dev"))
+		}
+	})
+
+	ginkgo.It("should apply the geolocation", func() {
+		changes, err := conf.ApplyRuntimeParams(map[string]string{GeolocationKey: "Madrid"})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(changes.Applied).To(gomega.HaveLen(1))
+		gomega.Expect(changes.GeolocationChanged).To(gomega.BeTrue())
+		gomega.Expect(conf.Labels).To(gomega.Equal("env:dev"))
+		gomega.Expect(conf.Geolocation).To(gomega.Equal("Madrid"))
+	})
+
+	ginkgo.It("should restore the previous plugin options", func() {
+		conf.PluginConfig.Set("plugin.metrics.retention", "1d")
+		keys := []string{"plugin.metrics.retention", "plugin.metrics.interval"}
+		previous := conf.GetPluginOptions(keys)
+		gomega.Expect(previous).To(gomega.HaveLen(1))
+
+		_, err := conf.ApplyRuntimeParams(map[string]string{"plugin.metrics.retention": "7d", "plugin.metrics.interval": "1m"})
+		gomega.Expect(err).To(gomega.Succeed())
+		conf.RestorePluginOptions(keys, previous)
+
+		gomega.Expect(conf.PluginConfig.GetString("plugin.metrics.retention")).To(gomega.Equal("1d"))
+		gomega.Expect(conf.PluginConfig.IsSet("plugin.metrics.interval")).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should persist the options merging them with the previous ones", func() {
+		dir, err := ioutil.TempDir("", "runtime")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "runtime.json")
+
+		params, derr := LoadRuntimeParams(path)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(params).To(gomega.BeEmpty())
+
+		gomega.Expect(SaveRuntimeParams(path, map[string]string{NotifyPeriodKey: "10s", AlivePeriodKey: "1m"})).To(gomega.Succeed())
+		gomega.Expect(SaveRuntimeParams(path, map[string]string{NotifyPeriodKey: "20s"})).To(gomega.Succeed())
+
+		params, derr = LoadRuntimeParams(path)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(params).To(gomega.Equal(map[string]string{NotifyPeriodKey: "20s", AlivePeriodKey: "1m"}))
+
+		files, err := ioutil.ReadDir(dir)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(files).To(gomega.HaveLen(1))
+		gomega.Expect(files[0].Mode().Perm()).To(gomega.Equal(os.FileMode(0600)))
+	})
+})
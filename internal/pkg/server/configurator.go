@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	plugin "github.com/nalej/infra-net-plugin"
+	"github.com/rs/zerolog/log"
+)
+
+// configurator applies the options received from the management cluster while the service is running.
+type configurator struct {
+	sync.Mutex
+	service  *Service
+	notifier *agent.Notifier
+	// agentManager receives the geolocation of the agents that join without one. It is nil until the agent server
+	// is launched.
+	agentManager *agent.Manager
+	// alivePeriod receives the new period of the alive loop.
+	alivePeriod chan time.Duration
+}
+
+func newConfigurator(service *Service, notifier *agent.Notifier) *configurator {
+	return &configurator{
+		service:     service,
+		notifier:    notifier,
+		alivePeriod: make(chan time.Duration, 1),
+	}
+}
+
+// Configure validates and applies a set of options, restarting the affected plugins. The options are persisted so
+// they are applied again on the next start.
+func (c *configurator) Configure(params map[string]string) (map[string]string, derrors.Error) {
+	c.Lock()
+	defer c.Unlock()
+
+	registered := plugin.ListPlugins()
+	for key := range params {
+		name := config.PluginName(key)
+		if name == "" {
+			continue
+		}
+		if _, exists := registered[plugin.PluginName(name)]; !exists {
+			return nil, derrors.NewInvalidArgumentError("unknown plugin").WithParams(key)
+		}
+	}
+
+	pluginKeys := make([]string, 0)
+	for key := range params {
+		if config.PluginName(key) != "" {
+			pluginKeys = append(pluginKeys, key)
+		}
+	}
+
+	c.service.configLock.Lock()
+	previous := c.service.Configuration
+	previousPluginOptions := previous.GetPluginOptions(pluginKeys)
+	changes, derr := c.service.Configuration.ApplyRuntimeParams(params)
+	c.service.configLock.Unlock()
+	if derr != nil {
+		return nil, derr
+	}
+
+	derr = c.restartPlugins(changes.Plugins)
+	if derr != nil {
+		log.Warn().Str("trace", derr.DebugReport()).Msg("cannot apply plugin options, restoring the previous configuration")
+		c.service.configLock.Lock()
+		c.service.Configuration.NotifyPeriod = previous.NotifyPeriod
+		c.service.Configuration.AlivePeriod = previous.AlivePeriod
+		c.service.Configuration.Geolocation = previous.Geolocation
+		c.service.Configuration.RestorePluginOptions(pluginKeys, previousPluginOptions)
+		c.service.configLock.Unlock()
+		rErr := c.restartPlugins(changes.Plugins)
+		if rErr != nil {
+			log.Error().Str("trace", rErr.DebugReport()).Msg("cannot restart plugins with the previous configuration")
+		}
+		return nil, derr
+	}
+
+	current := c.service.runtimeConfiguration()
+	if changes.NotifyPeriodChanged {
+		c.notifier.SetNotifyPeriod(current.NotifyPeriod)
+	}
+	if changes.AlivePeriodChanged {
+		// only the last period matters if the alive loop has not read the previous one
+		select {
+		case <-c.alivePeriod:
+		default:
+		}
+		c.alivePeriod <- current.AlivePeriod
+	}
+	if changes.GeolocationChanged && c.agentManager != nil {
+		c.agentManager.SetGeolocation(current.Geolocation)
+	}
+
+	derr = config.SaveRuntimeParams(current.RuntimeConfigPath, changes.Applied)
+	if derr != nil {
+		log.Warn().Str("trace", derr.DebugReport()).Msg("configuration applied but not persisted")
+	}
+
+	log.Info().Interface("params", changes.Applied).Msg("configuration applied")
+	return changes.Applied, nil
+}
+
+// setAgentManager sets the manager that receives the geolocation of the agents, with the current one.
+func (c *configurator) setAgentManager(manager *agent.Manager) {
+	c.Lock()
+	defer c.Unlock()
+	c.agentManager = manager
+	manager.SetGeolocation(c.service.runtimeConfiguration().Geolocation)
+}
+
+// restartPlugins stops and starts again a set of plugins so they read their options.
+func (c *configurator) restartPlugins(names []string) derrors.Error {
+	pluginConfig := getSubConfig(c.service.runtimeConfiguration().PluginConfig, plugin.DefaultPluginPrefix)
+	for _, name := range names {
+		log.Info().Str("name", name).Msg("restarting plugin")
+		derr := plugin.StopPlugin(plugin.PluginName(name))
+		if derr != nil {
+			log.Warn().Str("name", name).Str("trace", derr.DebugReport()).Msg("error stopping plugin")
+		}
+		derr = startPlugin(pluginConfig, name)
+		if derr != nil {
+			return derr
+		}
+	}
+	return nil
+}
+
+// applyPersistedConfiguration applies the options received from the management cluster in previous executions.
+func (s *Service) applyPersistedConfiguration() {
+	params, derr := config.LoadRuntimeParams(s.Configuration.RuntimeConfigPath)
+	if derr != nil {
+		log.Warn().Str("trace", derr.DebugReport()).Msg("cannot load the runtime configuration, using the initial one")
+		return
+	}
+	if len(params) == 0 {
+		return
+	}
+	_, derr = s.Configuration.ApplyRuntimeParams(params)
+	if derr != nil {
+		log.Warn().Str("trace", derr.DebugReport()).Msg("invalid runtime configuration, using the initial one")
+		return
+	}
+	log.Info().Interface("params", params).Msg("runtime configuration applied")
+}
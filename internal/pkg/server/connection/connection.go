@@ -26,7 +26,12 @@ import (
 
 // Connection interface for the various methods of connecting to a node
 type Connection interface {
-	// TODO: Add connect / disconnect to be able to run multiple commands over a single connection
+	// Connect to a node. Commands and copies are executed over the same connection until Close is called. If the
+	// connection is not established, each operation connects and disconnects on its own.
+	Connect() error
+
+	// Close the connection with the node
+	Close() error
 
 	// Execute a single command on a node capturing stdout
 	Execute(command string) ([]byte, error)
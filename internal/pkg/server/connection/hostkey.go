@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy defines how the identity of a remote host is verified before sending any data to it.
+type HostKeyPolicy string
+
+const (
+	// KnownHostsPolicy only accepts the hosts whose key is found in a known_hosts file.
+	KnownHostsPolicy HostKeyPolicy = "known_hosts"
+	// TrustOnFirstUsePolicy accepts the key of a host the first time and persists its fingerprint. Later connections
+	// must present the same key.
+	TrustOnFirstUsePolicy HostKeyPolicy = "tofu"
+	// FingerprintPolicy only accepts the key matching an explicit fingerprint.
+	FingerprintPolicy HostKeyPolicy = "fingerprint"
+)
+
+// HostKeyStore persists the fingerprints of the hosts trusted on first use.
+type HostKeyStore interface {
+	// TrustHostKey stores the fingerprint of a host if the host is not known, and returns the fingerprint trusted
+	// for the host. The check and the store must be atomic so concurrent connections trust the same key.
+	TrustHostKey(host string, fingerprint string) (string, derrors.Error)
+}
+
+// HostKeyError is returned when the key presented by a remote host cannot be verified.
+type HostKeyError struct {
+	// Host as it was dialed.
+	Host string
+	// Reason with a description of the failure.
+	Reason string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s: %s", e.Host, e.Reason)
+}
+
+// Fingerprint returns the SHA256 fingerprint of a key with the format used by OpenSSH.
+func Fingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// matchFingerprint checks a key against a SHA256 or legacy MD5 fingerprint.
+func matchFingerprint(key ssh.PublicKey, fingerprint string) bool {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if fingerprint == ssh.FingerprintSHA256(key) {
+		return true
+	}
+	return strings.TrimPrefix(strings.ToLower(fingerprint), "md5:") == ssh.FingerprintLegacyMD5(key)
+}
+
+// NewKnownHostsCallback creates a callback that verifies the hosts against a known_hosts file.
+func NewKnownHostsCallback(path string) (ssh.HostKeyCallback, derrors.Error) {
+	verify, err := knownhosts.New(path)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read known hosts file").WithParams(path)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return &HostKeyError{Host: hostname, Reason: fmt.Sprintf("host not found in %s", path)}
+			}
+			return &HostKeyError{Host: hostname,
+				Reason: fmt.Sprintf("received key %s does not match %s", Fingerprint(key), path)}
+		}
+		return &HostKeyError{Host: hostname, Reason: err.Error()}
+	}, nil
+}
+
+// NewTrustOnFirstUseCallback creates a callback that trusts the key received on the first connection to a host.
+func NewTrustOnFirstUseCallback(store HostKeyStore) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		received := Fingerprint(key)
+		expected, err := store.TrustHostKey(hostname, received)
+		if err != nil {
+			return &HostKeyError{Host: hostname, Reason: fmt.Sprintf("cannot trust key: %s", err.Error())}
+		}
+		if expected != received {
+			return &HostKeyError{Host: hostname,
+				Reason: fmt.Sprintf("received key %s does not match the key %s trusted on first use", received, expected)}
+		}
+		return nil
+	}
+}
+
+// NewFingerprintCallback creates a callback that only accepts the key with the given fingerprint.
+func NewFingerprintCallback(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !matchFingerprint(key, fingerprint) {
+			return &HostKeyError{Host: hostname,
+				Reason: fmt.Sprintf("received key %s does not match the expected fingerprint %s", Fingerprint(key), fingerprint)}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// memoryHostKeyStore keeps the trusted keys in memory.
+type memoryHostKeyStore map[string]string
+
+func (m memoryHostKeyStore) TrustHostKey(host string, fingerprint string) (string, derrors.Error) {
+	if trusted, exists := m[host]; exists {
+		return trusted, nil
+	}
+	m[host] = fingerprint
+	return fingerprint, nil
+}
+
+func newTestKey() ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	key, err := ssh.NewPublicKey(public)
+	gomega.Expect(err).To(gomega.Succeed())
+	return key
+}
+
+func expectHostKeyError(err error) {
+	gomega.Expect(err).To(gomega.HaveOccurred())
+	_, ok := err.(*HostKeyError)
+	gomega.Expect(ok).To(gomega.BeTrue(), err.Error())
+}
+
+var _ = ginkgo.Describe("Host key verification", func() {
+
+	const host = "10.0.0.1:22"
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	ginkgo.It("should trust the key received on first use", func() {
+		store := memoryHostKeyStore{}
+		callback := NewTrustOnFirstUseCallback(store)
+		key := newTestKey()
+
+		gomega.Expect(callback(host, remote, key)).To(gomega.Succeed())
+		gomega.Expect(store[host]).To(gomega.Equal(Fingerprint(key)))
+		gomega.Expect(callback(host, remote, key)).To(gomega.Succeed())
+
+		expectHostKeyError(callback(host, remote, newTestKey()))
+	})
+
+	ginkgo.It("should only accept the expected fingerprint", func() {
+		key := newTestKey()
+		gomega.Expect(NewFingerprintCallback(Fingerprint(key))(host, remote, key)).To(gomega.Succeed())
+		gomega.Expect(NewFingerprintCallback(ssh.FingerprintLegacyMD5(key))(host, remote, key)).To(gomega.Succeed())
+		expectHostKeyError(NewFingerprintCallback(Fingerprint(key))(host, remote, newTestKey()))
+	})
+
+	ginkgo.It("should verify the hosts against a known_hosts file", func() {
+		dir, err := ioutil.TempDir("", "knownhosts")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.RemoveAll(dir)
+
+		key := newTestKey()
+		path := filepath.Join(dir, "known_hosts")
+		line := fmt.Sprintln(knownhosts.Line([]string{host}, key))
+		gomega.Expect(ioutil.WriteFile(path, []byte(line), 0600)).To(gomega.Succeed())
+
+		callback, derr := NewKnownHostsCallback(path)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(callback(host, remote, key)).To(gomega.Succeed())
+		expectHostKeyError(callback(host, remote, newTestKey()))
+		expectHostKeyError(callback("10.0.0.2:22", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 22}, key))
+	})
+
+	ginkgo.It("should reject connections without host key verification", func() {
+		conn, err := NewSSHConnection("10.0.0.1", "22", "user", "password", "", "")
+		gomega.Expect(err).To(gomega.Succeed())
+		_, err = conn.GetSSHConfig()
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
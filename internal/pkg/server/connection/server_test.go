@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/onsi/gomega"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "password"
+)
+
+// testSSHServer is a minimal SSH server that replies to any command with its name and records the data received
+// on its standard input.
+type testSSHServer struct {
+	sync.Mutex
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	// connections with the number of accepted connections.
+	connections int
+	// commands with the executed commands and the data received on their input.
+	commands map[string][]byte
+}
+
+func newTestSSHServer() *testSSHServer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	signer, err := ssh.NewSignerFromKey(private)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testUsername && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	gomega.Expect(err).To(gomega.Succeed())
+
+	server := &testSSHServer{
+		listener: listener,
+		config:   config,
+		hostKey:  signer.PublicKey(),
+		commands: make(map[string][]byte, 0),
+	}
+	go server.serve()
+	return server
+}
+
+// newConnection returns a connection to the server verifying its key.
+func (s *testSSHServer) newConnection() *SSHConnection {
+	host, port, err := net.SplitHostPort(s.listener.Addr().String())
+	gomega.Expect(err).To(gomega.Succeed())
+	conn, err := NewSSHConnection(host, port, testUsername, testPassword, "", "")
+	gomega.Expect(err).To(gomega.Succeed())
+	conn.HostKeyCallback = NewFingerprintCallback(Fingerprint(s.hostKey))
+	return conn
+}
+
+func (s *testSSHServer) getConnections() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.connections
+}
+
+func (s *testSSHServer) getInput(command string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	input, exists := s.commands[command]
+	return input, exists
+}
+
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		tcpConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(tcpConn)
+	}
+}
+
+func (s *testSSHServer) handle(tcpConn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(tcpConn, s.config)
+	if err != nil {
+		return
+	}
+	s.Lock()
+	s.connections++
+	s.Unlock()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, channelRequests)
+	}
+}
+
+func (s *testSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		exec := struct{ Command string }{}
+		if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+
+		input, _ := ioutil.ReadAll(channel)
+		s.Lock()
+		s.commands[exec.Command] = input
+		s.Unlock()
+
+		output := exec.Command
+		if strings.HasPrefix(output, "env") {
+			output = "SSH_CLIENT=127.0.0.1 50000 22\n"
+		}
+		channel.Write([]byte(output))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -48,6 +49,13 @@ type SSHConnection struct {
 	KeyFile string `json:"keyfile,omitempty"`
 	// Private key should contain the string representation of .ssh/id_rsa
 	PrivateKey string `json:"privateKey"`
+	// HostKeyCallback verifies the identity of the remote host. Connections are rejected if it is not set.
+	HostKeyCallback ssh.HostKeyCallback `json:"-"`
+
+	// lock protects the client.
+	lock sync.Mutex
+	// client with the established connection. If it is nil, each operation dials its own connection.
+	client *ssh.Client
 }
 
 // GetSSHConfig returns the connection configuration.
@@ -85,11 +93,13 @@ func (conn *SSHConnection) GetSSHConfig() (*ssh.ClientConfig, error) {
 		}
 	}
 
+	if conn.HostKeyCallback == nil {
+		return nil, errors.New("no host key verification method found")
+	}
+
 	sshConfig = &ssh.ClientConfig{
 		User: conn.Username,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
+		HostKeyCallback: conn.HostKeyCallback,
 		Timeout: time.Second * 15,
 	}
 
@@ -111,15 +121,78 @@ func (conn *SSHConnection) createClient() (*ssh.Client, error) {
 		return nil, err
 	}
 
+	// keep the verification error as the handshake error only contains its message
+	var hostKeyErr error
+	verify := sshConfig.HostKeyCallback
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = verify(hostname, remote, key)
+		return hostKeyErr
+	}
+
 	sshAddress := fmt.Sprintf("%s:%s", conn.Address, conn.Port)
 	client, err := ssh.Dial("tcp", sshAddress, sshConfig)
 	if err != nil {
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
 		return nil, err
 	}
 
 	return client, nil
 }
 
+// Connect establishes a connection with the remote host. Commands and copies reuse it until Close is called.
+func (conn *SSHConnection) Connect() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.client != nil {
+		return nil
+	}
+	client, err := conn.createClient()
+	if err != nil {
+		return err
+	}
+	conn.client = client
+	return nil
+}
+
+// Close the connection established with Connect.
+func (conn *SSHConnection) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.client == nil {
+		return nil
+	}
+	err := conn.client.Close()
+	conn.client = nil
+	return err
+}
+
+// newSession opens a session over the established connection, or over a new one if Connect has not been called.
+// The returned function releases the session and the connection if it was created for it.
+func (conn *SSHConnection) newSession() (*ssh.Session, func(), error) {
+	conn.lock.Lock()
+	client := conn.client
+	conn.lock.Unlock()
+
+	if client == nil {
+		client, session, err := conn.OpenSession()
+		if err != nil {
+			return nil, nil, err
+		}
+		return session, func() {
+			session.Close()
+			client.Close()
+		}, nil
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, func() { session.Close() }, nil
+}
+
 // OpenSession generates a new session.
 func (conn *SSHConnection) OpenSession() (*ssh.Client, *ssh.Session, error) {
 	client, err := conn.createClient()
@@ -138,12 +211,11 @@ func (conn *SSHConnection) OpenSession() (*ssh.Client, *ssh.Session, error) {
 
 // Execute a given command.
 func (conn *SSHConnection) Execute(command string) ([]byte, error) {
-	client, session, err := conn.OpenSession()
+	session, release, err := conn.newSession()
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
-	defer session.Close()
+	defer release()
 
 	var stderrBuffer bytes.Buffer
 	stderrReader, err := session.StderrPipe()
@@ -165,12 +237,11 @@ func (conn *SSHConnection) Execute(command string) ([]byte, error) {
 
 // Copy a file to a remote host or viceversa.
 func (conn *SSHConnection) Copy(lpath, rpath string, remoteSource bool, sudo bool) error {
-	client, session, err := conn.OpenSession()
+	session, release, err := conn.newSession()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-	defer session.Close()
+	defer release()
 
 	// rpath -> lpath
 	if remoteSource == true {
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("SSH connection", func() {
+
+	var server *testSSHServer
+
+	ginkgo.BeforeEach(func() {
+		server = newTestSSHServer()
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should execute several commands and copies over a single connection", func() {
+		conn := server.newConnection()
+		gomega.Expect(conn.Connect()).To(gomega.Succeed())
+
+		for _, command := range []string{"first", "second", "third"} {
+			output, err := conn.Execute(command)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(string(output)).To(gomega.Equal(command))
+		}
+
+		file, err := ioutil.TempFile("", "copy")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.Remove(file.Name())
+		_, err = file.WriteString("content")
+		gomega.Expect(err).To(gomega.Succeed())
+		file.Close()
+
+		gomega.Expect(conn.Copy(file.Name(), "/tmp/target", false, true)).To(gomega.Succeed())
+		input, executed := server.getInput("sudo scp -t /tmp/target")
+		gomega.Expect(executed).To(gomega.BeTrue())
+		gomega.Expect(string(input)).To(gomega.ContainSubstring("content"))
+
+		gomega.Expect(server.getConnections()).To(gomega.Equal(1))
+		gomega.Expect(conn.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should connect for each operation if the connection is not established", func() {
+		conn := server.newConnection()
+		_, err := conn.Execute("first")
+		gomega.Expect(err).To(gomega.Succeed())
+		_, err = conn.Execute("second")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(server.getConnections()).To(gomega.Equal(2))
+
+		gomega.Expect(conn.Connect()).To(gomega.Succeed())
+		gomega.Expect(conn.Close()).To(gomega.Succeed())
+		_, err = conn.Execute("third")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(server.getConnections()).To(gomega.Equal(4))
+	})
+
+	ginkgo.It("should fail to connect to a host with an unexpected key", func() {
+		conn := server.newConnection()
+		conn.HostKeyCallback = NewFingerprintCallback("SHA256:unexpected")
+		err := conn.Connect()
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, ok := err.(*HostKeyError)
+		gomega.Expect(ok).To(gomega.BeTrue())
+	})
+})
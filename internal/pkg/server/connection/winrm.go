@@ -0,0 +1,560 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/rs/zerolog/log"
+	"github.com/satori/go.uuid"
+)
+
+// WinRMType defines the type of connection.
+const WinRMType ConnectionType = "winrm"
+
+const (
+	// DefaultWinRMPort with the default WinRM HTTP port.
+	DefaultWinRMPort = "5985"
+	// DefaultWinRMHTTPSPort with the default WinRM HTTPS port.
+	DefaultWinRMHTTPSPort = "5986"
+)
+
+// WS-Management actions and resources used to execute commands in a remote cmd shell.
+const (
+	winRMShellResource  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	winRMCreateAction   = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	winRMDeleteAction   = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	winRMCommandAction  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	winRMReceiveAction  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	winRMSignalAction   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+	winRMTerminateCode  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+	winRMCommandDone    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+	winRMTimedOutFault  = "TimedOut"
+	winRMOperationLimit = 60 * time.Second
+)
+
+// DefaultWinRMCommandTimeout with the maximum time a command runs in the host if the connection does not set it.
+const DefaultWinRMCommandTimeout = 30 * time.Minute
+
+// winRMCopyChunkSize with the number of base64 characters sent on each command of a copy, keeping the command line
+// under the 8191 characters accepted by cmd.
+const winRMCopyChunkSize = 6000
+
+// WinRMConnection structure with the information required to execute commands on a Windows host through WinRM.
+// Only basic authentication is supported, so the service must accept it. HTTPS is required unless AllowHTTP is set.
+type WinRMConnection struct {
+	Type     ConnectionType `json:"type"` // Needed for proper serialization
+	Address  string         `json:"address"`
+	Port     string         `json:"port,omitempty"`
+	Username string         `json:"username"`
+	Password string         `json:"password,omitempty"`
+	// HTTPS enables TLS in the connection with the WinRM service.
+	HTTPS bool `json:"https,omitempty"`
+	// AllowHTTP allows sending the credentials over plain HTTP, where basic authentication exposes the password.
+	AllowHTTP bool `json:"allowHTTP,omitempty"`
+	// CACert with the PEM certificate of the CA that signs the certificate of the host. The system CAs are used if
+	// it is empty.
+	CACert string `json:"caCert,omitempty"`
+	// CommandTimeout with the maximum time a command runs in the host, DefaultWinRMCommandTimeout if it is 0.
+	CommandTimeout time.Duration `json:"commandTimeout,omitempty"`
+
+	// lock protects the client, the shell and the local address.
+	lock sync.Mutex
+	// client to send the WS-Management requests.
+	client *http.Client
+	// shellID with the shell created by Connect. If it is empty, each operation creates its own shell.
+	shellID string
+	// localAddress used to reach the host in the last request.
+	localAddress string
+}
+
+// winRMStream is a chunk of the output of a command.
+type winRMStream struct {
+	Name    string `xml:"Name,attr"`
+	Content string `xml:",chardata"`
+}
+
+// winRMCommandState is the state of a command reported while receiving its output.
+type winRMCommandState struct {
+	State    string `xml:"State,attr"`
+	ExitCode int    `xml:"ExitCode"`
+}
+
+// winRMResponse contains the fields of the WS-Management responses used by the connection.
+type winRMResponse struct {
+	Body struct {
+		ShellID      string             `xml:"Shell>ShellId"`
+		CommandID    string             `xml:"CommandResponse>CommandId"`
+		Streams      []winRMStream      `xml:"ReceiveResponse>Stream"`
+		CommandState *winRMCommandState `xml:"ReceiveResponse>CommandState"`
+		Fault        *struct {
+			Code   string `xml:"Code>Subcode>Value"`
+			Reason string `xml:"Reason>Text"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// winRMFault is returned when the service answers with a SOAP fault.
+type winRMFault struct {
+	Code   string
+	Reason string
+}
+
+func (f *winRMFault) Error() string {
+	return fmt.Sprintf("winrm fault %s: %s", f.Code, strings.TrimSpace(f.Reason))
+}
+
+// getURL returns the endpoint of the WinRM service.
+func (conn *WinRMConnection) getURL() string {
+	scheme := "http"
+	if conn.HTTPS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/wsman", scheme, net.JoinHostPort(conn.Address, conn.Port))
+}
+
+// getClient returns the HTTP client, creating it on first use.
+func (conn *WinRMConnection) getClient() (*http.Client, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.client != nil {
+		return conn.client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if conn.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(conn.CACert)) {
+			return nil, errors.New("cannot parse winrm CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		// keep the local address as it is the address of the edge controller as seen by the host
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			c, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			host, _, err := net.SplitHostPort(c.LocalAddr().String())
+			if err == nil {
+				conn.lock.Lock()
+				conn.localAddress = host
+				conn.lock.Unlock()
+			}
+			return c, nil
+		},
+	}
+	conn.client = &http.Client{Transport: transport, Timeout: winRMOperationLimit + 30*time.Second}
+	return conn.client, nil
+}
+
+// LocalAddress returns the address used by the edge controller to reach the host.
+func (conn *WinRMConnection) LocalAddress() (string, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.localAddress == "" {
+		return "", errors.New("no request has been sent to the host")
+	}
+	return conn.localAddress, nil
+}
+
+// envelope builds a WS-Management request.
+func (conn *WinRMConnection) envelope(action string, shellID string, options string, body string) []byte {
+	selector := ""
+	if shellID != "" {
+		selector = fmt.Sprintf(`<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`, escapeXML(shellID))
+	}
+	return []byte(fmt.Sprintf(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" `+
+		`xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" `+
+		`xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" `+
+		`xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">`+
+		`<s:Header>`+
+		`<a:To>%s</a:To>`+
+		`<w:ResourceURI s:mustUnderstand="true">%s</w:ResourceURI>`+
+		`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`+
+		`<a:Action s:mustUnderstand="true">%s</a:Action>`+
+		`<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize>`+
+		`<a:MessageID>uuid:%s</a:MessageID>`+
+		`<w:OperationTimeout>PT%dS</w:OperationTimeout>`+
+		`%s%s`+
+		`</s:Header>`+
+		`<s:Body>%s</s:Body>`+
+		`</s:Envelope>`,
+		escapeXML(conn.getURL()), winRMShellResource, action, uuid.NewV4().String(), int(winRMOperationLimit.Seconds()),
+		selector, options, body))
+}
+
+// send posts a request to the WinRM service and parses the response.
+func (conn *WinRMConnection) send(request []byte) (*winRMResponse, error) {
+	if !conn.HTTPS && !conn.AllowHTTP {
+		return nil, errors.New("winrm basic authentication over http is not allowed")
+	}
+	client, err := conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, conn.getURL(), bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	httpRequest.SetBasicAuth(conn.Username, conn.Password)
+
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	content, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("winrm authentication failed")
+	}
+
+	response := &winRMResponse{}
+	xmlErr := xml.Unmarshal(content, response)
+	if xmlErr == nil && response.Body.Fault != nil {
+		return nil, &winRMFault{Code: response.Body.Fault.Code, Reason: response.Body.Fault.Reason}
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("winrm request failed with status %s", httpResponse.Status)
+	}
+	if xmlErr != nil {
+		return nil, fmt.Errorf("cannot parse winrm response: %v", xmlErr)
+	}
+	return response, nil
+}
+
+// createShell opens a cmd shell in the host.
+func (conn *WinRMConnection) createShell() (string, error) {
+	options := `<w:OptionSet><w:Option Name="WINRS_NOPROFILE">TRUE</w:Option>` +
+		`<w:Option Name="WINRS_CODEPAGE">65001</w:Option></w:OptionSet>`
+	body := `<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams>` +
+		`<rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	response, err := conn.send(conn.envelope(winRMCreateAction, "", options, body))
+	if err != nil {
+		return "", err
+	}
+	if response.Body.ShellID == "" {
+		return "", errors.New("winrm shell identifier not received")
+	}
+	return response.Body.ShellID, nil
+}
+
+// deleteShell closes a shell.
+func (conn *WinRMConnection) deleteShell(shellID string) error {
+	_, err := conn.send(conn.envelope(winRMDeleteAction, shellID, "", ""))
+	return err
+}
+
+// Connect creates a shell in the remote host. Commands and copies reuse it until Close is called.
+func (conn *WinRMConnection) Connect() error {
+	conn.lock.Lock()
+	connected := conn.shellID != ""
+	conn.lock.Unlock()
+	if connected {
+		return nil
+	}
+	shellID, err := conn.createShell()
+	if err != nil {
+		return err
+	}
+	conn.lock.Lock()
+	conn.shellID = shellID
+	conn.lock.Unlock()
+	return nil
+}
+
+// Close the shell created with Connect.
+func (conn *WinRMConnection) Close() error {
+	conn.lock.Lock()
+	shellID := conn.shellID
+	conn.shellID = ""
+	conn.lock.Unlock()
+	if shellID == "" {
+		return nil
+	}
+	return conn.deleteShell(shellID)
+}
+
+// getShell returns the shell created by Connect, or a new one if Connect has not been called. The returned function
+// releases the shell if it was created for the operation.
+func (conn *WinRMConnection) getShell() (string, func(), error) {
+	conn.lock.Lock()
+	shellID := conn.shellID
+	conn.lock.Unlock()
+	if shellID != "" {
+		return shellID, func() {}, nil
+	}
+	shellID, err := conn.createShell()
+	if err != nil {
+		return "", nil, err
+	}
+	return shellID, func() {
+		err := conn.deleteShell(shellID)
+		if err != nil {
+			log.Warn().Str("address", conn.Address).Err(err).Msg("cannot delete winrm shell")
+		}
+	}, nil
+}
+
+// run executes a command in a shell and returns its output and exit code.
+func (conn *WinRMConnection) run(shellID string, command string) ([]byte, []byte, int, error) {
+	body := fmt.Sprintf(`<rsp:CommandLine><rsp:Command>%s</rsp:Command></rsp:CommandLine>`, escapeXML(command))
+	response, err := conn.send(conn.envelope(winRMCommandAction, shellID, "", body))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	commandID := response.Body.CommandID
+	if commandID == "" {
+		return nil, nil, 0, errors.New("winrm command identifier not received")
+	}
+	defer conn.terminate(shellID, commandID)
+
+	timeout := conn.CommandTimeout
+	if timeout <= 0 {
+		timeout = DefaultWinRMCommandTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	var stdout, stderr bytes.Buffer
+	receive := fmt.Sprintf(`<rsp:Receive><rsp:DesiredStream CommandId="%s">stdout stderr</rsp:DesiredStream></rsp:Receive>`,
+		escapeXML(commandID))
+	for {
+		response, err = conn.send(conn.envelope(winRMReceiveAction, shellID, "", receive))
+		if fault, ok := err.(*winRMFault); ok && strings.HasSuffix(fault.Code, winRMTimedOutFault) {
+			// the command is still running
+			if time.Now().After(deadline) {
+				return nil, nil, 0, fmt.Errorf("winrm command has not finished after %s", timeout)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		for _, stream := range response.Body.Streams {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stream.Content))
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("cannot decode winrm output: %v", err)
+			}
+			if stream.Name == "stderr" {
+				stderr.Write(decoded)
+			} else {
+				stdout.Write(decoded)
+			}
+		}
+		state := response.Body.CommandState
+		if state != nil && state.State == winRMCommandDone {
+			return stdout.Bytes(), stderr.Bytes(), state.ExitCode, nil
+		}
+	}
+}
+
+// terminate releases the resources of a command.
+func (conn *WinRMConnection) terminate(shellID string, commandID string) {
+	body := fmt.Sprintf(`<rsp:Signal CommandId="%s"><rsp:Code>%s</rsp:Code></rsp:Signal>`,
+		escapeXML(commandID), winRMTerminateCode)
+	_, err := conn.send(conn.envelope(winRMSignalAction, shellID, "", body))
+	if err != nil {
+		log.Debug().Str("address", conn.Address).Err(err).Msg("cannot terminate winrm command")
+	}
+}
+
+// execute runs a command in a shell, failing if the exit code is not zero.
+func (conn *WinRMConnection) execute(shellID string, command string) ([]byte, error) {
+	stdout, stderr, exitCode, err := conn.run(shellID, command)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return stdout, fmt.Errorf("Error executing %s, exit code %d.\nSTDOUT\n%sSTDERR\n%s",
+			command, exitCode, stdout, stderr)
+	}
+	return stdout, nil
+}
+
+// Execute a given command.
+func (conn *WinRMConnection) Execute(command string) ([]byte, error) {
+	shellID, release, err := conn.getShell()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	log.Debug().Str("command", command).Msg("Executing command")
+	return conn.execute(shellID, command)
+}
+
+// Copy a file to a remote host or viceversa. WinRM does not transfer files, so the content is sent encoded in base64
+// in several commands that append it to a temporary file, which is decoded in the remote path. The remote path must
+// be the full path of the file. The sudo flag is ignored.
+func (conn *WinRMConnection) Copy(lpath, rpath string, remoteSource bool, sudo bool) error {
+	shellID, release, err := conn.getShell()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// rpath -> lpath
+	if remoteSource {
+		log.Info().Str("rpath", rpath).Msg("Transferring file")
+		output, err := conn.execute(shellID, powershellCommand(
+			fmt.Sprintf("[Convert]::ToBase64String([IO.File]::ReadAllBytes('%s'))", escapePowershell(rpath))))
+		if err != nil {
+			return err
+		}
+		content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+		if err != nil {
+			return fmt.Errorf("cannot decode remote file: %v", err)
+		}
+		return ioutil.WriteFile(lpath, content, 0644)
+	}
+
+	// lpath -> rpath
+	content, err := ioutil.ReadFile(lpath)
+	if err != nil {
+		log.Error().Str("lpath", lpath).Msg("Error opening")
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	log.Info().Int("size", len(content)).Str("address", conn.Address).Msg("Transferring file")
+
+	// cmd expands the temporary directory in the commands that write the file, PowerShell in the one that decodes it
+	tmpName := fmt.Sprintf("%s.b64", uuid.NewV4().String())
+	tmpPath := fmt.Sprintf(`%%TEMP%%\%s`, tmpName)
+	_, err = conn.execute(shellID, fmt.Sprintf(`type NUL > "%s"`, tmpPath))
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(encoded); start += winRMCopyChunkSize {
+		end := start + winRMCopyChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		_, err = conn.execute(shellID, fmt.Sprintf(`echo %s >> "%s"`, encoded[start:end], tmpPath))
+		if err != nil {
+			conn.execute(shellID, fmt.Sprintf(`del /q "%s"`, tmpPath))
+			return err
+		}
+	}
+	_, err = conn.execute(shellID, powershellCommand(fmt.Sprintf(
+		"$t = Join-Path $env:TEMP '%s'; $c = Get-Content -Raw $t; [IO.File]::WriteAllBytes('%s', [Convert]::FromBase64String(($c -replace '\\s', ''))); Remove-Item $t",
+		tmpName, escapePowershell(rpath))))
+	return err
+}
+
+// IsOnline checks the connectivity creating a shell, so we also know the authentication mechanism works.
+func (conn *WinRMConnection) IsOnline() (bool, error) {
+	shellID, err := conn.createShell()
+	if err != nil {
+		return false, err
+	}
+	err = conn.deleteShell(shellID)
+	if err != nil {
+		log.Warn().Str("address", conn.Address).Err(err).Msg("cannot delete winrm shell")
+	}
+	return true, nil
+}
+
+// powershellCommand returns the command line that executes a PowerShell script. The script is sent encoded in base64
+// of its UTF-16LE representation, so neither cmd nor PowerShell interpret its quotes or variables on the command line.
+func powershellCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], unit)
+	}
+	return fmt.Sprintf(`powershell -NoProfile -NonInteractive -EncodedCommand %s`, base64.StdEncoding.EncodeToString(encoded))
+}
+
+// escapePowershell escapes a value to be used between single quotes in PowerShell.
+func escapePowershell(value string) string {
+	return strings.Replace(value, "'", "''", -1)
+}
+
+// escapeXML escapes a value to be included in an XML document.
+func escapeXML(value string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
+
+// NewWinRMConnection creates a new WinRMConnection structure. Connections without HTTPS are refused unless allowHTTP
+// is set, as the password is sent with basic authentication.
+func NewWinRMConnection(address, port, username, password string, https bool, allowHTTP bool, caCert string) (*WinRMConnection, error) {
+	if address == "" {
+		return nil, errors.New("winrm connection needs address")
+	}
+
+	if port == "" {
+		port = DefaultWinRMPort
+		if https {
+			port = DefaultWinRMHTTPSPort
+		}
+	}
+
+	if username == "" {
+		return nil, errors.New("winrm connection needs username")
+	}
+
+	if password == "" {
+		return nil, errors.New("winrm connection needs password")
+	}
+
+	if !https && !allowHTTP {
+		return nil, errors.New("winrm basic authentication over http is not allowed")
+	}
+
+	return &WinRMConnection{
+		Type:      WinRMType,
+		Address:   address,
+		Port:      port,
+		Username:  username,
+		Password:  password,
+		HTTPS:     https,
+		AllowHTTP: allowHTTP,
+		CACert:    caCert,
+	}, nil
+}
+
+// NewEmptyWinRMConnection creates an empty WinRM connection.
+func NewEmptyWinRMConnection() Connection {
+	conn := &WinRMConnection{}
+	return Connection(conn)
+}
+
+func init() {
+	AddConnectionType(WinRMType, NewEmptyWinRMConnection)
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"unicode/utf16"
+)
+
+// testWinRMServer is a fake WinRM endpoint that executes the commands with a function. It only implements the
+// WS-Management operations used by WinRMConnection.
+type testWinRMServer struct {
+	sync.Mutex
+	server *httptest.Server
+	// run executes a command returning its output and exit code.
+	run func(command string) (string, int)
+	// shells with the number of shells created.
+	shells int
+	// open with the shells not deleted yet.
+	open map[string]bool
+	// commands with the commands executed in order.
+	commands []string
+	// results with the output and exit code of the commands pending to be received.
+	results map[string]testWinRMResult
+	// running makes the commands never finish, the receive requests time out.
+	running bool
+}
+
+type testWinRMResult struct {
+	output   string
+	exitCode int
+}
+
+// testWinRMRequest contains the fields of the requests used by the fake server.
+type testWinRMRequest struct {
+	Header struct {
+		Action   string `xml:"Action"`
+		Selector string `xml:"SelectorSet>Selector"`
+	} `xml:"Header"`
+	Body struct {
+		Command string `xml:"CommandLine>Command"`
+		Receive *struct {
+			CommandID string `xml:"CommandId,attr"`
+		} `xml:"Receive>DesiredStream"`
+	} `xml:"Body"`
+}
+
+const testWinRMEnvelope = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" ` +
+	`xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Header/><s:Body>%s</s:Body></s:Envelope>`
+
+// encodedCommand matches the command lines created by powershellCommand.
+var encodedCommand = regexp.MustCompile(`^powershell .*-EncodedCommand (\S+)$`)
+
+// decodePowershellCommand returns the script of a command line created by powershellCommand, or the command line
+// itself if it is not a PowerShell script.
+func decodePowershellCommand(command string) string {
+	matches := encodedCommand.FindStringSubmatch(command)
+	if matches == nil {
+		return command
+	}
+	encoded, err := base64.StdEncoding.DecodeString(matches[1])
+	if err != nil {
+		panic(err)
+	}
+	units := make([]uint16, len(encoded)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(encoded[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func newTestWinRMServer(run func(command string) (string, int)) *testWinRMServer {
+	server := &testWinRMServer{
+		run:     run,
+		open:    make(map[string]bool, 0),
+		results: make(map[string]testWinRMResult, 0),
+	}
+	server.server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// newConnection returns a connection to the server.
+func (s *testWinRMServer) newConnection(password string) *WinRMConnection {
+	address, err := url.Parse(s.server.URL)
+	if err != nil {
+		panic(err)
+	}
+	host, port, err := net.SplitHostPort(address.Host)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := NewWinRMConnection(host, port, testUsername, password, false, true, "")
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (s *testWinRMServer) Close() {
+	s.server.Close()
+}
+
+func (s *testWinRMServer) getShells() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.shells, len(s.open)
+}
+
+func (s *testWinRMServer) setRunning(running bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.running = running
+}
+
+func (s *testWinRMServer) getCommands() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *testWinRMServer) handle(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != testUsername || password != testPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	request := &testWinRMRequest{}
+	err = xml.Unmarshal(content, request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if request.Header.Action != winRMCreateAction && !s.open[request.Header.Selector] {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, testWinRMEnvelope, `<s:Fault><s:Code><s:Subcode><s:Value>w:InvalidSelectors</s:Value></s:Subcode></s:Code>`+
+			`<s:Reason><s:Text>unknown shell</s:Text></s:Reason></s:Fault>`)
+		return
+	}
+
+	switch request.Header.Action {
+	case winRMCreateAction:
+		s.shells++
+		shellID := fmt.Sprintf("shell-%d", s.shells)
+		s.open[shellID] = true
+		fmt.Fprintf(w, testWinRMEnvelope, fmt.Sprintf(`<rsp:Shell><rsp:ShellId>%s</rsp:ShellId></rsp:Shell>`, shellID))
+	case winRMDeleteAction:
+		delete(s.open, request.Header.Selector)
+		fmt.Fprintf(w, testWinRMEnvelope, "")
+	case winRMCommandAction:
+		s.commands = append(s.commands, request.Body.Command)
+		output, exitCode := s.run(decodePowershellCommand(request.Body.Command))
+		commandID := fmt.Sprintf("command-%d", len(s.commands))
+		s.results[commandID] = testWinRMResult{output, exitCode}
+		fmt.Fprintf(w, testWinRMEnvelope, fmt.Sprintf(`<rsp:CommandResponse><rsp:CommandId>%s</rsp:CommandId></rsp:CommandResponse>`, commandID))
+	case winRMReceiveAction:
+		if s.running {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, testWinRMEnvelope, `<s:Fault><s:Code><s:Subcode><s:Value>w:TimedOut</s:Value></s:Subcode></s:Code>`+
+				`<s:Reason><s:Text>operation timeout</s:Text></s:Reason></s:Fault>`)
+			return
+		}
+		result := s.results[request.Body.Receive.CommandID]
+		delete(s.results, request.Body.Receive.CommandID)
+		fmt.Fprintf(w, testWinRMEnvelope, fmt.Sprintf(`<rsp:ReceiveResponse>`+
+			`<rsp:Stream Name="stdout" CommandId="%s">%s</rsp:Stream>`+
+			`<rsp:Stream Name="stdout" CommandId="%s" End="true"></rsp:Stream>`+
+			`<rsp:CommandState CommandId="%s" State="%s"><rsp:ExitCode>%d</rsp:ExitCode></rsp:CommandState>`+
+			`</rsp:ReceiveResponse>`,
+			request.Body.Receive.CommandID, base64.StdEncoding.EncodeToString([]byte(result.output)),
+			request.Body.Receive.CommandID, request.Body.Receive.CommandID, winRMCommandDone, result.exitCode))
+	case winRMSignalAction:
+		fmt.Fprintf(w, testWinRMEnvelope, "")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
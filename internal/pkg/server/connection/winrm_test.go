@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package connection
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("WinRM connection", func() {
+
+	var server *testWinRMServer
+	// files with the content written by the copies
+	var files map[string][]byte
+
+	ginkgo.BeforeEach(func() {
+		files = make(map[string][]byte, 0)
+		var encoded strings.Builder
+		appendChunk := regexp.MustCompile(`^echo (\S+) >> `)
+		writeFile := regexp.MustCompile(`WriteAllBytes\('([^']+)'`)
+		readFile := regexp.MustCompile(`ReadAllBytes\('([^']+)'`)
+
+		server = newTestWinRMServer(func(command string) (string, int) {
+			if matches := appendChunk.FindStringSubmatch(command); matches != nil {
+				encoded.WriteString(matches[1])
+				return "", 0
+			}
+			if matches := writeFile.FindStringSubmatch(command); matches != nil {
+				content, err := base64.StdEncoding.DecodeString(encoded.String())
+				if err != nil {
+					return err.Error(), 1
+				}
+				files[matches[1]] = content
+				encoded.Reset()
+				return "", 0
+			}
+			if matches := readFile.FindStringSubmatch(command); matches != nil {
+				return base64.StdEncoding.EncodeToString(files[matches[1]]) + "\r\n", 0
+			}
+			if strings.HasPrefix(command, "exit") {
+				return "failed", 3
+			}
+			return command, 0
+		})
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should execute several commands in a single shell", func() {
+		conn := server.newConnection(testPassword)
+		gomega.Expect(conn.Connect()).To(gomega.Succeed())
+		for _, command := range []string{"first", "second"} {
+			output, err := conn.Execute(command)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(string(output)).To(gomega.Equal(command))
+		}
+		created, open := server.getShells()
+		gomega.Expect(created).To(gomega.Equal(1))
+		gomega.Expect(open).To(gomega.Equal(1))
+
+		gomega.Expect(conn.Close()).To(gomega.Succeed())
+		_, open = server.getShells()
+		gomega.Expect(open).To(gomega.Equal(0))
+
+		address, err := conn.LocalAddress()
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(address).To(gomega.Equal("127.0.0.1"))
+	})
+
+	ginkgo.It("should create a shell for each operation if the connection is not established", func() {
+		conn := server.newConnection(testPassword)
+		_, err := conn.Execute("first")
+		gomega.Expect(err).To(gomega.Succeed())
+		_, err = conn.Execute("second")
+		gomega.Expect(err).To(gomega.Succeed())
+		created, open := server.getShells()
+		gomega.Expect(created).To(gomega.Equal(2))
+		gomega.Expect(open).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should fail if the command exits with an error", func() {
+		conn := server.newConnection(testPassword)
+		output, err := conn.Execute("exit 3")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("exit code 3"))
+		gomega.Expect(string(output)).To(gomega.Equal("failed"))
+	})
+
+	ginkgo.It("should fail if the command does not finish in time", func() {
+		server.setRunning(true)
+		conn := server.newConnection(testPassword)
+		conn.CommandTimeout = 50 * time.Millisecond
+		_, err := conn.Execute("never ends")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("has not finished"))
+	})
+
+	ginkgo.It("should fail with invalid credentials", func() {
+		conn := server.newConnection("invalid")
+		online, err := conn.IsOnline()
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(online).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should copy files in both directions", func() {
+		content := make([]byte, 3*winRMCopyChunkSize)
+		for i := range content {
+			content[i] = byte(i)
+		}
+		file, err := ioutil.TempFile("", "winrm")
+		gomega.Expect(err).To(gomega.Succeed())
+		defer os.Remove(file.Name())
+		_, err = file.Write(content)
+		gomega.Expect(err).To(gomega.Succeed())
+		file.Close()
+
+		conn := server.newConnection(testPassword)
+		gomega.Expect(conn.Connect()).To(gomega.Succeed())
+		defer conn.Close()
+		remote := `C:\ProgramData\Nalej\bin\agent.exe`
+		gomega.Expect(conn.Copy(file.Name(), remote, false, false)).To(gomega.Succeed())
+		gomega.Expect(files[remote]).To(gomega.Equal(content))
+		// the content is split in several commands
+		gomega.Expect(len(server.getCommands())).To(gomega.BeNumerically(">", 4))
+
+		gomega.Expect(conn.Copy(file.Name(), remote, true, false)).To(gomega.Succeed())
+		copied, err := ioutil.ReadFile(file.Name())
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(copied).To(gomega.Equal(content))
+	})
+
+	ginkgo.It("should encode the PowerShell scripts", func() {
+		script := `Write-Output "it's %TEMP%" $env:TEMP`
+		command := powershellCommand(script)
+		gomega.Expect(command).ToNot(gomega.ContainSubstring(`"`))
+		gomega.Expect(decodePowershellCommand(command)).To(gomega.Equal(script))
+	})
+
+	ginkgo.It("should refuse basic authentication over http unless it is allowed", func() {
+		_, err := NewWinRMConnection("host", "", "user", "password", false, false, "")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+
+		conn, cErr := NewConnection(WinRMType, []byte(`{"type":"winrm","address":"host","username":"user","password":"password"}`))
+		gomega.Expect(cErr).To(gomega.Succeed())
+		online, err := conn.IsOnline()
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(online).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should be created from its JSON representation", func() {
+		conn, err := NewConnection(WinRMType, []byte(`{"type":"winrm","address":"host","port":"5986","username":"user","https":true}`))
+		gomega.Expect(err).To(gomega.Succeed())
+		winrm, ok := conn.(*WinRMConnection)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(winrm.HTTPS).To(gomega.BeTrue())
+		gomega.Expect(winrm.getURL()).To(gomega.Equal("https://host:5986/wsman"))
+	})
+})
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/rs/zerolog/log"
+	"github.com/satori/go.uuid"
+)
+
+// MaxBulkHosts with the maximum number of hosts of a bulk install.
+const MaxBulkHosts = 1024
+
+const BulkInstallResponseInfo = "Agent Bulk Install"
+
+// GetBulkTargets returns the hosts of a request with a list or range of hosts, or nil if the request targets a
+// single host.
+func GetBulkTargets(request *grpc_inventory_manager_go.InstallAgentRequest) ([]string, derrors.Error) {
+	params := request.GetParams()
+	list := params[entities.TargetHostsParam]
+	cidr := params[entities.TargetCIDRParam]
+	if list == "" && cidr == "" {
+		return nil, nil
+	}
+
+	candidates := make([]string, 0)
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			candidates = append(candidates, host)
+		}
+	}
+	if cidr != "" {
+		expanded, err := expandCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, expanded...)
+	}
+
+	hosts := make([]string, 0, len(candidates))
+	added := make(map[string]bool, len(candidates))
+	for _, host := range candidates {
+		if !added[host] {
+			added[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, derrors.NewInvalidArgumentError("no target hosts found")
+	}
+	if len(hosts) > MaxBulkHosts {
+		return nil, derrors.NewInvalidArgumentError("too many target hosts").WithParams(len(hosts), MaxBulkHosts)
+	}
+	return hosts, nil
+}
+
+// expandCIDR returns the addresses of a range. The network and broadcast addresses of IPv4 ranges are excluded.
+func expandCIDR(cidr string) ([]string, derrors.Error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid target range", err).WithParams(cidr)
+	}
+	ones, size := network.Mask.Size()
+	// larger ranges would overflow the count, they are far over the limit anyway
+	if size-ones > 30 {
+		return nil, derrors.NewInvalidArgumentError("target range too large").WithParams(cidr, MaxBulkHosts)
+	}
+	count := 1 << uint(size-ones)
+	skipEdges := network.IP.To4() != nil && count > 2
+	available := count
+	if skipEdges {
+		available -= 2
+	}
+	if available > MaxBulkHosts {
+		return nil, derrors.NewInvalidArgumentError("target range too large").WithParams(cidr, MaxBulkHosts)
+	}
+
+	hosts := make([]string, 0, count)
+	current := make(net.IP, len(network.IP))
+	copy(current, network.IP)
+	for i := 0; i < count; i++ {
+		if !skipEdges || (i != 0 && i != count-1) {
+			hosts = append(hosts, current.String())
+		}
+		for j := len(current) - 1; j >= 0; j-- {
+			current[j]++
+			if current[j] != 0 {
+				break
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// runBulk executes an operation on each host with a pool of workers, and returns the errors of the failed hosts.
+func runBulk(hosts []string, workers int, operation func(host string) derrors.Error) map[string]derrors.Error {
+	if workers <= 0 {
+		workers = DefaultInstallWorkers
+	}
+	if workers > len(hosts) {
+		workers = len(hosts)
+	}
+	pending := make(chan string, len(hosts))
+	for _, host := range hosts {
+		pending <- host
+	}
+	close(pending)
+
+	var lock sync.Mutex
+	failed := make(map[string]derrors.Error, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range pending {
+				err := operation(host)
+				if err != nil {
+					lock.Lock()
+					failed[host] = err
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// bulkSummary describes the result of a bulk install, listing the failed hosts in the order they were requested.
+func bulkSummary(hosts []string, failed map[string]derrors.Error) string {
+	summary := fmt.Sprintf("Agent installed in %d of %d hosts", len(hosts)-len(failed), len(hosts))
+	if len(failed) == 0 {
+		return summary
+	}
+	failures := make([]string, 0, len(failed))
+	for _, host := range hosts {
+		if err, exists := failed[host]; exists {
+			failures = append(failures, fmt.Sprintf("%s (%s)", host, err.Error()))
+		}
+	}
+	return fmt.Sprintf("%s, failed: %s", summary, strings.Join(failures, ", "))
+}
+
+// bulkInstallAgent installs the agent in several hosts with the credentials of the request. Each host is reported
+// as a child operation with the identifier <operation_id>/<host>, and the operation itself receives a summary once
+// all the hosts have finished. The operation is journaled so a restart before the summary is reported as a failure.
+func (m *Manager) bulkInstallAgent(request *grpc_inventory_manager_go.InstallAgentRequest, hosts []string) (*grpc_inventory_manager_go.EdgeControllerOpResponse, error) {
+	opID := uuid.NewV4().String()
+	log.Info().Str("operationID", opID).Int("hosts", len(hosts)).Msg("triggering bulk agent install")
+
+	journal := &entities.InstallOperation{
+		OperationId:      opID,
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		Created:          time.Now().Unix(),
+	}
+	m.agentInstaller.journalStep(journal, fmt.Sprintf("install in %d hosts", len(hosts)))
+
+	m.runInBackground(func() {
+		defer m.agentInstaller.removeJournal(opID)
+		failed := runBulk(hosts, m.config.InstallWorkers, func(host string) derrors.Error {
+			// each host has its own token so it cannot be reused by other agents
+			tokenInfo, err := m.createJoinToken(asset.JoinTokenOptions{MaxUses: 1})
+			if err != nil {
+				return err
+			}
+			err = m.agentInstaller.InstallAgent(fmt.Sprintf("%s/%s", opID, host), tokenInfo.Token,
+				&grpc_inventory_manager_go.InstallAgentRequest{
+					OrganizationId:   request.OrganizationId,
+					EdgeControllerId: request.EdgeControllerId,
+					AgentType:        request.AgentType,
+					Credentials:      request.Credentials,
+					TargetHost:       host,
+					CaCert:           request.CaCert,
+					Params:           request.Params,
+				})
+			if err != nil {
+				if rErr := m.provider.RemoveJoinToken(tokenInfo.Token); rErr != nil {
+					log.Warn().Str("operationID", opID).Str("host", host).Str("trace", rErr.DebugReport()).
+						Msg("cannot revoke join token")
+				}
+			}
+			return err
+		})
+
+		status := grpc_inventory_go.OpStatus_SUCCESS
+		if len(failed) > 0 {
+			status = grpc_inventory_go.OpStatus_FAIL
+		}
+		summary := bulkSummary(hosts, failed)
+		log.Info().Str("operationID", opID).Str("summary", summary).Msg("bulk agent install finished")
+		nErr := m.notifier.NotifyECOpResponse(&grpc_inventory_manager_go.EdgeControllerOpResponse{
+			OrganizationId:   request.OrganizationId,
+			EdgeControllerId: request.EdgeControllerId,
+			OperationId:      opID,
+			Status:           status,
+			Timestamp:        time.Now().Unix(),
+			Info:             summary,
+		})
+		if nErr != nil {
+			log.Error().Str("trace", nErr.DebugReport()).Msg("notify EC op response failed")
+		}
+	})
+
+	return &grpc_inventory_manager_go.EdgeControllerOpResponse{
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		OperationId:      opID,
+		Status:           grpc_inventory_go.OpStatus_INPROGRESS,
+		Timestamp:        time.Now().Unix(),
+		Info:             fmt.Sprintf("%s in %d hosts", BulkInstallResponseInfo, len(hosts)),
+	}, nil
+}
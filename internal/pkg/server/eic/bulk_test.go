@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Bulk install", func() {
+
+	newRequest := func(params map[string]string) *grpc_inventory_manager_go.InstallAgentRequest {
+		return &grpc_inventory_manager_go.InstallAgentRequest{Params: params}
+	}
+
+	ginkgo.Context("obtaining the target hosts", func() {
+		ginkgo.It("should return nil for single host requests", func() {
+			hosts, err := GetBulkTargets(newRequest(nil))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.BeNil())
+		})
+
+		ginkgo.It("should combine the list and the range without duplicates", func() {
+			hosts, err := GetBulkTargets(newRequest(map[string]string{
+				entities.TargetHostsParam: " host1, 10.0.0.2,,host1",
+				entities.TargetCIDRParam:  "10.0.0.0/29",
+			}))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.Equal([]string{
+				"host1", "10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}))
+		})
+
+		ginkgo.It("should keep all the addresses of point to point ranges", func() {
+			hosts, err := GetBulkTargets(newRequest(map[string]string{entities.TargetCIDRParam: "192.168.1.10/31"}))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.Equal([]string{"192.168.1.10", "192.168.1.11"}))
+		})
+
+		ginkgo.It("should expand ranges crossing a byte boundary", func() {
+			hosts, err := GetBulkTargets(newRequest(map[string]string{entities.TargetCIDRParam: "10.0.0.0/23"}))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.HaveLen(510))
+			gomega.Expect(hosts).To(gomega.ContainElement("10.0.1.0"))
+			gomega.Expect(hosts[len(hosts)-1]).To(gomega.Equal("10.0.1.254"))
+		})
+
+		ginkgo.It("should accept ranges up to the maximum number of hosts", func() {
+			hosts, err := GetBulkTargets(newRequest(map[string]string{entities.TargetCIDRParam: "10.0.0.0/22"}))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.HaveLen(1022))
+			hosts, err = GetBulkTargets(newRequest(map[string]string{entities.TargetCIDRParam: "fd00::/118"}))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(hosts).To(gomega.HaveLen(MaxBulkHosts))
+			_, err = expandCIDR("10.0.0.0/21")
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should reject invalid or large ranges", func() {
+			for _, cidr := range []string{"10.0.0.0", "10.0.0.0/8", "10.0.0.0/21", "fd00::/117", "fd00::/64"} {
+				_, err := GetBulkTargets(newRequest(map[string]string{entities.TargetCIDRParam: cidr}))
+				gomega.Expect(err).NotTo(gomega.Succeed(), cidr)
+			}
+			_, err := GetBulkTargets(newRequest(map[string]string{entities.TargetHostsParam: " , "}))
+			gomega.Expect(err).NotTo(gomega.Succeed())
+		})
+	})
+
+	ginkgo.Context("running the operations", func() {
+		ginkgo.It("should limit the number of concurrent operations", func() {
+			hosts := make([]string, 0)
+			for i := 0; i < 20; i++ {
+				hosts = append(hosts, fmt.Sprintf("host%d", i))
+			}
+			var lock sync.Mutex
+			running, maxRunning, executed := 0, 0, 0
+			failed := runBulk(hosts, 3, func(host string) derrors.Error {
+				lock.Lock()
+				running++
+				executed++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				lock.Unlock()
+				time.Sleep(time.Millisecond)
+				lock.Lock()
+				running--
+				lock.Unlock()
+				if host == "host7" {
+					return derrors.NewInternalError("unreachable")
+				}
+				return nil
+			})
+			gomega.Expect(executed).To(gomega.Equal(len(hosts)))
+			gomega.Expect(maxRunning).To(gomega.BeNumerically("<=", 3))
+			gomega.Expect(failed).To(gomega.HaveLen(1))
+			gomega.Expect(failed).To(gomega.HaveKey("host7"))
+		})
+
+		ginkgo.It("should remove the join token of a failed install", func() {
+			provider := asset.NewMockupAssetProvider()
+			notifier := agent.NewNotifier(time.Minute, provider, nil, "org", "ec")
+			manager := NewManager(config.Config{}, provider, nil, notifier, nil)
+			response, err := manager.bulkInstallAgent(&grpc_inventory_manager_go.InstallAgentRequest{
+				OrganizationId: "org", EdgeControllerId: "ec"}, []string{"host1", "host2"})
+			gomega.Expect(err).To(gomega.Succeed())
+
+			// the install fails as there are no recipes
+			gomega.Eventually(func() []entities.EdgeControllerOpResponse {
+				responses := make([]entities.EdgeControllerOpResponse, 0)
+				for _, r := range getECOpResponses(provider) {
+					if r.OperationId == response.OperationId {
+						responses = append(responses, r)
+					}
+				}
+				return responses
+			}).Should(gomega.HaveLen(1))
+			tokens, err := provider.ListJoinTokens()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(tokens).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should summarize the result", func() {
+			hosts := []string{"host1", "host2", "host3"}
+			gomega.Expect(bulkSummary(hosts, map[string]derrors.Error{})).To(gomega.Equal("Agent installed in 3 of 3 hosts"))
+			summary := bulkSummary(hosts, map[string]derrors.Error{
+				"host3": derrors.NewInternalError("unreachable"),
+				"host1": derrors.NewInternalError("denied"),
+			})
+			gomega.Expect(summary).To(gomega.Equal("Agent installed in 1 of 3 hosts, failed: host1 (denied), host3 (unreachable)"))
+		})
+	})
+})
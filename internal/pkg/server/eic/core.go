@@ -0,0 +1,420 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/rs/zerolog/log"
+	"github.com/satori/go.uuid"
+)
+
+// Operations of the core plugin executed by the edge controller itself instead of being queued for the agent. Their
+// result is returned in the info of the response.
+const (
+	// AgentStartsOp returns the recent starts of the agent as a JSON list, the most recent first.
+	AgentStartsOp = "agent_starts"
+	// ConnectivityOp returns the connectivity of the edge controller with the management cluster as JSON, including
+	// the metrics of the calls. The asset of the request is ignored.
+	ConnectivityOp = "connectivity"
+	// CancelOperationOp cancels the operation of the asset whose identifier is in the OperationIdParam. The
+	// operation is reported as canceled, and the info of the response has a CancelResult as JSON.
+	CancelOperationOp = "cancel_operation"
+	// CreateJoinTokenOp creates a join token restricted by the TTLParam, MaxUsesParam and LabelParamPrefix params,
+	// and returns it as JSON. The asset of the request is ignored.
+	CreateJoinTokenOp = "create_join_token"
+	// ListJoinTokensOp returns the join tokens as a JSON list. The asset of the request is ignored.
+	ListJoinTokensOp = "list_join_tokens"
+	// RevokeJoinTokenOp revokes the join token in the TokenParam. The asset of the request is ignored.
+	RevokeJoinTokenOp = "revoke_join_token"
+	// RotateTokenOp replaces the token of the asset. The new token is delivered to the agent with an UpdateTokenOp and
+	// the previous one is still valid for the duration in the GraceParam. The info of the response has a TokenRotation
+	// as JSON.
+	RotateTokenOp = "rotate_token"
+	// RevokeTokenOp revokes the token of the asset in the TokenParam immediately, or all of them if the param is not
+	// set. An agent whose current token is revoked cannot authenticate and must join again.
+	RevokeTokenOp = "revoke_token"
+	// UninstallAgentOp removes the agent from the host of the asset through SSH, for agents that cannot execute
+	// their own uninstall. The host and credentials are taken from the TargetHostParam, UsernameParam, PasswordParam or
+	// ClientCertificateParam and SudoParam params, and the host key is verified as in an install. The progress is
+	// reported as edge controller operation responses with the identifier of the request, and the asset is removed
+	// once the agent has been uninstalled.
+	UninstallAgentOp = "uninstall_agent"
+)
+
+// TokenRotation with the result of a RotateTokenOp.
+type TokenRotation struct {
+	// OperationId with the operation that delivers the new token to the agent.
+	OperationId string `json:"operation_id"`
+	// GraceUntil with the timestamp when the previous token stops being valid.
+	GraceUntil int64 `json:"grace_until"`
+}
+
+const (
+	// OperationIdParam with the identifier of the operation to cancel.
+	OperationIdParam = "operation_id"
+	// TTLParam with the duration of a join token.
+	TTLParam = "ttl"
+	// MaxUsesParam with the number of agents that can join with a join token.
+	MaxUsesParam = "max_uses"
+	// LabelParamPrefix is the prefix of the params with the labels of the agents that join with a join token. For
+	// example, the param label.zone=north adds the label zone with value north.
+	LabelParamPrefix = "label."
+	// TokenParam with the join token or the asset token to revoke.
+	TokenParam = "token"
+	// GraceParam with the time the previous token of an asset is valid after a rotation.
+	GraceParam = "grace"
+	// TargetHostParam with the host where the agent is uninstalled.
+	TargetHostParam = "target_host"
+	// UsernameParam with the user that connects to the target host.
+	UsernameParam = "username"
+	// PasswordParam with the password of the user.
+	PasswordParam = "password"
+	// ClientCertificateParam with the private key of the user, used instead of the password.
+	ClientCertificateParam = "client_certificate"
+	// SudoParam set to true executes the commands with sudo.
+	SudoParam = "sudo"
+)
+
+// CancelResult with the result of a CancelOperationOp.
+type CancelResult struct {
+	// OperationId with the canceled operation.
+	OperationId string `json:"operation_id"`
+	// BeforeDelivery is true if the operation was removed from the queue before the agent received it. Otherwise the
+	// agent may still execute it, but it is not delivered again and its response is ignored.
+	BeforeDelivery bool `json:"before_delivery"`
+}
+
+// coreOperation executes an operation of the core plugin and returns the info of the response.
+type coreOperation func(m *Manager, request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error)
+
+var coreOperations = map[string]coreOperation{
+	AgentStartsOp:     (*Manager).agentStarts,
+	ConnectivityOp:    (*Manager).connectivity,
+	CancelOperationOp: (*Manager).cancelOperation,
+	CreateJoinTokenOp: (*Manager).createJoinTokenOp,
+	ListJoinTokensOp:  (*Manager).listJoinTokens,
+	RevokeJoinTokenOp: (*Manager).revokeJoinToken,
+	RotateTokenOp:     (*Manager).rotateToken,
+	RevokeTokenOp:     (*Manager).revokeToken,
+	UninstallAgentOp:  (*Manager).uninstallAgentOp,
+}
+
+// asyncCoreOperations with the operations of the core plugin that continue after the response is returned. They are
+// reported as in progress and their result is notified later.
+var asyncCoreOperations = map[string]bool{
+	UninstallAgentOp: true,
+}
+
+// executeCoreOperation executes the request if it is an operation of the core plugin handled by the edge controller.
+// The returned flag is false if the request must be queued for the agent.
+func (m *Manager) executeCoreOperation(request *grpc_inventory_manager_go.AgentOpRequest) (*grpc_inventory_manager_go.AgentOpResponse, bool, derrors.Error) {
+	if request.Plugin != agent.CorePluging {
+		return nil, false, nil
+	}
+	operation, exists := coreOperations[request.Operation]
+	if !exists {
+		return nil, false, nil
+	}
+	log.Debug().Str("operation", request.Operation).Str("assetID", request.AssetId).Msg("executing core operation")
+	info, err := operation(m, request)
+	if err != nil {
+		return nil, true, err
+	}
+	status := grpc_inventory_go.OpStatus_SUCCESS
+	if asyncCoreOperations[request.Operation] {
+		status = grpc_inventory_go.OpStatus_INPROGRESS
+	}
+	return &grpc_inventory_manager_go.AgentOpResponse{
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		AssetId:          request.AssetId,
+		OperationId:      request.OperationId,
+		Timestamp:        time.Now().Unix(),
+		Status:           status,
+		Info:             info,
+	}, true, nil
+}
+
+// agentStarts returns the recent starts of the agent of the request.
+func (m *Manager) agentStarts(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	starts, err := m.provider.GetAgentStarts(request.AssetId)
+	if err != nil {
+		return "", err
+	}
+	content, jErr := json.Marshal(starts)
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal agent starts")
+	}
+	return string(content), nil
+}
+
+// connectivity returns the connectivity with the management cluster.
+func (m *Manager) connectivity(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	tracker := m.notifier.Connectivity()
+	if tracker == nil {
+		return "", derrors.NewFailedPreconditionError("connectivity with the management cluster is not tracked")
+	}
+	content, jErr := json.Marshal(tracker.Get())
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal connectivity")
+	}
+	return string(content), nil
+}
+
+// cancelOperation removes an operation from the queue of the asset or, if it has already been delivered, flags it so
+// it is not delivered again. The operation is reported as canceled to the management cluster.
+func (m *Manager) cancelOperation(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	operationID := request.Params[OperationIdParam]
+	if operationID == "" {
+		return "", derrors.NewInvalidArgumentError("operation_id param cannot be empty")
+	}
+
+	result := CancelResult{OperationId: operationID, BeforeDelivery: true}
+	operation, err := m.provider.RemovePendingOperation(request.AssetId, operationID)
+	if err != nil {
+		if err.Type() != derrors.NotFound {
+			return "", err
+		}
+		operation, err = m.provider.CancelDeliveredOperation(request.AssetId, operationID)
+		if err != nil {
+			return "", err
+		}
+		result.BeforeDelivery = false
+	}
+	log.Info().Str("assetID", request.AssetId).Str("operationID", operationID).
+		Bool("beforeDelivery", result.BeforeDelivery).Msg("agent operation canceled")
+
+	err = m.notifier.NotifyCallback(&grpc_inventory_manager_go.AgentOpResponse{
+		OrganizationId:   operation.OrganizationId,
+		EdgeControllerId: operation.EdgeControllerId,
+		AssetId:          operation.AssetId,
+		OperationId:      operation.OperationId,
+		Timestamp:        time.Now().Unix(),
+		Status:           grpc_inventory_go.OpStatus_CANCELED,
+		Info:             CanceledByRequestResponseInfo,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	content, jErr := json.Marshal(result)
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal cancel result")
+	}
+	return string(content), nil
+}
+
+// joinTokenOptions reads the restrictions of a join token from the params of a request.
+func joinTokenOptions(params map[string]string) (asset.JoinTokenOptions, derrors.Error) {
+	options := asset.JoinTokenOptions{}
+	if ttl, exists := params[TTLParam]; exists {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return options, derrors.NewInvalidArgumentError("ttl must be a positive duration").WithParams(ttl)
+		}
+		options.TTL = duration
+	}
+	if maxUses, exists := params[MaxUsesParam]; exists {
+		uses, err := strconv.Atoi(maxUses)
+		if err != nil || uses < 0 {
+			return options, derrors.NewInvalidArgumentError("max_uses must be a non negative integer").WithParams(maxUses)
+		}
+		options.MaxUses = uses
+	}
+	for key, value := range params {
+		if strings.HasPrefix(key, LabelParamPrefix) {
+			label := strings.TrimPrefix(key, LabelParamPrefix)
+			if label == "" {
+				return options, derrors.NewInvalidArgumentError("label name cannot be empty").WithParams(key)
+			}
+			if options.Labels == nil {
+				options.Labels = make(map[string]string, 0)
+			}
+			options.Labels[label] = value
+		}
+	}
+	return options, nil
+}
+
+// createJoinTokenOp creates a join token with the restrictions in the params of the request.
+func (m *Manager) createJoinTokenOp(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	options, err := joinTokenOptions(request.Params)
+	if err != nil {
+		return "", err
+	}
+	token, err := m.createJoinToken(options)
+	if err != nil {
+		return "", err
+	}
+	content, jErr := json.Marshal(token)
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal join token")
+	}
+	return string(content), nil
+}
+
+// listJoinTokens returns the join tokens of the edge controller.
+func (m *Manager) listJoinTokens(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	tokens, err := m.provider.ListJoinTokens()
+	if err != nil {
+		return "", err
+	}
+	content, jErr := json.Marshal(tokens)
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal join tokens")
+	}
+	return string(content), nil
+}
+
+// revokeJoinToken revokes the join token in the params of the request.
+func (m *Manager) revokeJoinToken(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	token := request.Params[TokenParam]
+	if token == "" {
+		return "", derrors.NewInvalidArgumentError("token param cannot be empty")
+	}
+	if err := m.provider.RevokeJoinToken(token); err != nil {
+		return "", err
+	}
+	log.Info().Str("token", token).Msg("agent join token revoked")
+	return "", nil
+}
+
+// rotateToken replaces the token of the asset and queues the operation that delivers the new token to the agent.
+func (m *Manager) rotateToken(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	grace := m.config.AgentTokenGrace
+	if value, exists := request.Params[GraceParam]; exists {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return "", derrors.NewInvalidArgumentError("grace must be a positive duration").WithParams(value)
+		}
+		grace = duration
+	}
+
+	now := time.Now()
+	token := uuid.NewV4().String()
+	graceUntil := now.Add(grace).Unix()
+	if _, err := m.provider.RotateAssetToken(request.AssetId, token, graceUntil); err != nil {
+		return "", err
+	}
+
+	// the operation is not rejected by the capacity of the queue, and it is useless once the grace period is over
+	operation := entities.AgentOpRequest{
+		Created:          now.Unix(),
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		AssetId:          request.AssetId,
+		OperationId:      uuid.NewV4().String(),
+		Operation:        agent.UpdateTokenOp,
+		Plugin:           agent.CorePluging,
+		Params:           map[string]string{agent.NewTokenParam: token},
+		Priority:         agent.CorePriority,
+		Deadline:         graceUntil,
+	}
+	if _, err := m.provider.AddPendingOperation(operation, 0); err != nil {
+		return "", err
+	}
+	log.Info().Str("assetID", request.AssetId).Str("operationID", operation.OperationId).
+		Int64("graceUntil", graceUntil).Msg("agent token rotated")
+
+	content, jErr := json.Marshal(TokenRotation{OperationId: operation.OperationId, GraceUntil: graceUntil})
+	if jErr != nil {
+		return "", derrors.AsError(jErr, "cannot marshal token rotation")
+	}
+	return string(content), nil
+}
+
+// revokeToken revokes the token in the params of the request, or all the tokens of the asset.
+func (m *Manager) revokeToken(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	if err := m.provider.RevokeAssetToken(request.AssetId, request.Params[TokenParam]); err != nil {
+		return "", err
+	}
+	log.Warn().Str("assetID", request.AssetId).Bool("allTokens", request.Params[TokenParam] == "").
+		Msg("agent token revoked")
+	return "", nil
+}
+
+// uninstallRequest reads the host and credentials of an UninstallAgentOp from the params of a request.
+func uninstallRequest(request *grpc_inventory_manager_go.AgentOpRequest) (*UninstallRequest, derrors.Error) {
+	params := request.Params
+	if params[TargetHostParam] == "" {
+		return nil, derrors.NewInvalidArgumentError("target_host param cannot be empty")
+	}
+	if params[UsernameParam] == "" {
+		return nil, derrors.NewInvalidArgumentError("username param cannot be empty")
+	}
+	credentials := &grpc_inventory_manager_go.InstallCredentials{
+		Username: params[UsernameParam],
+		IsSudoer: params[SudoParam] == "true",
+	}
+	switch {
+	case params[PasswordParam] != "" && params[ClientCertificateParam] != "":
+		return nil, derrors.NewInvalidArgumentError("only one of password and client_certificate params can be set")
+	case params[PasswordParam] != "":
+		credentials.Credentials = &grpc_inventory_manager_go.InstallCredentials_Password{Password: params[PasswordParam]}
+	case params[ClientCertificateParam] != "":
+		credentials.Credentials = &grpc_inventory_manager_go.InstallCredentials_ClientCertificate{
+			ClientCertificate: params[ClientCertificateParam]}
+	default:
+		return nil, derrors.NewInvalidArgumentError("password or client_certificate param must be set")
+	}
+	return &UninstallRequest{
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		AssetId:          request.AssetId,
+		TargetHost:       params[TargetHostParam],
+		Credentials:      credentials,
+		Params:           params,
+	}, nil
+}
+
+// uninstallAgentOp uninstalls the agent of the asset through SSH in the background. Once the agent is removed from
+// the host, the asset is removed as in a forced uninstall since the agent cannot confirm it.
+func (m *Manager) uninstallAgentOp(request *grpc_inventory_manager_go.AgentOpRequest) (string, derrors.Error) {
+	uninstall, err := uninstallRequest(request)
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.provider.GetManagedAsset(request.AssetId); err != nil {
+		return "", err
+	}
+
+	m.runInBackground(func() {
+		if err := m.agentInstaller.UninstallAgent(request.OperationId, uninstall); err != nil {
+			return
+		}
+		err := m.uninstallAsset(&grpc_inventory_manager_go.FullUninstallAgentRequest{
+			OrganizationId:   request.OrganizationId,
+			EdgeControllerId: request.EdgeControllerId,
+			AssetId:          request.AssetId,
+			Force:            true,
+		}, request.OperationId)
+		if err != nil {
+			log.Error().Str("assetID", request.AssetId).Str("trace", err.DebugReport()).Msg("cannot remove uninstalled agent")
+		}
+	})
+	return UninstallResponseInfo, nil
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/proxy"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Core operations", func() {
+
+	var provider *asset.MockupAssetProvider
+	var manager Manager
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		notifier := agent.NewNotifier(time.Minute, provider, nil, "org", "ec")
+		manager = NewManager(config.Config{}, provider, nil, notifier, nil)
+		gomega.Expect(provider.AddManagedAsset(entities.AgentJoinInfo{AssetId: "asset", Token: "token"})).To(gomega.Succeed())
+	})
+
+	coreRequest := func(operation string) *grpc_inventory_manager_go.AgentOpRequest {
+		return &grpc_inventory_manager_go.AgentOpRequest{
+			OrganizationId:   "org",
+			EdgeControllerId: "ec",
+			AssetId:          "asset",
+			OperationId:      "op",
+			Plugin:           agent.CorePluging,
+			Operation:        operation,
+		}
+	}
+
+	ginkgo.It("should return the recent starts of an agent", func() {
+		gomega.Expect(provider.AddAgentStart(entities.AgentStartInfo{Created: 1, AssetId: "asset", Ip: "10.0.0.1"})).To(gomega.Succeed())
+		gomega.Expect(provider.AddAgentStart(entities.AgentStartInfo{Created: 2, AssetId: "asset", Ip: "10.0.0.2"})).To(gomega.Succeed())
+
+		response, err := manager.TriggerAgentOperation(coreRequest(AgentStartsOp))
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		starts := make([]entities.AgentStartInfo, 0)
+		gomega.Expect(json.Unmarshal([]byte(response.Info), &starts)).To(gomega.Succeed())
+		gomega.Expect(starts).To(gomega.HaveLen(2))
+		gomega.Expect(starts[0].Ip).To(gomega.Equal("10.0.0.2"))
+
+		pending, err := provider.GetPendingOperations("asset", false)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should queue the core operations of the agent", func() {
+		response, err := manager.TriggerAgentOperation(coreRequest(agent.UninstallOp))
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+		pending, err := provider.GetPendingOperations("asset", false)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(pending).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should return the connectivity with the management cluster", func() {
+		tracker := proxy.NewConnectivityTracker()
+		tracker.Record(nil, proxy.CircuitClosed)
+		manager.notifier.SetConnectivity(tracker)
+
+		response, err := manager.TriggerAgentOperation(coreRequest(ConnectivityOp))
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		connectivity := proxy.Connectivity{}
+		gomega.Expect(json.Unmarshal([]byte(response.Info), &connectivity)).To(gomega.Succeed())
+		gomega.Expect(connectivity.State).To(gomega.Equal(proxy.Online))
+	})
+
+	ginkgo.Context("cancel operation", func() {
+		var request *grpc_inventory_manager_go.AgentOpRequest
+
+		ginkgo.BeforeEach(func() {
+			response, err := manager.TriggerAgentOperation(coreRequest(agent.UninstallOp))
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+			request = coreRequest(CancelOperationOp)
+			request.OperationId = "cancel"
+			request.Params = map[string]string{OperationIdParam: "op"}
+		})
+
+		cancel := func() CancelResult {
+			response, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+			result := CancelResult{}
+			gomega.Expect(json.Unmarshal([]byte(response.Info), &result)).To(gomega.Succeed())
+			gomega.Expect(result.OperationId).To(gomega.Equal("op"))
+			return result
+		}
+
+		canceledResponses := func() []string {
+			messages, err := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(err).To(gomega.Succeed())
+			canceled := make([]string, 0)
+			for _, msg := range messages {
+				response := &entities.AgentOpResponse{}
+				gomega.Expect(msg.GetPayload(response)).To(gomega.Succeed())
+				if response.Status == grpc_inventory_go.OpStatus_CANCELED.String() {
+					canceled = append(canceled, response.OperationId)
+				}
+			}
+			return canceled
+		}
+
+		ginkgo.It("should remove a queued operation before its delivery", func() {
+			gomega.Expect(cancel().BeforeDelivery).To(gomega.BeTrue())
+			pending, err := provider.GetPendingOperations("asset", false)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(pending).To(gomega.BeEmpty())
+			gomega.Expect(canceledResponses()).To(gomega.Equal([]string{"op"}))
+		})
+
+		ginkgo.It("should flag an operation already delivered", func() {
+			_, _, err := provider.TakePendingOperations("asset", time.Now().Unix(), asset.DeliveryPolicy{Limit: 1})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(cancel().BeforeDelivery).To(gomega.BeFalse())
+			delivered, err := provider.GetDeliveredOperations("asset")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(delivered).To(gomega.HaveLen(1))
+			gomega.Expect(delivered[0].Canceled).To(gomega.BeTrue())
+			gomega.Expect(canceledResponses()).To(gomega.Equal([]string{"op"}))
+		})
+
+		ginkgo.It("should fail to cancel an unknown operation", func() {
+			request.Params[OperationIdParam] = "unknown"
+			_, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(canceledResponses()).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should fail if the operation is not specified", func() {
+			request.Params = nil
+			_, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+
+	ginkgo.Context("agent uninstall", func() {
+		ginkgo.It("should cancel the queued and the delivered operations", func() {
+			for _, operationID := range []string{"delivered", "queued"} {
+				request := coreRequest(agent.UninstallOp)
+				request.OperationId = operationID
+				_, err := manager.TriggerAgentOperation(request)
+				gomega.Expect(err).To(gomega.Succeed())
+			}
+			_, _, pErr := provider.TakePendingOperations("asset", time.Now().Unix(), asset.DeliveryPolicy{Limit: 1})
+			gomega.Expect(pErr).To(gomega.Succeed())
+
+			_, err := manager.UninstallAgent(&grpc_inventory_manager_go.FullUninstallAgentRequest{
+				OrganizationId: "org", EdgeControllerId: "ec", AssetId: "asset", Force: true})
+			gomega.Expect(err).To(gomega.Succeed())
+
+			messages, pErr := provider.GetOutboxMessages(0, 0)
+			gomega.Expect(pErr).To(gomega.Succeed())
+			canceled := make([]string, 0)
+			for _, msg := range messages {
+				if msg.Type != entities.AgentOpResponseMessage {
+					continue
+				}
+				response := &entities.AgentOpResponse{}
+				gomega.Expect(msg.GetPayload(response)).To(gomega.Succeed())
+				gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_CANCELED.String()))
+				canceled = append(canceled, response.OperationId)
+			}
+			gomega.Expect(canceled).To(gomega.ConsistOf("delivered", "queued"))
+			delivered, pErr := provider.GetDeliveredOperations("asset")
+			gomega.Expect(pErr).To(gomega.Succeed())
+			gomega.Expect(delivered).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("remote uninstall", func() {
+		ginkgo.It("should reject a request without host or credentials", func() {
+			for _, params := range []map[string]string{
+				{UsernameParam: "admin", PasswordParam: "secret"},
+				{TargetHostParam: "10.0.0.1", PasswordParam: "secret"},
+				{TargetHostParam: "10.0.0.1", UsernameParam: "admin"},
+				{TargetHostParam: "10.0.0.1", UsernameParam: "admin", PasswordParam: "secret", ClientCertificateParam: "key"},
+			} {
+				request := coreRequest(UninstallAgentOp)
+				request.Params = params
+				_, err := manager.TriggerAgentOperation(request)
+				gomega.Expect(err).To(gomega.HaveOccurred())
+			}
+		})
+
+		ginkgo.It("should reject the uninstall of an unknown asset", func() {
+			request := coreRequest(UninstallAgentOp)
+			request.AssetId = "unknown"
+			request.Params = map[string]string{TargetHostParam: "10.0.0.1", UsernameParam: "admin", PasswordParam: "secret"}
+			_, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+
+	ginkgo.Context("join tokens", func() {
+		ginkgo.It("should create a join token with restrictions", func() {
+			request := coreRequest(CreateJoinTokenOp)
+			request.Params = map[string]string{TTLParam: "10m", MaxUsesParam: "1", LabelParamPrefix + "zone": "north"}
+			response, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.Succeed())
+			token := entities.JoinToken{}
+			gomega.Expect(json.Unmarshal([]byte(response.Info), &token)).To(gomega.Succeed())
+			gomega.Expect(token.ExpiredOn).To(gomega.Equal(token.Created + 600))
+			gomega.Expect(token.MaxUses).To(gomega.Equal(1))
+			gomega.Expect(token.Labels).To(gomega.Equal(map[string]string{"zone": "north"}))
+			valid, err := provider.CheckJoinToken(token.Token)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(valid).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("should reject invalid restrictions", func() {
+			for _, params := range []map[string]string{{TTLParam: "-1m"}, {MaxUsesParam: "many"}, {LabelParamPrefix: "value"}} {
+				request := coreRequest(CreateJoinTokenOp)
+				request.Params = params
+				_, err := manager.TriggerAgentOperation(request)
+				gomega.Expect(err).To(gomega.HaveOccurred())
+			}
+		})
+
+		ginkgo.It("should list and revoke the join tokens", func() {
+			_, err := provider.AddJoinToken("join", asset.JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			request := coreRequest(RevokeJoinTokenOp)
+			request.Params = map[string]string{TokenParam: "join"}
+			_, tErr := manager.TriggerAgentOperation(request)
+			gomega.Expect(tErr).To(gomega.Succeed())
+
+			response, tErr := manager.TriggerAgentOperation(coreRequest(ListJoinTokensOp))
+			gomega.Expect(tErr).To(gomega.Succeed())
+			tokens := make([]entities.JoinToken, 0)
+			gomega.Expect(json.Unmarshal([]byte(response.Info), &tokens)).To(gomega.Succeed())
+			gomega.Expect(tokens).To(gomega.HaveLen(1))
+			gomega.Expect(tokens[0].Revoked).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.Context("agent tokens", func() {
+		ginkgo.It("should rotate the token of an agent", func() {
+			request := coreRequest(RotateTokenOp)
+			request.Params = map[string]string{GraceParam: "10m"}
+			response, err := manager.TriggerAgentOperation(request)
+			gomega.Expect(err).To(gomega.Succeed())
+			rotation := TokenRotation{}
+			gomega.Expect(json.Unmarshal([]byte(response.Info), &rotation)).To(gomega.Succeed())
+
+			pending, err := provider.GetPendingOperations("asset", false)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(pending).To(gomega.HaveLen(1))
+			gomega.Expect(pending[0].OperationId).To(gomega.Equal(rotation.OperationId))
+			gomega.Expect(pending[0].Operation).To(gomega.Equal(agent.UpdateTokenOp))
+			gomega.Expect(pending[0].Deadline).To(gomega.Equal(rotation.GraceUntil))
+			token := pending[0].Params[agent.NewTokenParam]
+
+			for _, valid := range []string{"token", token} {
+				joined, err := provider.GetAssetByToken(valid)
+				gomega.Expect(err).To(gomega.Succeed())
+				gomega.Expect(joined.AssetId).To(gomega.Equal("asset"))
+			}
+		})
+
+		ginkgo.It("should deliver the new token even if the queue is full", func() {
+			manager.config.AgentQueueSize = 1
+			_, err := manager.TriggerAgentOperation(coreRequest(agent.UninstallOp))
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = manager.TriggerAgentOperation(coreRequest(RotateTokenOp))
+			gomega.Expect(err).To(gomega.Succeed())
+			pending, pErr := provider.GetPendingOperations("asset", false)
+			gomega.Expect(pErr).To(gomega.Succeed())
+			gomega.Expect(pending).To(gomega.HaveLen(2))
+			gomega.Expect(pending[0].Operation).To(gomega.Equal(agent.UpdateTokenOp))
+		})
+
+		ginkgo.It("should revoke the token of an agent", func() {
+			_, err := manager.TriggerAgentOperation(coreRequest(RevokeTokenOp))
+			gomega.Expect(err).To(gomega.Succeed())
+			_, pErr := provider.GetAssetByToken("token")
+			gomega.Expect(pErr).To(gomega.HaveOccurred())
+		})
+	})
+})
@@ -43,7 +43,8 @@ func (h *Handler)Unlink(_ context.Context, in *grpc_common_go.Empty) (*grpc_comm
 	return h.Manager.Unlink()
 }
 // TriggerAgentOperation registers the operation in the EIC so that the agent will be notified on the
-// next connection.
+// next connection. The operations of the core plugin listed in core.go are executed by the EIC instead, and their
+// result is returned in the info of the response (see the Core operations section of the README).
 func (h *Handler)TriggerAgentOperation(_ context.Context, request *grpc_inventory_manager_go.AgentOpRequest) (*grpc_inventory_manager_go.AgentOpResponse, error){
 
 	vErr := entities.ValidAgentOpRequest(request)
@@ -56,7 +57,12 @@ func (h *Handler)TriggerAgentOperation(_ context.Context, request *grpc_inventor
 // Configure changes specific configuration options of the Edge Controller
 // and/or Edge Controller plugins
 func (h *Handler)Configure(_ context.Context, request *grpc_inventory_manager_go.ConfigureEICRequest) (*grpc_common_go.Success, error) {
-	return nil, nil
+	log.Debug().Interface("params", request.Params).Msg("configure edge controller")
+	vErr := entities.ValidConfigureEICRequest(request)
+	if vErr != nil {
+		return nil, conversions.ToGRPCError(vErr)
+	}
+	return h.Manager.Configure(request)
 }
 // ListMetrics returns available metrics for a certain selection of assets
 func (h *Handler)ListMetrics(_ context.Context, selector *grpc_inventory_go.AssetSelector) (*grpc_monitoring_go.MetricsList, error) {
@@ -17,14 +17,18 @@
 package eic
 
 import (
+	"crypto/x509"
 	"fmt"
 	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
 	"github.com/nalej/edge-controller/internal/pkg/server/agent"
 	"github.com/nalej/edge-controller/internal/pkg/server/config"
 	"github.com/nalej/edge-controller/internal/pkg/server/connection"
 	grpc_inventory_go "github.com/nalej/grpc-inventory-go"
 	grpc_inventory_manager_go "github.com/nalej/grpc-inventory-manager-go"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -35,78 +39,152 @@ import (
 
 const DefaultSSHPort = "22"
 
+// Params of the InstallAgentRequest to select how the identity of the target host is verified.
+const (
+	// HostKeyPolicyParam overrides the host key policy of the edge controller configuration. The policy of the
+	// request can only be as strict as the configured one or stricter.
+	HostKeyPolicyParam = "host_key_policy"
+	// HostKeyFingerprintParam with the expected fingerprint of the target host key. It implies the fingerprint policy.
+	HostKeyFingerprintParam = "host_key_fingerprint"
+)
+
+// WinRMCACertParam of the InstallAgentRequest with the PEM certificate of the CA that signs the certificate of a
+// WinRM host served through HTTPS. The system CAs are used if it is not set.
+const WinRMCACertParam = "winrm_ca_cert"
+
+// hostKeyPolicyLevel orders the host key policies from the less to the most strict.
+var hostKeyPolicyLevel = map[connection.HostKeyPolicy]int{
+	connection.TrustOnFirstUsePolicy: 0,
+	connection.KnownHostsPolicy:      1,
+	connection.FingerprintPolicy:     2,
+}
+
+// DefaultInstallWorkers with the number of installs executed at the same time if it is not configured.
+const DefaultInstallWorkers = 8
+
 type AgentInstaller struct {
 	cfg      config.Config
 	notifier *agent.Notifier
+	// assetProvider with the fingerprints of the hosts trusted on first use and the journal of the installs.
+	assetProvider asset.Provider
+	// workers limits the number of installs running at the same time.
+	workers chan struct{}
 }
 
-type AgentInstallOptions struct {
-	// AgentBinaryName with the name of the binary
-	AgentBinaryName string
-	// AgentBinaryPath with the path in the edge controller where the agent to be installed resides.
-	AgentBinaryPath string
-	// AgentBinarySCPTargetPath with the path where the binary will be copied prior installation.
-	AgentBinarySCPTargetPath string
-	// CertPath with the path where the certificates will be stored.
-	CertPath string
-	// CACertTargetPath with the target path to store the CA.
-	CACertTargetPath string
-
-	// CreateCertDirCmd with the command to create the certificate directory.
-	CreateCertDirCmd string
-	// SetExecutionPermissionsCmd with the command to give execution permissions to the executable
-	SetExecutionPermissionsCmd string
-	// InstallAgentCmd with the command to install the agent.
-	InstallAgentCmd string
-	// AgentJoinCmd with the command to perform the agent join
-	AgentJoinCmd string
-	// AgentStartCmd with the command to start the agent
-	AgentStartCmd string
+// NewAgentInstall creates a new installer for agents.
+func NewAgentInstaller(cfg config.Config, notifier *agent.Notifier, assetProvider asset.Provider) *AgentInstaller {
+	workers := cfg.InstallWorkers
+	if workers <= 0 {
+		workers = DefaultInstallWorkers
+	}
+	return &AgentInstaller{cfg, notifier, assetProvider, make(chan struct{}, workers)}
 }
 
-// NewAgentInstall creates a new installer for agents.
-func NewAgentInstaller(cfg config.Config, notifier *agent.Notifier) *AgentInstaller {
-	return &AgentInstaller{cfg, notifier}
+// acquireWorker waits until the number of running installs is under the limit.
+func (ai *AgentInstaller) acquireWorker() {
+	ai.workers <- struct{}{}
 }
 
-// getAgentInstallOptions obtains the options regarding commands and path required to install an agent.
-func (ai *AgentInstaller) getAgentInstallOptions(agentType grpc_inventory_manager_go.AgentType) (*AgentInstallOptions, derrors.Error) {
-	if agentType == grpc_inventory_manager_go.AgentType_WINDOWS_AMD64 {
-		return nil, derrors.NewUnimplementedError("windows automatic install is not supported")
+// releaseWorker signals the end of an install.
+func (ai *AgentInstaller) releaseWorker() {
+	<-ai.workers
+}
+
+// getHostKeyCallback returns the verification of the target host key defined by the request params or the
+// edge controller configuration.
+func (ai *AgentInstaller) getHostKeyCallback(params map[string]string) (ssh.HostKeyCallback, derrors.Error) {
+	policy := connection.HostKeyPolicy(ai.cfg.HostKeyPolicy)
+	if requested, exists := params[HostKeyPolicyParam]; exists {
+		level, supported := hostKeyPolicyLevel[connection.HostKeyPolicy(requested)]
+		if !supported {
+			return nil, derrors.NewInvalidArgumentError("unsupported host key policy").WithParams(requested)
+		}
+		if level < hostKeyPolicyLevel[policy] {
+			return nil, derrors.NewInvalidArgumentError("host key policy cannot be less strict than the configured one").
+				WithParams(requested, ai.cfg.HostKeyPolicy)
+		}
+		policy = connection.HostKeyPolicy(requested)
+	}
+	fingerprint := params[HostKeyFingerprintParam]
+	if fingerprint != "" {
+		policy = connection.FingerprintPolicy
 	}
 
-	agentPath := filepath.Join(ai.cfg.AgentBinaryPath, strings.ToLower(agentType.String()), "service-net-agent")
+	switch policy {
+	case connection.KnownHostsPolicy:
+		return connection.NewKnownHostsCallback(ai.cfg.KnownHostsPath)
+	case connection.TrustOnFirstUsePolicy:
+		return connection.NewTrustOnFirstUseCallback(ai.assetProvider), nil
+	case connection.FingerprintPolicy:
+		if fingerprint == "" {
+			return nil, derrors.NewInvalidArgumentError("fingerprint policy requires a host key fingerprint")
+		}
+		return connection.NewFingerprintCallback(fingerprint), nil
+	}
+	return nil, derrors.NewInvalidArgumentError("unsupported host key policy").WithParams(string(policy))
+}
 
-	_, err := os.Stat(agentPath)
+// newSSHConnection creates the connection to a target host with the credentials and params of a request.
+func (ai *AgentInstaller) newSSHConnection(targetHost string, credentials *grpc_inventory_manager_go.InstallCredentials, params map[string]string) (*connection.SSHConnection, derrors.Error) {
+	hostKeyCallback, dErr := ai.getHostKeyCallback(params)
+	if dErr != nil {
+		return nil, dErr
+	}
+	conn, err := connection.NewSSHConnection(
+		targetHost, DefaultSSHPort,
+		credentials.GetUsername(), credentials.GetPassword(), "", credentials.GetClientCertificate())
 	if err != nil {
-		log.Error().Str("agentPath", agentPath).Msg("cannot access agent binary")
-		return nil, derrors.AsError(err, "agent binary is not accessible")
-	}
-
-	return &AgentInstallOptions{
-		AgentBinaryName:          "service-net-agent",
-		AgentBinaryPath:          agentPath,
-		AgentBinarySCPTargetPath: ".",
-		CertPath:                 "/opt/nalej/certs",
-		CACertTargetPath:         "/opt/nalej/certs/cacert.pem",
-		CreateCertDirCmd:         "mkdir -p /opt/nalej/certs",
-		SetExecutionPermissionsCmd: "chmod +x service-net-agent",
-		InstallAgentCmd:          "./service-net-agent install",
-		AgentJoinCmd:             "/opt/nalej/bin/service-net-agent join --token=%s --address=%s:5588 --cert=/opt/nalej/certs/cacert.pem",
-		AgentStartCmd:            "/opt/nalej/bin/service-net-agent start",
-	}, nil
+		return nil, derrors.NewInternalError("cannot establish ssh connection", err).WithParams(targetHost)
+	}
+	conn.HostKeyCallback = hostKeyCallback
+	return conn, nil
 }
 
-// getAgentJoinCmd substitutes the missing parameters in the agent join command.
-func (aio *AgentInstallOptions) getAgentJoinCmd(agentJoinToken string, edgeControllerIP string) string {
-	return fmt.Sprintf(aio.AgentJoinCmd, agentJoinToken, edgeControllerIP)
+// newConnection creates the connection to the target host of an install request with the type defined by the recipe.
+func (ai *AgentInstaller) newConnection(recipe *Recipe, request *grpc_inventory_manager_go.InstallAgentRequest) (connection.Connection, derrors.Error) {
+	switch recipe.ConnectionType() {
+	case connection.SSHType:
+		conn, dErr := ai.newSSHConnection(request.TargetHost, request.Credentials, request.GetParams())
+		if dErr != nil {
+			return nil, dErr
+		}
+		if recipe.Port != "" {
+			conn.Port = recipe.Port
+		}
+		return conn, nil
+	case connection.WinRMType:
+		credentials := request.GetCredentials()
+		if credentials.GetClientCertificate() != "" {
+			return nil, derrors.NewUnimplementedError("winrm connections only support password authentication")
+		}
+		caCert := request.GetParams()[WinRMCACertParam]
+		if caCert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(caCert)) {
+			return nil, derrors.NewInvalidArgumentError("cannot parse winrm CA certificate").WithParams(request.TargetHost)
+		}
+		conn, err := connection.NewWinRMConnection(request.TargetHost, recipe.Port,
+			credentials.GetUsername(), credentials.GetPassword(), recipe.HTTPS, recipe.AllowHTTP, caCert)
+		if err != nil {
+			return nil, derrors.NewInvalidArgumentError("cannot create winrm connection", err).WithParams(request.TargetHost)
+		}
+		return conn, nil
+	}
+	return nil, derrors.NewInvalidArgumentError("unsupported connection type").WithParams(string(recipe.Connection))
 }
 
-// getBaseResponse returns a base response to send an update on the progress of the install.
-func (ai *AgentInstaller) getBaseResponse(operationID string, request *grpc_inventory_manager_go.InstallAgentRequest) *grpc_inventory_manager_go.EdgeControllerOpResponse {
+// sshError converts the error of an SSH operation. Host key verification failures are reported with their reason
+// as no data has been sent to the host.
+func sshError(err error, msg string) derrors.Error {
+	if hostKeyErr, ok := err.(*connection.HostKeyError); ok {
+		return derrors.NewPermissionDeniedError(hostKeyErr.Error())
+	}
+	return derrors.NewInternalError(msg, err)
+}
+
+// getBaseResponse returns a base response to send an update on the progress of an install.
+func (ai *AgentInstaller) getBaseResponse(operationID string, organizationID string, edgeControllerID string) *grpc_inventory_manager_go.EdgeControllerOpResponse {
 	return &grpc_inventory_manager_go.EdgeControllerOpResponse{
-		OrganizationId:   request.OrganizationId,
-		EdgeControllerId: request.EdgeControllerId,
+		OrganizationId:   organizationID,
+		EdgeControllerId: edgeControllerID,
 		OperationId:      operationID,
 		Timestamp:        time.Now().Unix(),
 	}
@@ -121,191 +199,382 @@ func (ai *AgentInstaller) getBaseResponse(operationID string, request *grpc_inve
   161  /opt/nalej/bin/service-net-agent join --token=d62cc38f-64a7-4d7c-b591-a2032dad0ef5 --address=172.16.17.93:5588 --debug --cert=/opt/nalej/certs/cacert.pem
   162  /opt/nalej/bin/service-net-agent start
 */
-// InstallAgent triggers the steps required to install the agent.
-func (ai *AgentInstaller) InstallAgent(operationID string, agentJoinToken string, request *grpc_inventory_manager_go.InstallAgentRequest) {
-	log.Debug().Interface("request", request).Msg("triggering agent install")
+// InstallAgent triggers the steps of the install recipe of the agent type. All the steps are executed over a single
+// connection and the progress notifications include the time taken by each one. The install waits if the maximum
+// number of installs is already running. The step being executed is journaled until the install finishes.
+func (ai *AgentInstaller) InstallAgent(operationID string, agentJoinToken string, request *grpc_inventory_manager_go.InstallAgentRequest) derrors.Error {
+	journal := &entities.InstallOperation{
+		OperationId:      operationID,
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		TargetHost:       request.TargetHost,
+		Token:            agentJoinToken,
+		Created:          time.Now().Unix(),
+	}
+	ai.journalStep(journal, "wait for a free worker")
+	defer ai.removeJournal(operationID)
 
-	options, optErr := ai.getAgentInstallOptions(request.AgentType)
-	if optErr != nil {
-		update := ai.getBaseResponse(operationID, request)
-		update.Status = grpc_inventory_go.OpStatus_FAIL
-		update.Info = optErr.Error()
-		ai.notifier.NotifyECOpResponse(update)
-		return
+	ai.acquireWorker()
+	defer ai.releaseWorker()
+	// the request is not logged as it contains the credentials of the target host
+	log.Debug().Str("operationID", operationID).Str("targetHost", request.TargetHost).
+		Str("agentType", request.AgentType.String()).Strs("params", paramNames(request.Params)).Msg("triggering agent install")
+	report := func(err derrors.Error, info string) {
+		ai.notifyResult(operationID, request.OrganizationId, request.EdgeControllerId, err, info)
+	}
+	ai.journalStep(journal, "prepare install")
+
+	recipe, dErr := LoadRecipe(ai.cfg.InstallRecipesPath, request.AgentType)
+	if dErr != nil {
+		report(dErr, "")
+		return dErr
+	}
+	agentPath, dErr := ai.getAgentBinaryPath(request.AgentType, recipe)
+	if dErr != nil {
+		report(dErr, "")
+		return dErr
+	}
+	caCertFile, dErr := writeCACert(operationID, request.CaCert)
+	if dErr != nil {
+		report(dErr, "")
+		return dErr
 	}
-	log.Debug().Interface("options", options).Msg("install options defined")
+	defer os.Remove(caCertFile)
 	start := time.Now()
-	edgeControllerIP, err := ai.detectEdgeControllerIP(operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot detect edge controller IP")
-		return
+
+	conn, dErr := ai.newConnection(recipe, request)
+	if dErr != nil {
+		report(dErr, "")
+		return dErr
 	}
-	log.Debug().Str("IP", edgeControllerIP).Msg("edge controller IP as seen by the asset")
-	// First copy the agent binary to the target host
-	err = ai.copyBinaryToAsset(options, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot copy agent binary")
-		return
+	ai.journalStep(journal, "connect")
+	dErr = runStep("connect", report, func() (string, derrors.Error) {
+		return "", connect(conn, request.TargetHost)
+	})
+	if dErr != nil {
+		return dErr
 	}
-	// Copy the CA
-	err = ai.createCacert(options, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot create CA cert on target host")
-		return
+	defer conn.Close()
+
+	var edgeControllerIP string
+	ai.journalStep(journal, "detect edge controller IP")
+	dErr = runStep("detect edge controller IP", report, func() (string, derrors.Error) {
+		ip, err := detectEdgeControllerIP(conn)
+		edgeControllerIP = ip
+		return ip, err
+	})
+	if dErr != nil {
+		return dErr
 	}
-	// Set exec permissions
-	err = ai.execSSHCommand(options.SetExecutionPermissionsCmd, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot set execution permissions")
-		return
+
+	recipeSteps, dErr := recipe.Render(RecipeVariables{
+		Token:        agentJoinToken,
+		ControllerIP: edgeControllerIP,
+		AgentPort:    ai.cfg.AgentPort,
+		AgentBinary:  agentPath,
+		CACertFile:   caCertFile,
+	})
+	if dErr != nil {
+		report(dErr, "")
+		return dErr
 	}
-	// Install the agent.
-	err = ai.execSSHCommand(options.InstallAgentCmd, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot install agent")
-		return
+	// the rendered steps contain the join token, only their names are logged
+	stepNames := make([]string, 0, len(recipeSteps))
+	for _, recipeStep := range recipeSteps {
+		stepNames = append(stepNames, recipeStep.Name)
 	}
-	// Join the agent
-	agentJoinCmd := options.getAgentJoinCmd(agentJoinToken, edgeControllerIP)
-	err = ai.execSSHCommand(agentJoinCmd, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot join agent")
-		return
+	log.Debug().Strs("steps", stepNames).Msg("install steps defined")
+
+	// sudo is only available in the hosts reached by SSH
+	isSudoer := request.Credentials.GetIsSudoer() && recipe.ConnectionType() == connection.SSHType
+	steps := make([]remoteStep, 0, len(recipeSteps))
+	for _, recipeStep := range recipeSteps {
+		recipeStep := recipeStep
+		steps = append(steps, remoteStep{recipeStep.Name, func() (string, derrors.Error) {
+			return executeRecipeStep(conn, recipeStep, isSudoer)
+		}})
 	}
-	// Start the agent
-	err = ai.execSSHCommand(options.AgentStartCmd, operationID, request)
-	if err != nil {
-		log.Debug().Str("trace", err.DebugReport()).Msg("cannot start agent")
-		return
+	for _, step := range steps {
+		ai.journalStep(journal, step.name)
+		dErr = runStep(step.name, report, step.run)
+		if dErr != nil {
+			log.Debug().Str("step", step.name).Str("trace", dErr.DebugReport()).Msg("agent install failed")
+			return dErr
+		}
 	}
+
 	log.Info().Str("targetHost", request.TargetHost).Msg("agent has been installed")
 	// Send success update
-	update := ai.getBaseResponse(operationID, request)
+	update := ai.getBaseResponse(operationID, request.OrganizationId, request.EdgeControllerId)
 	update.Status = grpc_inventory_go.OpStatus_SUCCESS
 	update.Info = fmt.Sprintf("Agent has been installed, took %s", time.Since(start).String())
 	nErr := ai.notifier.NotifyECOpResponse(update)
 	if nErr != nil {
 		log.Error().Str("trace", nErr.DebugReport()).Msg("notify EC op response failed")
 	}
+	return nil
 }
 
-// copyBinaryToAsset copies the agent binary to the remote asset so that it can be installed.
-func (ai *AgentInstaller) copyBinaryToAsset(options *AgentInstallOptions, operationID string, request *grpc_inventory_manager_go.InstallAgentRequest) derrors.Error {
-	log.Debug().Str("agentPath", options.AgentBinaryPath).Msg("copying binary to asset")
-	conn, err := connection.NewSSHConnection(
-		request.TargetHost, DefaultSSHPort,
-		request.Credentials.Username, request.Credentials.GetPassword(), "", request.Credentials.GetClientCertificate())
-	if err != nil {
-		dErr := derrors.NewInternalError("cannot establish ssh connection", err).WithParams(request.TargetHost)
-		ai.notifyResult(operationID, request, dErr, "")
+// UninstallRequest with the host and credentials used to uninstall an agent through SSH.
+type UninstallRequest struct {
+	// OrganizationId with the organization identifier.
+	OrganizationId string
+	// EdgeControllerId with the EIC identifier.
+	EdgeControllerId string
+	// AssetId with the asset whose agent is uninstalled.
+	AssetId string
+	// TargetHost where the agent is installed.
+	TargetHost string
+	// Credentials to connect to the target host.
+	Credentials *grpc_inventory_manager_go.InstallCredentials
+	// Params with the host key verification of the target host.
+	Params map[string]string
+}
+
+// agentUnitFile is the systemd unit registered by the install command of the agent.
+const agentUnitFile = "/etc/systemd/system/service-net-agent.service"
+
+// uninstallSteps stops and disables the agent, and removes its systemd unit, binary and certificates. The agent is only
+// stopped and disabled if its binary and unit are still installed, so an uninstall can be repeated on a host that has
+// been partially cleaned.
+var uninstallSteps = []RecipeStep{
+	{Name: "stop agent", Exec: "sh -c '[ ! -x /opt/nalej/bin/service-net-agent ] || /opt/nalej/bin/service-net-agent stop'"},
+	{Name: "disable agent service", Exec: "sh -c '[ ! -f " + agentUnitFile + " ] || systemctl disable service-net-agent'"},
+	{Name: "remove agent service", Exec: "rm -f " + agentUnitFile},
+	{Name: "reload systemd", Exec: "systemctl daemon-reload"},
+	{Name: "remove agent binary", Exec: "rm -f /opt/nalej/bin/service-net-agent"},
+	{Name: "remove certificates", Exec: "rm -rf /opt/nalej/certs"},
+}
+
+// UninstallAgent removes the agent from the target host through SSH, reporting the progress of each step as the
+// install does. It is triggered by the uninstall_agent core operation, which carries the credentials of the target
+// host; the uninstall request of the inventory manager has no credentials, so it only unlinks the asset. The uninstall waits if the maximum number of installs is already running, and it is journaled
+// so a restart reports it as failed.
+func (ai *AgentInstaller) UninstallAgent(operationID string, request *UninstallRequest) derrors.Error {
+	journal := &entities.InstallOperation{
+		OperationId:      operationID,
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		TargetHost:       request.TargetHost,
+		Created:          time.Now().Unix(),
+	}
+	ai.journalStep(journal, "wait for a free worker")
+	defer ai.removeJournal(operationID)
+
+	ai.acquireWorker()
+	defer ai.releaseWorker()
+	log.Debug().Str("assetID", request.AssetId).Str("targetHost", request.TargetHost).Msg("triggering agent uninstall")
+
+	conn, dErr := ai.newSSHConnection(request.TargetHost, request.Credentials, request.Params)
+	if dErr != nil {
+		ai.notifyResult(operationID, request.OrganizationId, request.EdgeControllerId, dErr, "")
 		return dErr
 	}
-	start := time.Now()
+	return ai.uninstall(conn, operationID, request, journal)
+}
 
-	isSudoer := false
-	if request.Credentials != nil && request.Credentials.IsSudoer{
-		isSudoer = true
+// uninstall executes the uninstall steps over a connection.
+func (ai *AgentInstaller) uninstall(conn connection.Connection, operationID string, request *UninstallRequest, journal *entities.InstallOperation) derrors.Error {
+	report := func(err derrors.Error, info string) {
+		ai.notifyResult(operationID, request.OrganizationId, request.EdgeControllerId, err, info)
 	}
-	err = conn.Copy(options.AgentBinaryPath, options.AgentBinarySCPTargetPath, false, isSudoer)
-	if err != nil {
-		dErr := derrors.NewInternalError("cannot scp agent binary", err).WithParams(request.TargetHost)
-		ai.notifyResult(operationID, request, dErr, "")
+	start := time.Now()
+
+	ai.journalStep(journal, "connect")
+	dErr := runStep("connect", report, func() (string, derrors.Error) {
+		return "", connect(conn, request.TargetHost)
+	})
+	if dErr != nil {
 		return dErr
 	}
-	msg := fmt.Sprintf("agent binary copied in %s", time.Since(start).String())
-	ai.notifyResult(operationID, request, nil, msg)
+	defer conn.Close()
+
+	isSudoer := request.Credentials.GetIsSudoer()
+	for _, step := range uninstallSteps {
+		step := step
+		ai.journalStep(journal, step.Name)
+		dErr = runStep(step.Name, report, func() (string, derrors.Error) {
+			return executeRecipeStep(conn, step, isSudoer)
+		})
+		if dErr != nil {
+			log.Debug().Str("step", step.Name).Str("trace", dErr.DebugReport()).Msg("agent uninstall failed")
+			return dErr
+		}
+	}
+
+	log.Info().Str("assetID", request.AssetId).Str("targetHost", request.TargetHost).Msg("agent has been uninstalled")
+	update := ai.getBaseResponse(operationID, request.OrganizationId, request.EdgeControllerId)
+	update.Status = grpc_inventory_go.OpStatus_SUCCESS
+	update.Info = fmt.Sprintf("Agent has been uninstalled, took %s", time.Since(start).String())
+	nErr := ai.notifier.NotifyECOpResponse(update)
+	if nErr != nil {
+		log.Error().Str("trace", nErr.DebugReport()).Msg("notify EC op response failed")
+	}
 	return nil
 }
 
-// createCacertDir creates the directory to store the certificates for the agent and transfer the appropiate CA.
-func (ai *AgentInstaller) createCacert(options *AgentInstallOptions, operationID string, request *grpc_inventory_manager_go.InstallAgentRequest) derrors.Error {
-	// Create the directory
-	cErr := ai.execSSHCommand(options.CreateCertDirCmd, operationID, request)
-	if cErr != nil {
-		ai.notifyResult(operationID, request, cErr, "")
-		return cErr
-	}
+// remoteStep is one of the steps executed on a remote host.
+type remoteStep struct {
+	// name of the step used in the notifications.
+	name string
+	// run executes the step and returns its output.
+	run func() (string, derrors.Error)
+}
 
-	// Create the file locally.
-	f, err := ioutil.TempFile("", operationID)
+// journalStep records the step being executed by an install. Failing to journal does not stop the install.
+func (ai *AgentInstaller) journalStep(journal *entities.InstallOperation, step string) {
+	journal.Step = step
+	journal.Updated = time.Now().Unix()
+	err := ai.assetProvider.AddInstallOperation(*journal)
 	if err != nil {
-		dErr := derrors.AsError(err, "cannot create temp file")
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		log.Warn().Str("operationID", journal.OperationId).Str("trace", err.DebugReport()).Msg("cannot journal agent install")
 	}
-	defer os.Remove(f.Name())
+}
 
-	// Copy the content of the ca_cert to the file
-	// TODO enable scp from buffer
-	err = ioutil.WriteFile(f.Name(), []byte(request.CaCert), os.ModePerm)
+// removeJournal removes a finished install from the journal.
+func (ai *AgentInstaller) removeJournal(operationID string) {
+	err := ai.assetProvider.RemoveInstallOperation(operationID)
 	if err != nil {
-		dErr := derrors.AsError(err, "cannot write cacert to temp file")
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		log.Warn().Str("operationID", operationID).Str("trace", err.DebugReport()).Msg("cannot remove agent install from the journal")
 	}
+}
 
-	// Now copy the file.
-	conn, err := connection.NewSSHConnection(
-		request.TargetHost, DefaultSSHPort,
-		request.Credentials.Username, request.Credentials.GetPassword(), "", request.Credentials.GetClientCertificate())
+// FailInterruptedInstalls reports the installs and uninstalls left in the journal by a previous execution of the edge
+// controller. The credentials are never persisted, so they cannot be resumed: they are marked as failed with the step
+// they were executing and the join token of the installs is revoked. It must be called before any new install is
+// triggered.
+func (ai *AgentInstaller) FailInterruptedInstalls() derrors.Error {
+	interrupted, err := ai.assetProvider.GetInstallOperations()
 	if err != nil {
-		dErr := derrors.NewInternalError("cannot establish ssh connection", err).WithParams(request.TargetHost)
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		return err
 	}
-	start := time.Now()
-	isSudoer := false
-	if request.Credentials != nil && request.Credentials.IsSudoer{
-		isSudoer = true
+	for _, op := range interrupted {
+		log.Warn().Str("operationID", op.OperationId).Str("step", op.Step).Msg("agent operation interrupted by a restart")
+		ai.notifyResult(op.OperationId, op.OrganizationId, op.EdgeControllerId,
+			derrors.NewAbortedError(fmt.Sprintf("controller restarted during step %s", op.Step)).WithParams(op.TargetHost), "")
+		if op.Token != "" {
+			if err := ai.assetProvider.RemoveJoinToken(op.Token); err != nil {
+				log.Warn().Str("operationID", op.OperationId).Str("trace", err.DebugReport()).Msg("cannot revoke join token")
+			}
+		}
+		if err := ai.assetProvider.RemoveInstallOperation(op.OperationId); err != nil {
+			return err
+		}
 	}
-	err = conn.Copy(f.Name(), options.CACertTargetPath, false, isSudoer)
+	return nil
+}
+
+// progressFunc sends an update on the progress of an operation.
+type progressFunc func(err derrors.Error, info string)
+
+// runStep executes a step and reports its result with the time it took.
+func runStep(name string, report progressFunc, run func() (string, derrors.Error)) derrors.Error {
+	start := time.Now()
+	output, err := run()
+	elapsed := time.Since(start).String()
 	if err != nil {
-		dErr := derrors.NewInternalError("cannot scp CA Cert", err).WithParams(request.TargetHost)
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		report(err, fmt.Sprintf("%s failed after %s", name, elapsed))
+		return err
+	}
+	info := fmt.Sprintf("%s done in %s", name, elapsed)
+	if output = strings.TrimSpace(output); output != "" {
+		info = fmt.Sprintf("%s: %s", info, output)
 	}
-	msg := fmt.Sprintf("CA cert copied in %s", time.Since(start).String())
-	ai.notifyResult(operationID, request, nil, msg)
+	report(nil, info)
 	return nil
 }
 
-// execSSHCommand executes an SSH command.
-func (ai *AgentInstaller) execSSHCommand(cmd string, operationID string, request *grpc_inventory_manager_go.InstallAgentRequest) derrors.Error {
-
-	conn, err := connection.NewSSHConnection(
-		request.TargetHost, DefaultSSHPort,
-		request.Credentials.Username, request.Credentials.GetPassword(), "", request.Credentials.GetClientCertificate())
+// connect establishes the connection with a remote host.
+func connect(conn connection.Connection, targetHost string) derrors.Error {
+	err := conn.Connect()
 	if err != nil {
-		dErr := derrors.AsError(err, "cannot establish ssh connection")
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		return sshError(err, "cannot establish ssh connection").WithParams(targetHost)
 	}
+	return nil
+}
 
+// execCommand executes a command on a remote host.
+func execCommand(conn connection.Connection, cmd string, sudo bool) (string, derrors.Error) {
 	// check if the user is sudoer [NP-1602]
-	if request.Credentials != nil && request.Credentials.IsSudoer {
+	if sudo {
 		cmd = fmt.Sprintf("sudo %s", cmd)
 	}
-
 	log.Debug().Str("toExecute", cmd).Msg("SSH exec")
 	output, err := conn.Execute(cmd)
 	if err != nil {
-		dErr := derrors.NewInternalError("cannot execute ssh command", err)
-		ai.notifyResult(operationID, request, dErr, "")
-		return dErr
+		return "", sshError(err, "cannot execute ssh command")
+	}
+	return string(output), nil
+}
+
+// copyFile copies a local file to a remote host.
+func copyFile(conn connection.Connection, localPath string, remotePath string, sudo bool) derrors.Error {
+	log.Debug().Str("localPath", localPath).Str("remotePath", remotePath).Msg("copying file to asset")
+	err := conn.Copy(localPath, remotePath, false, sudo)
+	if err != nil {
+		return sshError(err, "cannot copy file").WithParams(localPath)
 	}
-	ai.notifyResult(operationID, request, nil, string(output))
 	return nil
 }
 
-// notifyResult sends an update on a given operation.
-func (ai *AgentInstaller) notifyResult(operationID string, request *grpc_inventory_manager_go.InstallAgentRequest, err derrors.Error, info string) {
-	update := ai.getBaseResponse(operationID, request)
+// executeRecipeStep executes a rendered step of an install recipe.
+func executeRecipeStep(conn connection.Connection, step RecipeStep, sudo bool) (string, derrors.Error) {
+	switch {
+	case step.Copy != "":
+		return "", copyFile(conn, step.Copy, step.Target, sudo)
+	case step.Exec != "":
+		return execCommand(conn, step.Exec, sudo)
+	}
+	output, err := execCommand(conn, step.Verify, sudo)
+	if err != nil {
+		return "", err
+	}
+	if step.Expect != "" && !regexp.MustCompile(step.Expect).MatchString(output) {
+		return "", derrors.NewFailedPreconditionError("unexpected output").WithParams(step.Expect, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// getAgentBinaryPath returns the local path of the agent binary of an agent type.
+func (ai *AgentInstaller) getAgentBinaryPath(agentType grpc_inventory_manager_go.AgentType, recipe *Recipe) (string, derrors.Error) {
+	agentPath := filepath.Join(ai.cfg.AgentBinaryPath, strings.ToLower(agentType.String()), recipe.Binary)
+	_, err := os.Stat(agentPath)
+	if err != nil {
+		log.Error().Str("agentPath", agentPath).Msg("cannot access agent binary")
+		return "", derrors.AsError(err, "agent binary is not accessible")
+	}
+	return agentPath, nil
+}
+
+// writeCACert stores the CA received in the request in a temporary file so it can be copied to the remote asset.
+func writeCACert(operationID string, caCert string) (string, derrors.Error) {
+	f, err := ioutil.TempFile("", operationID)
+	if err != nil {
+		return "", derrors.AsError(err, "cannot create temp file")
+	}
+	// TODO enable scp from buffer
+	_, err = f.WriteString(caCert)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", derrors.AsError(err, "cannot write cacert to temp file")
+	}
+	return f.Name(), nil
+}
+
+// notifyResult sends an update on a given operation. Failures are reported with the error, preceded by the info
+// if any.
+func (ai *AgentInstaller) notifyResult(operationID string, organizationID string, edgeControllerID string, err derrors.Error, info string) {
+	update := ai.getBaseResponse(operationID, organizationID, edgeControllerID)
 	if err == nil {
 		update.Status = grpc_inventory_go.OpStatus_INPROGRESS
 		update.Info = info
 	} else {
 		update.Status = grpc_inventory_go.OpStatus_FAIL
 		update.Info = err.Error()
+		if info != "" {
+			update.Info = fmt.Sprintf("%s: %s", info, err.Error())
+		}
 	}
 	log.Debug().Interface("update", update).Msg("sending notification on ec operation")
 	nErr := ai.notifier.NotifyECOpResponse(update)
@@ -314,32 +583,30 @@ func (ai *AgentInstaller) notifyResult(operationID string, request *grpc_invento
 	}
 }
 
+// localAddresser is implemented by the connections that know the local address used to reach the host.
+type localAddresser interface {
+	LocalAddress() (string, error)
+}
+
 // detectEdgeControllerIP atempts to detect the IP address of the edge controler as seen by the asset. In order to do
-// that we use ssh <targetHost> env | grep SSH_CONNECTION
-func (ai *AgentInstaller) detectEdgeControllerIP(operationID string, request *grpc_inventory_manager_go.InstallAgentRequest) (string, derrors.Error) {
-	envCmd := "env"
-	conn, err := connection.NewSSHConnection(
-		request.TargetHost, DefaultSSHPort,
-		request.Credentials.Username, request.Credentials.GetPassword(), "", request.Credentials.GetClientCertificate())
-	if err != nil {
-		dErr := derrors.AsError(err, "cannot establish ssh connection")
-		ai.notifyResult(operationID, request, dErr, "")
-		return "", dErr
+// that we use ssh <targetHost> env | grep SSH_CONNECTION, other connections return the local address they use.
+func detectEdgeControllerIP(conn connection.Connection) (string, derrors.Error) {
+	if addresser, ok := conn.(localAddresser); ok {
+		address, err := addresser.LocalAddress()
+		if err != nil {
+			return "", derrors.NewInternalError("cannot detect edge controller address", err)
+		}
+		return address, nil
 	}
-	log.Debug().Str("toExecute", envCmd).Msg("SSH exec")
-	output, err := conn.Execute(envCmd)
-	if err != nil {
-		dErr := derrors.NewInternalError("cannot execute ssh command", err)
-		ai.notifyResult(operationID, request, dErr, "")
+	output, dErr := execCommand(conn, "env", false)
+	if dErr != nil {
 		return "", dErr
 	}
 	// Now grep the SSH_CONNECTION
 	var re = regexp.MustCompile(`.*SSH_CLIENT=.*`)
-	matches := re.FindStringSubmatch(string(output))
+	matches := re.FindStringSubmatch(output)
 	if len(matches) != 1 {
-		dErr := derrors.NewInternalError("cannot find SSH_CLIENT in output", err)
-		ai.notifyResult(operationID, request, dErr, "")
-		return "", dErr
+		return "", derrors.NewInternalError("cannot find SSH_CLIENT in output")
 	}
 	withoutVar := strings.Replace(matches[0], "SSH_CLIENT=", "", 1)
 	splits := strings.Split(withoutVar, " ")
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/entities"
+	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
+	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/config"
+	"github.com/nalej/edge-controller/internal/pkg/server/connection"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// fakeConnection records the commands executed and the files copied. Commands output the value of output, and the
+// commands that contain fail return an error.
+type fakeConnection struct {
+	executed []string
+	copied   []string
+	output   string
+	fail     string
+}
+
+func (f *fakeConnection) Connect() error {
+	return nil
+}
+
+func (f *fakeConnection) Close() error {
+	return nil
+}
+
+func (f *fakeConnection) Execute(command string) ([]byte, error) {
+	f.executed = append(f.executed, command)
+	if f.fail != "" && strings.Contains(command, f.fail) {
+		return nil, fmt.Errorf("command failed: %s", command)
+	}
+	return []byte(f.output), nil
+}
+
+func (f *fakeConnection) Copy(lpath string, rpath string, remoteSource bool, sudo bool) error {
+	f.copied = append(f.copied, fmt.Sprintf("%s:%s", lpath, rpath))
+	return nil
+}
+
+func (f *fakeConnection) IsOnline() (bool, error) {
+	return true, nil
+}
+
+// fakeAddressConnection is a connection that reports its local address.
+type fakeAddressConnection struct {
+	fakeConnection
+}
+
+func (f *fakeAddressConnection) LocalAddress() (string, error) {
+	return "10.0.0.1", nil
+}
+
+// getECOpResponses returns the edge controller responses queued in the outbox.
+func getECOpResponses(provider asset.Provider) []entities.EdgeControllerOpResponse {
+	messages, err := provider.GetOutboxMessages(0, 0)
+	gomega.Expect(err).To(gomega.Succeed())
+	responses := make([]entities.EdgeControllerOpResponse, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Type == entities.ECOpResponseMessage {
+			response := entities.EdgeControllerOpResponse{}
+			gomega.Expect(msg.GetPayload(&response)).To(gomega.Succeed())
+			responses = append(responses, response)
+		}
+	}
+	return responses
+}
+
+// selfSignedCertificate returns a PEM self-signed certificate.
+func selfSignedCertificate() string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "winrm-ca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+var _ = ginkgo.Describe("Agent installer", func() {
+
+	var provider *asset.MockupAssetProvider
+	var installer *AgentInstaller
+
+	ginkgo.BeforeEach(func() {
+		provider = asset.NewMockupAssetProvider()
+		notifier := agent.NewNotifier(time.Minute, provider, nil, "org", "ec")
+		installer = NewAgentInstaller(config.Config{}, notifier, provider)
+	})
+
+	ginkgo.It("should detect the edge controller address", func() {
+		conn := &fakeConnection{output: "PATH=/bin\nSSH_CLIENT=192.168.1.1 50000 22\n"}
+		address, err := detectEdgeControllerIP(conn)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(address).To(gomega.Equal("192.168.1.1"))
+
+		address, err = detectEdgeControllerIP(&fakeAddressConnection{})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(address).To(gomega.Equal("10.0.0.1"))
+	})
+
+	ginkgo.It("should notify the failure of a step", func() {
+		installer.notifyResult("op", "org", "ec", derrors.NewInternalError("failed"), "start agent failed")
+		responses := getECOpResponses(provider)
+		gomega.Expect(responses).To(gomega.HaveLen(1))
+		gomega.Expect(responses[0].Status).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL.String()))
+		gomega.Expect(responses[0].Info).To(gomega.HavePrefix("start agent failed"))
+	})
+
+	ginkgo.Context("host key policy", func() {
+		ginkgo.It("should allow a stricter policy than the configured one", func() {
+			installer = NewAgentInstaller(config.Config{HostKeyPolicy: string(connection.TrustOnFirstUsePolicy)}, nil, provider)
+			_, err := installer.getHostKeyCallback(map[string]string{HostKeyPolicyParam: string(connection.FingerprintPolicy),
+				HostKeyFingerprintParam: "SHA256:test"})
+			gomega.Expect(err).To(gomega.Succeed())
+		})
+
+		ginkgo.It("should reject a less strict policy than the configured one", func() {
+			installer = NewAgentInstaller(config.Config{HostKeyPolicy: string(connection.KnownHostsPolicy)}, nil, provider)
+			_, err := installer.getHostKeyCallback(map[string]string{HostKeyPolicyParam: string(connection.TrustOnFirstUsePolicy)})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.InvalidArgument))
+		})
+
+		ginkgo.It("should reject an unsupported policy", func() {
+			_, err := installer.getHostKeyCallback(map[string]string{HostKeyPolicyParam: "none"})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.InvalidArgument))
+		})
+	})
+
+	ginkgo.Context("winrm connections", func() {
+		recipe := &Recipe{Connection: connection.WinRMType, HTTPS: true}
+		request := func(caCert string) *grpc_inventory_manager_go.InstallAgentRequest {
+			return &grpc_inventory_manager_go.InstallAgentRequest{
+				TargetHost: "10.0.0.2",
+				Credentials: &grpc_inventory_manager_go.InstallCredentials{Username: "admin",
+					Credentials: &grpc_inventory_manager_go.InstallCredentials_Password{Password: "secret"}},
+				Params: map[string]string{WinRMCACertParam: caCert},
+			}
+		}
+
+		ginkgo.It("should use the CA of the request", func() {
+			caCert := selfSignedCertificate()
+			conn, err := installer.newConnection(recipe, request(caCert))
+			gomega.Expect(err).To(gomega.Succeed())
+			winrm, ok := conn.(*connection.WinRMConnection)
+			gomega.Expect(ok).To(gomega.BeTrue())
+			gomega.Expect(winrm.CACert).To(gomega.Equal(caCert))
+			gomega.Expect(winrm.Port).To(gomega.Equal(connection.DefaultWinRMHTTPSPort))
+		})
+
+		ginkgo.It("should reject an invalid CA", func() {
+			_, err := installer.newConnection(recipe, request("invalid"))
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.InvalidArgument))
+		})
+	})
+
+	ginkgo.Context("remote uninstall", func() {
+		var request *UninstallRequest
+		var journal *entities.InstallOperation
+
+		ginkgo.BeforeEach(func() {
+			request = &UninstallRequest{
+				OrganizationId:   "org",
+				EdgeControllerId: "ec",
+				AssetId:          "asset",
+				TargetHost:       "10.0.0.1",
+				Credentials:      &grpc_inventory_manager_go.InstallCredentials{Username: "admin", IsSudoer: true},
+			}
+			journal = &entities.InstallOperation{OperationId: "op", TargetHost: "10.0.0.1"}
+		})
+
+		ginkgo.It("should stop the agent and remove its files", func() {
+			conn := &fakeConnection{}
+			err := installer.uninstall(conn, "op", request, journal)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(conn.executed).To(gomega.HaveLen(len(uninstallSteps)))
+			gomega.Expect(conn.executed[0]).To(gomega.ContainSubstring("service-net-agent stop"))
+			gomega.Expect(conn.executed[1]).To(gomega.ContainSubstring("systemctl disable service-net-agent"))
+			gomega.Expect(conn.executed[2]).To(gomega.Equal("sudo rm -f /etc/systemd/system/service-net-agent.service"))
+			gomega.Expect(conn.executed[3]).To(gomega.Equal("sudo systemctl daemon-reload"))
+			gomega.Expect(conn.executed[4]).To(gomega.Equal("sudo rm -f /opt/nalej/bin/service-net-agent"))
+			gomega.Expect(conn.executed[5]).To(gomega.Equal("sudo rm -rf /opt/nalej/certs"))
+
+			responses := getECOpResponses(provider)
+			// connect and each step report their progress before the final result
+			gomega.Expect(responses).To(gomega.HaveLen(len(uninstallSteps) + 2))
+			for _, response := range responses[:len(responses)-1] {
+				gomega.Expect(response.OperationId).To(gomega.Equal("op"))
+				gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_INPROGRESS.String()))
+			}
+			gomega.Expect(responses[len(responses)-1].Status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS.String()))
+		})
+
+		ginkgo.It("should stop at the first failed step", func() {
+			conn := &fakeConnection{fail: "rm -f"}
+			err := installer.uninstall(conn, "op", request, journal)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(conn.executed).To(gomega.HaveLen(2))
+
+			responses := getECOpResponses(provider)
+			last := responses[len(responses)-1]
+			gomega.Expect(last.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL.String()))
+			gomega.Expect(last.Info).To(gomega.HavePrefix("remove agent binary failed"))
+			for _, response := range responses {
+				gomega.Expect(response.Status).NotTo(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS.String()))
+			}
+		})
+	})
+
+	ginkgo.Context("journaling installs", func() {
+		ginkgo.It("should remove a finished install from the journal", func() {
+			err := installer.InstallAgent("op", "token", &grpc_inventory_manager_go.InstallAgentRequest{
+				OrganizationId:   "org",
+				EdgeControllerId: "ec",
+				TargetHost:       "10.0.0.1",
+			})
+			// the agent binary is not available
+			gomega.Expect(err).NotTo(gomega.Succeed())
+			ops, err := provider.GetInstallOperations()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(ops).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should remove the join token of a failed install", func() {
+			notifier := agent.NewNotifier(time.Minute, provider, nil, "org", "ec")
+			manager := NewManager(config.Config{}, provider, nil, notifier, nil)
+			response, err := manager.InstallAgent(&grpc_inventory_manager_go.InstallAgentRequest{
+				OrganizationId:   "org",
+				EdgeControllerId: "ec",
+				TargetHost:       "10.0.0.1",
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(response.Status).To(gomega.Equal(grpc_inventory_go.OpStatus_INPROGRESS))
+
+			// the agent binary is not available
+			gomega.Eventually(func() []entities.JoinToken {
+				tokens, err := provider.ListJoinTokens()
+				gomega.Expect(err).To(gomega.Succeed())
+				return tokens
+			}).Should(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should fail the installs interrupted by a restart", func() {
+			token, err := provider.AddJoinToken("token", asset.JoinTokenOptions{})
+			gomega.Expect(err).To(gomega.Succeed())
+			err = provider.AddInstallOperation(entities.InstallOperation{
+				OperationId:      "op",
+				OrganizationId:   "org",
+				EdgeControllerId: "ec",
+				TargetHost:       "10.0.0.1",
+				Token:            token.Token,
+				Step:             "start agent",
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+
+			err = installer.FailInterruptedInstalls()
+			gomega.Expect(err).To(gomega.Succeed())
+
+			responses := getECOpResponses(provider)
+			gomega.Expect(responses).To(gomega.HaveLen(1))
+			gomega.Expect(responses[0].OperationId).To(gomega.Equal("op"))
+			gomega.Expect(responses[0].Status).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL.String()))
+			gomega.Expect(responses[0].Info).To(gomega.ContainSubstring("controller restarted during step start agent"))
+			valid, err := provider.CheckJoinToken("token")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(valid).To(gomega.BeFalse())
+			ops, err := provider.GetInstallOperations()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(ops).To(gomega.BeEmpty())
+		})
+	})
+})
@@ -17,11 +17,13 @@
 package eic
 
 import (
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/edge-controller/internal/pkg/entities"
 	"github.com/nalej/edge-controller/internal/pkg/provider/asset"
 	"github.com/nalej/edge-controller/internal/pkg/provider/metricstorage"
 	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/bootstrap"
 	"github.com/nalej/edge-controller/internal/pkg/server/config"
 	"github.com/nalej/edge-controller/internal/pkg/server/helper"
 	"github.com/nalej/grpc-common-go"
@@ -31,12 +33,24 @@ import (
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/rs/zerolog/log"
 	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 const CanceledResponseInfo = "Canceled by the System. Agent Uninstalled"
+const CanceledByRequestResponseInfo = "Canceled by the System"
 const InstallResponseInfo  = "Agent Install"
 const UninstallResponseInfo = "Agent Uninstall"
+const ConfigureResponseInfo = "Configuration applied"
+const QueuedResponseInfo = "Queued at position"
+
+// Configurator applies the configuration options received from the management cluster.
+type Configurator interface {
+	// Configure validates and applies the options and returns the ones that have been applied.
+	Configure(params map[string]string) (map[string]string, derrors.Error)
+}
 
 type Manager struct {
 	config   config.Config
@@ -45,14 +59,37 @@ type Manager struct {
 	metricStorageProvider metricstorage.Provider
 	agentInstaller        *AgentInstaller
 	notifier              *agent.Notifier
+	configurator          Configurator
+	// tasks tracks the operations that continue after the response is sent, so the shutdown can wait for them.
+	tasks *sync.WaitGroup
+}
+
+func NewManager(cfg config.Config, assetProvider asset.Provider, metricStorageProvider metricstorage.Provider, notifier *agent.Notifier, configurator Configurator) Manager {
+	installer := NewAgentInstaller(cfg, notifier, assetProvider)
+	return Manager{cfg, assetProvider, metricStorageProvider, installer, notifier, configurator, &sync.WaitGroup{}}
+}
+
+// runInBackground launches an operation that continues after the response is sent.
+func (m *Manager) runInBackground(task func()) {
+	m.tasks.Add(1)
+	go func() {
+		defer m.tasks.Done()
+		task()
+	}()
 }
 
-func NewManager(cfg config.Config, assetProvider asset.Provider, metricStorageProvider metricstorage.Provider, notifier *agent.Notifier) Manager {
-	installer := NewAgentInstaller(cfg, notifier)
-	return Manager{cfg, assetProvider, metricStorageProvider, installer, notifier}
+// WaitBackgroundTasks waits for the operations launched in background. The EIC server must be stopped so no new
+// operation is launched while waiting.
+func (m *Manager) WaitBackgroundTasks() {
+	m.tasks.Wait()
 }
 
-// unlinkEC removes VPN Client and credentials file
+// FailInterruptedInstalls reports the agent installs interrupted by a restart of the edge controller.
+func (m *Manager) FailInterruptedInstalls() derrors.Error {
+	return m.agentInstaller.FailInterruptedInstalls()
+}
+
+// unlinkEC removes VPN Client, credentials file and bootstrap state
 func (m *Manager) unlinkEC() {
 
 	vpnHelper, err := helper.NewJoinHelper(m.config.JoinTokenPath, m.config.EicApiPort)
@@ -70,6 +107,11 @@ func (m *Manager) unlinkEC() {
 		log.Warn().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error deleting credentials")
 	}
 
+	derr := bootstrap.RemoveState(m.config.BootstrapStatePath)
+	if derr != nil {
+		log.Warn().Str("error", derr.DebugReport()).Msg("error deleting bootstrap state")
+	}
+
 	m.notifier.StopNotifierLoop()
 
 	log.Info().Str("EC", m.config.EdgeControllerId).Msg("unlinked")
@@ -86,7 +128,7 @@ func (m *Manager) Unlink() (*grpc_common_go.Success, error) {
 		log.Warn().Str("err", err.DebugReport()).Msg("error clearing database")
 	}
 
-	go m.unlinkEC()
+	m.runInBackground(m.unlinkEC)
 
 	return &grpc_common_go.Success{}, nil
 }
@@ -95,23 +137,27 @@ func (m *Manager) Unlink() (*grpc_common_go.Success, error) {
 // next connection.
 func (m *Manager) TriggerAgentOperation(request *grpc_inventory_manager_go.AgentOpRequest) (*grpc_inventory_manager_go.AgentOpResponse, error) {
 
-	log.Info().Interface("request", request).Msg("Triggering agent operation")
+	// the values of the params are not logged as they may contain credentials or tokens
+	log.Info().Str("plugin", request.Plugin).Str("operation", request.Operation).Str("assetID", request.AssetId).
+		Str("operationID", request.OperationId).Strs("params", paramNames(request.Params)).Msg("Triggering agent operation")
 
-	// NP-1506. Limit agent operation pending queue on EC
-	ops, err := m.provider.GetPendingOperations(request.AssetId, false)
-	if err != nil {
-		return nil, conversions.ToGRPCError(err)
-	}
-	if len(ops) > 0 {
-		return nil, conversions.ToGRPCError(derrors.NewFailedPreconditionError("unable to queue this operation, there is already one"))
+	response, executed, err := m.executeCoreOperation(request)
+	if executed {
+		if err != nil {
+			return nil, conversions.ToGRPCError(err)
+		}
+		return response, nil
 	}
 
 	operation := entities.NewAgentOpRequestFromGRPC(request)
+	if timeout := entities.GetOperationTimeout(request.Params, m.config.AgentOpTimeout); timeout > 0 {
+		operation.Deadline = operation.Created + int64(timeout.Seconds())
+	}
 
-	// adds the operation
-	err = m.provider.AddPendingOperation(*operation)
+	// adds the operation to the queue of the agent, it is rejected if the queue is full
+	position, err := m.provider.AddPendingOperation(*operation, m.config.AgentQueueSize)
 	if err != nil {
-		return nil, conversions.ToDerror(err)
+		return nil, conversions.ToGRPCError(err)
 	}
 
 	return &grpc_inventory_manager_go.AgentOpResponse{
@@ -121,14 +167,55 @@ func (m *Manager) TriggerAgentOperation(request *grpc_inventory_manager_go.Agent
 		OperationId:      request.OperationId,
 		Timestamp:        operation.Created,
 		Status:           grpc_inventory_go.OpStatus_SCHEDULED,
-		Info:             "",
+		Info:             fmt.Sprintf("%s %d", QueuedResponseInfo, position),
 	}, nil
 }
 
+// paramNames returns the sorted names of a set of params.
+func paramNames(params map[string]string) []string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Configure changes specific configuration options of the Edge Controller
-// and/or Edge Controller plugins
+// and/or Edge Controller plugins. The applied options are reported to the management cluster
+// as an edge controller operation response.
 func (m *Manager) Configure(request *grpc_inventory_manager_go.ConfigureEICRequest) (*grpc_common_go.Success, error) {
-	return nil, nil
+
+	applied, err := m.configurator.Configure(request.Params)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	keys := make([]string, 0, len(applied))
+	for key := range applied {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	options := make([]string, 0, len(keys))
+	for _, key := range keys {
+		options = append(options, fmt.Sprintf("%s=%s", key, applied[key]))
+	}
+
+	// the configure request does not carry an operation id, so the response gets a new one and the management
+	// cluster identifies it by the applied options in the info field
+	err = m.notifier.NotifyECOpResponse(&grpc_inventory_manager_go.EdgeControllerOpResponse{
+		OrganizationId:   request.OrganizationId,
+		EdgeControllerId: request.EdgeControllerId,
+		OperationId:      uuid.NewV4().String(),
+		Timestamp:        time.Now().Unix(),
+		Status:           grpc_inventory_go.OpStatus_SUCCESS,
+		Info:             fmt.Sprintf("%s: %s", ConfigureResponseInfo, strings.Join(options, ",")),
+	})
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Msg("cannot store the configure response")
+	}
+
+	return &grpc_common_go.Success{}, nil
 }
 
 // ListMetrics returns available metrics for a certain selection of assets
@@ -207,49 +294,97 @@ func (m *Manager) QueryMetrics(request *grpc_monitoring_go.QueryMetricsRequest)
 
 // CreateAgentJoinToken generates a JoinToken to allow an agent to join to a controller
 func (m *Manager) CreateAgentJoinToken(edgeControllerID *grpc_inventory_go.EdgeControllerId) (*grpc_inventory_manager_go.AgentJoinToken, error) {
-	token := uuid.NewV4().String()
-
-	tokenInfo, err := m.provider.AddJoinToken(token)
+	tokenInfo, err := m.createJoinToken(asset.JoinTokenOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	log.Info().Interface("token", token).Msg("agent join token added")
-
 	return &grpc_inventory_manager_go.AgentJoinToken{
 		OrganizationId:   edgeControllerID.OrganizationId,
 		EdgeControllerId: edgeControllerID.EdgeControllerId,
-		Token:            token,
+		Token:            tokenInfo.Token,
 		ExpiresOn:        tokenInfo.ExpiredOn,
 	}, nil
 
 }
 
-// UninstallAgent operation to uninstall an agent
+// createJoinToken generates a join token with the given restrictions.
+func (m *Manager) createJoinToken(options asset.JoinTokenOptions) (*entities.JoinToken, derrors.Error) {
+	tokenInfo, err := m.provider.AddJoinToken(uuid.NewV4().String(), options)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("token", tokenInfo.Token).Int64("expiresOn", tokenInfo.ExpiredOn).Int("maxUses", tokenInfo.MaxUses).
+		Msg("agent join token added")
+	return tokenInfo, nil
+}
+
+// UninstallAgent operation to uninstall an agent. The request has no credentials for the target host, so the agent
+// is not removed from the host; the uninstall_agent core operation removes it through SSH.
 func (m *Manager) UninstallAgent(assetID *grpc_inventory_manager_go.FullUninstallAgentRequest) (*grpc_inventory_manager_go.EdgeControllerOpResponse, error) {
 
+	operationID := uuid.NewV4().String()
+	if err := m.uninstallAsset(assetID, operationID); err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	return &grpc_inventory_manager_go.EdgeControllerOpResponse{
+		OrganizationId: assetID.OrganizationId,
+		EdgeControllerId: assetID.EdgeControllerId,
+		OperationId: operationID,
+		Status: grpc_inventory_go.OpStatus_SCHEDULED,
+		Timestamp: time.Now().Unix(),
+		Info: UninstallResponseInfo,
+
+	}, nil
+}
+
+// uninstallAsset records the uninstall of an agent and cancels its operations. A forced uninstall removes the asset
+// directly, otherwise the uninstall waits for the agent to connect.
+func (m *Manager) uninstallAsset(assetID *grpc_inventory_manager_go.FullUninstallAgentRequest, operationID string) derrors.Error {
+
 	// TODO: check what happens if a 'forced uninstall' message is received and before the token is deleted the agent connects
 	// send the message to the notifier
-	operationID := uuid.NewV4().String()
-	m.notifier.UninstallAgent(assetID, operationID)
+	if err := m.notifier.UninstallAgent(assetID, operationID); err != nil {
+		log.Error().Str("assetID", assetID.AssetId).Str("trace", err.DebugReport()).Msg("cannot store agent uninstall")
+		return err
+	}
 
-	//  remove pending operations and send them as cancelled to the IM.
+	//  remove pending operations and send them as cancelled to the IM with the delivered ones.
 	pending, err := m.provider.GetPendingOperations(assetID.AssetId, true)
 	if err != nil {
 		log.Error().Str("trace", err.DebugReport()).Msg("cannot retrieve pending operations for an agent uninstalling agent")
 		// In this case the error is not returned to the agent as it cannot do anything.
-		return nil, err
+		return err
+	}
+
+	// the operations delivered to the agent are flagged so their response is ignored, the ones already canceled
+	// have been reported
+	delivered, err := m.provider.GetDeliveredOperations(assetID.AssetId)
+	if err != nil {
+		log.Error().Str("trace", err.DebugReport()).Msg("cannot retrieve delivered operations for an agent uninstalling agent")
+		return err
+	}
+	for _, operation := range delivered {
+		if operation.Canceled {
+			continue
+		}
+		if _, err := m.provider.CancelDeliveredOperation(assetID.AssetId, operation.OperationId); err != nil {
+			log.Warn().Str("trace", err.DebugReport()).Str("asset_id", operation.AssetId).
+				Str("operation_id", operation.OperationId).Msg("cannot cancel delivered operation")
+			continue
+		}
+		pending = append(pending, operation)
 	}
 
 	for _, operation := range pending {
-		err = m.provider.AddOpResponse(entities.AgentOpResponse{
-			Created:          time.Now().Unix(),
+		err = m.notifier.NotifyCallback(&grpc_inventory_manager_go.AgentOpResponse{
 			OrganizationId:   assetID.OrganizationId,
 			EdgeControllerId: assetID.EdgeControllerId,
 			AssetId:          assetID.AssetId,
 			OperationId:      operation.OperationId,
 			Timestamp:        time.Now().Unix(),
-			Status:           grpc_inventory_go.OpStatus_CANCELED.String(),
+			Status:           grpc_inventory_go.OpStatus_CANCELED,
 			Info:             CanceledResponseInfo,
 		})
 		if err != nil {
@@ -269,26 +404,34 @@ func (m *Manager) UninstallAgent(assetID *grpc_inventory_manager_go.FullUninstal
 		}
 	}
 
-	return &grpc_inventory_manager_go.EdgeControllerOpResponse{
-		OrganizationId: assetID.OrganizationId,
-		EdgeControllerId: assetID.EdgeControllerId,
-		OperationId: operationID,
-		Status: grpc_inventory_go.OpStatus_SCHEDULED,
-		Timestamp: time.Now().Unix(),
-		Info: UninstallResponseInfo,
-
-	}, nil
+	return nil
 }
 
+// InstallAgent triggers the install of an agent in the target host, or in each host of the list or range of the
+// request params.
 func (m *Manager) InstallAgent(request *grpc_inventory_manager_go.InstallAgentRequest) (*grpc_inventory_manager_go.EdgeControllerOpResponse, error) {
-	// Prepare the data to trigger the async install
+	hosts, bErr := GetBulkTargets(request)
+	if bErr != nil {
+		return nil, conversions.ToGRPCError(bErr)
+	}
+	if hosts != nil {
+		return m.bulkInstallAgent(request, hosts)
+	}
+
+	// Prepare the data to trigger the async install, the token can only be used by the installed agent
 	opID := uuid.NewV4().String()
-	token := uuid.NewV4().String()
-	tokenInfo, err := m.provider.AddJoinToken(token)
+	tokenInfo, err := m.createJoinToken(asset.JoinTokenOptions{MaxUses: 1})
 	if err != nil {
-		return nil, err
+		return nil, conversions.ToGRPCError(err)
 	}
-	go m.agentInstaller.InstallAgent(opID, tokenInfo.Token, request)
+	m.runInBackground(func() {
+		err := m.agentInstaller.InstallAgent(opID, tokenInfo.Token, request)
+		if err != nil {
+			if rErr := m.provider.RemoveJoinToken(tokenInfo.Token); rErr != nil {
+				log.Warn().Str("operationID", opID).Str("trace", rErr.DebugReport()).Msg("cannot revoke join token")
+			}
+		}
+	})
 	response := &grpc_inventory_manager_go.EdgeControllerOpResponse{
 		OrganizationId:		request.OrganizationId,
 		EdgeControllerId:	request.EdgeControllerId,
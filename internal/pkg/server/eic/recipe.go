@@ -0,0 +1,235 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/edge-controller/internal/pkg/server/connection"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultAgentBinaryName with the name of the agent binary if the recipe does not define it.
+const DefaultAgentBinaryName = "service-net-agent"
+
+// RecipeStep is one of the steps of an install recipe. Exactly one of Copy, Exec or Verify must be set. The values
+// are templates that can use the fields of RecipeVariables, e.g. {{.AgentPort}}.
+type RecipeStep struct {
+	// Name of the step used in the progress notifications.
+	Name string `yaml:"name"`
+	// Copy with the local file to be copied to Target.
+	Copy string `yaml:"copy,omitempty"`
+	// Target with the remote path of a copy.
+	Target string `yaml:"target,omitempty"`
+	// Exec with a command to execute.
+	Exec string `yaml:"exec,omitempty"`
+	// Verify with a command whose output must match the Expect regular expression.
+	Verify string `yaml:"verify,omitempty"`
+	// Expect with the regular expression the output of Verify must match. Any output is valid if empty.
+	Expect string `yaml:"expect,omitempty"`
+}
+
+// Recipe with the steps required to install an agent of a given type.
+type Recipe struct {
+	// Connection with the type of connection used to reach the host, ssh or winrm. Defaults to ssh.
+	Connection connection.ConnectionType `yaml:"connection,omitempty"`
+	// Port of the connection. Defaults to the standard port of the connection type.
+	Port string `yaml:"port,omitempty"`
+	// HTTPS enables TLS in WinRM connections.
+	HTTPS bool `yaml:"https,omitempty"`
+	// AllowHTTP allows WinRM connections without HTTPS, where basic authentication sends the password unencrypted.
+	AllowHTTP bool `yaml:"allowHTTP,omitempty"`
+	// Binary with the name of the agent binary in the directory of the agent type.
+	Binary string `yaml:"binary"`
+	// CACertPath with the remote path where the CA certificate is stored, available as {{.CACertPath}}.
+	CACertPath string `yaml:"caCertPath"`
+	// Steps to be executed in order.
+	Steps []RecipeStep `yaml:"steps"`
+}
+
+// RecipeVariables with the values available in the templates of a recipe.
+type RecipeVariables struct {
+	// Token to join the agent.
+	Token string
+	// ControllerIP with the address of the edge controller as seen by the target host.
+	ControllerIP string
+	// AgentPort where the edge controller receives agent messages.
+	AgentPort int
+	// CACertPath with the remote path of the CA certificate.
+	CACertPath string
+	// AgentBinary with the local path of the agent binary.
+	AgentBinary string
+	// CACertFile with the local path of a file containing the CA certificate received in the request.
+	CACertFile string
+}
+
+// defaultLinuxRecipe installs the agent with the layout used before recipes were configurable. The default recipes
+// are the only copy of the built-in install steps, configs/recipes/README.md describes how to replace them.
+var defaultLinuxRecipe = Recipe{
+	Binary:     DefaultAgentBinaryName,
+	CACertPath: "/opt/nalej/certs/cacert.pem",
+	Steps: []RecipeStep{
+		{Name: "copy agent binary", Copy: "{{.AgentBinary}}", Target: "."},
+		{Name: "create cert directory", Exec: "mkdir -p /opt/nalej/certs"},
+		{Name: "copy CA cert", Copy: "{{.CACertFile}}", Target: "{{.CACertPath}}"},
+		{Name: "set execution permissions", Exec: "chmod +x service-net-agent"},
+		{Name: "install agent", Exec: "./service-net-agent install"},
+		{Name: "join agent", Exec: "/opt/nalej/bin/service-net-agent join --token={{.Token}} --address={{.ControllerIP}}:{{.AgentPort}} --cert={{.CACertPath}}"},
+		{Name: "start agent", Exec: "/opt/nalej/bin/service-net-agent start"},
+	},
+}
+
+// defaultWindowsRecipe installs the agent through WinRM over HTTPS.
+var defaultWindowsRecipe = Recipe{
+	Connection: connection.WinRMType,
+	HTTPS:      true,
+	Binary:     DefaultAgentBinaryName + ".exe",
+	CACertPath: `C:\ProgramData\Nalej\certs\cacert.pem`,
+	Steps: []RecipeStep{
+		{Name: "create bin directory", Exec: `if not exist C:\ProgramData\Nalej\bin mkdir C:\ProgramData\Nalej\bin`},
+		{Name: "create cert directory", Exec: `if not exist C:\ProgramData\Nalej\certs mkdir C:\ProgramData\Nalej\certs`},
+		{Name: "copy agent binary", Copy: "{{.AgentBinary}}", Target: `C:\ProgramData\Nalej\bin\service-net-agent.exe`},
+		{Name: "copy CA cert", Copy: "{{.CACertFile}}", Target: "{{.CACertPath}}"},
+		{Name: "install agent", Exec: `C:\ProgramData\Nalej\bin\service-net-agent.exe install`},
+		{Name: "join agent", Exec: `C:\ProgramData\Nalej\bin\service-net-agent.exe join --token={{.Token}} --address={{.ControllerIP}}:{{.AgentPort}} --cert={{.CACertPath}}`},
+		{Name: "start agent", Exec: `C:\ProgramData\Nalej\bin\service-net-agent.exe start`},
+	},
+}
+
+// recipeFileName returns the name of the recipe file of an agent type, e.g. linux_amd64.yaml.
+func recipeFileName(agentType grpc_inventory_manager_go.AgentType) string {
+	return fmt.Sprintf("%s.yaml", strings.ToLower(agentType.String()))
+}
+
+// LoadRecipe reads the recipe of an agent type from a directory. If the directory does not contain a recipe for
+// the type, the default one is returned.
+func LoadRecipe(dir string, agentType grpc_inventory_manager_go.AgentType) (*Recipe, derrors.Error) {
+	path := filepath.Join(dir, recipeFileName(agentType))
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		recipe := defaultLinuxRecipe
+		if agentType == grpc_inventory_manager_go.AgentType_WINDOWS_AMD64 {
+			recipe = defaultWindowsRecipe
+		}
+		return &recipe, nil
+	}
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot read install recipe").WithParams(path)
+	}
+	recipe := &Recipe{}
+	err = yaml.UnmarshalStrict(content, recipe)
+	if err != nil {
+		return nil, derrors.AsError(err, "cannot parse install recipe").WithParams(path)
+	}
+	if recipe.Binary == "" {
+		recipe.Binary = DefaultAgentBinaryName
+	}
+	vErr := recipe.Validate()
+	if vErr != nil {
+		return nil, vErr.WithParams(path)
+	}
+	return recipe, nil
+}
+
+// Validate checks that the steps of the recipe are well formed.
+func (r *Recipe) Validate() derrors.Error {
+	if r.Connection != "" && r.Connection != connection.SSHType && r.Connection != connection.WinRMType {
+		return derrors.NewInvalidArgumentError("recipe connection must be ssh or winrm").WithParams(string(r.Connection))
+	}
+	if r.ConnectionType() == connection.WinRMType && !r.HTTPS && !r.AllowHTTP {
+		return derrors.NewInvalidArgumentError("winrm recipes must use https unless allowHTTP is set")
+	}
+	if len(r.Steps) == 0 {
+		return derrors.NewInvalidArgumentError("recipe must contain at least one step")
+	}
+	for i, step := range r.Steps {
+		if step.Name == "" {
+			return derrors.NewInvalidArgumentError("recipe step must have a name").WithParams(i)
+		}
+		actions := 0
+		for _, action := range []string{step.Copy, step.Exec, step.Verify} {
+			if action != "" {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return derrors.NewInvalidArgumentError("recipe step must define one of copy, exec or verify").WithParams(step.Name)
+		}
+		if step.Copy != "" && step.Target == "" {
+			return derrors.NewInvalidArgumentError("recipe copy step must define a target").WithParams(step.Name)
+		}
+		if step.Expect != "" {
+			if _, err := regexp.Compile(step.Expect); err != nil {
+				return derrors.NewInvalidArgumentError("invalid expect expression", err).WithParams(step.Name)
+			}
+		}
+	}
+	// rendering with empty values detects malformed templates and unknown variables
+	_, err := r.Render(RecipeVariables{})
+	return err
+}
+
+// ConnectionType returns the type of connection used by the recipe.
+func (r *Recipe) ConnectionType() connection.ConnectionType {
+	if r.Connection == "" {
+		return connection.SSHType
+	}
+	return r.Connection
+}
+
+// Render returns the steps of the recipe with the variables substituted.
+func (r *Recipe) Render(variables RecipeVariables) ([]RecipeStep, derrors.Error) {
+	variables.CACertPath = r.CACertPath
+	rendered := make([]RecipeStep, 0, len(r.Steps))
+	for _, step := range r.Steps {
+		result := step
+		for _, field := range []*string{&result.Copy, &result.Target, &result.Exec, &result.Verify} {
+			value, err := renderTemplate(step.Name, *field, variables)
+			if err != nil {
+				return nil, err
+			}
+			*field = value
+		}
+		rendered = append(rendered, result)
+	}
+	return rendered, nil
+}
+
+func renderTemplate(name string, value string, variables RecipeVariables) (string, derrors.Error) {
+	if value == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", derrors.NewInvalidArgumentError("invalid recipe template", err).WithParams(name)
+	}
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, variables)
+	if err != nil {
+		return "", derrors.NewInvalidArgumentError("cannot render recipe template", err).WithParams(name)
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nalej/edge-controller/internal/pkg/server/connection"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Install recipes", func() {
+
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "recipes")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeRecipe := func(content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, "linux_arm64.yaml"), []byte(content), 0600)
+		gomega.Expect(err).To(gomega.Succeed())
+	}
+
+	ginkgo.It("should use the default recipe if there is no file for the agent type", func() {
+		recipe, err := LoadRecipe(dir, grpc_inventory_manager_go.AgentType_LINUX_AMD64)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(*recipe).To(gomega.Equal(defaultLinuxRecipe))
+
+		gomega.Expect(recipe.ConnectionType()).To(gomega.Equal(connection.SSHType))
+
+		recipe, err = LoadRecipe(dir, grpc_inventory_manager_go.AgentType_WINDOWS_AMD64)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(*recipe).To(gomega.Equal(defaultWindowsRecipe))
+		gomega.Expect(recipe.ConnectionType()).To(gomega.Equal(connection.WinRMType))
+	})
+
+	ginkgo.It("should render the variables of the steps", func() {
+		writeRecipe(`
+caCertPath: /home/agent/ca.pem
+steps:
+  - name: copy CA cert
+    copy: "{{.CACertFile}}"
+    target: "{{.CACertPath}}"
+  - name: join agent
+    exec: ./agent join --token={{.Token}} --address={{.ControllerIP}}:{{.AgentPort}} --cert={{.CACertPath}}
+  - name: check agent
+    verify: ./agent status
+    expect: running
+`)
+		recipe, err := LoadRecipe(dir, grpc_inventory_manager_go.AgentType_LINUX_ARM64)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(recipe.Binary).To(gomega.Equal(DefaultAgentBinaryName))
+
+		steps, err := recipe.Render(RecipeVariables{
+			Token:        "token",
+			ControllerIP: "10.0.0.1",
+			AgentPort:    6000,
+			CACertFile:   "/tmp/ca",
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(steps).To(gomega.HaveLen(3))
+		gomega.Expect(steps[0].Copy).To(gomega.Equal("/tmp/ca"))
+		gomega.Expect(steps[0].Target).To(gomega.Equal("/home/agent/ca.pem"))
+		gomega.Expect(steps[1].Exec).To(gomega.Equal("./agent join --token=token --address=10.0.0.1:6000 --cert=/home/agent/ca.pem"))
+	})
+
+	ginkgo.It("should reject invalid recipes", func() {
+		invalid := map[string]string{
+			"without steps":                  "binary: agent",
+			"with unknown fields":            "steps:\n  - name: a\n    run: ls",
+			"with several actions in a step": "steps:\n  - name: a\n    exec: ls\n    verify: ls",
+			"with a copy without target":     "steps:\n  - name: a\n    copy: file",
+			"with unknown variables":         "steps:\n  - name: a\n    exec: ls {{.Unknown}}",
+			"with an unknown connection":     "connection: telnet\nsteps:\n  - name: a\n    exec: ls",
+			"with an invalid expression":     "steps:\n  - name: a\n    verify: ls\n    expect: \"[\"",
+			"with winrm over http":           "connection: winrm\nsteps:\n  - name: a\n    exec: dir",
+		}
+		for description, content := range invalid {
+			writeRecipe(content)
+			_, err := LoadRecipe(dir, grpc_inventory_manager_go.AgentType_LINUX_ARM64)
+			gomega.Expect(err).NotTo(gomega.Succeed(), description)
+		}
+	})
+
+	ginkgo.Context("executing the steps", func() {
+		ginkgo.It("should copy files and execute commands", func() {
+			conn := &fakeConnection{}
+			_, err := executeRecipeStep(conn, RecipeStep{Name: "copy", Copy: "/tmp/ca", Target: "ca.pem"}, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = executeRecipeStep(conn, RecipeStep{Name: "exec", Exec: "ls"}, true)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(conn.copied).To(gomega.Equal([]string{"/tmp/ca:ca.pem"}))
+			gomega.Expect(conn.executed).To(gomega.Equal([]string{"sudo ls"}))
+		})
+
+		ginkgo.It("should check the output of the verify steps", func() {
+			conn := &fakeConnection{output: "agent is running\n"}
+			_, err := executeRecipeStep(conn, RecipeStep{Name: "check", Verify: "status", Expect: "running"}, false)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = executeRecipeStep(conn, RecipeStep{Name: "check", Verify: "status", Expect: "^stopped"}, false)
+			gomega.Expect(err).NotTo(gomega.Succeed())
+		})
+	})
+})
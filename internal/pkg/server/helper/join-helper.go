@@ -200,6 +200,14 @@ func (j * JoinHelper) Join (name string, labels string, geolocation string) (*gr
 func (j * JoinHelper) ConfigureDNS () error {
 	log.Info().Msg("Configuring DNS")
 
+	// the token is not loaded if the edge controller was restarted after the join
+	if j.EicToken.DnsUrl == "" {
+		loadErr := j.LoadTokenFile()
+		if loadErr != nil {
+			return conversions.ToGRPCError(loadErr)
+		}
+	}
+
 	ips, err := net.LookupHost(j.EicToken.DnsUrl)
 	if err != nil {
 		return err
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pki contains the certificate authority that issues the client certificates of the agents.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// AgentOrganizationalUnit identifies the client certificates issued to the agents.
+const AgentOrganizationalUnit = "edge-controller-agent"
+
+// DefaultCertificateValidity with the time the client certificates are valid.
+const DefaultCertificateValidity = 365 * 24 * time.Hour
+
+// DefaultKeyFile with the path where the private key of the authority is stored if it is not configured.
+const DefaultKeyFile = "/etc/edge-controller/agent-ca.key"
+
+// IssuedCertificate with a client certificate in PEM format.
+type IssuedCertificate struct {
+	// Serial number of the certificate in hexadecimal.
+	Serial string
+	// Certificate in PEM format.
+	Certificate string
+	// Expires with the timestamp when the certificate expires.
+	Expires int64
+}
+
+// Authority issues the client certificates of the agents. It is a CA with its own private key, named after the
+// certificate of the edge controller. Its certificate is derived from the key, so only the key needs to be stored for
+// the authority to be the same after a restart.
+type Authority struct {
+	certificate *x509.Certificate
+	signer      crypto.Signer
+	validity    time.Duration
+}
+
+// NewAuthority creates the authority named after the certificate of the edge controller, with the private key of the
+// authority. Both are in PEM format.
+func NewAuthority(certificatePEM string, authorityKeyPEM string, validity time.Duration) (*Authority, derrors.Error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, derrors.NewInvalidArgumentError("cannot load the edge controller certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot parse the edge controller certificate", err)
+	}
+	signer, dErr := parseSigner(authorityKeyPEM)
+	if dErr != nil {
+		return nil, dErr
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot marshal the public key of the authority", err)
+	}
+
+	// the serial and the key identifier are derived from the key so the authority is always the same
+	keyID := sha1.Sum(publicKey)
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(keyID[:]),
+		Subject: pkix.Name{
+			CommonName:   leaf.Subject.CommonName + " agent CA",
+			Organization: leaf.Subject.Organization,
+		},
+		NotBefore:             leaf.NotBefore,
+		NotAfter:              leaf.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          keyID[:],
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create the agent certificate authority", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot parse the agent certificate authority", err)
+	}
+	if validity <= 0 {
+		validity = DefaultCertificateValidity
+	}
+	return &Authority{certificate: certificate, signer: signer, validity: validity}, nil
+}
+
+// parseSigner parses a private key in PEM format that can sign certificates.
+func parseSigner(keyPEM string) (crypto.Signer, derrors.Error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, derrors.NewInvalidArgumentError("cannot load the private key of the authority")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot parse the private key of the authority", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, derrors.NewInvalidArgumentError("the private key of the authority cannot sign certificates")
+	}
+	return signer, nil
+}
+
+// LoadOrCreateKey returns the private key of the authority in PEM format stored in a file. The key is generated and
+// stored the first time, so the certificates issued before a restart are still valid.
+func LoadOrCreateKey(path string) (string, derrors.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		return string(content), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", derrors.AsError(err, "cannot read the private key of the authority")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", derrors.NewInternalError("cannot generate the private key of the authority", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", derrors.NewInternalError("cannot marshal the private key of the authority", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// the key is written into a temporary file that replaces the path, so a crash never leaves a partial key
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return "", derrors.AsError(err, "cannot create the private key file of the authority")
+	}
+	// the temporary file is only readable by the owner
+	_, err = tmp.Write(keyPEM)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", derrors.AsError(err, "cannot write the private key of the authority")
+	}
+	return string(keyPEM), nil
+}
+
+// Pool returns the pool with the authority to verify the client certificates.
+func (a *Authority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.certificate)
+	return pool
+}
+
+// Sign creates a client certificate for an asset from the certificate request of its agent in PEM format. The
+// subject of the request is ignored, the certificate always identifies the asset.
+func (a *Authority) Sign(assetID string, requestPEM string) (*IssuedCertificate, derrors.Error) {
+	block, _ := pem.Decode([]byte(requestPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, derrors.NewInvalidArgumentError("invalid certificate request").WithParams(assetID)
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("cannot parse the certificate request", err).WithParams(assetID)
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid signature of the certificate request", err).WithParams(assetID)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot generate the serial number", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(a.validity)
+	if notAfter.After(a.certificate.NotAfter) {
+		notAfter = a.certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         assetID,
+			OrganizationalUnit: []string{AgentOrganizationalUnit},
+		},
+		// tolerate clock skew between the edge controller and the agent
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.certificate, request.PublicKey, a.signer)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create the client certificate", err)
+	}
+
+	return &IssuedCertificate{
+		Serial:      Serial(template),
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Expires:     notAfter.Unix(),
+	}, nil
+}
+
+// NewCertificateRequest creates a private key and a certificate request for an asset in PEM format, as the agents do.
+func NewCertificateRequest(assetID string) (string, string, derrors.Error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", derrors.NewInternalError("cannot generate the private key", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: assetID},
+	}, key)
+	if err != nil {
+		return "", "", derrors.NewInternalError("cannot create the certificate request", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", derrors.NewInternalError("cannot marshal the private key", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), nil
+}
+
+// AssetID returns the asset of a client certificate issued by an authority, or an empty string if it is not an agent
+// certificate.
+func AssetID(certificate *x509.Certificate) string {
+	for _, unit := range certificate.Subject.OrganizationalUnit {
+		if unit == AgentOrganizationalUnit {
+			return certificate.Subject.CommonName
+		}
+	}
+	return ""
+}
+
+// Serial returns the serial number of a certificate in hexadecimal.
+func Serial(certificate *x509.Certificate) string {
+	return certificate.SerialNumber.Text(16)
+}
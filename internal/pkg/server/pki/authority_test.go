@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// newServerCertificate creates a self-signed certificate and its private key in PEM format.
+func newServerCertificate() (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "edge-controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	gomega.Expect(err).To(gomega.Succeed())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+var _ = ginkgo.Describe("Certificate authority", func() {
+
+	var dir string
+	var certificatePEM, serverKeyPEM, keyPEM string
+	var authority *Authority
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pki")
+		gomega.Expect(err).To(gomega.Succeed())
+		certificatePEM, serverKeyPEM = newServerCertificate()
+		keyPEM, err = LoadOrCreateKey(filepath.Join(dir, "agent-ca.key"))
+		gomega.Expect(err).To(gomega.Succeed())
+		created, aErr := NewAuthority(certificatePEM, keyPEM, time.Hour)
+		gomega.Expect(aErr).To(gomega.Succeed())
+		authority = created
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// sign returns a certificate for an asset and the private key generated by its agent.
+	sign := func(assetID string) (*IssuedCertificate, string) {
+		request, key, err := NewCertificateRequest("spoofed")
+		gomega.Expect(err).To(gomega.Succeed())
+		issued, err := authority.Sign(assetID, request)
+		gomega.Expect(err).To(gomega.Succeed())
+		return issued, key
+	}
+
+	ginkgo.It("should issue client certificates verified by the authority", func() {
+		issued, key := sign("asset")
+
+		pair, tErr := tls.X509KeyPair([]byte(issued.Certificate), []byte(key))
+		gomega.Expect(tErr).To(gomega.Succeed())
+		certificate, pErr := x509.ParseCertificate(pair.Certificate[0])
+		gomega.Expect(pErr).To(gomega.Succeed())
+		_, vErr := certificate.Verify(x509.VerifyOptions{
+			Roots:     authority.Pool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		gomega.Expect(vErr).To(gomega.Succeed())
+		gomega.Expect(AssetID(certificate)).To(gomega.Equal("asset"))
+		gomega.Expect(Serial(certificate)).To(gomega.Equal(issued.Serial))
+		gomega.Expect(certificate.NotAfter).To(gomega.BeTemporally("<=", time.Now().Add(time.Hour)))
+		gomega.Expect(issued.Expires).To(gomega.Equal(certificate.NotAfter.Unix()))
+	})
+
+	ginkgo.It("should issue a different serial to each certificate", func() {
+		first, _ := sign("asset")
+		second, _ := sign("asset")
+		gomega.Expect(first.Serial).ToNot(gomega.Equal(second.Serial))
+	})
+
+	ginkgo.It("should verify the certificates after a restart", func() {
+		issued, _ := sign("asset")
+		restarted, err := NewAuthority(certificatePEM, keyPEM, time.Hour)
+		gomega.Expect(err).To(gomega.Succeed())
+
+		block, _ := pem.Decode([]byte(issued.Certificate))
+		certificate, pErr := x509.ParseCertificate(block.Bytes)
+		gomega.Expect(pErr).To(gomega.Succeed())
+		_, vErr := certificate.Verify(x509.VerifyOptions{
+			Roots:     restarted.Pool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		gomega.Expect(vErr).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should store its own key", func() {
+		path := filepath.Join(dir, "agent-ca.key")
+		info, err := os.Stat(path)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(info.Mode().Perm()).To(gomega.Equal(os.FileMode(0600)))
+		stored, kErr := LoadOrCreateKey(path)
+		gomega.Expect(kErr).To(gomega.Succeed())
+		gomega.Expect(stored).To(gomega.Equal(keyPEM))
+		gomega.Expect(keyPEM).ToNot(gomega.Equal(serverKeyPEM))
+
+		pair, tErr := tls.X509KeyPair([]byte(certificatePEM), []byte(serverKeyPEM))
+		gomega.Expect(tErr).To(gomega.Succeed())
+		server, pErr := x509.ParseCertificate(pair.Certificate[0])
+		gomega.Expect(pErr).To(gomega.Succeed())
+		gomega.Expect(authority.certificate.PublicKey).ToNot(gomega.Equal(server.PublicKey))
+		gomega.Expect(authority.certificate.Subject.CommonName).To(gomega.Equal("edge-controller agent CA"))
+	})
+
+	ginkgo.It("should reject an invalid certificate request", func() {
+		_, err := authority.Sign("asset", "not a request")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = authority.Sign("asset", certificatePEM)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should not consider other certificates as agent certificates", func() {
+		block, _ := pem.Decode([]byte(certificatePEM))
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(AssetID(certificate)).To(gomega.BeEmpty())
+	})
+})
@@ -59,11 +59,7 @@ func getSubConfig(config *viper.Viper, prefix string) *viper.Viper {
 func startRegisteredPlugins(config *viper.Viper) (derrors.Error) {
 	for name, entry := range(plugin.ListPlugins()) {
 		log.Info().Str("name", name.String()).Str("description", entry.Description).Msg("starting plugin")
-		pluginConfig := config.Sub(name.String())
-		if pluginConfig == nil {
-			pluginConfig = viper.New()
-		}
-		derr := plugin.StartPlugin(name, pluginConfig)
+		derr := startPlugin(config, name.String())
 		if derr != nil {
 			plugin.StopAll()
 			return derr
@@ -72,3 +68,12 @@ func startRegisteredPlugins(config *viper.Viper) (derrors.Error) {
 
 	return nil
 }
+
+// startPlugin starts a plugin with its section of the plugin configuration.
+func startPlugin(config *viper.Viper, name string) (derrors.Error) {
+	pluginConfig := config.Sub(name)
+	if pluginConfig == nil {
+		pluginConfig = viper.New()
+	}
+	return plugin.StartPlugin(plugin.PluginName(name), pluginConfig)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/utils"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultFailureThreshold with the number of consecutive failures that opens the circuit.
+const DefaultFailureThreshold = 3
+
+// DefaultJitter with the fraction of the backoff delay that is randomized.
+const DefaultJitter = 0.2
+
+// DefaultBackoff with the delay before trying again to reach the management cluster once the circuit is open.
+var DefaultBackoff = utils.Backoff{
+	Initial: 5 * time.Second,
+	Max:     2 * time.Minute,
+	Factor:  2,
+}
+
+// CircuitState with the state of a circuit breaker.
+type CircuitState string
+
+const (
+	// CircuitClosed lets all the calls through.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen skips the calls until the backoff delay expires.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single trial call through to check if the remote service is reachable again.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// Stats with the metrics of a circuit breaker.
+type Stats struct {
+	// State of the circuit.
+	State CircuitState `json:"state"`
+	// ConsecutiveFailures with the number of failures since the last successful call.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// TotalFailures with the number of failed calls.
+	TotalFailures uint64 `json:"total_failures"`
+	// Skipped with the number of calls skipped because the circuit was open.
+	Skipped uint64 `json:"skipped"`
+	// LastFailure with the time of the last failed call.
+	LastFailure time.Time `json:"last_failure"`
+	// RetryAt with the time when the next call will be let through if the circuit is open.
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// CircuitBreaker skips the calls to a remote service while it is unreachable. After a number of consecutive
+// failures the circuit opens and calls are skipped for an exponential backoff delay with jitter; then a single trial
+// call is let through, closing the circuit if it succeeds or opening it again with a longer delay if it fails.
+type CircuitBreaker struct {
+	sync.Mutex
+	backoff   utils.Backoff
+	jitter    float64
+	threshold int
+	// openings with the number of times the circuit has been opened since it was closed.
+	openings int
+	// trial is true while the trial call of a half open circuit is running.
+	trial bool
+	stats Stats
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker.
+func NewCircuitBreaker(backoff utils.Backoff, jitter float64, threshold int) *CircuitBreaker {
+	return &CircuitBreaker{
+		backoff:   backoff,
+		jitter:    jitter,
+		threshold: threshold,
+		stats:     Stats{State: CircuitClosed},
+		now:       time.Now,
+	}
+}
+
+// Allow returns whether a call can be made. If the circuit is half open, only the first caller is allowed and must
+// report the result with Record.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	if cb.stats.State == CircuitOpen && !cb.now().Before(cb.stats.RetryAt) {
+		cb.stats.State = CircuitHalfOpen
+	}
+	switch cb.stats.State {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if !cb.trial {
+			cb.trial = true
+			return true
+		}
+	}
+	cb.stats.Skipped++
+	return false
+}
+
+// Record updates the circuit with the result of a call. Only the errors that indicate that the remote service is
+// unreachable count as failures.
+func (cb *CircuitBreaker) Record(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.trial = false
+	if !IsConnectivityError(err) {
+		if cb.stats.State != CircuitClosed {
+			log.Info().Int("failures", cb.stats.ConsecutiveFailures).Msg("management cluster reachable, circuit closed")
+		}
+		cb.stats.State = CircuitClosed
+		cb.stats.ConsecutiveFailures = 0
+		cb.openings = 0
+		return
+	}
+
+	cb.stats.ConsecutiveFailures++
+	cb.stats.TotalFailures++
+	cb.stats.LastFailure = cb.now()
+	if cb.stats.State == CircuitHalfOpen || cb.stats.ConsecutiveFailures >= cb.threshold {
+		delay := cb.delay()
+		cb.openings++
+		cb.stats.State = CircuitOpen
+		cb.stats.RetryAt = cb.stats.LastFailure.Add(delay)
+		log.Warn().Int("failures", cb.stats.ConsecutiveFailures).Str("retryIn", delay.String()).
+			Msg("management cluster unreachable, circuit open")
+	}
+}
+
+// delay returns the backoff delay of the current opening with jitter.
+func (cb *CircuitBreaker) delay() time.Duration {
+	delay := float64(cb.backoff.Delay(cb.openings))
+	delay = delay + delay*cb.jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// Stats returns the current metrics of the circuit breaker.
+func (cb *CircuitBreaker) Stats() Stats {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.stats
+}
+
+// IsConnectivityError returns whether an error indicates that the remote service could not be reached. Other errors,
+// including Unknown ones raised by the handlers of the remote service, show that it is reachable.
+func IsConnectivityError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
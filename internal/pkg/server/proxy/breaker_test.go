@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/edge-controller/internal/pkg/utils"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-edge-inventory-proxy-go"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// aliveClient is an inventory proxy client whose EICAlive calls return err.
+type aliveClient struct {
+	grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient
+	calls int
+	err   error
+}
+
+func (a *aliveClient) EICAlive(ctx context.Context, in *grpc_inventory_go.EdgeControllerId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	a.calls++
+	return &grpc_common_go.Success{}, a.err
+}
+
+var _ = ginkgo.Describe("Circuit breaker", func() {
+
+	var now time.Time
+	var breaker *CircuitBreaker
+	var remote *aliveClient
+	var client *Client
+
+	ginkgo.BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		breaker = NewCircuitBreaker(utils.Backoff{Initial: time.Second, Max: 4 * time.Second, Factor: 2}, 0, 2)
+		breaker.now = func() time.Time { return now }
+		remote = &aliveClient{}
+		client = NewClientWithBreaker(remote, breaker)
+	})
+
+	alive := func() error {
+		_, err := client.EICAlive(context.Background(), &grpc_inventory_go.EdgeControllerId{})
+		return err
+	}
+
+	ginkgo.It("should skip the calls once the failure threshold is reached", func() {
+		remote.err = status.Error(codes.Unavailable, "down")
+		gomega.Expect(alive()).To(gomega.Equal(remote.err))
+		gomega.Expect(breaker.Stats().State).To(gomega.Equal(CircuitClosed))
+		gomega.Expect(alive()).To(gomega.Equal(remote.err))
+		gomega.Expect(breaker.Stats().State).To(gomega.Equal(CircuitOpen))
+
+		gomega.Expect(IsCircuitOpen(alive())).To(gomega.BeTrue())
+		gomega.Expect(remote.calls).To(gomega.Equal(2))
+		stats := breaker.Stats()
+		gomega.Expect(stats.ConsecutiveFailures).To(gomega.Equal(2))
+		gomega.Expect(stats.Skipped).To(gomega.Equal(uint64(1)))
+		gomega.Expect(stats.RetryAt).To(gomega.Equal(now.Add(time.Second)))
+	})
+
+	ginkgo.It("should back off exponentially while the remote service is unreachable", func() {
+		remote.err = status.Error(codes.DeadlineExceeded, "timeout")
+		alive()
+		alive()
+		for _, delay := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+			now = breaker.Stats().RetryAt
+			gomega.Expect(IsCircuitOpen(alive())).To(gomega.BeFalse())
+			gomega.Expect(breaker.Stats().RetryAt).To(gomega.Equal(now.Add(delay)))
+		}
+	})
+
+	ginkgo.It("should close the circuit when the trial call succeeds", func() {
+		remote.err = status.Error(codes.Unavailable, "down")
+		alive()
+		alive()
+		now = breaker.Stats().RetryAt
+		remote.err = nil
+		gomega.Expect(alive()).To(gomega.Succeed())
+		stats := breaker.Stats()
+		gomega.Expect(stats.State).To(gomega.Equal(CircuitClosed))
+		gomega.Expect(stats.ConsecutiveFailures).To(gomega.Equal(0))
+		gomega.Expect(stats.TotalFailures).To(gomega.Equal(uint64(2)))
+	})
+
+	ginkgo.It("should let a single trial call through", func() {
+		remote.err = status.Error(codes.Unavailable, "down")
+		alive()
+		alive()
+		now = breaker.Stats().RetryAt
+		gomega.Expect(breaker.Allow()).To(gomega.BeTrue())
+		gomega.Expect(breaker.Allow()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should not count the errors of a reachable service as failures", func() {
+		for _, code := range []codes.Code{codes.InvalidArgument, codes.Unknown} {
+			remote.err = status.Error(code, "rejected")
+			for i := 0; i < 3; i++ {
+				gomega.Expect(alive()).To(gomega.Equal(remote.err))
+			}
+		}
+		gomega.Expect(breaker.Stats().State).To(gomega.Equal(CircuitClosed))
+		gomega.Expect(remote.calls).To(gomega.Equal(6))
+	})
+
+	ginkgo.It("should report the metrics of the calls with the connectivity", func() {
+		remote.err = status.Error(codes.Unavailable, "down")
+		alive()
+		alive()
+		alive()
+		connectivity := client.Connectivity().Get()
+		gomega.Expect(connectivity.State).To(gomega.Equal(Offline))
+		gomega.Expect(connectivity.Calls).NotTo(gomega.BeNil())
+		gomega.Expect(*connectivity.Calls).To(gomega.Equal(client.Stats()))
+		gomega.Expect(connectivity.Calls.Skipped).To(gomega.Equal(uint64(1)))
+	})
+})
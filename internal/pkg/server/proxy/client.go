@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-edge-inventory-proxy-go"
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned instead of calling the management cluster while it is unreachable.
+var ErrCircuitOpen = status.Error(codes.Unavailable, "management cluster unreachable, call skipped")
+
+// IsCircuitOpen returns whether a call has been skipped because the management cluster is unreachable.
+func IsCircuitOpen(err error) bool {
+	return err == ErrCircuitOpen
+}
+
+// Client of the inventory proxy of the management cluster that skips the calls while the proxy is unreachable. All
+// the calls share the same circuit breaker, and their results are tracked to know the connectivity state.
+type Client struct {
+	client       grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient
+	breaker      *CircuitBreaker
+	connectivity *ConnectivityTracker
+}
+
+// NewClient wraps an inventory proxy client with a circuit breaker with the default policy.
+func NewClient(client grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient) *Client {
+	return NewClientWithBreaker(client, NewCircuitBreaker(DefaultBackoff, DefaultJitter, DefaultFailureThreshold))
+}
+
+// NewClientWithBreaker wraps an inventory proxy client with the given circuit breaker.
+func NewClientWithBreaker(client grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient, breaker *CircuitBreaker) *Client {
+	connectivity := NewConnectivityTracker()
+	connectivity.stats = breaker.Stats
+	return &Client{client: client, breaker: breaker, connectivity: connectivity}
+}
+
+// Stats returns the metrics of the calls to the management cluster.
+func (c *Client) Stats() Stats {
+	return c.breaker.Stats()
+}
+
+// Connectivity returns the tracker of the connectivity with the management cluster.
+func (c *Client) Connectivity() *ConnectivityTracker {
+	return c.connectivity
+}
+
+// call executes a call if the circuit breaker allows it and records the result.
+func (c *Client) call(send func() error) error {
+	if !c.breaker.Allow() {
+		return ErrCircuitOpen
+	}
+	err := send()
+	c.breaker.Record(err)
+	c.connectivity.Record(err, c.breaker.Stats().State)
+	return err
+}
+
+func (c *Client) EICStart(ctx context.Context, in *grpc_inventory_manager_go.EICStartInfo, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.EICStart(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) EICAlive(ctx context.Context, in *grpc_inventory_go.EdgeControllerId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.EICAlive(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) AgentJoin(ctx context.Context, in *grpc_inventory_manager_go.AgentJoinRequest, opts ...grpc.CallOption) (*grpc_inventory_manager_go.AgentJoinResponse, error) {
+	var out *grpc_inventory_manager_go.AgentJoinResponse
+	err := c.call(func() (err error) {
+		out, err = c.client.AgentJoin(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) AgentStart(ctx context.Context, in *grpc_inventory_manager_go.AgentStartInfo, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.AgentStart(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) LogAgentAlive(ctx context.Context, in *grpc_inventory_manager_go.AgentsAlive, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.LogAgentAlive(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) CallbackAgentOperation(ctx context.Context, in *grpc_inventory_manager_go.AgentOpResponse, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.CallbackAgentOperation(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) CallbackECOperation(ctx context.Context, in *grpc_inventory_manager_go.EdgeControllerOpResponse, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.CallbackECOperation(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *Client) AgentUninstalled(ctx context.Context, in *grpc_inventory_go.AssetUninstalledId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	var out *grpc_common_go.Success
+	err := c.call(func() (err error) {
+		out, err = c.client.AgentUninstalled(ctx, in, opts...)
+		return err
+	})
+	return out, err
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectivityState with the connectivity of the edge controller with the management cluster.
+type ConnectivityState string
+
+const (
+	// Online if the last call to the management cluster reached it.
+	Online ConnectivityState = "online"
+	// Degraded if the last calls failed but the circuit is still closed.
+	Degraded ConnectivityState = "degraded"
+	// Offline if the management cluster is unreachable and the calls are skipped. This is also the state before the
+	// first call.
+	Offline ConnectivityState = "offline"
+)
+
+// Connectivity with the connectivity state and the times of the last calls.
+type Connectivity struct {
+	// State with the current state.
+	State ConnectivityState `json:"state"`
+	// Since with the time of the last transition.
+	Since time.Time `json:"since"`
+	// LastSuccess with the time of the last call that reached the management cluster.
+	LastSuccess time.Time `json:"last_success"`
+	// LastFailure with the time of the last call that could not reach the management cluster.
+	LastFailure time.Time `json:"last_failure"`
+	// LastError with the error of the last failed call.
+	LastError string `json:"last_error,omitempty"`
+	// Calls with the metrics of the calls to the management cluster, if they are tracked.
+	Calls *Stats `json:"calls,omitempty"`
+}
+
+// ConnectivityTracker keeps the connectivity state from the result of the calls to the management cluster. The
+// subscribers are signaled when the management cluster is reachable again after being offline.
+type ConnectivityTracker struct {
+	sync.Mutex
+	connectivity Connectivity
+	reconnected  []chan struct{}
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+	// stats returns the metrics of the calls to the management cluster, nil if they are not tracked.
+	stats func() Stats
+}
+
+// NewConnectivityTracker creates a tracker in the offline state.
+func NewConnectivityTracker() *ConnectivityTracker {
+	return &ConnectivityTracker{
+		connectivity: Connectivity{State: Offline, Since: time.Now()},
+		reconnected:  make([]chan struct{}, 0),
+		now:          time.Now,
+	}
+}
+
+// Record updates the state with the result of a call and the state of the circuit after it.
+func (ct *ConnectivityTracker) Record(err error, circuit CircuitState) {
+	ct.Lock()
+	defer ct.Unlock()
+	now := ct.now()
+	state := Online
+	if IsConnectivityError(err) {
+		ct.connectivity.LastFailure = now
+		ct.connectivity.LastError = err.Error()
+		state = Degraded
+		if circuit == CircuitOpen {
+			state = Offline
+		}
+	} else {
+		ct.connectivity.LastSuccess = now
+	}
+	if state == ct.connectivity.State {
+		return
+	}
+
+	previous := ct.connectivity
+	ct.connectivity.State = state
+	ct.connectivity.Since = now
+	logger := log.Warn()
+	if state == Online {
+		logger = log.Info()
+	}
+	logger.Str("from", string(previous.State)).Str("to", string(state)).
+		Str("after", now.Sub(previous.Since).String()).Msg("management cluster connectivity changed")
+
+	if previous.State == Offline && state == Online {
+		for _, reconnected := range ct.reconnected {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Get returns the current connectivity with the metrics of the calls.
+func (ct *ConnectivityTracker) Get() Connectivity {
+	ct.Lock()
+	connectivity := ct.connectivity
+	stats := ct.stats
+	ct.Unlock()
+	if stats != nil {
+		calls := stats()
+		connectivity.Calls = &calls
+	}
+	return connectivity
+}
+
+// IsOffline returns whether the management cluster is unreachable.
+func (ct *ConnectivityTracker) IsOffline() bool {
+	return ct.Get().State == Offline
+}
+
+// Reconnected returns a channel that receives a signal each time the management cluster is reachable again after
+// being offline. Signals are not queued, a single one is kept until it is read.
+func (ct *ConnectivityTracker) Reconnected() <-chan struct{} {
+	ct.Lock()
+	defer ct.Unlock()
+	reconnected := make(chan struct{}, 1)
+	ct.reconnected = append(ct.reconnected, reconnected)
+	return reconnected
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("Connectivity tracker", func() {
+
+	var now time.Time
+	var tracker *ConnectivityTracker
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	ginkgo.BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		tracker = NewConnectivityTracker()
+		tracker.now = func() time.Time { return now }
+	})
+
+	ginkgo.It("should follow the results of the calls", func() {
+		gomega.Expect(tracker.Get().State).To(gomega.Equal(Offline))
+		tracker.Record(nil, CircuitClosed)
+		gomega.Expect(tracker.Get().State).To(gomega.Equal(Online))
+
+		now = now.Add(time.Minute)
+		tracker.Record(unavailable, CircuitClosed)
+		connectivity := tracker.Get()
+		gomega.Expect(connectivity.State).To(gomega.Equal(Degraded))
+		gomega.Expect(connectivity.Since).To(gomega.Equal(now))
+		gomega.Expect(connectivity.LastSuccess).To(gomega.Equal(now.Add(-time.Minute)))
+		gomega.Expect(connectivity.LastFailure).To(gomega.Equal(now))
+		gomega.Expect(connectivity.LastError).To(gomega.ContainSubstring("down"))
+
+		tracker.Record(unavailable, CircuitOpen)
+		gomega.Expect(tracker.IsOffline()).To(gomega.BeTrue())
+
+		// errors returned by the management cluster mean that it is reachable
+		tracker.Record(status.Error(codes.NotFound, "asset"), CircuitClosed)
+		gomega.Expect(tracker.Get().State).To(gomega.Equal(Online))
+	})
+
+	ginkgo.It("should signal once when the management cluster is reachable after being offline", func() {
+		reconnected := tracker.Reconnected()
+		tracker.Record(unavailable, CircuitClosed)
+		tracker.Record(nil, CircuitClosed)
+		gomega.Expect(reconnected).ToNot(gomega.Receive())
+
+		tracker.Record(unavailable, CircuitOpen)
+		tracker.Record(nil, CircuitClosed)
+		tracker.Record(unavailable, CircuitOpen)
+		tracker.Record(nil, CircuitClosed)
+		gomega.Expect(reconnected).To(gomega.Receive())
+		gomega.Expect(reconnected).ToNot(gomega.Receive())
+	})
+})
@@ -20,14 +20,17 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"github.com/nalej/authx-interceptors/pkg/interceptor/apikey"
-	interceptorConfig "github.com/nalej/authx-interceptors/pkg/interceptor/config"
+	"github.com/nalej/derrors"
 	assetProvider "github.com/nalej/edge-controller/internal/pkg/provider/asset"
 	"github.com/nalej/edge-controller/internal/pkg/provider/metricstorage"
 	"github.com/nalej/edge-controller/internal/pkg/server/agent"
+	"github.com/nalej/edge-controller/internal/pkg/server/bootstrap"
 	"github.com/nalej/edge-controller/internal/pkg/server/config"
 	"github.com/nalej/edge-controller/internal/pkg/server/eic"
 	"github.com/nalej/edge-controller/internal/pkg/server/helper"
+	"github.com/nalej/edge-controller/internal/pkg/server/pki"
+	"github.com/nalej/edge-controller/internal/pkg/server/proxy"
+	"github.com/nalej/edge-controller/internal/pkg/utils"
 	"github.com/nalej/grpc-edge-controller-go"
 	"github.com/nalej/grpc-edge-inventory-proxy-go"
 	"github.com/nalej/grpc-inventory-go"
@@ -39,7 +42,12 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -48,12 +56,25 @@ const DefaultTimeout = 30 * time.Second
 // Service structure containing the configuration and gRPC server.
 type Service struct {
 	Configuration config.Config
+	// configLock guards the options of Configuration that the management cluster changes at runtime. Configuration
+	// must be read with runtimeConfiguration once the servers are launched.
+	configLock sync.RWMutex
+	// background tracks the loops launched by Run, which finish when its context is done.
+	background sync.WaitGroup
+	// eicServer with the gRPC server that receives requests from the management cluster.
+	eicServer *grpc.Server
+	// eicManager with the manager of the eicServer, whose operations in background are waited by the shutdown.
+	eicManager *eic.Manager
+	// agentServer with the gRPC server that receives requests from the agents.
+	agentServer *grpc.Server
+	// adminServer with the HTTP server that receives the queries of the operators.
+	adminServer *http.Server
 }
 
 // NewService creates a new system model service.
 func NewService(conf config.Config) *Service {
 	return &Service{
-		conf,
+		Configuration: conf,
 	}
 }
 
@@ -62,8 +83,37 @@ type Providers struct{
 	metricStorageProvider metricstorage.Provider
 }
 
+// Close releases the resources of the providers.
+func (p *Providers) Close() {
+	if p.metricStorageProvider != nil && p.metricStorageProvider.Connected() {
+		derr := p.metricStorageProvider.Disconnect()
+		if derr != nil {
+			log.Warn().Str("trace", derr.DebugReport()).Msg("error disconnecting metric storage provider")
+		}
+	}
+	p.assetProvider.Close()
+}
+
 type Clients struct{
 	inventoryProxyClient grpc_edge_inventory_proxy_go.EdgeInventoryProxyClient
+	// connectivity with the connectivity state of inventoryProxyClient.
+	connectivity *proxy.ConnectivityTracker
+}
+
+// runInBackground launches a loop tracked by the service so the shutdown can wait for it.
+func (s *Service) runInBackground(loop func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		loop()
+	}()
+}
+
+// runtimeConfiguration returns a copy of the configuration with the options applied at runtime.
+func (s *Service) runtimeConfiguration() config.Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.Configuration
 }
 
 // Name of the service.
@@ -128,23 +178,26 @@ func (s*Service) GetClients() * Clients{
 		log.Fatal().Str("error", err.Error()).Msg("cannot create connection with Edge Management URL")
 	}
 
+	proxyClient := proxy.NewClient(grpc_edge_inventory_proxy_go.NewEdgeInventoryProxyClient(mngtConn))
 	return &Clients{
-		inventoryProxyClient: grpc_edge_inventory_proxy_go.NewEdgeInventoryProxyClient(mngtConn),
+		inventoryProxyClient: proxyClient,
+		connectivity: proxyClient.Connectivity(),
 	}
 }
 
 
-// TODO: check the error control. When the service can not be launching the VM restart it and a lot of users can be added into VPN
 // Run the service, launch the REST service handler.
 func (s *Service) Run() error {
 
-	var joinResponse *grpc_inventory_manager_go.EICJoinResponse
-	joinResponse = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(ctx, cancel)
 
 	valErr := s.Configuration.Validate()
 	if valErr != nil{
 		log.Fatal().Str("error", valErr.DebugReport()).Msg("Invalid configuration")
 	}
+	s.applyPersistedConfiguration()
 	s.Configuration.Print()
 
 	// Start plugins
@@ -159,58 +212,16 @@ func (s *Service) Run() error {
 		log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("Error creating joinHelper")
 	}
 
-	needJoin, err := joinHelper.NeedJoin()
-	if err != nil {
-		log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("Error asking for join")
-	}
-
-	log.Info().Bool("need join", needJoin).Msg("Join")
-
-	if needJoin{
-		joinResponse, err = joinHelper.Join(s.Configuration.Name, s.Configuration.Labels,
-			s.Configuration.Geolocation)
-		if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("Error in join")
-		}
-
-		err = joinHelper.SaveCredentials(*joinResponse)
-		if err != nil {
-			log.Info().Str("error", conversions.ToDerror(err).DebugReport()).Msg("Error saving cedentials")
-		}
-
-		// configureDNS
-		err = joinHelper.ConfigureDNS()
-		if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("enable to configure DNS")
-		}
-
-		// ConfigureLocalVPN
-		err = joinHelper.ConfigureLocalVPN(joinResponse.Credentials)
-		if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("enable to configure VPN")
-		}
-
-		err = joinHelper.GetIP()
-		if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("getting IP")
-		}
-	}
-
-	if joinResponse == nil {
-		joinResponse, err = joinHelper.LoadCredentials()
-		if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error getting credentials")
-		}
+	boot := bootstrap.NewBootstrap(s.Configuration, joinHelper, s.Configuration.BootstrapStatePath, utils.DefaultBackoff)
+	joinResponse, derr := boot.Prepare(ctx)
+	if derr != nil {
+		plugin.StopAll()
+		return bootstrapError(ctx, derr)
 	}
 
 	log.Info().Str("VpnUser", joinResponse.Credentials.Username).Str("pass", strings.Repeat("*", len(joinResponse.Credentials.Password))).
 		Msg("VPN credentials")
 
-	err = joinHelper.ExecuteDhClient()
-	if err != nil {
-		log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error executing dhclient")
-	}
-
 	// Store organization_id, edge_controller_id and proxyName
 	s.Configuration.OrganizationId = joinResponse.OrganizationId
 	s.Configuration.EdgeControllerId = joinResponse.EdgeControllerId
@@ -221,35 +232,182 @@ func (s *Service) Run() error {
 	providers := s.GetProviders()
 	clients := s.GetClients()
 
-	// GetVPNIP (if VPN_nicname has no IP -> Get it)
-	ip, err := joinHelper.GetVPNAddress()
-	if err != nil {
-			log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error getting vpnAddress")
+	derr = boot.Start(ctx, func(ip string) error {
+		log.Info().Msg("EIC Start")
+		startCtx, startCancel := context.WithTimeout(ctx, DefaultTimeout)
+		defer startCancel()
+		_, err := clients.inventoryProxyClient.EICStart(startCtx, &grpc_inventory_manager_go.EICStartInfo{
+			OrganizationId: joinResponse.OrganizationId,
+			EdgeControllerId: joinResponse.EdgeControllerId,
+			Ip: ip,
+		})
+		return err
+	})
+	if derr != nil {
+		plugin.StopAll()
+		providers.Close()
+		return bootstrapError(ctx, derr)
 	}
 
-	// EICStart
-	log.Info().Msg("EIC Start")
-	_, err = clients.inventoryProxyClient.EICStart(context.Background(), &grpc_inventory_manager_go.EICStartInfo{
-		OrganizationId: joinResponse.OrganizationId,
-		EdgeControllerId: joinResponse.EdgeControllerId,
-		Ip: *ip,
-	})
+	notifier := agent.NewNotifier(s.runtimeConfiguration().NotifyPeriod, providers.assetProvider, clients.inventoryProxyClient,
+		s.Configuration.OrganizationId, s.Configuration.EdgeControllerId)
+	notifier.SetDeliveryLimits(s.Configuration.NotifyBatchSize, s.Configuration.NotifySenders)
+	notifier.SetConnectivity(clients.connectivity)
+	s.runInBackground(func() { notifier.LaunchNotifierLoop(ctx) })
+	sweeper := agent.NewOperationSweeper(providers.assetProvider, notifier, agent.DefaultSweepPeriod)
+	s.runInBackground(func() { sweeper.LaunchSweeperLoop(ctx) })
+	janitor := assetProvider.NewJanitor(providers.assetProvider, s.retentionPolicy(), s.Configuration.JanitorPeriod)
+	s.runInBackground(func() { janitor.LaunchJanitorLoop(ctx) })
+	configurator := newConfigurator(s, notifier)
 
 	// launch the alive loop
-	go s.aliveLoop(clients)
-
+	alivePeriod := s.runtimeConfiguration().AlivePeriod
+	s.runInBackground(func() { s.aliveLoop(ctx, clients, alivePeriod, configurator.alivePeriod) })
+
+	serverErrors := make(chan error, 3)
+	// the servers already launched are stopped by the shutdown if any of them cannot be launched
+	err = s.LaunchEICServer(providers, clients, notifier, configurator, serverErrors)
+	if err == nil {
+		err = s.LaunchAgentServer(ctx, providers, clients, notifier, configurator, serverErrors)
+	}
+	if err == nil {
+		err = s.LaunchAdminServer(providers, serverErrors)
+	}
 	if err != nil {
-		log.Fatal().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error starting EIC")
+		log.Error().Err(err).Msg("error launching servers, shutting down edge controller")
+		cancel()
+		s.shutdown(providers, notifier)
+		return err
 	}
 
-	notifier := agent.NewNotifier(s.Configuration.NotifyPeriod, providers.assetProvider, clients.inventoryProxyClient,
-		s.Configuration.OrganizationId, s.Configuration.EdgeControllerId)
-	go notifier.LaunchNotifierLoop()
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		log.Info().Msg("shutting down edge controller")
+	case serveErr = <-serverErrors:
+		log.Error().Err(serveErr).Msg("gRPC server finished unexpectedly, shutting down edge controller")
+		cancel()
+	}
 
+	s.shutdown(providers, notifier)
+	return serveErr
+}
 
-	go s.LaunchEICServer(providers, clients, notifier)
+// bootstrapError returns the error of a bootstrap that did not finish. A bootstrap interrupted by the shutdown of the
+// service is not an error.
+func bootstrapError(ctx context.Context, derr derrors.Error) error {
+	if ctx.Err() != nil {
+		log.Warn().Str("error", derr.DebugReport()).Msg("bootstrap interrupted")
+		return nil
+	}
+	log.Error().Str("error", derr.DebugReport()).Msg("bootstrap failed")
+	return derr
+}
+
+// retentionPolicy returns the retention of the records removed by the storage janitor.
+func (s *Service) retentionPolicy() assetProvider.RetentionPolicy {
+	return assetProvider.RetentionPolicy{
+		JoinTokens:     assetProvider.Retention{MaxAge: s.Configuration.JoinTokenRetention, MaxRecords: s.Configuration.JoinTokenMaxRecords},
+		OutboxMessages: assetProvider.Retention{MaxAge: s.Configuration.OutboxRetention, MaxRecords: s.Configuration.OutboxMaxRecords},
+		AgentStarts:    assetProvider.Retention{MaxAge: s.Configuration.AgentStartRetention, MaxRecords: s.Configuration.AgentStartMaxRecords},
+	}
+}
+
+// handleSignals cancels the context of the service when a SIGTERM or SIGINT is received.
+func handleSignals(ctx context.Context, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.Info().Str("signal", sig.String()).Msg("signal received")
+		cancel()
+	case <-ctx.Done():
+	}
+}
+
+// shutdown stops the gRPC servers, sends the pending notifications and releases the resources. The order matters,
+// agents must not be able to modify the state once the last notification is sent, and the providers are closed once
+// the background loops have finished. The context of the service must be done.
+func (s *Service) shutdown(providers *Providers, notifier *agent.Notifier) {
+	stopServer("eic", s.eicServer)
+	stopServer("agent", s.agentServer)
+	s.stopAdminServer()
+
+	// the operations launched by the EIC server notify their result, so they finish before the last notification
+	if s.eicManager != nil {
+		log.Info().Msg("waiting for the background operations")
+		s.eicManager.WaitBackgroundTasks()
+	}
+
+	notifier.StopNotifierLoop()
+	notifier.Flush()
+
+	log.Info().Msg("stopping plugins")
+	plugin.StopAll()
+
+	log.Info().Msg("waiting for the background loops")
+	s.background.Wait()
+	providers.Close()
+	log.Info().Msg("edge controller stopped")
+}
+
+// stopServer gracefully stops a gRPC server. If the pending RPCs do not finish in time, the server is forced to stop.
+func stopServer(name string, server *grpc.Server) {
+	if server == nil {
+		return
+	}
+	log.Info().Str("server", name).Msg("stopping gRPC server")
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(DefaultTimeout):
+		log.Warn().Str("server", name).Msg("graceful stop timed out, forcing stop")
+		server.Stop()
+	}
+}
+
+// LaunchAdminServer creates the HTTP server for the queries of the operators and starts serving in background on the
+// loopback interface. Serving errors are sent to the serverErrors channel.
+func (s *Service) LaunchAdminServer(providers *Providers, serverErrors chan<- error) error {
+	if s.Configuration.AdminPort == 0 {
+		log.Info().Msg("Admin server disabled")
+		return nil
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", s.Configuration.AdminPort))
+	if err != nil {
+		log.Error().Errs("failed to listen: %v", []error{err})
+		return err
+	}
+	server := &http.Server{Handler: NewAdminHandler(providers.assetProvider)}
+	s.adminServer = server
+
+	log.Info().Int("port", s.Configuration.AdminPort).Msg("Launching admin HTTP server")
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.Error().Errs("failed to serve: %v", []error{err})
+			serverErrors <- err
+		}
+	}()
+	return nil
+}
 
-	return s.LaunchAgentServer(providers, clients, notifier)
+// stopAdminServer gracefully stops the admin server, waiting for the pending queries.
+func (s *Service) stopAdminServer() {
+	if s.adminServer == nil {
+		return
+	}
+	log.Info().Msg("stopping admin server")
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	if err := s.adminServer.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("graceful stop of the admin server timed out")
+	}
 }
 
 func (s *Service) sendAliveMessage(clients * Clients)  {
@@ -263,38 +421,54 @@ func (s *Service) sendAliveMessage(clients * Clients)  {
 		OrganizationId: s.Configuration.OrganizationId,
 		EdgeControllerId: s.Configuration.EdgeControllerId,
 	})
-	if err != nil {
+	if proxy.IsCircuitOpen(err) {
+		log.Debug().Msg("management cluster unreachable, alive message skipped")
+	} else if err != nil {
 		log.Warn().Str("error", conversions.ToDerror(err).DebugReport()).Msg("error sending the alive message")
 	}
 	cancel()
 
 }
 
-// aliveLoop sends alive message to proxy
-func (s*Service) aliveLoop(clients * Clients) {
+// aliveLoop sends alive message to proxy until the context is done. The period is reset when a new one is received.
+func (s*Service) aliveLoop(ctx context.Context, clients * Clients, alivePeriod time.Duration, periodUpdates <-chan time.Duration) {
 
 	// send the first ONLINE message
 	s.sendAliveMessage(clients)
 
 	// every AlivePeriod seconds ...
-	ticker := time.NewTicker(s.Configuration.AlivePeriod)
+	ticker := time.NewTicker(alivePeriod)
 
 	for {
 		select {
 			case <- ticker.C:
 				s.sendAliveMessage(clients)
+			case period := <- periodUpdates:
+				log.Info().Str("duration", period.String()).Msg("Alive period changed")
+				ticker.Stop()
+				ticker = time.NewTicker(period)
+			case <- ctx.Done():
+				ticker.Stop()
+				return
 		}
 	}
 }
 
-func (s*Service) LaunchEICServer(providers * Providers, clients * Clients, notifier *agent.Notifier) error{
+// LaunchEICServer creates the gRPC server for the management cluster requests and starts serving in background. Serving
+// errors are sent to the serverErrors channel.
+func (s*Service) LaunchEICServer(providers * Providers, clients * Clients, notifier *agent.Notifier, configurator eic.Configurator, serverErrors chan<- error) error{
 
 	EICLis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.Port))
 	if err != nil {
-		log.Fatal().Errs("failed to listen: %v", []error{err})
+		log.Error().Errs("failed to listen: %v", []error{err})
+		return err
 	}
 
-	eicManager := eic.NewManager(s.Configuration, providers.assetProvider, providers.metricStorageProvider, notifier)
+	eicManager := eic.NewManager(s.runtimeConfiguration(), providers.assetProvider, providers.metricStorageProvider, notifier, configurator)
+	if dErr := eicManager.FailInterruptedInstalls(); dErr != nil {
+		log.Error().Str("trace", dErr.DebugReport()).Msg("cannot report interrupted agent installs")
+	}
+	s.eicManager = &eicManager
 	eicHandler := eic.NewHandler(eicManager)
 
 	grpcEICServer := grpc.NewServer()
@@ -304,42 +478,65 @@ func (s*Service) LaunchEICServer(providers * Providers, clients * Clients, notif
 		// Register reflection service on gRPC server.
 		reflection.Register(grpcEICServer)
 	}
+	s.eicServer = grpcEICServer
 
 	log.Info().Int("port", s.Configuration.Port).Msg("Launching gRPC server")
-	if err := grpcEICServer.Serve(EICLis); err != nil {
-		log.Fatal().Errs("failed to serve: %v", []error{err})
-	}
+	go func() {
+		if err := grpcEICServer.Serve(EICLis); err != nil {
+			log.Error().Errs("failed to serve: %v", []error{err})
+			serverErrors <- err
+		}
+	}()
 
 	return nil
 }
 
-func (s*Service) LaunchAgentServer(providers * Providers, clients * Clients, notifier *agent.Notifier) error{
+// LaunchAgentServer creates the gRPC server for the agent requests and starts serving in background. Serving
+// errors are sent to the serverErrors channel. The client certificates are renewed until the context is done, and
+// the options that affect the agents are received from the configurator.
+func (s*Service) LaunchAgentServer(ctx context.Context, providers * Providers, clients * Clients, notifier *agent.Notifier, configurator *configurator, serverErrors chan<- error) error{
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.AgentPort))
 	if err != nil {
-		log.Fatal().Errs("failed to listen: %v", []error{err})
+		log.Error().Errs("failed to listen: %v", []error{err})
+		return err
 	}
 
-	agentManager := agent.NewManager(s.Configuration, providers.assetProvider, *notifier, clients.inventoryProxyClient)
-	agentHandler := agent.NewHandler(agentManager)
+	agentManager := agent.NewManager(s.runtimeConfiguration(), providers.assetProvider, notifier, clients.inventoryProxyClient)
+	configurator.setAgentManager(&agentManager)
 
-	apiKeyAccess := NewAgentTokenInterceptor(providers.assetProvider)
-
-	cfg := interceptorConfig.NewConfig(&interceptorConfig.AuthorizationConfig{
-		AllowsAll: false,
-		Permissions: map[string]interceptorConfig.Permission{
-			"/edge_controller.Agent/AgentJoin": {Must: []string{"APIKEY"}},
-			"/edge_controller.Agent/AgentCheck": {Must: []string{"APIKEY"}},
-			"/edge_controller.Agent/CallbackAgentOperation": {Must: []string{"APIKEY"}},
-		}}, "not-used", "authorization")
+	apiKeyAccess := NewAgentTokenInterceptor(providers.assetProvider, s.Configuration.AgentClientCerts)
 
 	x509Cert, err := tls.X509KeyPair([]byte(s.Configuration.CaCert.Certificate), []byte(s.Configuration.CaCert.PrivateKey))
-	creds :=  credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{x509Cert}})
 	if err != nil {
-		log.Fatal().Errs("Failed to generate credentials: %v", []error{err})
+		log.Error().Errs("Failed to generate credentials: %v", []error{err})
+		lis.Close()
+		return err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{x509Cert}}
+	if s.Configuration.AgentClientCerts != config.ClientCertsDisabled {
+		// the agents receive a client certificate when they join, so it cannot be required in the handshake
+		authorityKey, aErr := pki.LoadOrCreateKey(s.Configuration.AgentCAKeyPath)
+		if aErr != nil {
+			log.Error().Str("trace", aErr.DebugReport()).Msg("cannot load the key of the agent certificate authority")
+			lis.Close()
+			return aErr
+		}
+		authority, aErr := pki.NewAuthority(s.Configuration.CaCert.Certificate, authorityKey, s.Configuration.AgentCertValidity)
+		if aErr != nil {
+			log.Error().Str("trace", aErr.DebugReport()).Msg("cannot create the agent certificate authority")
+			lis.Close()
+			return aErr
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = authority.Pool()
+		agentManager.SetCertificateAuthority(authority)
+		s.runInBackground(func() { agentManager.LaunchCertificateRenewalLoop(ctx, agent.DefaultCertificateRenewalPeriod) })
 	}
+	creds :=  credentials.NewTLS(tlsConfig)
+	agentHandler := agent.NewHandler(agentManager)
 
 	// server with apiKeyAccess and caCert
-	options :=[]grpc.ServerOption{apikey.WithAPIKeyInterceptor(apiKeyAccess, cfg), grpc.Creds(creds)}
+	options :=[]grpc.ServerOption{grpc.UnaryInterceptor(apiKeyAccess.UnaryInterceptor()), grpc.Creds(creds)}
 	grpcServer := grpc.NewServer(options...)
 	grpc_edge_controller_go.RegisterAgentServer(grpcServer, agentHandler)
 
@@ -349,11 +546,15 @@ func (s*Service) LaunchAgentServer(providers * Providers, clients * Clients, not
 		// Register reflection service on gRPC server.
 		reflection.Register(grpcServer)
 	}
+	s.agentServer = grpcServer
 
 	log.Info().Int("port", s.Configuration.AgentPort).Msg("Launching Agent gRPC server")
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatal().Errs("failed to serve: %v", []error{err})
-	}
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Error().Errs("failed to serve: %v", []error{err})
+			serverErrors <- err
+		}
+	}()
 
 	return nil
 }
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff defines an exponential backoff policy.
+type Backoff struct {
+	// Initial delay after the first failure.
+	Initial time.Duration
+	// Max delay between two attempts.
+	Max time.Duration
+	// Factor applied to the delay after each failure.
+	Factor float64
+}
+
+// DefaultBackoff is the policy used when retrying operations against local or remote services.
+var DefaultBackoff = Backoff{
+	Initial: time.Second,
+	Max:     time.Minute,
+	Factor:  2,
+}
+
+// Delay returns the time to wait before the given retry (starting at 0).
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < retry && delay < float64(b.Max); i++ {
+		delay = delay * b.Factor
+	}
+	if delay > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(delay)
+}
+
+// Wait blocks for the delay of the given retry. It returns false if the context is done before.
+func (b Backoff) Wait(ctx context.Context, retry int) bool {
+	timer := time.NewTimer(b.Delay(retry))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}